@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ===== Хранилище шифртекстов медиа =====
+//
+// В SQLite остаются только метаданные и обёрнутый DEK, сами шифртексты лежат
+// в BlobStore под ключом = sha256 шифртекста (hex). Ключ не зависит от того,
+// кто и куда загрузил, поэтому повторная запись того же блоба ничего не меняет.
+
+var ErrBlobNotFound = errors.New("blob not found")
+
+type BlobStore interface {
+	// Put сохраняет size байт из r под ключом key.
+	Put(key string, r io.Reader, size int64) error
+	// OpenRange читает блоб с offset; length < 0 — до конца.
+	OpenRange(key string, offset, length int64) (io.ReadCloser, error)
+	Delete(key string) error
+	// spoolDir — куда писать шифртекст до того, как известен его хэш.
+	spoolDir() string
+}
+
+// blobShardPath — ab/cd/abcd…: не больше 65536 файлов-каталогов на уровень.
+func blobShardPath(key string) string {
+	return filepath.Join(key[0:2], key[2:4], key)
+}
+
+func validBlobKey(key string) bool {
+	if len(key) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(key)
+	return err == nil && strings.ToLower(key) == key
+}
+
+// putBlob пишет шифртекст через write во временный файл, попутно считая sha256,
+// и сохраняет его в store под этим хэшем. Возвращает ключ и размер.
+func putBlob(store BlobStore, write func(w io.Writer) error) (string, int64, error) {
+	if err := os.MkdirAll(store.spoolDir(), 0700); err != nil {
+		return "", 0, err
+	}
+	f, err := os.CreateTemp(store.spoolDir(), "blob-*.tmp")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	h := sha256.New()
+	cw := &countingWriter{w: io.MultiWriter(f, h)}
+	if err := write(cw); err != nil {
+		return "", 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+
+	key := hex.EncodeToString(h.Sum(nil))
+	if err := store.Put(key, f, cw.n); err != nil {
+		return "", 0, err
+	}
+	return key, cw.n, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// readBlob — весь блоб в память; только для старых форматов без сегментов.
+func readBlob(store BlobStore, key string) ([]byte, error) {
+	rc, err := store.OpenRange(key, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// ===== Локальная файловая система =====
+
+type LocalBlobStore struct {
+	root string
+}
+
+func NewLocalBlobStore(root string) (*LocalBlobStore, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	return &LocalBlobStore{root: root}, nil
+}
+
+func (s *LocalBlobStore) spoolDir() string { return filepath.Join(s.root, "tmp") }
+
+func (s *LocalBlobStore) path(key string) (string, error) {
+	if !validBlobKey(key) {
+		return "", fmt.Errorf("bad blob key %q", key)
+	}
+	return filepath.Join(s.root, blobShardPath(key)), nil
+}
+
+func (s *LocalBlobStore) Put(key string, r io.Reader, size int64) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return nil // тот же хэш — тот же блоб
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	// временный файл из putBlob лежит на той же ФС — просто переименовываем
+	if f, ok := r.(*os.File); ok && filepath.Dir(f.Name()) == s.spoolDir() {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		return os.Rename(f.Name(), path)
+	}
+
+	tmp, err := os.CreateTemp(s.spoolDir(), "put-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, io.LimitReader(r, size)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *LocalBlobStore) OpenRange(key string, offset, length int64) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+func (s *LocalBlobStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ===== S3-совместимое хранилище (AWS S3, MinIO, Ceph RGW, ...) =====
+//
+// Только то, что нужно BlobStore: PUT, GET с Range и DELETE объекта.
+// Адресация path-style (endpoint/bucket/key) — её понимают все совместимые
+// серверы, включая локальный MinIO. Запросы подписываются AWS Signature V4.
+
+const emptyPayloadSHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+type S3Config struct {
+	Endpoint  string // https://s3.eu-central-1.amazonaws.com или http://localhost:9000
+	Region    string
+	Bucket    string
+	Prefix    string // префикс ключей внутри бакета
+	AccessKey string
+	SecretKey string
+}
+
+type S3BlobStore struct {
+	cfg    S3Config
+	base   *url.URL
+	client *http.Client
+	spool  string
+}
+
+func NewS3BlobStore(cfg S3Config) (*S3BlobStore, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3: endpoint and bucket are required")
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, fmt.Errorf("s3: credentials are not set (AWS_ACCESS_KEY_ID / AWS_SECRET_ACCESS_KEY)")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	base, err := url.Parse(strings.TrimRight(cfg.Endpoint, "/"))
+	if err != nil || base.Host == "" {
+		return nil, fmt.Errorf("s3: bad endpoint %q", cfg.Endpoint)
+	}
+	return &S3BlobStore{
+		cfg:    cfg,
+		base:   base,
+		client: &http.Client{Timeout: 10 * time.Minute},
+		spool:  os.TempDir(),
+	}, nil
+}
+
+func (s *S3BlobStore) spoolDir() string { return s.spool }
+
+func (s *S3BlobStore) objectURL(key string) (string, error) {
+	if !validBlobKey(key) {
+		return "", fmt.Errorf("bad blob key %q", key)
+	}
+	objectKey := strings.Trim(s.cfg.Prefix, "/")
+	if objectKey != "" {
+		objectKey += "/"
+	}
+	objectKey += strings.ReplaceAll(blobShardPath(key), string(os.PathSeparator), "/")
+
+	u := *s.base
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + s.cfg.Bucket + "/" + objectKey
+	return u.String(), nil
+}
+
+func (s *S3BlobStore) do(method, key string, body io.Reader, size int64, payloadHash string, header http.Header) (*http.Response, error) {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	signS3Request(req, s.cfg, payloadHash, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+func s3Error(op string, resp *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3 %s: %s: %s", op, resp.Status, strings.TrimSpace(string(b)))
+}
+
+// Put: ключ — это sha256 содержимого, он же x-amz-content-sha256 (сервер его проверит).
+func (s *S3BlobStore) Put(key string, r io.Reader, size int64) error {
+	resp, err := s.do(http.MethodPut, key, io.LimitReader(r, size), size, key, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("put", resp)
+	}
+	return nil
+}
+
+func (s *S3BlobStore) OpenRange(key string, offset, length int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	switch {
+	case length >= 0:
+		if length == 0 {
+			return io.NopCloser(strings.NewReader("")), nil
+		}
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	case offset > 0:
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := s.do(http.MethodGet, key, nil, 0, emptyPayloadSHA256, header)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrBlobNotFound
+	}
+	defer resp.Body.Close()
+	return nil, s3Error("get", resp)
+}
+
+func (s *S3BlobStore) Delete(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, 0, emptyPayloadSHA256, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return s3Error("delete", resp)
+	}
+	return nil
+}
+
+// signS3Request — AWS Signature Version 4 (заголовок Authorization).
+// Подписываются host, x-amz-* и range, если он есть.
+func signS3Request(req *http.Request, cfg S3Config, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "range" {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + cfg.Region + "/s3/aws4_request"
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+cfg.SecretKey), date)
+	key = hmacSHA256(key, cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+cfg.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 — бакет в памяти. Подпись каждого запроса проверяется заново по
+// описанию SigV4, независимо от signS3Request: неверная подпись — 403, как у S3.
+type fakeS3 struct {
+	t      *testing.T
+	cfg    S3Config
+	mu     sync.Mutex
+	bucket map[string][]byte // путь без /bucket/
+	ranges []string          // Range каждого GET
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *S3BlobStore) {
+	t.Helper()
+	f := &fakeS3{t: t, bucket: map[string][]byte{}, cfg: S3Config{
+		Region: "eu-test-1", Bucket: "chat", Prefix: "media", AccessKey: "AKTEST", SecretKey: "secret",
+	}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	cfg := f.cfg
+	cfg.Endpoint = srv.URL
+	store, err := NewS3BlobStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.spool = t.TempDir()
+	return f, store
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := f.verify(r, body); err != nil {
+		f.t.Logf("fake s3: %s %s: %v", r.Method, r.URL.Path, err)
+		http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+f.cfg.Bucket+"/")
+	if !ok {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		f.bucket[key] = body
+	case http.MethodDelete:
+		delete(f.bucket, key)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		data, ok := f.bucket[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		rng := r.Header.Get("Range")
+		f.ranges = append(f.ranges, rng)
+		if rng == "" {
+			_, _ = w.Write(data)
+			return
+		}
+		from, to, ok := parseTestRange(rng, int64(len(data)))
+		if !ok {
+			http.Error(w, "InvalidRange", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", from, to, len(data)))
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write(data[from : to+1])
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// verify — проверка подписи так, как её делает S3.
+func (f *fakeS3) verify(r *http.Request, body []byte) error {
+	auth := r.Header.Get("Authorization")
+	rest, ok := strings.CutPrefix(auth, "AWS4-HMAC-SHA256 ")
+	if !ok {
+		return fmt.Errorf("no SigV4 authorization: %q", auth)
+	}
+	parts := map[string]string{}
+	for _, p := range strings.Split(rest, ", ") {
+		k, v, _ := strings.Cut(p, "=")
+		parts[k] = v
+	}
+	amzDate := r.Header.Get("x-amz-date")
+	when, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil || time.Since(when).Abs() > 15*time.Minute {
+		return fmt.Errorf("bad x-amz-date %q", amzDate)
+	}
+	scope := amzDate[:8] + "/" + f.cfg.Region + "/s3/aws4_request"
+	if parts["Credential"] != f.cfg.AccessKey+"/"+scope {
+		return fmt.Errorf("credential %q", parts["Credential"])
+	}
+
+	payloadHash := r.Header.Get("x-amz-content-sha256")
+	if sum := sha256.Sum256(body); payloadHash != hex.EncodeToString(sum[:]) {
+		return fmt.Errorf("x-amz-content-sha256 does not match the body")
+	}
+
+	signed := strings.Split(parts["SignedHeaders"], ";")
+	if !sort.StringsAreSorted(signed) {
+		return fmt.Errorf("signed headers not sorted: %v", signed)
+	}
+	must := map[string]bool{"host": true, "x-amz-date": true, "x-amz-content-sha256": true}
+	if r.Header.Get("Range") != "" {
+		must["range"] = true
+	}
+	var canonical strings.Builder
+	for _, h := range signed {
+		delete(must, h)
+		v := r.Header.Get(h)
+		if h == "host" {
+			v = r.Host
+		}
+		canonical.WriteString(h + ":" + strings.TrimSpace(v) + "\n")
+	}
+	if len(must) > 0 {
+		return fmt.Errorf("headers not signed: %v", must)
+	}
+
+	request := strings.Join([]string{r.Method, r.URL.EscapedPath(), r.URL.RawQuery, canonical.String(), parts["SignedHeaders"], payloadHash}, "\n")
+	reqHash := sha256.Sum256([]byte(request))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(reqHash[:])
+
+	mac := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	k := mac([]byte("AWS4"+f.cfg.SecretKey), amzDate[:8])
+	for _, s := range []string{f.cfg.Region, "s3", "aws4_request"} {
+		k = mac(k, s)
+	}
+	if want := hex.EncodeToString(mac(k, toSign)); !hmac.Equal([]byte(want), []byte(parts["Signature"])) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+func parseTestRange(h string, size int64) (from, to int64, ok bool) {
+	spec, ok := strings.CutPrefix(h, "bytes=")
+	if !ok {
+		return 0, 0, false
+	}
+	a, b, _ := strings.Cut(spec, "-")
+	from, err := strconv.ParseInt(a, 10, 64)
+	if err != nil || from >= size {
+		return 0, 0, false
+	}
+	to = size - 1
+	if b != "" {
+		if to, err = strconv.ParseInt(b, 10, 64); err != nil || to < from {
+			return 0, 0, false
+		}
+		to = min(to, size-1)
+	}
+	return from, to, true
+}
+
+func readAllRange(t *testing.T, store BlobStore, key string, offset, length int64) []byte {
+	t.Helper()
+	rc, err := store.OpenRange(key, offset, length)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestS3PutGetDelete(t *testing.T) {
+	f, store := newFakeS3(t)
+	data := bytes.Repeat([]byte("blob"), 1000)
+	key, size := putTestBlob(t, store, data)
+	if size != int64(len(data)) {
+		t.Fatalf("size %d", size)
+	}
+	// раскладка ключей: prefix/ab/cd/<sha256>
+	if _, ok := f.bucket["media/"+key[:2]+"/"+key[2:4]+"/"+key]; !ok {
+		t.Fatalf("object not at the expected path: %v", f.bucket)
+	}
+
+	if got := readAllRange(t, store, key, 0, -1); !bytes.Equal(got, data) {
+		t.Fatal("full read differs")
+	}
+	if got := readAllRange(t, store, key, 10, 5); !bytes.Equal(got, data[10:15]) {
+		t.Fatalf("range read %q", got)
+	}
+	if got := readAllRange(t, store, key, 3990, -1); !bytes.Equal(got, data[3990:]) {
+		t.Fatalf("tail read %q", got)
+	}
+	if got := readAllRange(t, store, key, 10, 0); len(got) != 0 {
+		t.Fatalf("empty range read %q", got)
+	}
+	if want := []string{"", "bytes=10-14", "bytes=3990-"}; fmt.Sprint(f.ranges) != fmt.Sprint(want) {
+		t.Fatalf("ranges %q, want %q", f.ranges, want)
+	}
+
+	if err := store.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.OpenRange(key, 0, -1); !errors.Is(err, ErrBlobNotFound) {
+		t.Fatalf("after delete: %v", err)
+	}
+}
+
+func TestS3MissingKey(t *testing.T) {
+	_, store := newFakeS3(t)
+	missing := strings.Repeat("ab", 32)
+	if _, err := store.OpenRange(missing, 0, -1); !errors.Is(err, ErrBlobNotFound) {
+		t.Fatalf("get: %v", err)
+	}
+	if _, err := store.OpenRange(missing, 100, 10); !errors.Is(err, ErrBlobNotFound) {
+		t.Fatalf("ranged get: %v", err)
+	}
+	// удалить несуществующее — не ошибка (GC мог удалить раньше)
+	if err := store.Delete(missing); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := store.OpenRange("../etc/passwd", 0, -1); err == nil {
+		t.Fatal("bad key accepted")
+	}
+}
+
+func TestS3WrongSecretRejected(t *testing.T) {
+	_, store := newFakeS3(t)
+	store.cfg.SecretKey = "wrong"
+	sum := sha256.Sum256([]byte("x"))
+	err := store.Put(hex.EncodeToString(sum[:]), strings.NewReader("x"), 1)
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("put with wrong secret: %v", err)
+	}
+}
+
+// Сегментированное медиа поверх S3: чтение с позиции запрашивает диапазон,
+// начинающийся ровно с нужного сегмента (первого, среднего, последнего).
+func TestS3SegmentedRanges(t *testing.T) {
+	f, store := newFakeS3(t)
+	k := newTestKeyring(t)
+	plain := make([]byte, 3*mediaSegmentSize+1000)
+	for i := range plain {
+		plain[i] = byte(i % 251)
+	}
+	m := &PlainMedia{ID: 7, Kind: "direct", FromUserID: 4, ContentType: "video/mp4"}
+	if _, err := sealMediaWith(k, store, m, bytes.NewReader(plain)); err != nil {
+		t.Fatal(err)
+	}
+
+	full := int64(mediaSegmentSize + mediaSegmentOverhead)
+	for _, c := range []struct {
+		name string
+		pos  int64
+		seg  int64
+	}{
+		{"first", 0, 0},
+		{"middle", mediaSegmentSize + 123, 1},
+		{"last", 3*mediaSegmentSize + 500, 3},
+	} {
+		f.ranges = nil
+		rc, err := openMediaContentWith(k, store, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rc.Seek(c.pos, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, 100)
+		n, err := io.ReadFull(rc, got)
+		rc.Close()
+		want := plain[c.pos:min(c.pos+100, int64(len(plain)))]
+		if err != nil && err != io.ErrUnexpectedEOF || !bytes.Equal(got[:n], want) {
+			t.Fatalf("%s segment: %d bytes, %v", c.name, n, err)
+		}
+		if wantRange := fmt.Sprintf("bytes=%d-%d", c.seg*full, m.BlobSize-1); len(f.ranges) != 1 || f.ranges[0] != wantRange {
+			t.Errorf("%s segment: ranges %q, want %q", c.name, f.ranges, wantRange)
+		}
+	}
+}
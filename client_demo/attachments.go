@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ===== E2E-вложения =====
+//
+// Файл шифруется случайным ключом, на сервер уходит только blob = nonce || ciphertext.
+// Ключ, sha256 блоба и метаданные едут внутри обычного E2E-сообщения (подписанного),
+// поэтому сервер не может ни прочитать файл, ни подменить его незаметно.
+
+const (
+	attachmentType    = "attachment"
+	attachmentAAD     = "mollysage-e2e-attachment-v1"
+	maxAttachmentSize = 45 << 20 // с запасом под лимит сервера (50 MiB на шифртекст)
+)
+
+// AttachmentMessage — открытый текст E2E-сообщения с вложением.
+type AttachmentMessage struct {
+	Type        string `json:"type"`
+	MediaID     int64  `json:"media_id"`
+	KeyBase64   string `json:"key_base64"`
+	SHA256      string `json:"sha256"` // хэш загруженного блоба (nonce || ciphertext)
+	Name        string `json:"name"`
+	Size        int64  `json:"size"` // размер исходного файла
+	ContentType string `json:"content_type"`
+}
+
+// parseAttachment: обычные текстовые сообщения — не JSON, их просто печатаем.
+func parseAttachment(plain []byte) (*AttachmentMessage, bool) {
+	if len(plain) == 0 || plain[0] != '{' {
+		return nil, false
+	}
+	var a AttachmentMessage
+	if err := json.Unmarshal(plain, &a); err != nil || a.Type != attachmentType {
+		return nil, false
+	}
+	return &a, true
+}
+
+func encryptAttachment(path string) (blob []byte, att *AttachmentMessage, err error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !st.Mode().IsRegular() {
+		return nil, nil, errors.New("not a regular file")
+	}
+	if st.Size() > maxAttachmentSize {
+		return nil, nil, fmt.Errorf("file too large (max %d MiB)", maxAttachmentSize>>20)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, nil, err
+	}
+	ct, nonce, err := aesGCMEncrypt(key, data, []byte(attachmentAAD))
+	if err != nil {
+		return nil, nil, err
+	}
+	blob = append(nonce, ct...)
+	sum := sha256.Sum256(blob)
+
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+
+	return blob, &AttachmentMessage{
+		Type:        attachmentType,
+		KeyBase64:   encodeBase64(key),
+		SHA256:      hex.EncodeToString(sum[:]),
+		Name:        filepath.Base(path),
+		Size:        int64(len(data)),
+		ContentType: contentType,
+	}, nil
+}
+
+func uploadAttachment(baseURL string, fromID, toID int64, blob []byte) (int64, error) {
+	url := fmt.Sprintf("%s/api/e2e_media/upload?from_user_id=%d&to_user_id=%d", baseURL, fromID, toID)
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewReader(blob))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return 0, fmt.Errorf("upload status %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	var out struct {
+		ID int64 `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return 0, err
+	}
+	return out.ID, nil
+}
+
+// downloadAttachment скачивает блоб, сверяет sha256 из подписанного сообщения,
+// расшифровывает и сохраняет в dir. Возвращает путь к файлу.
+func downloadAttachment(baseURL string, selfID int64, att *AttachmentMessage, dir string) (string, error) {
+	url := fmt.Sprintf("%s/api/e2e_media/get?id=%d&user_id=%d", baseURL, att.MediaID, selfID)
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download status %d", resp.StatusCode)
+	}
+	blob, err := io.ReadAll(io.LimitReader(resp.Body, maxAttachmentSize+1024))
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(blob)
+	if hex.EncodeToString(sum[:]) != strings.ToLower(att.SHA256) {
+		return "", errors.New("digest mismatch")
+	}
+	key, err := decodeBase64(att.KeyBase64)
+	if err != nil || len(key) != 32 {
+		return "", errors.New("bad attachment key")
+	}
+	const nonceSize = 12
+	if len(blob) < nonceSize {
+		return "", errors.New("blob too short")
+	}
+	data, err := aesGCMDecrypt(key, blob[nonceSize:], blob[:nonceSize], []byte(attachmentAAD))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(data)) != att.Size {
+		return "", errors.New("size mismatch")
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return writeUniqueFile(dir, safeFileName(att.Name), data)
+}
+
+// safeFileName: имя приходит от собеседника — никаких путей и скрытых файлов.
+func safeFileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimLeft(name, ".")
+	if name == "" || name == "/" {
+		name = "attachment"
+	}
+	return name
+}
+
+// writeUniqueFile не перезаписывает существующие файлы: name, name (1), name (2)...
+func writeUniqueFile(dir, name string, data []byte) (string, error) {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for i := 0; i < 1000; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = fmt.Sprintf("%s (%d)%s", stem, i, ext)
+		}
+		path := filepath.Join(dir, candidate)
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			return "", err
+		}
+		return path, f.Close()
+	}
+	return "", errors.New("too many files with the same name")
+}
@@ -6,15 +6,21 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/ecdh"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/argon2"
@@ -28,12 +34,17 @@ type LoginResponse struct {
 	PasswordSalt       string `json:"password_salt_base64"`
 	EncPrivateKey      string `json:"enc_private_key_base64"`
 	EncPrivateKeyNonce string `json:"enc_private_key_nonce_base64"`
+
+	SignPublicKey          string `json:"sign_public_key_base64"`
+	EncSignPrivateKey      string `json:"enc_sign_private_key_base64"`
+	EncSignPrivateKeyNonce string `json:"enc_sign_private_key_nonce_base64"`
 }
 
 type PublicKeyResponse struct {
-	ID       int64  `json:"id"`
-	Username string `json:"username"`
-	PublicKey string `json:"public_key_base64"`
+	ID            int64  `json:"id"`
+	Username      string `json:"username"`
+	PublicKey     string `json:"public_key_base64"`
+	SignPublicKey string `json:"sign_public_key_base64"`
 }
 
 type SendMessageRequest struct {
@@ -41,6 +52,15 @@ type SendMessageRequest struct {
 	ToUserID         int64  `json:"to_user_id"`
 	CiphertextBase64 string `json:"ciphertext_base64"`
 	NonceBase64      string `json:"nonce_base64"`
+	MessageID        string `json:"message_id"`
+	SignatureBase64  string `json:"signature_base64"`
+	Version          int    `json:"version"`
+}
+
+// из ответа /sync клиенту нужны только токен и E2E-сообщения
+type SyncResponse struct {
+	Token string       `json:"token"`
+	E2E   []MessageDTO `json:"e2e"`
 }
 
 type MessageDTO struct {
@@ -49,6 +69,9 @@ type MessageDTO struct {
 	ToUserID         int64  `json:"to_user_id"`
 	CiphertextBase64 string `json:"ciphertext_base64"`
 	NonceBase64      string `json:"nonce_base64"`
+	MessageID        string `json:"message_id"`
+	SignatureBase64  string `json:"signature_base64"`
+	Version          int    `json:"version"`
 }
 
 // те же параметры Argon2, что на сервере
@@ -78,7 +101,7 @@ func deriveKeyFromPassword(password string, salt []byte, cfg CryptoConfig) []byt
 	return argon2.IDKey([]byte(password), salt, cfg.ArgonTime, cfg.ArgonMemory, cfg.ArgonThreads, cfg.ArgonKeyLen)
 }
 
-func aesGCMEncrypt(key, plaintext []byte) (ciphertext, nonce []byte, err error) {
+func aesGCMEncrypt(key, plaintext, aad []byte) (ciphertext, nonce []byte, err error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, nil, err
@@ -92,11 +115,11 @@ func aesGCMEncrypt(key, plaintext []byte) (ciphertext, nonce []byte, err error)
 	if err != nil {
 		return nil, nil, err
 	}
-	ciphertext = aesgcm.Seal(nil, nonce, plaintext, nil)
+	ciphertext = aesgcm.Seal(nil, nonce, plaintext, aad)
 	return ciphertext, nonce, nil
 }
 
-func aesGCMDecrypt(key, ciphertext, nonce []byte) ([]byte, error) {
+func aesGCMDecrypt(key, ciphertext, nonce, aad []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
@@ -105,7 +128,7 @@ func aesGCMDecrypt(key, ciphertext, nonce []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	return aesgcm.Open(nil, nonce, ciphertext, nil)
+	return aesgcm.Open(nil, nonce, ciphertext, aad)
 }
 
 func deriveSessionKeyFromX25519(privateKeyBytes, peerPublicKeyBytes []byte) ([]byte, error) {
@@ -130,20 +153,81 @@ func deriveSessionKeyFromX25519(privateKeyBytes, peerPublicKeyBytes []byte) ([]b
 	return key, nil
 }
 
-func EncryptMessageE2E(senderPriv, receiverPub, plaintext []byte) (ciphertext, nonce []byte, err error) {
+// версии формата, как в crypto.go на сервере: 1 — без AAD, 2 — AAD = (from, to, версия)
+const (
+	e2eVersionLegacy = 1
+	e2eVersionAAD    = 2
+)
+
+func e2eAAD(version int, fromUserID, toUserID int64) []byte {
+	if version < e2eVersionAAD {
+		return nil
+	}
+	aad := []byte("mollysage-e2e")
+	aad = binary.BigEndian.AppendUint32(aad, uint32(version))
+	aad = binary.BigEndian.AppendUint64(aad, uint64(fromUserID))
+	aad = binary.BigEndian.AppendUint64(aad, uint64(toUserID))
+	return aad
+}
+
+func EncryptMessageE2E(senderPriv, receiverPub, plaintext, aad []byte) (ciphertext, nonce []byte, err error) {
 	sessionKey, err := deriveSessionKeyFromX25519(senderPriv, receiverPub)
 	if err != nil {
 		return nil, nil, err
 	}
-	return aesGCMEncrypt(sessionKey, plaintext)
+	return aesGCMEncrypt(sessionKey, plaintext, aad)
 }
 
-func DecryptMessageE2E(receiverPriv, senderPub, ciphertext, nonce []byte) ([]byte, error) {
+func DecryptMessageE2E(receiverPriv, senderPub, ciphertext, nonce, aad []byte) ([]byte, error) {
 	sessionKey, err := deriveSessionKeyFromX25519(receiverPriv, senderPub)
 	if err != nil {
 		return nil, err
 	}
-	return aesGCMDecrypt(sessionKey, ciphertext, nonce)
+	return aesGCMDecrypt(sessionKey, ciphertext, nonce, aad)
+}
+
+// подпись: тот же формат, что и на сервере (crypto.go)
+const e2eSignatureContext = "mollysage-e2e-sig-v1"
+
+var errBadSignature = errors.New("bad signature")
+
+func e2eSignaturePayload(fromUserID, toUserID int64, msgID string, nonce, ciphertext []byte) []byte {
+	buf := make([]byte, 0, len(e2eSignatureContext)+16+12+len(msgID)+len(nonce)+len(ciphertext))
+	buf = append(buf, e2eSignatureContext...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(fromUserID))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(toUserID))
+	for _, part := range [][]byte{[]byte(msgID), nonce, ciphertext} {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(part)))
+		buf = append(buf, part...)
+	}
+	return buf
+}
+
+func SignMessageE2E(signPriv []byte, fromUserID, toUserID int64, msgID string, nonce, ciphertext []byte) ([]byte, error) {
+	if len(signPriv) != ed25519.PrivateKeySize {
+		return nil, errors.New("bad signing key size")
+	}
+	payload := e2eSignaturePayload(fromUserID, toUserID, msgID, nonce, ciphertext)
+	return ed25519.Sign(ed25519.PrivateKey(signPriv), payload), nil
+}
+
+func VerifyMessageE2E(signPub []byte, fromUserID, toUserID int64, msgID string, nonce, ciphertext, sig []byte) error {
+	if len(signPub) != ed25519.PublicKeySize || len(sig) != ed25519.SignatureSize || msgID == "" {
+		return errBadSignature
+	}
+	payload := e2eSignaturePayload(fromUserID, toUserID, msgID, nonce, ciphertext)
+	if !ed25519.Verify(ed25519.PublicKey(signPub), payload, sig) {
+		return errBadSignature
+	}
+	return nil
+}
+
+func newMessageID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
 
 // helper: POST JSON
@@ -164,11 +248,63 @@ func httpPostJSON(url string, body any, out any) (*http.Response, error) {
 	return resp, nil
 }
 
+// syncClient ждёт дольше, чем сервер держит long-poll
+var syncClient = &http.Client{Timeout: 60 * time.Second}
+
+func getJSON(client *http.Client, rawURL string, out any) error {
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func fetchMessages(baseURL string, selfID, peerID int64) ([]MessageDTO, error) {
+	var msgs []MessageDTO
+	err := getJSON(http.DefaultClient, fmt.Sprintf("%s/messages?user_a=%d&user_b=%d", baseURL, selfID, peerID), &msgs)
+	return msgs, err
+}
+
+// fetchPeerSignKey перечитывает ключ подписи собеседника; пустой — его всё ещё нет.
+func fetchPeerSignKey(baseURL, username string, peerID int64) ([]byte, error) {
+	var pkr PublicKeyResponse
+	if err := getJSON(http.DefaultClient, fmt.Sprintf("%s/public_key?username=%s", baseURL, url.QueryEscape(username)), &pkr); err != nil {
+		return nil, err
+	}
+	if pkr.ID != peerID {
+		return nil, fmt.Errorf("%s now has id %d, expected %d", username, pkr.ID, peerID)
+	}
+	if pkr.SignPublicKey == "" {
+		return nil, nil
+	}
+	return decodeBase64(pkr.SignPublicKey)
+}
+
+// syncHead — токен «на сейчас», без данных.
+func syncHead(baseURL string, selfID int64) (string, error) {
+	var resp SyncResponse
+	err := getJSON(syncClient, fmt.Sprintf("%s/sync?user_id=%d", baseURL, selfID), &resp)
+	return resp.Token, err
+}
+
+// syncWait — всё новое после token; если нового нет, сервер держит запрос до 25 секунд.
+func syncWait(baseURL string, selfID int64, token string) (*SyncResponse, error) {
+	var resp SyncResponse
+	err := getJSON(syncClient, fmt.Sprintf("%s/sync?user_id=%d&token=%s&timeout=25", baseURL, selfID, url.QueryEscape(token)), &resp)
+	return &resp, err
+}
+
 func main() {
 	baseURL := flag.String("base", "http://localhost:8080", "server base URL")
 	userName := flag.String("user", "alice", "current username")
 	userPass := flag.String("pass", "", "current user password (default alicepass/bobpass)")
 	peerName := flag.String("peer", "bob", "peer username to chat with")
+	downloadsDir := flag.String("downloads", "downloads", "directory for received attachments")
 	flag.Parse()
 
 	if *userPass == "" {
@@ -217,7 +353,20 @@ func main() {
 	}
 
 	derivedKey := deriveKeyFromPassword(*userPass, salt, defaultCryptoConfig)
-	userPriv, err := aesGCMDecrypt(derivedKey, encPriv, privNonce)
+	userPriv, err := aesGCMDecrypt(derivedKey, encPriv, privNonce, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	encSignPriv, err := decodeBase64(loginResp.EncSignPrivateKey)
+	if err != nil {
+		panic(err)
+	}
+	signNonce, err := decodeBase64(loginResp.EncSignPrivateKeyNonce)
+	if err != nil {
+		panic(err)
+	}
+	userSignPriv, err := aesGCMDecrypt(derivedKey, encSignPriv, signNonce, nil)
 	if err != nil {
 		panic(err)
 	}
@@ -241,66 +390,194 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	// ключа подписи нет, если собеседник ни разу не входил после обновления сервера
+	var peerSignPub []byte
+	if peerPKR.SignPublicKey != "" {
+		peerSignPub, err = decodeBase64(peerPKR.SignPublicKey)
+		if err != nil {
+			panic(err)
+		}
+	}
 	selfID := loginResp.ID
 	peerID := peerPKR.ID
 
 	fmt.Printf("Logged in as %s (id=%d). Peer %s (id=%d)\n", loginResp.Username, selfID, peerPKR.Username, peerID)
-	fmt.Println("Type messages and press Enter to send. Type /quit to exit.")
+	if len(peerSignPub) == 0 {
+		fmt.Printf("warning: %s has no signing key yet, it will be fetched again on the first message\n", peerPKR.Username)
+	}
+	fmt.Println("Type messages and press Enter to send. /send <path> sends a file, /quit exits.")
 
-	// 5. Горутина-поллер, которая каждые 2 секунды скачивает и расшифровывает новые сообщения
+	// 5. Горутина-поллер: история один раз через /messages, дальше только новые
+	// сообщения — long-poll /sync держит запрос, пока не придёт что-нибудь.
 	lastSeenID := int64(0)
+	seenMsgIDs := map[string]bool{}
+
+	handleMessage := func(m MessageDTO) {
+		if m.ID <= lastSeenID {
+			return
+		}
+		// интересуют только входящие сообщения
+		if m.ToUserID != selfID {
+			return
+		}
+		// дальше сообщение либо показано, либо отброшено — второй раз не разбираем
+		lastSeenID = m.ID
+		if m.FromUserID != peerID {
+			fmt.Printf("[msg %d] rejected: unexpected sender %d\n", m.ID, m.FromUserID)
+			return
+		}
+		ctBytes, err := decodeBase64(m.CiphertextBase64)
+		if err != nil {
+			fmt.Println("cipher b64 error:", err)
+			return
+		}
+		nBytes, err := decodeBase64(m.NonceBase64)
+		if err != nil {
+			fmt.Println("nonce b64 error:", err)
+			return
+		}
+		if m.SignatureBase64 == "" || m.MessageID == "" {
+			fmt.Printf("[msg %d] rejected: unsigned message\n", m.ID)
+			return
+		}
+		sig, err := decodeBase64(m.SignatureBase64)
+		if err != nil {
+			fmt.Printf("[msg %d] rejected: bad signature encoding\n", m.ID)
+			return
+		}
+		err = VerifyMessageE2E(peerSignPub, m.FromUserID, m.ToUserID, m.MessageID, nBytes, ctBytes, sig)
+		if err != nil {
+			// ключа не было или он сменился (собеседник вошёл после обновления
+			// сервера) — перечитываем и проверяем ещё раз, но только один
+			fresh, ferr := fetchPeerSignKey(*baseURL, *peerName, peerID)
+			if ferr != nil {
+				fmt.Printf("[msg %d] refresh signing key: %v\n", m.ID, ferr)
+			} else if len(fresh) > 0 && !bytes.Equal(fresh, peerSignPub) {
+				peerSignPub = fresh
+				err = VerifyMessageE2E(peerSignPub, m.FromUserID, m.ToUserID, m.MessageID, nBytes, ctBytes, sig)
+			}
+		}
+		if err != nil {
+			fmt.Printf("[msg %d] rejected: %v\n", m.ID, err)
+			return
+		}
+		// сервер мог повторить старый подписанный шифртекст под новым id
+		if seenMsgIDs[m.MessageID] {
+			fmt.Printf("[msg %d] rejected: replayed message %s\n", m.ID, m.MessageID)
+			return
+		}
+		seenMsgIDs[m.MessageID] = true
+
+		// подпись проверена — отправитель действительно peer
+		aad := e2eAAD(m.Version, m.FromUserID, m.ToUserID)
+		plain, err := DecryptMessageE2E(userPriv, peerPub, ctBytes, nBytes, aad)
+		if err != nil {
+			fmt.Printf("[msg %d] decrypt error: %v\n", m.ID, err)
+			return
+		}
+		if att, ok := parseAttachment(plain); ok {
+			path, err := downloadAttachment(*baseURL, selfID, att, *downloadsDir)
+			if err != nil {
+				fmt.Printf("\n[%s] attachment %q rejected: %v\n> ", *peerName, att.Name, err)
+				return
+			}
+			fmt.Printf("\n[%s] sent file %s (%d bytes, %s) -> %s\n> ", *peerName, att.Name, att.Size, att.ContentType, path)
+			return
+		}
+		fmt.Printf("\n[%s] %s\n> ", *peerName, string(plain))
+	}
 
 	go func() {
+		// токен берём до истории: всё, что придёт после, получим дельтой
+		token, err := syncHead(*baseURL, selfID)
+		if err != nil {
+			fmt.Println("sync error:", err)
+		}
+		msgs, err := fetchMessages(*baseURL, selfID, peerID)
+		if err != nil {
+			fmt.Println("history error:", err)
+		}
+		for _, m := range msgs {
+			handleMessage(m)
+		}
+
 		for {
-			msgsURL := fmt.Sprintf("%s/messages?user_a=%d&user_b=%d", *baseURL, selfID, peerID)
-			resp, err := http.Get(msgsURL)
-			if err != nil {
-				fmt.Println("poll error:", err)
-				time.Sleep(2 * time.Second)
-				continue
+			if token == "" {
+				if token, err = syncHead(*baseURL, selfID); err != nil {
+					fmt.Println("sync error:", err)
+					time.Sleep(2 * time.Second)
+					continue
+				}
 			}
-			var msgs []MessageDTO
-			if err := json.NewDecoder(resp.Body).Decode(&msgs); err != nil {
-				resp.Body.Close()
-				fmt.Println("decode messages error:", err)
+			delta, err := syncWait(*baseURL, selfID, token)
+			if err != nil {
+				fmt.Println("sync error:", err)
 				time.Sleep(2 * time.Second)
 				continue
 			}
-			resp.Body.Close()
-
-			for _, m := range msgs {
-				if m.ID <= lastSeenID {
-					continue
-				}
-				// интересуют только входящие сообщения
-				if m.ToUserID != selfID {
-					continue
-				}
-				ctBytes, err := decodeBase64(m.CiphertextBase64)
-				if err != nil {
-					fmt.Println("cipher b64 error:", err)
-					continue
-				}
-				nBytes, err := decodeBase64(m.NonceBase64)
-				if err != nil {
-					fmt.Println("nonce b64 error:", err)
-					continue
-				}
-				// расшифровываем, предполагая, что отправитель — наш peer
-				plain, err := DecryptMessageE2E(userPriv, peerPub, ctBytes, nBytes)
-				if err != nil {
-					fmt.Printf("[msg %d] decrypt error: %v\n", m.ID, err)
+			token = delta.Token
+			for _, m := range delta.E2E {
+				// /sync отдаёт переписку со всеми, нам нужна только с peer
+				if m.FromUserID != peerID && m.ToUserID != peerID {
 					continue
 				}
-				fmt.Printf("\n[%s] %s\n> ", *peerName, string(plain))
-				lastSeenID = m.ID
+				handleMessage(m)
 			}
-
-			time.Sleep(2 * time.Second)
 		}
 	}()
 
 	// 6. Читаем ввод пользователя и шлём сообщения
+	sendPlaintext := func(plain []byte) error {
+		ct, msgNonce, err := EncryptMessageE2E(userPriv, peerPub, plain, e2eAAD(e2eVersionAAD, selfID, peerID))
+		if err != nil {
+			return fmt.Errorf("encrypt: %w", err)
+		}
+		msgID, err := newMessageID()
+		if err != nil {
+			return fmt.Errorf("message id: %w", err)
+		}
+		sig, err := SignMessageE2E(userSignPriv, selfID, peerID, msgID, msgNonce, ct)
+		if err != nil {
+			return fmt.Errorf("sign: %w", err)
+		}
+
+		sendReq := SendMessageRequest{
+			FromUserID:       selfID,
+			ToUserID:         peerID,
+			CiphertextBase64: encodeBase64(ct),
+			NonceBase64:      encodeBase64(msgNonce),
+			MessageID:        msgID,
+			SignatureBase64:  encodeBase64(sig),
+			Version:          e2eVersionAAD,
+		}
+		resp, err := httpPostJSON(*baseURL+"/send_message", sendReq, nil)
+		if err != nil {
+			return fmt.Errorf("send: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			b, _ := io.ReadAll(resp.Body)
+			return fmt.Errorf("send status %d: %s", resp.StatusCode, string(b))
+		}
+		return nil
+	}
+
+	sendFile := func(path string) error {
+		blob, att, err := encryptAttachment(path)
+		if err != nil {
+			return err
+		}
+		att.MediaID, err = uploadAttachment(*baseURL, selfID, peerID, blob)
+		if err != nil {
+			return err
+		}
+		plain, err := json.Marshal(att)
+		if err != nil {
+			return err
+		}
+		return sendPlaintext(plain)
+	}
+
 	scanner := bufio.NewScanner(os.Stdin)
 	fmt.Print("> ")
 	for scanner.Scan() {
@@ -314,28 +591,19 @@ func main() {
 			continue
 		}
 
-		ct, msgNonce, err := EncryptMessageE2E(userPriv, peerPub, []byte(text))
-		if err != nil {
-			fmt.Println("encrypt error:", err)
+		if path, ok := strings.CutPrefix(text, "/send "); ok {
+			path = strings.TrimSpace(path)
+			if err := sendFile(path); err != nil {
+				fmt.Println("send file error:", err)
+			} else {
+				fmt.Println("file sent:", path)
+			}
 			fmt.Print("> ")
 			continue
 		}
 
-		sendReq := SendMessageRequest{
-			FromUserID:       selfID,
-			ToUserID:         peerID,
-			CiphertextBase64: encodeBase64(ct),
-			NonceBase64:      encodeBase64(msgNonce),
-		}
-		resp, err := httpPostJSON(*baseURL+"/send_message", sendReq, nil)
-		if err != nil {
-			fmt.Println("send error:", err)
-			fmt.Print("> ")
-			continue
-		}
-		if resp.StatusCode != http.StatusOK {
-			b, _ := io.ReadAll(resp.Body)
-			fmt.Printf("send status %d: %s\n", resp.StatusCode, string(b))
+		if err := sendPlaintext([]byte(text)); err != nil {
+			fmt.Println(err)
 		}
 		fmt.Print("> ")
 	}
@@ -4,12 +4,13 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/ecdh"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"io"
-	"os"
 	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/hkdf"
 )
@@ -41,7 +42,9 @@ func deriveKeyFromPassword(password string, salt []byte, cfg CryptoConfig) []byt
 	return argon2.IDKey([]byte(password), salt, cfg.ArgonTime, cfg.ArgonMemory, cfg.ArgonThreads, cfg.ArgonKeyLen)
 }
 
-func aesGCMEncrypt(key, plaintext []byte) (ciphertext, nonce []byte, err error) {
+// aad — дополнительные аутентифицируемые данные (не шифруются, но входят в тег):
+// шифртекст, перенесённый в чужую запись, не расшифруется. nil — без привязки.
+func aesGCMEncrypt(key, plaintext, aad []byte) (ciphertext, nonce []byte, err error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, nil, err
@@ -54,11 +57,11 @@ func aesGCMEncrypt(key, plaintext []byte) (ciphertext, nonce []byte, err error)
 	if err != nil {
 		return nil, nil, err
 	}
-	ciphertext = aesgcm.Seal(nil, nonce, plaintext, nil)
+	ciphertext = aesgcm.Seal(nil, nonce, plaintext, aad)
 	return ciphertext, nonce, nil
 }
 
-func aesGCMDecrypt(key, ciphertext, nonce []byte) ([]byte, error) {
+func aesGCMDecrypt(key, ciphertext, nonce, aad []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
@@ -67,7 +70,7 @@ func aesGCMDecrypt(key, ciphertext, nonce []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	plaintext, err := aesgcm.Open(nil, nonce, ciphertext, nil)
+	plaintext, err := aesgcm.Open(nil, nonce, ciphertext, aad)
 	if err != nil {
 		return nil, err
 	}
@@ -92,6 +95,24 @@ func generateUserKeyPair() (*UserKeyPair, error) {
 	}, nil
 }
 
+// Ключи подписи (Ed25519) — отдельно от X25519: DH-ключ доказывает только,
+// что сообщение от одного из двух участников, а подпись — что от отправителя.
+type UserSigningKeyPair struct {
+	PublicKey  []byte
+	PrivateKey []byte
+}
+
+func generateUserSigningKeyPair() (*UserSigningKeyPair, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &UserSigningKeyPair{
+		PublicKey:  pub,
+		PrivateKey: priv,
+	}, nil
+}
+
 func encodeBase64(b []byte) string {
 	return base64.StdEncoding.EncodeToString(b)
 }
@@ -128,39 +149,107 @@ func deriveSessionKeyFromX25519(privateKeyBytes, peerPublicKeyBytes []byte) ([]b
 	return key, nil
 }
 
+// Версии формата E2E-сообщений (колонка messages.version):
+// 1 — без AAD (старые записи), 2 — AAD = (from, to, версия).
+const (
+	e2eVersionLegacy = 1
+	e2eVersionAAD    = 2
+)
+
+func e2eAAD(version int, fromUserID, toUserID int64) []byte {
+	if version < e2eVersionAAD {
+		return nil
+	}
+	aad := []byte("mollysage-e2e")
+	aad = binary.BigEndian.AppendUint32(aad, uint32(version))
+	aad = binary.BigEndian.AppendUint64(aad, uint64(fromUserID))
+	aad = binary.BigEndian.AppendUint64(aad, uint64(toUserID))
+	return aad
+}
+
 // Клиентские удобные функции: E2E-шифрование и дешифрование
 
-func EncryptMessageE2E(senderPriv, receiverPub, plaintext []byte) (ciphertext, nonce []byte, err error) {
+func EncryptMessageE2E(senderPriv, receiverPub, plaintext, aad []byte) (ciphertext, nonce []byte, err error) {
 	sessionKey, err := deriveSessionKeyFromX25519(senderPriv, receiverPub)
 	if err != nil {
 		return nil, nil, err
 	}
-	ct, n, err := aesGCMEncrypt(sessionKey, plaintext)
+	ct, n, err := aesGCMEncrypt(sessionKey, plaintext, aad)
 	if err != nil {
 		return nil, nil, err
 	}
 	return ct, n, nil
 }
 
-func DecryptMessageE2E(receiverPriv, senderPub, ciphertext, nonce []byte) ([]byte, error) {
+func DecryptMessageE2E(receiverPriv, senderPub, ciphertext, nonce, aad []byte) ([]byte, error) {
 	sessionKey, err := deriveSessionKeyFromX25519(receiverPriv, senderPub)
 	if err != nil {
 		return nil, err
 	}
-	return aesGCMDecrypt(sessionKey, ciphertext, nonce)
+	return aesGCMDecrypt(sessionKey, ciphertext, nonce, aad)
 }
 
-func mustLoadOrCreateServerKey(path string) []byte {
-	key, err := os.ReadFile(path)
-	if err == nil && len(key) == 32 {
-		return key
+// Версии формата plain_media (колонка enc_version):
+// 1 — без AAD (старые записи), 2 — AAD = (id, kind, владелец, content_type),
+// 3 — то же AAD, но блоб зашифрован своим DEK, обёрнутым мастер-ключом (keyring.go),
+// 4 — как 3, но блоб порезан на сегменты по 64 KiB (media_stream.go): шифруется и
+// читается потоком, без загрузки файла в память целиком.
+// Версии 1 и 2 зашифрованы напрямую мастер-ключом версии 1.
+const (
+	mediaEncVersionLegacy    = 1
+	mediaEncVersionAAD       = 2
+	mediaEncVersionEnvelope  = 3
+	mediaEncVersionSegmented = 4
+)
+
+func mediaAAD(version int, id int64, kind string, ownerUserID int64, contentType string) []byte {
+	if version < mediaEncVersionAAD {
+		return nil
+	}
+	aad := []byte("mollysage-media")
+	aad = binary.BigEndian.AppendUint32(aad, uint32(version))
+	aad = binary.BigEndian.AppendUint64(aad, uint64(id))
+	aad = binary.BigEndian.AppendUint64(aad, uint64(ownerUserID))
+	for _, part := range []string{kind, contentType} {
+		aad = binary.BigEndian.AppendUint32(aad, uint32(len(part)))
+		aad = append(aad, part...)
+	}
+	return aad
+}
+
+// Подпись E2E-сообщения: from, to и клиентский id сообщения входят в
+// подписываемые данные, чтобы сервер не мог переадресовать или повторить шифртекст.
+const e2eSignatureContext = "mollysage-e2e-sig-v1"
+
+var ErrBadSignature = errors.New("bad signature")
+
+func e2eSignaturePayload(fromUserID, toUserID int64, msgID string, nonce, ciphertext []byte) []byte {
+	buf := make([]byte, 0, len(e2eSignatureContext)+16+12+len(msgID)+len(nonce)+len(ciphertext))
+	buf = append(buf, e2eSignatureContext...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(fromUserID))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(toUserID))
+	for _, part := range [][]byte{[]byte(msgID), nonce, ciphertext} {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(part)))
+		buf = append(buf, part...)
 	}
-	key = make([]byte, 32)
-	if _, err := rand.Read(key); err != nil {
-		panic(err)
+	return buf
+}
+
+func SignMessageE2E(signPriv []byte, fromUserID, toUserID int64, msgID string, nonce, ciphertext []byte) ([]byte, error) {
+	if len(signPriv) != ed25519.PrivateKeySize {
+		return nil, errors.New("bad signing key size")
 	}
-	if err := os.WriteFile(path, key, 0600); err != nil {
-		panic(err)
+	payload := e2eSignaturePayload(fromUserID, toUserID, msgID, nonce, ciphertext)
+	return ed25519.Sign(ed25519.PrivateKey(signPriv), payload), nil
+}
+
+func VerifyMessageE2E(signPub []byte, fromUserID, toUserID int64, msgID string, nonce, ciphertext, sig []byte) error {
+	if len(signPub) != ed25519.PublicKeySize || len(sig) != ed25519.SignatureSize || msgID == "" {
+		return ErrBadSignature
+	}
+	payload := e2eSignaturePayload(fromUserID, toUserID, msgID, nonce, ciphertext)
+	if !ed25519.Verify(ed25519.PublicKey(signPub), payload, sig) {
+		return ErrBadSignature
 	}
-	return key
-}
\ No newline at end of file
+	return nil
+}
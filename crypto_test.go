@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func newTestE2EPair(t *testing.T) (*UserKeyPair, *UserKeyPair) {
+	t.Helper()
+	alice, err := generateUserKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := generateUserKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return alice, bob
+}
+
+func TestE2ESignatureRoundTrip(t *testing.T) {
+	sign, err := generateUserSigningKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, ct := []byte("nonce-123456"), []byte("ciphertext")
+
+	sig, err := SignMessageE2E(sign.PrivateKey, 4, 5, "msg-1", nonce, ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyMessageE2E(sign.PublicKey, 4, 5, "msg-1", nonce, ct, sig); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+}
+
+func TestE2ESignatureTamper(t *testing.T) {
+	sign, err := generateUserSigningKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := generateUserSigningKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, ct := []byte("nonce-123456"), []byte("ciphertext")
+	sig, err := SignMessageE2E(sign.PrivateKey, 4, 5, "msg-1", nonce, ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		pub      []byte
+		from, to int64
+		msgID    string
+		nonce    []byte
+		ct       []byte
+		sig      []byte
+	}{
+		{"wrong msgID", sign.PublicKey, 4, 5, "msg-2", nonce, ct, sig},
+		{"empty msgID", sign.PublicKey, 4, 5, "", nonce, ct, sig},
+		{"wrong sender", sign.PublicKey, 6, 5, "msg-1", nonce, ct, sig},
+		{"redirected", sign.PublicKey, 4, 6, "msg-1", nonce, ct, sig},
+		{"swapped direction", sign.PublicKey, 5, 4, "msg-1", nonce, ct, sig},
+		{"wrong nonce", sign.PublicKey, 4, 5, "msg-1", []byte("nonce-654321"), ct, sig},
+		{"wrong ciphertext", sign.PublicKey, 4, 5, "msg-1", nonce, []byte("ciphertexT"), sig},
+		// границы полей входят в подпись: байты нельзя перенести из одного в другое
+		{"moved boundary", sign.PublicKey, 4, 5, "msg-1n", []byte("once-123456"), ct, sig},
+		{"other key", other.PublicKey, 4, 5, "msg-1", nonce, ct, sig},
+		{"short signature", sign.PublicKey, 4, 5, "msg-1", nonce, ct, sig[:10]},
+		{"short key", sign.PublicKey[:10], 4, 5, "msg-1", nonce, ct, sig},
+	}
+	for _, c := range cases {
+		err := VerifyMessageE2E(c.pub, c.from, c.to, c.msgID, c.nonce, c.ct, c.sig)
+		if !errors.Is(err, ErrBadSignature) {
+			t.Errorf("%s: got %v, want ErrBadSignature", c.name, err)
+		}
+	}
+
+	if _, err := SignMessageE2E(sign.PrivateKey[:10], 4, 5, "msg-1", nonce, ct); err == nil {
+		t.Error("signing with a short key must fail")
+	}
+}
+
+func TestE2EEncryptRoundTrip(t *testing.T) {
+	alice, bob := newTestE2EPair(t)
+	aad := e2eAAD(e2eVersionAAD, 4, 5)
+
+	ct, nonce, err := EncryptMessageE2E(alice.PrivateKey, bob.PublicKey, []byte("привет"), aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// получатель выводит тот же сессионный ключ со своей стороны
+	plain, err := DecryptMessageE2E(bob.PrivateKey, alice.PublicKey, ct, nonce, aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plain) != "привет" {
+		t.Fatalf("got %q", plain)
+	}
+}
+
+func TestE2EAADBinding(t *testing.T) {
+	alice, bob := newTestE2EPair(t)
+	aad := e2eAAD(e2eVersionAAD, 4, 5)
+	ct, nonce, err := EncryptMessageE2E(alice.PrivateKey, bob.PublicKey, []byte("hi"), aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, wrong := range map[string][]byte{
+		"other recipient":   e2eAAD(e2eVersionAAD, 4, 6),
+		"other sender":      e2eAAD(e2eVersionAAD, 6, 5),
+		"swapped":           e2eAAD(e2eVersionAAD, 5, 4),
+		"other version":     e2eAAD(e2eVersionAAD+1, 4, 5),
+		"read as legacy v1": e2eAAD(e2eVersionLegacy, 4, 5),
+	} {
+		if _, err := DecryptMessageE2E(bob.PrivateKey, alice.PublicKey, ct, nonce, wrong); err == nil {
+			t.Errorf("%s: decrypted with wrong AAD", name)
+		}
+	}
+}
+
+func TestE2ELegacyWithoutAAD(t *testing.T) {
+	if aad := e2eAAD(e2eVersionLegacy, 4, 5); aad != nil {
+		t.Fatalf("legacy AAD must be nil, got %x", aad)
+	}
+	alice, bob := newTestE2EPair(t)
+	ct, nonce, err := EncryptMessageE2E(alice.PrivateKey, bob.PublicKey, []byte("old"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := DecryptMessageE2E(bob.PrivateKey, alice.PublicKey, ct, nonce, e2eAAD(e2eVersionLegacy, 4, 5))
+	if err != nil || string(plain) != "old" {
+		t.Fatalf("legacy read: %q, %v", plain, err)
+	}
+}
+
+func TestMediaAADDistinct(t *testing.T) {
+	base := mediaAAD(mediaEncVersionAAD, 7, "direct", 4, "image/png")
+	if mediaAAD(mediaEncVersionLegacy, 7, "direct", 4, "image/png") != nil {
+		t.Fatal("legacy media AAD must be nil")
+	}
+	for name, other := range map[string][]byte{
+		"id":           mediaAAD(mediaEncVersionAAD, 8, "direct", 4, "image/png"),
+		"kind":         mediaAAD(mediaEncVersionAAD, 7, "group", 4, "image/png"),
+		"owner":        mediaAAD(mediaEncVersionAAD, 7, "direct", 5, "image/png"),
+		"content type": mediaAAD(mediaEncVersionAAD, 7, "direct", 4, "image/jpeg"),
+		"version":      mediaAAD(mediaEncVersionEnvelope, 7, "direct", 4, "image/png"),
+		// длины частей входят в AAD: "direct"+"image/png" != "directi"+"mage/png"
+		"boundary": mediaAAD(mediaEncVersionAAD, 7, "directi", 4, "mage/png"),
+	} {
+		if bytes.Equal(base, other) {
+			t.Errorf("%s does not change the AAD", name)
+		}
+	}
+
+	key := bytes.Repeat([]byte{1}, 32)
+	ct, nonce, err := aesGCMEncrypt(key, []byte("png"), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := aesGCMDecrypt(key, ct, nonce, mediaAAD(mediaEncVersionAAD, 8, "direct", 4, "image/png")); err == nil {
+		t.Fatal("ciphertext moved to another media id decrypted")
+	}
+	if plain, err := aesGCMDecrypt(key, ct, nonce, base); err != nil || string(plain) != "png" {
+		t.Fatalf("round trip: %q, %v", plain, err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestE2EMediaStoredInBlobStore(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob, eve := newTestUser(t, s, "alice"), newTestUser(t, s, "bob"), newTestUser(t, s, "eve")
+	payload := bytes.Repeat([]byte("opaque"), 1000)
+
+	rec := httptest.NewRecorder()
+	s.handleE2EMediaUpload(rec, httptest.NewRequest(http.MethodPost,
+		fmt.Sprintf("/api/e2e_media/upload?from_user_id=%d&to_user_id=%d", alice, bob), bytes.NewReader(payload)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upload: %d %s", rec.Code, rec.Body)
+	}
+	var created struct{ ID, Size int64 }
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Size != int64(len(payload)) {
+		t.Fatalf("size %d, want %d", created.Size, len(payload))
+	}
+
+	// в базе шифртекста нет, только ключ блоба
+	var inline []byte
+	var key string
+	if err := s.e2eMedia.db.QueryRow(`SELECT blob, blob_key FROM e2e_media WHERE id = ?`, created.ID).Scan(&inline, &key); err != nil {
+		t.Fatal(err)
+	}
+	if len(inline) != 0 || key == "" {
+		t.Fatalf("inline %d bytes, blob_key %q", len(inline), key)
+	}
+
+	get := func(uid int64) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.handleE2EMediaGet(rec, httptest.NewRequest(http.MethodGet,
+			fmt.Sprintf("/api/e2e_media/get?id=%d&user_id=%d", created.ID, uid), nil))
+		return rec
+	}
+	for _, uid := range []int64{alice, bob} {
+		if rec := get(uid); rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), payload) {
+			t.Errorf("user %d: %d, %d bytes", uid, rec.Code, rec.Body.Len())
+		}
+	}
+	if rec := get(eve); rec.Code != http.StatusNotFound {
+		t.Errorf("stranger: %d", rec.Code)
+	}
+}
+
+func TestE2EMediaUploadLimits(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob := newTestUser(t, s, "alice"), newTestUser(t, s, "bob")
+	url := fmt.Sprintf("/api/e2e_media/upload?from_user_id=%d&to_user_id=%d", alice, bob)
+
+	rec := httptest.NewRecorder()
+	s.handleE2EMediaUpload(rec, httptest.NewRequest(http.MethodPost, url, bytes.NewReader(nil)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("empty body: %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleE2EMediaUpload(rec, httptest.NewRequest(http.MethodPost, url, bytes.NewReader(make([]byte, maxE2EMediaSize+1))))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body: %d", rec.Code)
+	}
+}
+
+func TestMoveInlineE2EMediaToBlobs(t *testing.T) {
+	db := newTestDB(t)
+	blobs := newTestBlobs(t)
+	if _, err := db.Exec(`INSERT INTO e2e_media (from_user_id, to_user_id, blob, size) VALUES (1, 2, ?, 3)`, []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewE2EMediaStore(db)
+	if n, err := moveInlineE2EMediaToBlobs(store, blobs); err != nil || n != 1 {
+		t.Fatalf("moved %d, %v", n, err)
+	}
+	m, err := store.GetByID(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := readBlob(blobs, m.BlobKey); err != nil || string(data) != "old" {
+		t.Fatalf("blob: %q, %v", data, err)
+	}
+	if n, err := moveInlineE2EMediaToBlobs(store, blobs); err != nil || n != 0 {
+		t.Fatalf("second pass moved %d, %v", n, err)
+	}
+}
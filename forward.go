@@ -0,0 +1,87 @@
+package main
+
+import (
+	"database/sql"
+)
+
+// ===== Пересылка сообщений =====
+//
+// /messages/forward копирует личное или групповое сообщение в другую личку или
+// беседу отправителя. Текст копируется (шифруется заново — под новое сообщение),
+// а вложения нет: новое сообщение ссылается на те же записи plain_media, блоб не
+// перезаливается и не перешифровывается. Открыть такое медиа может любой, кто
+// видит сообщение с этим вложением (canAccessMedia), а GC не удалит его, пока на
+// него ссылается хоть одно сообщение.
+//
+// У копии хранится автор оригинала (forwarded_from и его имя на момент
+// пересылки); пересылка пересланного указывает на самого первого автора.
+
+type forwardSourceMsg struct {
+	text     string
+	fromID   int64
+	fromName string
+	media    []int64
+}
+
+// forwardSource — что копировать из сообщения (доступ уже проверен).
+func (s *Server) forwardSource(kind string, messageID int64) (*forwardSourceMsg, error) {
+	atts, err := s.attachments.ListFor(kind, []int64{messageID})
+	if err != nil {
+		return nil, err
+	}
+
+	var src forwardSourceMsg
+	if kind == plainMessagesTable.kind {
+		msgs, err := s.plainMessages.ListByIDs([]int64{messageID})
+		if err != nil {
+			return nil, err
+		}
+		if len(msgs) == 0 {
+			return nil, sql.ErrNoRows
+		}
+		m := msgs[0]
+		src = forwardSourceMsg{text: m.Text, fromID: m.FromUserID, fromName: m.ForwardedFromName}
+		if m.ForwardedFrom != 0 {
+			src.fromID = m.ForwardedFrom
+		} else if u, err := s.users.GetByID(m.FromUserID); err == nil {
+			src.fromName = u.Username
+		}
+	} else {
+		msgs, err := s.groupMessages.ListByIDs([]int64{messageID})
+		if err != nil {
+			return nil, err
+		}
+		if len(msgs) == 0 {
+			return nil, sql.ErrNoRows
+		}
+		m := msgs[0]
+		src = forwardSourceMsg{text: m.Text, fromID: m.FromUserID, fromName: m.FromUsername}
+		if m.ForwardedFrom != 0 {
+			src.fromID, src.fromName = m.ForwardedFrom, m.ForwardedFromName
+		}
+	}
+
+	src.text = stripAttachmentMarkers(src.text, atts[messageID])
+	for _, a := range atts[messageID] {
+		src.media = append(src.media, a.ID)
+	}
+	return &src, nil
+}
+
+// attachForwardedMedia — вложения оригинала после собственных (с позиции from).
+// Вызывается в транзакции создания сообщения, как attachMedia.
+func attachForwardedMedia(tx *sql.Tx, kind string, messageID int64, from int, mediaIDs []int64) error {
+	for i, mediaID := range mediaIDs {
+		if err := insertAttachment(tx, kind, messageID, from+i, mediaID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func forwardedDTO(userID int64, username string) *ForwardedDTO {
+	if userID == 0 {
+		return nil
+	}
+	return &ForwardedDTO{UserID: userID, Username: username}
+}
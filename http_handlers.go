@@ -1,14 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"crypto/subtle"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Server struct {
@@ -20,21 +25,58 @@ type Server struct {
 	groupMessages *GroupMessageStore
 	crypto        CryptoConfig
 	plainMedia    *PlainMediaStore
-	plainMediaKey []byte
+	e2eMedia      *E2EMediaStore
+	mediaUploads  *MediaUploadStore
+	attachments   *AttachmentStore
+	syncs         *SyncStore
+	reactions     *ReactionStore
+	pins          *PinStore
+	polls         *PollStore
+	mentions      *MentionStore
+	scheduled     *ScheduledStore
+	replies       *ReplyStore
+	updates       *syncHub // будит /sync после записи (sync.go)
+	typing        *typingRegistry
+	presence      *presenceRegistry
+	keyring       *Keyring
+	mediaPolicy   *MediaPolicy
+	blobs         BlobStore
+	dedupKey      []byte // media_gc.go
+
+	defaultMediaQuota int64           // байты, 0 — без ограничений (media_quota.go)
+	admins            map[string]bool // username из -admins
+
+	stageLocks *uploadLocks // части одной загрузки пишутся по одной (media_upload.go)
 }
 
-
-func NewServer(db *sql.DB) *Server {
+func NewServer(db *sql.DB, keyring *Keyring, sealer *TextSealer, mediaPolicy *MediaPolicy, blobs BlobStore) *Server {
 	return &Server{
 		users:         NewUserStore(db),
 		messages:      NewMessageStore(db),
-		plainMessages: NewPlainMessageStore(db),
+		plainMessages: NewPlainMessageStore(db, sealer),
 		groups:        NewGroupStore(db),
 		groupMembers:  NewGroupMemberStore(db),
-		groupMessages: NewGroupMessageStore(db),
+		groupMessages: NewGroupMessageStore(db, sealer),
 		crypto:        defaultCryptoConfig,
 		plainMedia:    NewPlainMediaStore(db),
-		plainMediaKey: mustLoadOrCreateServerKey("server_media_key.bin"),
+		e2eMedia:      NewE2EMediaStore(db),
+		mediaUploads:  NewMediaUploadStore(db),
+		attachments:   NewAttachmentStore(db),
+		syncs:         NewSyncStore(db),
+		reactions:     NewReactionStore(db),
+		pins:          NewPinStore(db),
+		polls:         NewPollStore(db),
+		mentions:      NewMentionStore(db),
+		scheduled:     NewScheduledStore(db, sealer),
+		replies:       NewReplyStore(db, sealer),
+		updates:       newSyncHub(),
+		typing:        newTypingRegistry(),
+		presence:      newPresenceRegistry(NewUserStore(db)),
+		keyring:       keyring,
+		mediaPolicy:   mediaPolicy,
+		blobs:         blobs,
+		dedupKey:      mediaDedupKey(sealer.indexKey),
+		stageLocks:    newUploadLocks(),
 	}
 }
 
@@ -44,9 +86,10 @@ type RegisterRequest struct {
 }
 
 type RegisterResponse struct {
-	ID        int64  `json:"id"`
-	Username  string `json:"username"`
-	PublicKey string `json:"public_key_base64"`
+	ID            int64  `json:"id"`
+	Username      string `json:"username"`
+	PublicKey     string `json:"public_key_base64"`
+	SignPublicKey string `json:"sign_public_key_base64"`
 }
 
 func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
@@ -80,19 +123,34 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	encPriv, nonce, err := aesGCMEncrypt(passwordKey, keyPair.PrivateKey)
+	encPriv, nonce, err := aesGCMEncrypt(passwordKey, keyPair.PrivateKey, nil)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	signPair, err := generateUserSigningKeyPair()
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	encSignPriv, signNonce, err := aesGCMEncrypt(passwordKey, signPair.PrivateKey, nil)
 	if err != nil {
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
 
 	user := &User{
-		Username:           req.Username,
-		PasswordSalt:       salt,
-		PasswordHash:       passwordKey,
-		PublicKey:          keyPair.PublicKey,
-		EncPrivateKey:      encPriv,
-		EncPrivateKeyNonce: nonce,
+		Username:               req.Username,
+		PasswordSalt:           salt,
+		PasswordHash:           passwordKey,
+		PublicKey:              keyPair.PublicKey,
+		EncPrivateKey:          encPriv,
+		EncPrivateKeyNonce:     nonce,
+		SignPublicKey:          signPair.PublicKey,
+		EncSignPrivateKey:      encSignPriv,
+		EncSignPrivateKeyNonce: signNonce,
 	}
 
 	created, err := s.users.CreateUser(user)
@@ -106,9 +164,10 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 	}
 
 	resp := RegisterResponse{
-		ID:        created.ID,
-		Username:  created.Username,
-		PublicKey: encodeBase64(created.PublicKey),
+		ID:            created.ID,
+		Username:      created.Username,
+		PublicKey:     encodeBase64(created.PublicKey),
+		SignPublicKey: encodeBase64(created.SignPublicKey),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -127,6 +186,10 @@ type LoginResponse struct {
 	PasswordSalt       string `json:"password_salt_base64"`
 	EncPrivateKey      string `json:"enc_private_key_base64"`
 	EncPrivateKeyNonce string `json:"enc_private_key_nonce_base64"`
+
+	SignPublicKey          string `json:"sign_public_key_base64"`
+	EncSignPrivateKey      string `json:"enc_sign_private_key_base64"`
+	EncSignPrivateKeyNonce string `json:"enc_sign_private_key_nonce_base64"`
 }
 
 func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
@@ -158,6 +221,14 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// старые аккаунты без ключа подписи получают его при первом входе
+	if len(user.SignPublicKey) == 0 {
+		if err := s.ensureSigningKeys(user, derived); err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	resp := LoginResponse{
 		ID:                 user.ID,
 		Username:           user.Username,
@@ -165,12 +236,38 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 		PasswordSalt:       encodeBase64(user.PasswordSalt),
 		EncPrivateKey:      encodeBase64(user.EncPrivateKey),
 		EncPrivateKeyNonce: encodeBase64(user.EncPrivateKeyNonce),
+
+		SignPublicKey:          encodeBase64(user.SignPublicKey),
+		EncSignPrivateKey:      encodeBase64(user.EncSignPrivateKey),
+		EncSignPrivateKeyNonce: encodeBase64(user.EncSignPrivateKeyNonce),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(resp)
 }
 
+func (s *Server) ensureSigningKeys(user *User, passwordKey []byte) error {
+	signPair, err := generateUserSigningKeyPair()
+	if err != nil {
+		return err
+	}
+	encSignPriv, signNonce, err := aesGCMEncrypt(passwordKey, signPair.PrivateKey, nil)
+	if err != nil {
+		return err
+	}
+	if err := s.users.SetSigningKeys(user.ID, signPair.PublicKey, encSignPriv, signNonce); err != nil {
+		return err
+	}
+
+	// перечитываем: при параллельном входе ключ мог записать другой запрос
+	fresh, err := s.users.GetByID(user.ID)
+	if err != nil {
+		return err
+	}
+	*user = *fresh
+	return nil
+}
+
 func secureEqual(a, b []byte) bool {
 	if len(a) != len(b) {
 		return false
@@ -179,9 +276,10 @@ func secureEqual(a, b []byte) bool {
 }
 
 type PublicKeyResponse struct {
-	ID       int64  `json:"id"`
-	Username string `json:"username"`
-	PublicKey string `json:"public_key_base64"`
+	ID            int64  `json:"id"`
+	Username      string `json:"username"`
+	PublicKey     string `json:"public_key_base64"`
+	SignPublicKey string `json:"sign_public_key_base64,omitempty"`
 }
 
 
@@ -204,10 +302,13 @@ func (s *Server) handleGetPublicKey(w http.ResponseWriter, r *http.Request) {
 	}
 
 	resp := PublicKeyResponse{
-		ID:       user.ID,
-		Username: user.Username,
+		ID:        user.ID,
+		Username:  user.Username,
 		PublicKey: encodeBase64(user.PublicKey),
 	}
+	if len(user.SignPublicKey) > 0 {
+		resp.SignPublicKey = encodeBase64(user.SignPublicKey)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(resp)
@@ -218,6 +319,10 @@ type SendMessageRequest struct {
 	ToUserID         int64  `json:"to_user_id"`
 	CiphertextBase64 string `json:"ciphertext_base64"`
 	NonceBase64      string `json:"nonce_base64"`
+	MessageID        string `json:"message_id,omitempty"`
+	SignatureBase64  string `json:"signature_base64,omitempty"`
+	// версия формата шифртекста, см. e2eVersion* в crypto.go; 0 — старый клиент (1)
+	Version int `json:"version,omitempty"`
 }
 
 type SendMessageResponse struct {
@@ -240,8 +345,16 @@ func (s *Server) handleSendMessage(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "missing fields", http.StatusBadRequest)
 		return
 	}
+	if req.Version == 0 {
+		req.Version = e2eVersionLegacy
+	}
+	if req.Version != e2eVersionLegacy && req.Version != e2eVersionAAD {
+		http.Error(w, "unsupported version", http.StatusBadRequest)
+		return
+	}
 
-	if _, err := s.users.GetByID(req.FromUserID); err != nil {
+	fromUser, err := s.users.GetByID(req.FromUserID)
+	if err != nil {
 		http.Error(w, "from_user not found", http.StatusBadRequest)
 		return
 	}
@@ -266,6 +379,23 @@ func (s *Server) handleSendMessage(w http.ResponseWriter, r *http.Request) {
 		ToUserID:   req.ToUserID,
 		Ciphertext: ct,
 		Nonce:      nonce,
+		Version:    req.Version,
+	}
+
+	// подпись необязательна для старых клиентов, но если она есть — должна сходиться;
+	// окончательно подлинность проверяет получатель
+	if req.SignatureBase64 != "" {
+		sig, err := decodeBase64(req.SignatureBase64)
+		if err != nil {
+			http.Error(w, "bad signature", http.StatusBadRequest)
+			return
+		}
+		if err := VerifyMessageE2E(fromUser.SignPublicKey, req.FromUserID, req.ToUserID, req.MessageID, nonce, ct, sig); err != nil {
+			http.Error(w, "bad signature", http.StatusBadRequest)
+			return
+		}
+		msg.ClientMsgID = sql.NullString{String: req.MessageID, Valid: true}
+		msg.Signature = sig
 	}
 
 	created, err := s.messages.CreateMessage(msg)
@@ -273,6 +403,8 @@ func (s *Server) handleSendMessage(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
+	s.updates.notify()
+	s.presence.forgetContacts(req.FromUserID, req.ToUserID)
 
 	resp := SendMessageResponse{ID: created.ID}
 	w.Header().Set("Content-Type", "application/json")
@@ -285,6 +417,25 @@ type MessageDTO struct {
 	ToUserID         int64  `json:"to_user_id"`
 	CiphertextBase64 string `json:"ciphertext_base64"`
 	NonceBase64      string `json:"nonce_base64"`
+	MessageID        string `json:"message_id,omitempty"`
+	SignatureBase64  string `json:"signature_base64,omitempty"`
+	Version          int    `json:"version"`
+}
+
+func messageDTO(m *Message) MessageDTO {
+	dto := MessageDTO{
+		ID:               m.ID,
+		FromUserID:       m.FromUserID,
+		ToUserID:         m.ToUserID,
+		CiphertextBase64: encodeBase64(m.Ciphertext),
+		NonceBase64:      encodeBase64(m.Nonce),
+		MessageID:        m.ClientMsgID.String,
+		Version:          m.Version,
+	}
+	if len(m.Signature) > 0 {
+		dto.SignatureBase64 = encodeBase64(m.Signature)
+	}
+	return dto
 }
 
 func (s *Server) handleGetMessages(w http.ResponseWriter, r *http.Request) {
@@ -314,13 +465,7 @@ func (s *Server) handleGetMessages(w http.ResponseWriter, r *http.Request) {
 	msgs := s.messages.ListBetween(idA, idB)
 	out := make([]MessageDTO, 0, len(msgs))
 	for _, m := range msgs {
-		out = append(out, MessageDTO{
-			ID:               m.ID,
-			FromUserID:       m.FromUserID,
-			ToUserID:         m.ToUserID,
-			CiphertextBase64: encodeBase64(m.Ciphertext),
-			NonceBase64:      encodeBase64(m.Nonce),
-		})
+		out = append(out, messageDTO(m))
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -328,9 +473,11 @@ func (s *Server) handleGetMessages(w http.ResponseWriter, r *http.Request) {
 }
 
 type ChatSendRequest struct {
-	FromUserID int64  `json:"from_user_id"`
-	ToUserID   int64  `json:"to_user_id"`
-	Text       string `json:"text"`
+	FromUserID  int64    `json:"from_user_id"`
+	ToUserID    int64    `json:"to_user_id"`
+	Text        string   `json:"text"`
+	Attachments []string `json:"attachments,omitempty"` // public_id медиа, загруженных в эту беседу
+	ReplyTo     int64    `json:"reply_to,omitempty"`    // id сообщения из этой же беседы (replies.go)
 }
 
 type ChatSendResponse struct {
@@ -349,7 +496,7 @@ func (s *Server) handleChatSend(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.FromUserID == 0 || req.ToUserID == 0 || strings.TrimSpace(req.Text) == "" {
+	if req.FromUserID == 0 || req.ToUserID == 0 || (strings.TrimSpace(req.Text) == "" && len(req.Attachments) == 0) {
 		http.Error(w, "missing fields", http.StatusBadRequest)
 		return
 	}
@@ -364,12 +511,18 @@ func (s *Server) handleChatSend(w http.ResponseWriter, r *http.Request) {
 	}
 
 	msg := &PlainMessage{
-		FromUserID: req.FromUserID,
-		ToUserID:   req.ToUserID,
-		Text:       req.Text,
+		FromUserID:  req.FromUserID,
+		ToUserID:    req.ToUserID,
+		Text:        req.Text,
+		Attachments: req.Attachments,
+		ReplyTo:     req.ReplyTo,
 	}
 
-	created, err := s.plainMessages.Create(msg)
+	created, err := s.sendChatMessage(msg)
+	if errors.Is(err, ErrBadAttachment) || errors.Is(err, ErrBadReply) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
@@ -380,12 +533,91 @@ func (s *Server) handleChatSend(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(resp)
 }
 
+// sendChatMessage — запись личного сообщения и всё, что после неё: разбудить
+// /sync, сбросить кэш контактов, снять «печатает». Проверки — на вызывающем.
+func (s *Server) sendChatMessage(msg *PlainMessage) (*PlainMessage, error) {
+	created, err := s.plainMessages.Create(msg)
+	if err != nil {
+		return nil, err
+	}
+	s.updates.notify()
+	s.presence.forgetContacts(msg.FromUserID, msg.ToUserID)
+	s.typing.set(typingKey{kind: "direct", convID: msg.ToUserID, fromID: msg.FromUserID}, "", false)
+	return created, nil
+}
+
 type ChatMessageDTO struct {
-	ID         int64  `json:"id"`
-	FromUserID int64  `json:"from_user_id"`
-	ToUserID   int64  `json:"to_user_id"`
-	Text       string `json:"text"`
-	CreatedAt  string `json:"created_at"`
+	ID          int64            `json:"id"`
+	FromUserID  int64            `json:"from_user_id"`
+	ToUserID    int64            `json:"to_user_id"`
+	Text        string           `json:"text"`
+	Attachments []AttachmentDTO  `json:"attachments,omitempty"`
+	Reactions   []ReactionDTO    `json:"reactions,omitempty"`
+	ReplyTo     *ReplyPreviewDTO `json:"reply_to,omitempty"`    // цитата сообщения, на которое это ответ
+	Forwarded   *ForwardedDTO    `json:"forwarded_from,omitempty"`
+	ReplyCount  int              `json:"reply_count,omitempty"` // сколько ответов на это сообщение
+	CreatedAt   string           `json:"created_at"`
+}
+
+// ReplyPreviewDTO — цитата родителя в ответе (replies.go).
+// ForwardedDTO — автор оригинала пересланного сообщения (forward.go).
+type ForwardedDTO struct {
+	UserID   int64  `json:"user_id"`
+	Username string `json:"username"`
+}
+
+type ReplyPreviewDTO struct {
+	ID           int64  `json:"id"`
+	FromUserID   int64  `json:"from_user_id"`
+	FromUsername string `json:"from_username,omitempty"`
+	Text         string `json:"text"`                  // начало текста
+	Attachments  int    `json:"attachments,omitempty"` // сколько вложений
+}
+
+// ReactionDTO — реакции одним эмодзи (reactions.go).
+type ReactionDTO struct {
+	Emoji   string  `json:"emoji"`
+	Count   int     `json:"count"`
+	UserIDs []int64 `json:"user_ids"`
+}
+
+// chatMessageDTOs подтягивает вложения и реакции всех сообщений одним запросом на каждое.
+func (s *Server) chatMessageDTOs(msgs []*PlainMessage) ([]ChatMessageDTO, error) {
+	ids := make([]int64, 0, len(msgs))
+	replyTo := make(map[int64]int64, len(msgs))
+	for _, m := range msgs {
+		ids = append(ids, m.ID)
+		replyTo[m.ID] = m.ReplyTo
+	}
+	atts, err := s.attachments.ListFor(plainMessagesTable.kind, ids)
+	if err != nil {
+		return nil, err
+	}
+	reactions, err := s.reactions.ListFor(plainMessagesTable.kind, ids)
+	if err != nil {
+		return nil, err
+	}
+	replies, replyCounts, err := s.replyInfo(plainMessagesTable, replyTo)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]ChatMessageDTO, 0, len(msgs))
+	for _, m := range msgs {
+		out = append(out, ChatMessageDTO{
+			ID:          m.ID,
+			FromUserID:  m.FromUserID,
+			ToUserID:    m.ToUserID,
+			Text:        stripAttachmentMarkers(m.Text, atts[m.ID]),
+			Attachments: attachmentDTOs(atts[m.ID]),
+			Reactions:   reactionDTOs(reactions[m.ID]),
+			ReplyTo:     replies[m.ID],
+			Forwarded:   forwardedDTO(m.ForwardedFrom, m.ForwardedFromName),
+			ReplyCount:  replyCounts[m.ID],
+			CreatedAt:   m.CreatedAt,
+		})
+	}
+	return out, nil
 }
 
 func (s *Server) handleChatMessages(w http.ResponseWriter, r *http.Request) {
@@ -417,16 +649,10 @@ func (s *Server) handleChatMessages(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
-
-	out := make([]ChatMessageDTO, 0, len(msgs))
-	for _, m := range msgs {
-		out = append(out, ChatMessageDTO{
-			ID:         m.ID,
-			FromUserID: m.FromUserID,
-			ToUserID:   m.ToUserID,
-			Text:       m.Text,
-			CreatedAt:  m.CreatedAt,
-		})
+	out, err := s.chatMessageDTOs(msgs)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -486,6 +712,8 @@ func (s *Server) handleCreateGroup(w http.ResponseWriter, r *http.Request) {
 		// опционально можно проверить, что юзер существует
 		_ = s.groupMembers.AddMember(g.ID, uid)
 	}
+	s.updates.notify()
+	s.presence.forgetContacts()
 
 	resp := CreateGroupResponse{
 		ID:      g.ID,
@@ -530,14 +758,18 @@ func (s *Server) handleAddGroupMember(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
+	s.updates.notify()
+	s.presence.forgetContacts()
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
 type GroupSendRequest struct {
-	GroupID    int64  `json:"group_id"`
-	FromUserID int64  `json:"from_user_id"`
-	Text       string `json:"text"`
+	GroupID     int64    `json:"group_id"`
+	FromUserID  int64    `json:"from_user_id"`
+	Text        string   `json:"text"`
+	Attachments []string `json:"attachments,omitempty"` // public_id медиа, загруженных в эту беседу
+	ReplyTo     int64    `json:"reply_to,omitempty"`
 }
 
 type GroupSendResponse struct {
@@ -555,7 +787,7 @@ func (s *Server) handleGroupSend(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bad json", http.StatusBadRequest)
 		return
 	}
-	if req.GroupID == 0 || req.FromUserID == 0 || strings.TrimSpace(req.Text) == "" {
+	if req.GroupID == 0 || req.FromUserID == 0 || (strings.TrimSpace(req.Text) == "" && len(req.Attachments) == 0) {
 		http.Error(w, "missing fields", http.StatusBadRequest)
 		return
 	}
@@ -581,11 +813,17 @@ func (s *Server) handleGroupSend(w http.ResponseWriter, r *http.Request) {
 	}
 
 	msg := &GroupMessage{
-		GroupID:    req.GroupID,
-		FromUserID: req.FromUserID,
-		Text:       req.Text,
+		GroupID:     req.GroupID,
+		FromUserID:  req.FromUserID,
+		Text:        req.Text,
+		Attachments: req.Attachments,
+		ReplyTo:     req.ReplyTo,
+	}
+	created, err := s.sendGroupMessage(msg)
+	if errors.Is(err, ErrBadAttachment) || errors.Is(err, ErrBadReply) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	created, err := s.groupMessages.Create(msg)
 	if err != nil {
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
@@ -596,13 +834,99 @@ func (s *Server) handleGroupSend(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(resp)
 }
 
+// sendGroupMessage — как sendChatMessage, для беседы; заодно разбирает упоминания.
+func (s *Server) sendGroupMessage(msg *GroupMessage) (*GroupMessage, error) {
+	if msg.ForwardedFrom == 0 {
+		if err := s.resolveMentions(msg); err != nil {
+			return nil, err
+		}
+	}
+	created, err := s.groupMessages.Create(msg)
+	if err != nil {
+		return nil, err
+	}
+	s.updates.notify()
+	s.typing.set(typingKey{kind: "group", convID: msg.GroupID, fromID: msg.FromUserID}, "", false)
+	return created, nil
+}
+
 type GroupMessageDTO struct {
-	ID           int64  `json:"id"`
-	GroupID      int64  `json:"group_id"`
-	FromUserID   int64  `json:"from_user_id"`
-	FromUsername string `json:"from_username"`
-	Text         string `json:"text"`
-	CreatedAt    string `json:"created_at"`
+	ID           int64            `json:"id"`
+	GroupID      int64            `json:"group_id"`
+	FromUserID   int64            `json:"from_user_id"`
+	FromUsername string           `json:"from_username"`
+	Text         string           `json:"text"`
+	Attachments  []AttachmentDTO  `json:"attachments,omitempty"`
+	Reactions    []ReactionDTO    `json:"reactions,omitempty"`
+	Poll         *PollDTO         `json:"poll,omitempty"` // сообщение — опрос (polls.go), text — вопрос
+	ReplyTo      *ReplyPreviewDTO `json:"reply_to,omitempty"`
+	Forwarded    *ForwardedDTO    `json:"forwarded_from,omitempty"`
+	Mentions     []int64          `json:"mentions,omitempty"`    // id упомянутых по имени (mentions.go)
+	MentionAll   bool             `json:"mention_all,omitempty"` // было @all
+	ReplyCount   int              `json:"reply_count,omitempty"`
+	CreatedAt    string           `json:"created_at"`
+}
+
+// viewer — кто смотрит: для my_votes в опросах (polls.go).
+func (s *Server) groupMessageDTOs(msgs []*GroupMessage, viewer pollViewer) ([]GroupMessageDTO, error) {
+	ids := make([]int64, 0, len(msgs))
+	replyTo := make(map[int64]int64, len(msgs))
+	for _, m := range msgs {
+		ids = append(ids, m.ID)
+		replyTo[m.ID] = m.ReplyTo
+	}
+	atts, err := s.attachments.ListFor(groupMessagesTable.kind, ids)
+	if err != nil {
+		return nil, err
+	}
+	reactions, err := s.reactions.ListFor(groupMessagesTable.kind, ids)
+	if err != nil {
+		return nil, err
+	}
+	replies, replyCounts, err := s.replyInfo(groupMessagesTable, replyTo)
+	if err != nil {
+		return nil, err
+	}
+	mentions, err := s.mentions.ListFor(ids)
+	if err != nil {
+		return nil, err
+	}
+	polls, err := s.polls.ListFor(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	members := map[int64]bool{}
+	out := make([]GroupMessageDTO, 0, len(msgs))
+	for _, m := range msgs {
+		mentioned, all := mentionFields(mentions[m.ID])
+		text := stripAttachmentMarkers(m.Text, atts[m.ID])
+		var poll *PollDTO
+		if p := polls[m.ID]; p != nil {
+			v, err := s.pollViewerIn(viewer, m.GroupID, members)
+			if err != nil {
+				return nil, err
+			}
+			text, poll = pollDTO(p, m.Text, v, time.Now())
+		}
+		out = append(out, GroupMessageDTO{
+			ID:           m.ID,
+			GroupID:      m.GroupID,
+			FromUserID:   m.FromUserID,
+			FromUsername: m.FromUsername,
+			Text:         text,
+			Attachments:  attachmentDTOs(atts[m.ID]),
+			Reactions:    reactionDTOs(reactions[m.ID]),
+			Poll:         poll,
+			ReplyTo:      replies[m.ID],
+			Forwarded:    forwardedDTO(m.ForwardedFrom, m.ForwardedFromName),
+			Mentions:     mentioned,
+			MentionAll:   all,
+			ReplyCount:   replyCounts[m.ID],
+			CreatedAt:    m.CreatedAt,
+		})
+	}
+	return out, nil
 }
 
 func (s *Server) handleGroupMessages(w http.ResponseWriter, r *http.Request) {
@@ -617,38 +941,109 @@ func (s *Server) handleGroupMessages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// ВАЖНО: берём username отправителя через JOIN
-	const q = `
-SELECT gm.id, gm.group_id, gm.from_user_id, COALESCE(u.username, ''),
-       gm.text, gm.created_at
-FROM group_messages gm
-LEFT JOIN users u ON u.id = gm.from_user_id
-WHERE gm.group_id = ?
-ORDER BY gm.id;
-`
-	rows, err := s.plainMedia.db.Query(q, gid) // если у тебя нет s.db, используй любой store с db
+	// username отправителя store берёт через JOIN, текст расшифровывает
+	msgs, err := s.groupMessages.List(gid)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	// user_id необязателен: нужен только для my_votes в опросах, и то не в анонимных
+	out, err := s.groupMessageDTOs(msgs, pollViewer{userID: mustInt64(r.URL.Query().Get("user_id"))})
 	if err != nil {
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
-	out := make([]GroupMessageDTO, 0, 64)
-	for rows.Next() {
-		var m GroupMessageDTO
-		if err := rows.Scan(&m.ID, &m.GroupID, &m.FromUserID, &m.FromUsername, &m.Text, &m.CreatedAt); err != nil {
-			http.Error(w, "internal error", http.StatusInternalServerError)
-			return
-		}
-		out = append(out, m)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// ThreadResponse — сообщение и ответы на него, по порядку.
+type ChatThreadResponse struct {
+	Parent  ChatMessageDTO   `json:"parent"`
+	Replies []ChatMessageDTO `json:"replies"`
+}
+
+type GroupThreadResponse struct {
+	Parent  GroupMessageDTO   `json:"parent"`
+	Replies []GroupMessageDTO `json:"replies"`
+}
+
+// GET /chat/thread?user_id=...&message_id=... — ветка личного сообщения.
+func (s *Server) handleChatThread(w http.ResponseWriter, r *http.Request) {
+	parentID, ok := s.threadParams(w, r, plainMessagesTable.kind)
+	if !ok {
+		return
+	}
+	parents, err := s.plainMessages.ListByIDs([]int64{parentID})
+	if err != nil || len(parents) == 0 {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	replies, err := s.plainMessages.ListReplies(parentID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
 	}
-	if err := rows.Err(); err != nil {
+	out, err := s.chatMessageDTOs(append(parents, replies...))
+	if err != nil {
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(ChatThreadResponse{Parent: out[0], Replies: out[1:]})
+}
 
+// GET /groups/thread?user_id=...&message_id=... — ветка сообщения в беседе.
+func (s *Server) handleGroupThread(w http.ResponseWriter, r *http.Request) {
+	parentID, ok := s.threadParams(w, r, groupMessagesTable.kind)
+	if !ok {
+		return
+	}
+	parents, err := s.groupMessages.ListByIDs([]int64{parentID})
+	if err != nil || len(parents) == 0 {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	replies, err := s.groupMessages.ListReplies(parentID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	out, err := s.groupMessageDTOs(append(parents, replies...), pollViewer{userID: mustInt64(r.URL.Query().Get("user_id"))})
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(out)
+	_ = json.NewEncoder(w).Encode(GroupThreadResponse{Parent: out[0], Replies: out[1:]})
+}
+
+// threadParams разбирает message_id и user_id и проверяет, что пользователь видит сообщение.
+func (s *Server) threadParams(w http.ResponseWriter, r *http.Request, kind string) (int64, bool) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return 0, false
+	}
+	q := r.URL.Query()
+	uid := mustInt64(q.Get("user_id"))
+	messageID := mustInt64(q.Get("message_id"))
+	if uid <= 0 || messageID <= 0 {
+		http.Error(w, "user_id and message_id required", http.StatusBadRequest)
+		return 0, false
+	}
+	switch err := s.checkMessageAccess(kind, messageID, uid); {
+	case errors.Is(err, ErrMessageNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return 0, false
+	case errors.Is(err, ErrNotParticipant):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return 0, false
+	case err != nil:
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return 0, false
+	}
+	return messageID, true
 }
 
 type GroupDTO struct {
@@ -656,6 +1051,7 @@ type GroupDTO struct {
 	Name      string `json:"name"`
 	OwnerID   int64  `json:"owner_id"`
 	CreatedAt string `json:"created_at"`
+	Role      string `json:"role"` // owner | admin | member — роль запросившего
 }
 
 func (s *Server) handleGroupsByUser(w http.ResponseWriter, r *http.Request) {
@@ -688,6 +1084,7 @@ func (s *Server) handleGroupsByUser(w http.ResponseWriter, r *http.Request) {
 			Name:      g.Name,
 			OwnerID:   g.OwnerUserID,
 			CreatedAt: g.CreatedAt,
+			Role:      g.Role,
 		})
 	}
 
@@ -695,117 +1092,201 @@ func (s *Server) handleGroupsByUser(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(out)
 }
 
-func mustInt64(s string) int64 {
-	var v int64
-	if _, err := fmt.Sscan(strings.TrimSpace(s), &v); err != nil || v <= 0 {
-		return 0
-	}
-	return v
+type SetGroupRoleRequest struct {
+	GroupID int64  `json:"group_id"`
+	ActorID int64  `json:"actor_id"` // кто меняет — только владелец
+	UserID  int64  `json:"user_id"`
+	Role    string `json:"role"` // admin | member
 }
 
-// POST multipart/form-data:
-// kind=direct|group
-// from_user_id=...
-// to_user_id=... (для direct)
-// group_id=... (для group)
-// file=<image>
-func (s *Server) handlePlainMediaUpload(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleGroupSetRole(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	if err := r.ParseMultipartForm(20 << 20); err != nil {
-		http.Error(w, "bad multipart form", http.StatusBadRequest)
+	var req SetGroupRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	if req.GroupID == 0 || req.ActorID == 0 || req.UserID == 0 {
+		http.Error(w, "group_id, actor_id and user_id required", http.StatusBadRequest)
+		return
+	}
+	if !groupRoles[req.Role] {
+		http.Error(w, "role must be admin or member", http.StatusBadRequest)
 		return
 	}
 
-	kind := strings.TrimSpace(r.FormValue("kind"))
-	fromID := mustInt64(r.FormValue("from_user_id"))
+	g, err := s.groups.GetByID(req.GroupID)
+	if err != nil {
+		http.Error(w, "group not found", http.StatusBadRequest)
+		return
+	}
+	if g.OwnerUserID != req.ActorID {
+		http.Error(w, "forbidden: only the owner can change roles", http.StatusForbidden)
+		return
+	}
+	if req.UserID == g.OwnerUserID {
+		http.Error(w, "owner role cannot be changed", http.StatusBadRequest)
+		return
+	}
+
+	err = s.groupMembers.SetRole(req.GroupID, req.UserID, req.Role)
+	if err == sql.ErrNoRows {
+		http.Error(w, "user is not a member", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func mustInt64(s string) int64 {
+	var v int64
+	if _, err := fmt.Sscan(strings.TrimSpace(s), &v); err != nil || v <= 0 {
+		return 0
+	}
+	return v
+}
+
+// checkMediaTarget — кому можно отправить медиа: существующему пользователю
+// (direct) или в беседу, где состоит отправитель (group). Ошибка уже записана в w.
+func (s *Server) checkMediaTarget(w http.ResponseWriter, kind string, fromID, toID, gid int64) bool {
 	if fromID == 0 {
 		http.Error(w, "bad from_user_id", http.StatusBadRequest)
-		return
+		return false
 	}
 
 	// базовые проверки существования
 	if _, err := s.users.GetByID(fromID); err != nil {
 		http.Error(w, "from_user not found", http.StatusBadRequest)
-		return
+		return false
 	}
 
-	var toID int64
-	var gid int64
-
-	if kind == "direct" {
-		toID = mustInt64(r.FormValue("to_user_id"))
+	switch kind {
+	case "direct":
 		if toID == 0 {
 			http.Error(w, "bad to_user_id", http.StatusBadRequest)
-			return
+			return false
 		}
 		if _, err := s.users.GetByID(toID); err != nil {
 			http.Error(w, "to_user not found", http.StatusBadRequest)
-			return
+			return false
 		}
-	} else if kind == "group" {
-		gid = mustInt64(r.FormValue("group_id"))
+	case "group":
 		if gid == 0 {
 			http.Error(w, "bad group_id", http.StatusBadRequest)
-			return
+			return false
 		}
 		if _, err := s.groups.GetByID(gid); err != nil {
 			http.Error(w, "group not found", http.StatusBadRequest)
-			return
+			return false
 		}
 		ok, err := s.groupMembers.IsMember(gid, fromID)
 		if err != nil {
 			http.Error(w, "internal error", http.StatusInternalServerError)
-			return
+			return false
 		}
 		if !ok {
 			http.Error(w, "forbidden", http.StatusForbidden)
-			return
+			return false
 		}
-	} else {
+	default:
 		http.Error(w, "bad kind", http.StatusBadRequest)
-		return
+		return false
 	}
+	return true
+}
 
-	f, hdr, err := r.FormFile("file")
-	if err != nil {
-		http.Error(w, "file required", http.StatusBadRequest)
-		return
-	}
-	defer f.Close()
+// POST multipart/form-data:
+// kind=direct|group
+// from_user_id=...
+// to_user_id=... (для direct)
+// group_id=... (для group)
+// file=<image>
+func (s *Server) handlePlainMediaUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// запас в 1 MiB на остальные поля формы
+	r.Body = http.MaxBytesReader(w, r.Body, s.mediaPolicy.MaxSize()+1<<20)
+	if err := r.ParseMultipartForm(20 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "bad multipart form", http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	kind := strings.TrimSpace(r.FormValue("kind"))
+	fromID := mustInt64(r.FormValue("from_user_id"))
+	toID := mustInt64(r.FormValue("to_user_id"))
+	gid := mustInt64(r.FormValue("group_id"))
+	if !s.checkMediaTarget(w, kind, fromID, toID, gid) {
+		return
+	}
 
-	raw, err := io.ReadAll(io.LimitReader(f, 20<<20))
+	f, hdr, err := r.FormFile("file")
 	if err != nil {
-		http.Error(w, "read error", http.StatusInternalServerError)
+		http.Error(w, "file required", http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+
+	if hdr.Size == 0 {
+		http.Error(w, "empty file", http.StatusBadRequest)
 		return
 	}
 
-	contentType := hdr.Header.Get("Content-Type")
-	if contentType == "" {
-		contentType = http.DetectContentType(raw)
+	// тип — по первым байтам, а не по заголовку клиента
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		http.Error(w, "read error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, "read error", http.StatusInternalServerError)
+		return
+	}
+	contentType, err := detectContentType(hdr.Header.Get("Content-Type"), hdr.Filename, head[:n])
+	if err != nil {
+		http.Error(w, "file type not allowed: html/svg", http.StatusUnsupportedMediaType)
+		return
+	}
+	maxSize, err := s.mediaPolicy.Check(contentType)
+	if err != nil {
+		http.Error(w, "file type not allowed: "+contentType, http.StatusUnsupportedMediaType)
+		return
 	}
-	if !strings.HasPrefix(contentType, "image/") {
-		http.Error(w, "only images allowed", http.StatusBadRequest)
+	if hdr.Size > maxSize {
+		http.Error(w, fmt.Sprintf("file too large (max %d MiB for %s)", maxSize>>20, contentType), http.StatusRequestEntityTooLarge)
 		return
 	}
 
-	// 🔐 ШИФРУЕМ ПЕРЕД ЗАПИСЬЮ В БД
-	ct, nonce, err := aesGCMEncrypt(s.plainMediaKey, raw)
+	publicID, err := newMediaPublicID()
 	if err != nil {
-		http.Error(w, "crypto error", http.StatusInternalServerError)
+		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
 
 	pm := &PlainMedia{
+		PublicID:     publicID,
 		Kind:         kind,
 		FromUserID:   fromID,
-		Ciphertext:   ct,
-		Nonce:        nonce,
+		EncVersion:   mediaEncVersionEnvelope,
 		ContentType:  contentType,
-		OriginalName: hdr.Filename,
+		OriginalName: sanitizeFilename(hdr.Filename),
+		Size:         hdr.Size,
 	}
 
 	if kind == "direct" {
@@ -814,134 +1295,2198 @@ func (s *Server) handlePlainMediaUpload(w http.ResponseWriter, r *http.Request)
 		pm.GroupID = sql.NullInt64{Int64: gid, Valid: true}
 	}
 
-	created, err := s.plainMedia.Create(pm)
+	// картинки читаем целиком (их лимит невелик), остальное шифруется потоком
+	// прямо из временного файла multipart — поэтому хэш считаем отдельным проходом
+	var raw []byte
+	var body io.Reader = f
+	if isProcessableImage(contentType) {
+		if raw, err = io.ReadAll(f); err != nil {
+			http.Error(w, "read error", http.StatusInternalServerError)
+			return
+		}
+		body = bytes.NewReader(raw)
+	}
+	if pm.ContentHash, err = s.mediaContentHash(pm, body); err != nil {
+		http.Error(w, "read error", http.StatusInternalServerError)
+		return
+	}
+	// тот же файл уже есть в этой беседе — отдаём его, не шифруя копию
+	if dup := s.duplicateMedia(pm.ContentHash); dup != nil {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(mediaInfoDTO(dup))
+		return
+	}
+	if !s.checkMediaQuota(w, fromID, pm.Size) {
+		return
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, "read error", http.StatusInternalServerError)
+		return
+	}
+
+	// голосовые: длительность и волна — ещё одним проходом по файлу
+	if isVoiceAudio(contentType) {
+		info, err := analyzeAudio(f, contentType)
+		if err != nil {
+			http.Error(w, "bad audio", http.StatusBadRequest)
+			return
+		}
+		pm.DurationMS, pm.Waveform = info.DurationMS, info.Waveform
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			http.Error(w, "read error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// картинки: декодируем, вычищаем EXIF/GPS и прочие метаданные, делаем миниатюру
+	var img *processedImage
+	if raw != nil {
+		if img, err = processImage(raw, contentType); err != nil {
+			http.Error(w, "bad image", http.StatusBadRequest)
+			return
+		}
+		body, pm.Size = bytes.NewReader(img.Original), int64(len(img.Original))
+	}
+
+	// 🔐 ШИФРУЕМ ПЕРЕД ЗАПИСЬЮ В БД (id, kind, владелец и тип входят в AAD)
+	created, err := s.createMedia(pm, body, img, s.chargeMediaQuota)
+	if errors.Is(err, ErrQuotaExceeded) {
+		writeQuotaExceeded(w)
+		return
+	}
 	if err != nil {
-		http.Error(w, "db error", http.StatusInternalServerError)
+		log.Printf("media upload: %v", err)
+		http.Error(w, "store error", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(map[string]int64{"id": created.ID})
+	_ = json.NewEncoder(w).Encode(mediaInfoDTO(created))
 }
 
-func (s *Server) handlePlainMediaGet(w http.ResponseWriter, r *http.Request) {
+type MediaInfoDTO struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	HasThumb    bool   `json:"has_thumb,omitempty"`
+	DurationMS  int64  `json:"duration_ms,omitempty"`
+	Waveform    []int  `json:"waveform,omitempty"` // 0–255
+}
+
+func mediaInfoDTO(m *PlainMedia) MediaInfoDTO {
+	return MediaInfoDTO{
+		ID:          m.PublicID,
+		Name:        m.OriginalName,
+		Size:        m.Size,
+		ContentType: m.ContentType,
+		Width:       m.Width,
+		Height:      m.Height,
+		HasThumb:    m.ThumbBlobKey != "",
+		DurationMS:  m.DurationMS,
+		Waveform:    waveformInts(m.Waveform),
+	}
+}
+
+// []byte в JSON ушёл бы base64-строкой, клиенту удобнее массив чисел
+func waveformInts(w []byte) []int {
+	if len(w) == 0 {
+		return nil
+	}
+	out := make([]int, len(w))
+	for i, v := range w {
+		out[i] = int(v)
+	}
+	return out
+}
+
+// AttachmentDTO — вложение сообщения: метаданные как у /info плюс как его показывать.
+type AttachmentDTO struct {
+	Kind string `json:"kind"` // image | voice | file
+	MediaInfoDTO
+}
+
+func attachmentDTOs(atts []*PlainMedia) []AttachmentDTO {
+	if len(atts) == 0 {
+		return nil
+	}
+	out := make([]AttachmentDTO, 0, len(atts))
+	for _, m := range atts {
+		out = append(out, AttachmentDTO{Kind: attachmentKind(m), MediaInfoDTO: mediaInfoDTO(m)})
+	}
+	return out
+}
+
+// authorizedMedia — общая часть get и info: id + user_id, проверка доступа.
+// Ответ об ошибке уже записан, если вернулся nil.
+func (s *Server) authorizedMedia(w http.ResponseWriter, r *http.Request) *PlainMedia {
 	if r.Method != http.MethodGet {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-		return
+		return nil
 	}
-	id := mustInt64(r.URL.Query().Get("id"))
-	if id == 0 {
+	ref := strings.TrimSpace(r.URL.Query().Get("id"))
+	if ref == "" {
 		http.Error(w, "bad id", http.StatusBadRequest)
-		return
+		return nil
+	}
+	uid := mustInt64(r.URL.Query().Get("user_id"))
+	if uid == 0 {
+		http.Error(w, "user_id required", http.StatusBadRequest)
+		return nil
 	}
 
-	m, err := s.plainMedia.GetByID(id)
+	// только public_id: старые маркеры с порядковым id переписаны при старте
+	// (backfillLegacyAttachments), перебрать чужие файлы по номеру нельзя
+	m, err := s.plainMedia.GetByPublicID(ref)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return nil
+	}
+	ok, err := s.canAccessMedia(m, uid)
 	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil
+	}
+	if !ok {
 		http.Error(w, "not found", http.StatusNotFound)
+		return nil
+	}
+	return m
+}
+
+// GET /api/plain_media/info?id=<public_id>&user_id=...
+// Метаданные для карточки файла в вебе: имя, размер, тип.
+func (s *Server) handlePlainMediaInfo(w http.ResponseWriter, r *http.Request) {
+	m := s.authorizedMedia(w, r)
+	if m == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(mediaInfoDTO(m))
+}
+
+// GET /api/plain_media/get?id=<public_id>&user_id=...
+// Отдаём только участникам разговора; на чужое медиа — 404, как на несуществующее.
+func (s *Server) handlePlainMediaGet(w http.ResponseWriter, r *http.Request) {
+	m := s.authorizedMedia(w, r)
+	if m == nil {
 		return
 	}
 
-	raw, err := aesGCMDecrypt(s.plainMediaKey, m.Ciphertext, m.Nonce)
+	// size=thumb — миниатюра; если её нет (картинка маленькая или не умеем), отдаём оригинал
+	contentType := m.ContentType
+	open := s.openMediaContent
+	if r.URL.Query().Get("size") == "thumb" && m.ThumbBlobKey != "" {
+		contentType, open = m.ThumbContentType, s.openMediaThumb
+	}
+	content, err := open(m)
 	if err != nil {
 		http.Error(w, "decrypt failed", http.StatusInternalServerError)
 		return
 	}
+	defer content.Close()
 
-	w.Header().Set("Content-Type", m.ContentType)
-	w.Header().Set("Content-Disposition", `inline; filename="`+m.OriginalName+`"`)
-	_, _ = w.Write(raw)
+	// html/svg/js, загруженные до проверки по байтам, браузер исполнил бы — отдаём как бинарь
+	if isActiveContentType(contentType) {
+		contentType = "application/octet-stream"
+	}
+	// картинки и звук показываем в чате, всё остальное — только скачивание
+	disposition := "attachment"
+	if strings.HasPrefix(contentType, "image/") || strings.HasPrefix(contentType, "audio/") {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", contentDisposition(disposition, m.OriginalName))
+	// браузер не угадывает тип сам, а открытый напрямую файл живёт в песочнице без скриптов
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	// ServeContent сам обрабатывает Range: расшифровываются только нужные сегменты
+	http.ServeContent(w, r, "", time.Time{}, content)
 }
 
-type InboxDTO struct {
-	PeerID        int64  `json:"peer_id"`
-	PeerUsername  string `json:"peer_username"`
-	LastMessageID int64  `json:"last_message_id"`
-	LastText      string `json:"last_text"`
-	LastCreatedAt string `json:"last_created_at"`
+// ===== Загрузка по частям (media_upload.go) =====
+
+type CreateUploadRequest struct {
+	Kind        string `json:"kind"`
+	FromUserID  int64  `json:"from_user_id"`
+	ToUserID    int64  `json:"to_user_id"`
+	GroupID     int64  `json:"group_id"`
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
 }
 
-func (s *Server) handleChatInbox(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+type UploadStatusDTO struct {
+	UploadID  string `json:"upload_id"`
+	Size      int64  `json:"size"`
+	Offset    int64  `json:"offset"`
+	ChunkSize int64  `json:"chunk_size"` // максимум байт в одном PUT
+}
+
+func uploadStatusDTO(u *MediaUpload) UploadStatusDTO {
+	return UploadStatusDTO{UploadID: u.ID, Size: u.Size, Offset: u.Received, ChunkSize: maxUploadChunkSize}
+}
+
+// POST /api/plain_media/upload/create
+// JSON: kind, from_user_id, to_user_id | group_id, name, size, content_type
+func (s *Server) handleUploadCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-
-	userStr := strings.TrimSpace(r.URL.Query().Get("user_id"))
-	if userStr == "" {
-		http.Error(w, "user_id required", http.StatusBadRequest)
+	var req CreateUploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad json", http.StatusBadRequest)
 		return
 	}
-	var uid int64
-	if _, err := fmt.Sscan(userStr, &uid); err != nil || uid <= 0 {
-		http.Error(w, "bad user_id", http.StatusBadRequest)
+	req.Kind = strings.TrimSpace(req.Kind)
+	if !s.checkMediaTarget(w, req.Kind, req.FromUserID, req.ToUserID, req.GroupID) {
+		return
+	}
+	if req.Size <= 0 {
+		http.Error(w, "bad size", http.StatusBadRequest)
 		return
 	}
 
-	// (опционально) проверим что юзер существует
-	if _, err := s.users.GetByID(uid); err != nil {
-		http.Error(w, "user not found", http.StatusBadRequest)
+	// окончательно тип проверяется по байтам в finalize
+	contentType := normalizeContentType(req.ContentType, req.Name)
+	if isActiveContentType(contentType) {
+		http.Error(w, "file type not allowed: "+contentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	maxSize, err := s.mediaPolicy.Check(contentType)
+	if err != nil {
+		http.Error(w, "file type not allowed: "+contentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	if req.Size > maxSize {
+		http.Error(w, fmt.Sprintf("file too large (max %d MiB for %s)", maxSize>>20, contentType), http.StatusRequestEntityTooLarge)
+		return
+	}
+	// место резервируется сразу: незавершённая загрузка входит в занятое
+	if !s.checkMediaQuota(w, req.FromUserID, req.Size) {
 		return
 	}
 
-	items, err := s.plainMessages.ListInbox(uid)
+	id, err := newUploadID()
 	if err != nil {
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
-
-	out := make([]InboxDTO, 0, len(items))
-	for _, it := range items {
-		out = append(out, InboxDTO{
-			PeerID:        it.PeerID,
-			PeerUsername:  it.PeerUsername,
-			LastMessageID: it.LastMessageID,
-			LastText:      it.LastText,
-			LastCreatedAt: it.LastCreatedAt,
-		})
+	u := &MediaUpload{
+		ID:           id,
+		Kind:         req.Kind,
+		FromUserID:   req.FromUserID,
+		OriginalName: sanitizeFilename(req.Name),
+		ContentType:  contentType,
+		Size:         req.Size,
+	}
+	if req.Kind == "direct" {
+		u.ToUserID = sql.NullInt64{Int64: req.ToUserID, Valid: true}
+	} else {
+		u.GroupID = sql.NullInt64{Int64: req.GroupID, Valid: true}
+	}
+	if err := s.newUploadKey(u); err != nil {
+		http.Error(w, "crypto error", http.StatusInternalServerError)
+		return
+	}
+	err = s.mediaUploads.Create(u, s.chargeMediaQuota)
+	if errors.Is(err, ErrQuotaExceeded) {
+		writeQuotaExceeded(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(out)
+	_ = json.NewEncoder(w).Encode(uploadStatusDTO(u))
+}
+
+// ownUpload — загрузку видит только тот, кто её начал; чужая — 404.
+func (s *Server) ownUpload(w http.ResponseWriter, r *http.Request) *MediaUpload {
+	q := r.URL.Query()
+	id := strings.TrimSpace(q.Get("upload_id"))
+	uid := mustInt64(q.Get("user_id"))
+	if id == "" || uid == 0 {
+		http.Error(w, "upload_id and user_id required", http.StatusBadRequest)
+		return nil
+	}
+	u, err := s.mediaUploads.GetByID(id)
+	if err != nil || u.FromUserID != uid {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return nil
+	}
+	return u
 }
 
-// пример: 15 секунд считаем online
-const onlineWindowSec = 15
+// GET /api/plain_media/upload/status?upload_id=...&user_id=...
+// Сколько байт уже принято — с этого offset клиент продолжает после обрыва.
+func (s *Server) handleUploadStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u := s.ownUpload(w, r)
+	if u == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(uploadStatusDTO(u))
+}
 
-func (s *Server) handlePresencePing(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "method", http.StatusMethodNotAllowed)
+// PUT /api/plain_media/upload/chunk?upload_id=...&user_id=...&offset=...
+// Тело — следующие байты файла. offset должен совпадать с уже принятым,
+// иначе 409 и актуальный статус в ответе.
+func (s *Server) handleUploadChunk(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	var req struct {
-		UserID int64 `json:"user_id"`
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "bad offset", http.StatusBadRequest)
+		return
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID <= 0 {
-		http.Error(w, "bad request", http.StatusBadRequest)
+	u := s.ownUpload(w, r)
+	if u == nil {
+		return
+	}
+	if u.MediaPublicID.Valid {
+		http.Error(w, "upload already finalized", http.StatusConflict)
+		return
+	}
+
+	// тело читаем целиком до того, как трогать файл: оборванная часть не засчитывается
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxUploadChunkSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("chunk too large (max %d bytes)", maxUploadChunkSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "read error", http.StatusBadRequest)
+		return
+	}
+	if len(data) == 0 {
+		http.Error(w, "empty chunk", http.StatusBadRequest)
+		return
+	}
+
+	unlock := s.stageLocks.lock(u.ID)
+	defer unlock()
+
+	// статус мог измениться, пока читали тело
+	u, err = s.mediaUploads.GetByID(u.ID)
+	if err != nil {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+	if offset != u.Received {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		_ = json.NewEncoder(w).Encode(uploadStatusDTO(u))
+		return
+	}
+	if u.Received+int64(len(data)) > u.Size {
+		http.Error(w, "chunk exceeds declared size", http.StatusBadRequest)
+		return
+	}
+
+	stagedLen, err := s.stageChunk(u, data)
+	if err != nil {
+		http.Error(w, "staging error", http.StatusInternalServerError)
+		return
+	}
+	ok, err := s.mediaUploads.Advance(u.ID, u.Received, u.Received+int64(len(data)), stagedLen)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "upload changed concurrently", http.StatusConflict)
 		return
 	}
-	_ = s.users.UpdateLastSeen(req.UserID)
+	u.Received += int64(len(data))
+	u.StagedLen = stagedLen
+
 	w.Header().Set("Content-Type", "application/json")
-	_, _ = w.Write([]byte(`{"ok":true}`))
+	_ = json.NewEncoder(w).Encode(uploadStatusDTO(u))
 }
 
-func (s *Server) handlePresenceOnline(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "method", http.StatusMethodNotAllowed)
+// POST /api/plain_media/upload/finalize?upload_id=...&user_id=...
+// Шифрует принятый файл и возвращает то же, что обычный upload.
+// Повторный вызов после успеха возвращает тот же файл.
+func (s *Server) handleUploadFinalize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u := s.ownUpload(w, r)
+	if u == nil {
 		return
 	}
-	users, err := s.users.ListOnline(onlineWindowSec)
+	// не вместе с записью части: файл должен быть дописан целиком.
+	// Статус мог измениться, пока ждали замок
+	unlock := s.stageLocks.lock(u.ID)
+	defer unlock()
+	u, err := s.mediaUploads.GetByID(u.ID)
 	if err != nil {
-		http.Error(w, "db", http.StatusInternalServerError)
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+
+	if u.MediaPublicID.Valid {
+		m, err := s.plainMedia.GetByPublicID(u.MediaPublicID.String)
+		if err != nil {
+			http.Error(w, "finalize in progress", http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(mediaInfoDTO(m))
 		return
 	}
-	type dto struct {
-		ID       int64  `json:"id"`
-		Username string `json:"username"`
+	if u.Received != u.Size {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		_ = json.NewEncoder(w).Encode(uploadStatusDTO(u))
+		return
+	}
+
+	publicID, err := newMediaPublicID()
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	claimed, err := s.mediaUploads.ClaimFinalize(u.ID, publicID)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if !claimed {
+		http.Error(w, "finalize in progress", http.StatusConflict)
+		return
+	}
+
+	created, err := s.finalizeUpload(u, publicID)
+	switch {
+	case errors.Is(err, ErrBadImage), errors.Is(err, ErrBadAudio):
+		_ = s.mediaUploads.ReleaseFinalize(u.ID)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, ErrActiveContent), errors.Is(err, ErrMediaTypeNotAllowed):
+		_ = s.mediaUploads.ReleaseFinalize(u.ID)
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	case errors.Is(err, ErrMediaTooLarge):
+		_ = s.mediaUploads.ReleaseFinalize(u.ID)
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
 	}
-	out := make([]dto, 0, len(users))
-	for _, u := range users {
-		out = append(out, dto{ID: u.ID, Username: u.Username})
+	if err != nil {
+		log.Printf("finalize upload %s: %v", u.ID, err)
+		_ = s.mediaUploads.ReleaseFinalize(u.ID)
+		http.Error(w, "finalize failed", http.StatusInternalServerError)
+		return
 	}
+
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(out)
-}
\ No newline at end of file
+	_ = json.NewEncoder(w).Encode(mediaInfoDTO(created))
+}
+
+// ===== Квоты (media_quota.go) =====
+
+type MediaUsageDTO struct {
+	UserID  int64  `json:"user_id"`
+	Used    int64  `json:"used"`
+	Pending int64  `json:"pending"`
+	Files   int64  `json:"files"`
+	Quota   int64  `json:"quota"`          // 0 — без ограничений
+	Free    *int64 `json:"free,omitempty"` // нет — без ограничений
+	Custom  bool   `json:"custom"`
+}
+
+func mediaUsageDTO(userID int64, u *MediaUsage) MediaUsageDTO {
+	dto := MediaUsageDTO{UserID: userID, Used: u.Used, Pending: u.Pending, Files: u.Files, Quota: u.Quota, Custom: u.Custom}
+	if free := u.Free(); free >= 0 {
+		dto.Free = &free
+	}
+	return dto
+}
+
+// GET /account/usage?user_id=...
+func (s *Server) handleAccountUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := mustInt64(r.URL.Query().Get("user_id"))
+	if userID == 0 {
+		http.Error(w, "user_id required", http.StatusBadRequest)
+		return
+	}
+	u, err := s.mediaUsage(userID)
+	if errors.Is(err, ErrUserNotFound) {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(mediaUsageDTO(userID, u))
+}
+
+type AdminMediaQuotaRequest struct {
+	AdminUsername string `json:"admin_username"`
+	AdminPassword string `json:"admin_password"`
+	Username      string `json:"username"`
+	QuotaMiB      *int64 `json:"quota_mib"` // null — вернуть квоту по умолчанию, 0 — без ограничений
+}
+
+// POST /admin/media_quota — только для пользователей из -admins.
+func (s *Server) handleAdminMediaQuota(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req AdminMediaQuotaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	if s.authenticateAdmin(w, strings.TrimSpace(req.AdminUsername), req.AdminPassword) == nil {
+		return
+	}
+	user, err := s.users.GetByUsername(strings.TrimSpace(req.Username))
+	if err != nil {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+
+	var quota sql.NullInt64
+	if req.QuotaMiB != nil {
+		if *req.QuotaMiB < 0 {
+			http.Error(w, "bad quota_mib", http.StatusBadRequest)
+			return
+		}
+		quota = sql.NullInt64{Int64: *req.QuotaMiB << 20, Valid: true}
+	}
+	if err := s.users.SetMediaQuota(user.ID, quota); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if quota.Valid {
+		log.Printf("admin %s set media quota of %s to %d MiB", req.AdminUsername, user.Username, *req.QuotaMiB)
+	} else {
+		log.Printf("admin %s reset media quota of %s to default", req.AdminUsername, user.Username)
+	}
+
+	u, err := s.mediaUsage(user.ID)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(mediaUsageDTO(user.ID, u))
+}
+
+const maxE2EMediaSize = 50 << 20
+
+// POST /api/e2e_media/upload?from_user_id=...&to_user_id=...
+// Тело — непрозрачный шифртекст (application/octet-stream). Клиент шифрует файл
+// сам и передаёт ключ и хэш получателю внутри E2E-сообщения.
+func (s *Server) handleE2EMediaUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	fromID := mustInt64(q.Get("from_user_id"))
+	toID := mustInt64(q.Get("to_user_id"))
+	if fromID == 0 || toID == 0 {
+		http.Error(w, "from_user_id and to_user_id required", http.StatusBadRequest)
+		return
+	}
+	if _, err := s.users.GetByID(fromID); err != nil {
+		http.Error(w, "from_user not found", http.StatusBadRequest)
+		return
+	}
+	if _, err := s.users.GetByID(toID); err != nil {
+		http.Error(w, "to_user not found", http.StatusBadRequest)
+		return
+	}
+
+	// размер заранее известен не всегда (chunked) — тогда квота проверится только при записи
+	if r.ContentLength > 0 && !s.checkMediaQuota(w, fromID, r.ContentLength) {
+		return
+	}
+
+	// тело идёт в хранилище потоком, в память целиком не читается
+	body := http.MaxBytesReader(w, r.Body, maxE2EMediaSize)
+	key, size, err := putBlob(s.blobs, func(w io.Writer) error {
+		_, err := io.Copy(w, body)
+		return err
+	})
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "upload failed", http.StatusBadRequest)
+		return
+	}
+	if size == 0 {
+		http.Error(w, "empty body", http.StatusBadRequest)
+		return
+	}
+
+	created, err := s.e2eMedia.Create(&E2EMedia{FromUserID: fromID, ToUserID: toID, BlobKey: key, Size: size}, s.chargeMediaQuota)
+	if errors.Is(err, ErrQuotaExceeded) {
+		// блоб уже в хранилище — убираем, если на него больше ничего не ссылается
+		if inUse, err := s.plainMedia.BlobInUse(key); err == nil && !inUse {
+			_ = s.blobs.Delete(key)
+		}
+		writeQuotaExceeded(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int64{"id": created.ID, "size": created.Size})
+}
+
+// GET /api/e2e_media/get?id=...&user_id=... — только отправителю и получателю.
+func (s *Server) handleE2EMediaGet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := mustInt64(r.URL.Query().Get("id"))
+	uid := mustInt64(r.URL.Query().Get("user_id"))
+	if id == 0 || uid == 0 {
+		http.Error(w, "id and user_id required", http.StatusBadRequest)
+		return
+	}
+
+	m, err := s.e2eMedia.GetByID(id)
+	if err != nil || (m.FromUserID != uid && m.ToUserID != uid) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	rc, err := s.blobs.OpenRange(m.BlobKey, 0, -1)
+	if err != nil {
+		http.Error(w, "storage error", http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Length", fmt.Sprint(m.Size))
+	_, _ = io.Copy(w, rc)
+}
+
+type InboxDTO struct {
+	PeerID          int64           `json:"peer_id"`
+	PeerUsername    string          `json:"peer_username"`
+	LastMessageID   int64           `json:"last_message_id"`
+	LastText        string          `json:"last_text"`
+	LastAttachments []AttachmentDTO `json:"last_attachments,omitempty"`
+	LastCreatedAt   string          `json:"last_created_at"`
+}
+
+func (s *Server) handleChatInbox(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userStr := strings.TrimSpace(r.URL.Query().Get("user_id"))
+	if userStr == "" {
+		http.Error(w, "user_id required", http.StatusBadRequest)
+		return
+	}
+	var uid int64
+	if _, err := fmt.Sscan(userStr, &uid); err != nil || uid <= 0 {
+		http.Error(w, "bad user_id", http.StatusBadRequest)
+		return
+	}
+
+	// (опционально) проверим что юзер существует
+	if _, err := s.users.GetByID(uid); err != nil {
+		http.Error(w, "user not found", http.StatusBadRequest)
+		return
+	}
+
+	items, err := s.plainMessages.ListInbox(uid)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	ids := make([]int64, 0, len(items))
+	for _, it := range items {
+		ids = append(ids, it.LastMessageID)
+	}
+	atts, err := s.attachments.ListFor(plainMessagesTable.kind, ids)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	out := make([]InboxDTO, 0, len(items))
+	for _, it := range items {
+		out = append(out, InboxDTO{
+			PeerID:          it.PeerID,
+			PeerUsername:    it.PeerUsername,
+			LastMessageID:   it.LastMessageID,
+			LastText:        stripAttachmentMarkers(it.LastText, atts[it.LastMessageID]),
+			LastAttachments: attachmentDTOs(atts[it.LastMessageID]),
+			LastCreatedAt:   it.LastCreatedAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+type SearchResultDTO struct {
+	Kind       string `json:"kind"` // direct | group
+	ID         int64  `json:"id"`
+	FromUserID int64  `json:"from_user_id"`
+	ToUserID   int64  `json:"to_user_id,omitempty"`
+	GroupID    int64  `json:"group_id,omitempty"`
+	Text       string `json:"text"`
+	CreatedAt  string `json:"created_at"`
+}
+
+const searchLimit = 50
+
+// GET /chat/search?user_id=...&q=...
+// Ищет по целым словам (слепой индекс не умеет префиксы): все слова запроса должны быть в сообщении.
+func (s *Server) handleChatSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	uid := mustInt64(r.URL.Query().Get("user_id"))
+	if uid == 0 {
+		http.Error(w, "bad user_id", http.StatusBadRequest)
+		return
+	}
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		http.Error(w, "q required", http.StatusBadRequest)
+		return
+	}
+
+	direct, err := s.plainMessages.Search(uid, query, searchLimit)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	group, err := s.groupMessages.Search(uid, query, searchLimit)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	out := make([]SearchResultDTO, 0, len(direct)+len(group))
+	for _, m := range direct {
+		out = append(out, SearchResultDTO{
+			Kind:       "direct",
+			ID:         m.ID,
+			FromUserID: m.FromUserID,
+			ToUserID:   m.ToUserID,
+			Text:       m.Text,
+			CreatedAt:  m.CreatedAt,
+		})
+	}
+	for _, m := range group {
+		out = append(out, SearchResultDTO{
+			Kind:       "group",
+			ID:         m.ID,
+			FromUserID: m.FromUserID,
+			GroupID:    m.GroupID,
+			Text:       m.Text,
+			CreatedAt:  m.CreatedAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// ===== Реакции (reactions.go) =====
+
+type ReactionRequest struct {
+	UserID    int64  `json:"user_id"`
+	Kind      string `json:"kind"` // direct | group
+	MessageID int64  `json:"message_id"`
+	Emoji     string `json:"emoji"`
+}
+
+// POST /reactions/add — JSON {user_id, kind, message_id, emoji}
+func (s *Server) handleReactionAdd(w http.ResponseWriter, r *http.Request) {
+	s.handleReaction(w, r, true)
+}
+
+// POST /reactions/remove — JSON {user_id, kind, message_id, emoji}
+func (s *Server) handleReactionRemove(w http.ResponseWriter, r *http.Request) {
+	s.handleReaction(w, r, false)
+}
+
+func (s *Server) handleReaction(w http.ResponseWriter, r *http.Request, add bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ReactionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == 0 || req.MessageID == 0 || req.Emoji == "" {
+		http.Error(w, "missing fields", http.StatusBadRequest)
+		return
+	}
+	if req.Kind != plainMessagesTable.kind && req.Kind != groupMessagesTable.kind {
+		http.Error(w, "kind must be direct or group", http.StatusBadRequest)
+		return
+	}
+	if !validEmoji(req.Emoji) {
+		http.Error(w, "bad emoji", http.StatusBadRequest)
+		return
+	}
+
+	switch err := s.checkMessageAccess(req.Kind, req.MessageID, req.UserID); {
+	case errors.Is(err, ErrMessageNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, ErrNotParticipant):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case err != nil:
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	var changed bool
+	var err error
+	if add {
+		changed, err = s.reactions.Add(req.Kind, req.MessageID, req.UserID, req.Emoji)
+	} else {
+		changed, err = s.reactions.Remove(req.Kind, req.MessageID, req.UserID, req.Emoji)
+	}
+	if errors.Is(err, ErrTooManyReactions) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if changed {
+		s.updates.notify()
+	}
+
+	list, err := s.reactions.ListFor(req.Kind, []int64{req.MessageID})
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	reactions := reactionDTOs(list[req.MessageID])
+	if reactions == nil {
+		reactions = []ReactionDTO{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"changed": changed, "reactions": reactions})
+}
+
+// ===== Синхронизация (sync.go) =====
+
+type SyncMemberDTO struct {
+	GroupID   int64  `json:"group_id"`
+	GroupName string `json:"group_name"`
+	UserID    int64  `json:"user_id"`
+	Username  string `json:"username"`
+	CreatedAt string `json:"created_at"`
+}
+
+// SyncMediaDTO — новое медиа и беседа, в которую оно загружено.
+type SyncMediaDTO struct {
+	Conversation string `json:"conversation"` // direct | group
+	FromUserID   int64  `json:"from_user_id"`
+	ToUserID     int64  `json:"to_user_id,omitempty"`
+	GroupID      int64  `json:"group_id,omitempty"`
+	AttachmentDTO
+}
+
+func syncMediaDTO(m *PlainMedia) SyncMediaDTO {
+	return SyncMediaDTO{
+		Conversation:  m.Kind,
+		FromUserID:    m.FromUserID,
+		ToUserID:      m.ToUserID.Int64,
+		GroupID:       m.GroupID.Int64,
+		AttachmentDTO: AttachmentDTO{Kind: attachmentKind(m), MediaInfoDTO: mediaInfoDTO(m)},
+	}
+}
+
+// SyncReactionDTO — у сообщения поменялись реакции; reactions — текущий список
+// целиком (пустой — реакций не осталось).
+type SyncReactionDTO struct {
+	Conversation string        `json:"conversation"` // direct | group
+	MessageID    int64         `json:"message_id"`
+	FromUserID   int64         `json:"from_user_id"`
+	ToUserID     int64         `json:"to_user_id,omitempty"`
+	GroupID      int64         `json:"group_id,omitempty"`
+	Reactions    []ReactionDTO `json:"reactions"`
+}
+
+type SyncResponse struct {
+	Token     string            `json:"token"`
+	More      bool              `json:"more,omitempty"` // упёрлись в лимит — спросить ещё раз, не дожидаясь
+	Direct    []ChatMessageDTO  `json:"direct,omitempty"`
+	Group     []GroupMessageDTO `json:"group,omitempty"`
+	E2E       []MessageDTO      `json:"e2e,omitempty"`
+	Members   []SyncMemberDTO   `json:"members,omitempty"`
+	Media     []SyncMediaDTO    `json:"media,omitempty"`
+	Reactions []SyncReactionDTO `json:"reactions,omitempty"`
+	Polls     []SyncPollDTO     `json:"polls,omitempty"`
+}
+
+func (r *SyncResponse) empty() bool {
+	return len(r.Direct) == 0 && len(r.Group) == 0 && len(r.E2E) == 0 && len(r.Members) == 0 && len(r.Media) == 0 &&
+		len(r.Reactions) == 0 && len(r.Polls) == 0
+}
+
+// GET /sync?user_id=...&token=...&timeout=25
+// Отвечает сразу, если после token что-то есть, иначе ждёт до timeout секунд (0 — не ждать).
+// С Accept: text/event-stream — тот же поток событиями «sync»; после обрыва
+// EventSource присылает последний токен в Last-Event-ID.
+func (s *Server) handleSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	uid := mustInt64(q.Get("user_id"))
+	if uid == 0 {
+		http.Error(w, "user_id required", http.StatusBadRequest)
+		return
+	}
+	if _, err := s.users.GetByID(uid); err != nil {
+		http.Error(w, "user not found", http.StatusBadRequest)
+		return
+	}
+
+	stream := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	token := q.Get("token")
+	if id := r.Header.Get("Last-Event-ID"); stream && id != "" {
+		token = id
+	}
+
+	var cur SyncCursor
+	if token == "" {
+		head, err := s.syncs.Head()
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		cur = head
+		if !stream {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(SyncResponse{Token: cur.token(uid)})
+			return
+		}
+	} else {
+		var err error
+		if cur, err = parseSyncToken(token, uid); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if cur.Reactions < 0 || cur.Polls < 0 { // токен старше ленты реакций или опросов
+			head, err := s.syncs.Head()
+			if err != nil {
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			if cur.Reactions < 0 {
+				cur.Reactions = head.Reactions
+			}
+			if cur.Polls < 0 {
+				cur.Polls = head.Polls
+			}
+		}
+	}
+
+	if stream {
+		s.streamSync(w, r, uid, cur)
+		return
+	}
+
+	timeout := syncDefaultTimeout
+	if v := q.Get("timeout"); v != "" {
+		sec, err := strconv.Atoi(v)
+		if err != nil || sec < 0 {
+			http.Error(w, "bad timeout", http.StatusBadRequest)
+			return
+		}
+		timeout = min(time.Duration(sec)*time.Second, syncMaxTimeout)
+	}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		changed := s.updates.changed()
+		resp, _, err := s.syncDelta(uid, cur)
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if !resp.empty() || !time.Now().Before(deadline) {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(resp)
+			return
+		}
+
+		timer := time.NewTimer(time.Until(deadline))
+		select {
+		case <-changed:
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// streamSync — /sync как text/event-stream: первое событие сразу (с токеном, даже
+// пустое), дальше по событию на каждую дельту; id события — токен. Между ними —
+// события «typing» без id: полный список тех, кто сейчас печатает (typing.go).
+func (s *Server) streamSync(w http.ResponseWriter, r *http.Request, uid int64, cur SyncCursor) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx не должен копить поток
+	w.WriteHeader(http.StatusOK)
+
+	heartbeat := time.NewTicker(syncHeartbeat)
+	defer heartbeat.Stop()
+
+	first := true
+	checkTyping, sentTyping := true, false
+	var typingChanged <-chan struct{}
+	for {
+		changed := s.updates.changed()
+
+		if checkTyping {
+			checkTyping = false
+			typingChanged = s.typing.updates.changed()
+			typing, err := s.typingFor(uid)
+			if err != nil {
+				log.Printf("sync stream: %v", err)
+				return
+			}
+			// пустой список шлём один раз — чтобы клиент погасил индикатор
+			if len(typing) > 0 || sentTyping {
+				sentTyping = len(typing) > 0
+				data, err := json.Marshal(typing)
+				if err != nil {
+					return
+				}
+				if _, err := fmt.Fprintf(w, "event: typing\ndata: %s\n\n", data); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+
+		resp, next, err := s.syncDelta(uid, cur)
+		if err != nil {
+			log.Printf("sync stream: %v", err)
+			return
+		}
+		if first || !resp.empty() {
+			first = false
+			data, err := json.Marshal(resp)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "id: %s\nevent: sync\ndata: %s\n\n", resp.Token, data); err != nil {
+				return
+			}
+			flusher.Flush()
+			cur = next
+			if resp.More {
+				continue
+			}
+		}
+
+		select {
+		case <-changed:
+		case <-typingChanged:
+			checkTyping = true
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// ===== typing (typing.go) =====
+
+type TypingRequest struct {
+	UserID   int64 `json:"user_id"`
+	ToUserID int64 `json:"to_user_id,omitempty"` // личка
+	GroupID  int64 `json:"group_id,omitempty"`   // или беседа
+	Typing   bool  `json:"typing"`
+}
+
+type TypingDTO struct {
+	Kind       string `json:"kind"` // direct | group
+	FromUserID int64  `json:"from_user_id"`
+	Username   string `json:"username"`
+	ToUserID   int64  `json:"to_user_id,omitempty"`
+	GroupID    int64  `json:"group_id,omitempty"`
+	ExpiresIn  int64  `json:"expires_in_ms"` // столько показывать, если не придёт продление
+}
+
+// POST /typing — JSON {user_id, to_user_id | group_id, typing}: пока пользователь
+// набирает текст, клиент повторяет typing=true раз в пару секунд.
+// GET /typing?user_id=... — кто сейчас печатает в личках и беседах пользователя
+// (для клиентов без event-stream /sync).
+func (s *Server) handleTyping(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		uid := mustInt64(r.URL.Query().Get("user_id"))
+		if uid == 0 {
+			http.Error(w, "user_id required", http.StatusBadRequest)
+			return
+		}
+		out, err := s.typingFor(uid)
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req TypingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == 0 || (req.ToUserID == 0) == (req.GroupID == 0) {
+		http.Error(w, "user_id and one of to_user_id, group_id required", http.StatusBadRequest)
+		return
+	}
+
+	u, err := s.users.GetByID(req.UserID)
+	if err != nil {
+		http.Error(w, "user not found", http.StatusBadRequest)
+		return
+	}
+
+	key := typingKey{fromID: req.UserID}
+	if req.GroupID != 0 {
+		isMember, err := s.groupMembers.IsMember(req.GroupID, req.UserID)
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if !isMember {
+			http.Error(w, "forbidden: not a group member", http.StatusForbidden)
+			return
+		}
+		key.kind, key.convID = "group", req.GroupID
+	} else {
+		if req.ToUserID == req.UserID {
+			http.Error(w, "bad to_user_id", http.StatusBadRequest)
+			return
+		}
+		if _, err := s.users.GetByID(req.ToUserID); err != nil {
+			http.Error(w, "to_user not found", http.StatusBadRequest)
+			return
+		}
+		key.kind, key.convID = "direct", req.ToUserID
+	}
+
+	s.typing.set(key, u.Username, req.Typing)
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"ok":true}`))
+}
+
+// ===== presence (presence.go) =====
+
+type PresenceDTO struct {
+	ID         int64  `json:"id"`
+	Username   string `json:"username"`
+	Status     string `json:"status"` // online | away | busy | offline (invisible — только о себе)
+	StatusText string `json:"status_text,omitempty"`
+	LastSeen   string `json:"last_seen,omitempty"` // только у offline
+}
+
+func (s *Server) handlePresencePing(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		UserID int64 `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID <= 0 {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if err := s.presence.ping(req.UserID); err != nil {
+		http.Error(w, "user not found", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"ok":true}`))
+}
+
+// GET /presence/online?user_id=... — контакты, которые сейчас в сети.
+func (s *Server) handlePresenceOnline(w http.ResponseWriter, r *http.Request) {
+	s.writeContactsPresence(w, r, true)
+}
+
+// GET /presence/contacts?user_id=... — все контакты: статус, у offline — last_seen.
+func (s *Server) handlePresenceContacts(w http.ResponseWriter, r *http.Request) {
+	s.writeContactsPresence(w, r, false)
+}
+
+func (s *Server) writeContactsPresence(w http.ResponseWriter, r *http.Request, onlineOnly bool) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+		return
+	}
+	uid := mustInt64(r.URL.Query().Get("user_id"))
+	if uid == 0 {
+		http.Error(w, "user_id required", http.StatusBadRequest)
+		return
+	}
+	contacts, err := s.presence.contactsOf(uid)
+	if err != nil {
+		http.Error(w, "db", http.StatusInternalServerError)
+		return
+	}
+	out := contacts
+	if onlineOnly {
+		out = make([]PresenceDTO, 0, len(contacts))
+		for _, c := range contacts {
+			if c.Status != "offline" {
+				out = append(out, c)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// GET /presence/status?user_id=... — свой статус.
+// POST /presence/status — JSON {user_id, status, status_text}.
+func (s *Server) handlePresenceStatus(w http.ResponseWriter, r *http.Request) {
+	var uid int64
+	switch r.Method {
+	case http.MethodGet:
+		uid = mustInt64(r.URL.Query().Get("user_id"))
+		if uid == 0 {
+			http.Error(w, "user_id required", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		var req struct {
+			UserID     int64  `json:"user_id"`
+			Status     string `json:"status"`
+			StatusText string `json:"status_text"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID <= 0 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if !presenceStatuses[req.Status] {
+			http.Error(w, "status must be online, away, busy or invisible", http.StatusBadRequest)
+			return
+		}
+		text := strings.TrimSpace(req.StatusText)
+		if !validStatusText(text) {
+			http.Error(w, "status_text too long", http.StatusBadRequest)
+			return
+		}
+		if err := s.presence.setStatus(req.UserID, req.Status, text); err != nil {
+			if errors.Is(err, ErrUserNotFound) {
+				http.Error(w, "user not found", http.StatusBadRequest)
+				return
+			}
+			http.Error(w, "db", http.StatusInternalServerError)
+			return
+		}
+		uid = req.UserID
+	default:
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	me, err := s.presence.self(uid)
+	if errors.Is(err, ErrUserNotFound) {
+		http.Error(w, "user not found", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "db", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(me)
+}
+
+// ===== Закреплённые сообщения (pins.go) =====
+
+type PinRequest struct {
+	UserID    int64  `json:"user_id"`
+	Kind      string `json:"kind"` // direct | group
+	MessageID int64  `json:"message_id"`
+}
+
+type PinDTO struct {
+	MessageID int64           `json:"message_id"`
+	Position  int64           `json:"position"`
+	PinnedBy  int64           `json:"pinned_by"`
+	PinnedAt  string          `json:"pinned_at"`
+	Message   ReplyPreviewDTO `json:"message"`
+}
+
+func (s *Server) handlePin(w http.ResponseWriter, r *http.Request) {
+	s.handlePinChange(w, r, true)
+}
+
+func (s *Server) handleUnpin(w http.ResponseWriter, r *http.Request) {
+	s.handlePinChange(w, r, false)
+}
+
+// handlePinChange отвечает списком закреплённых в беседе после изменения.
+func (s *Server) handlePinChange(w http.ResponseWriter, r *http.Request, pin bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req PinRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == 0 || req.MessageID == 0 {
+		http.Error(w, "missing fields", http.StatusBadRequest)
+		return
+	}
+	if req.Kind != plainMessagesTable.kind && req.Kind != groupMessagesTable.kind {
+		http.Error(w, "kind must be direct or group", http.StatusBadRequest)
+		return
+	}
+
+	scope, err := s.pinScope(req.Kind, req.MessageID, req.UserID)
+	switch {
+	case errors.Is(err, ErrMessageNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, ErrNotParticipant), errors.Is(err, ErrNotGroupAdmin):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case err != nil:
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	if pin {
+		err = s.pins.Pin(req.Kind, req.MessageID, scope, req.UserID)
+	} else {
+		_, err = s.pins.Unpin(req.Kind, req.MessageID)
+	}
+	if errors.Is(err, ErrTooManyPins) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	s.writePins(w, req.Kind, scope)
+}
+
+// GET /pins/list?user_id=&kind=direct&peer_id= | ?user_id=&kind=group&group_id=
+func (s *Server) handlePinsList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	uid := mustInt64(q.Get("user_id"))
+	if uid <= 0 {
+		http.Error(w, "user_id required", http.StatusBadRequest)
+		return
+	}
+
+	var scope string
+	switch kind := q.Get("kind"); kind {
+	case plainMessagesTable.kind:
+		peerID := mustInt64(q.Get("peer_id"))
+		if peerID <= 0 {
+			http.Error(w, "peer_id required", http.StatusBadRequest)
+			return
+		}
+		scope = conversationScope(kind, uid, peerID)
+	case groupMessagesTable.kind:
+		groupID := mustInt64(q.Get("group_id"))
+		if groupID <= 0 {
+			http.Error(w, "group_id required", http.StatusBadRequest)
+			return
+		}
+		isMember, err := s.groupMembers.IsMember(groupID, uid)
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if !isMember {
+			http.Error(w, ErrNotParticipant.Error(), http.StatusForbidden)
+			return
+		}
+		scope = conversationScope(kind, 0, groupID)
+	default:
+		http.Error(w, "kind must be direct or group", http.StatusBadRequest)
+		return
+	}
+	s.writePins(w, q.Get("kind"), scope)
+}
+
+func (s *Server) writePins(w http.ResponseWriter, kind, scope string) {
+	pins, err := s.pins.List(scope)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	out, err := s.pinDTOs(kind, pins)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// ===== Пересылка (forward.go) =====
+
+type ForwardRequest struct {
+	UserID    int64  `json:"user_id"`
+	Kind      string `json:"kind"` // direct | group — откуда пересылаем
+	MessageID int64  `json:"message_id"`
+	ToUserID  int64  `json:"to_user_id,omitempty"` // куда: личка
+	GroupID   int64  `json:"group_id,omitempty"`   // или беседа
+}
+
+type ForwardResponse struct {
+	ID   int64  `json:"id"`
+	Kind string `json:"kind"`
+}
+
+func (s *Server) handleForward(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ForwardRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == 0 || req.MessageID == 0 {
+		http.Error(w, "missing fields", http.StatusBadRequest)
+		return
+	}
+	if req.Kind != plainMessagesTable.kind && req.Kind != groupMessagesTable.kind {
+		http.Error(w, "kind must be direct or group", http.StatusBadRequest)
+		return
+	}
+	if (req.ToUserID == 0) == (req.GroupID == 0) {
+		http.Error(w, "exactly one of to_user_id and group_id required", http.StatusBadRequest)
+		return
+	}
+
+	switch err := s.checkMessageAccess(req.Kind, req.MessageID, req.UserID); {
+	case errors.Is(err, ErrMessageNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, ErrNotParticipant):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case err != nil:
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	if req.GroupID != 0 {
+		isMember, err := s.groupMembers.IsMember(req.GroupID, req.UserID)
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if !isMember {
+			http.Error(w, "forbidden: not a group member", http.StatusForbidden)
+			return
+		}
+	} else if _, err := s.users.GetByID(req.ToUserID); err != nil {
+		http.Error(w, "to_user not found", http.StatusBadRequest)
+		return
+	}
+
+	src, err := s.forwardSource(req.Kind, req.MessageID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := ForwardResponse{}
+	if req.GroupID != 0 {
+		created, err := s.sendGroupMessage(&GroupMessage{
+			GroupID:           req.GroupID,
+			FromUserID:        req.UserID,
+			Text:              src.text,
+			ForwardedFrom:     src.fromID,
+			ForwardedFromName: src.fromName,
+			ForwardedMedia:    src.media,
+		})
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		resp = ForwardResponse{ID: created.ID, Kind: groupMessagesTable.kind}
+	} else {
+		created, err := s.sendChatMessage(&PlainMessage{
+			FromUserID:        req.UserID,
+			ToUserID:          req.ToUserID,
+			Text:              src.text,
+			ForwardedFrom:     src.fromID,
+			ForwardedFromName: src.fromName,
+			ForwardedMedia:    src.media,
+		})
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		resp = ForwardResponse{ID: created.ID, Kind: plainMessagesTable.kind}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// ===== Упоминания (mentions.go) =====
+
+type MentionDTO struct {
+	GroupID   int64           `json:"group_id"`
+	GroupName string          `json:"group_name"`
+	ViaAll    bool            `json:"via_all"` // упомянули через @all
+	Read      bool            `json:"read"`
+	Message   GroupMessageDTO `json:"message"`
+}
+
+// GET /mentions?user_id=...&before_id=...&unread_only=1&limit=50 — новые первыми;
+// следующая страница — before_id = message.id последнего.
+func (s *Server) handleMentions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	uid := mustInt64(q.Get("user_id"))
+	if uid <= 0 {
+		http.Error(w, "user_id required", http.StatusBadRequest)
+		return
+	}
+	limit := int(mustInt64(q.Get("limit")))
+	if limit <= 0 {
+		limit = defaultMentionsFeed
+	}
+	limit = min(limit, maxMentionsFeed)
+	unreadOnly := q.Get("unread_only") == "1" || q.Get("unread_only") == "true"
+
+	feed, err := s.mentions.Feed(uid, mustInt64(q.Get("before_id")), unreadOnly, limit)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	ids := make([]int64, 0, len(feed))
+	for _, m := range feed {
+		ids = append(ids, m.MessageID)
+	}
+	msgs, err := s.groupMessages.ListByIDs(ids)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	dtos, err := s.groupMessageDTOs(msgs, pollViewer{userID: uid})
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	byID := make(map[int64]GroupMessageDTO, len(dtos))
+	for _, d := range dtos {
+		byID[d.ID] = d
+	}
+
+	names := map[int64]string{}
+	out := make([]MentionDTO, 0, len(feed))
+	for _, m := range feed {
+		msg, ok := byID[m.MessageID]
+		if !ok {
+			continue
+		}
+		name, ok := names[m.GroupID]
+		if !ok {
+			if g, err := s.groups.GetByID(m.GroupID); err == nil {
+				name = g.Name
+			}
+			names[m.GroupID] = name
+		}
+		out = append(out, MentionDTO{GroupID: m.GroupID, GroupName: name, ViaAll: m.ViaAll, Read: m.Read, Message: msg})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+type MentionsUnreadDTO struct {
+	Total  int                      `json:"total"`
+	Groups []MentionsUnreadGroupDTO `json:"groups"`
+}
+
+type MentionsUnreadGroupDTO struct {
+	GroupID int64 `json:"group_id"`
+	Count   int   `json:"count"`
+}
+
+// GET /mentions/unread?user_id=...
+func (s *Server) handleMentionsUnread(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	uid := mustInt64(r.URL.Query().Get("user_id"))
+	if uid <= 0 {
+		http.Error(w, "user_id required", http.StatusBadRequest)
+		return
+	}
+
+	counts, err := s.mentions.UnreadCounts(uid)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	out := MentionsUnreadDTO{Groups: make([]MentionsUnreadGroupDTO, 0, len(counts))}
+	for gid, n := range counts {
+		out.Total += n
+		out.Groups = append(out.Groups, MentionsUnreadGroupDTO{GroupID: gid, Count: n})
+	}
+	sort.Slice(out.Groups, func(i, j int) bool { return out.Groups[i].GroupID < out.Groups[j].GroupID })
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+type MentionsReadRequest struct {
+	UserID        int64 `json:"user_id"`
+	GroupID       int64 `json:"group_id"`
+	UpToMessageID int64 `json:"up_to_message_id,omitempty"` // 0 — все в беседе
+}
+
+// POST /mentions/read
+func (s *Server) handleMentionsRead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req MentionsReadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == 0 || req.GroupID == 0 {
+		http.Error(w, "user_id and group_id required", http.StatusBadRequest)
+		return
+	}
+
+	n, err := s.mentions.MarkRead(req.UserID, req.GroupID, req.UpToMessageID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int64{"marked": n})
+}
+
+// ===== Опросы (polls.go) =====
+
+type PollDTO struct {
+	Options     []PollOptionDTO `json:"options"`
+	Multiple    bool            `json:"multiple"`
+	Anonymous   bool            `json:"anonymous"`
+	ClosesAt    string          `json:"closes_at,omitempty"`
+	Closed      bool            `json:"closed"`
+	TotalVoters int             `json:"total_voters"`
+	MyVotes     []int           `json:"my_votes,omitempty"` // номера вариантов, если известно, кто смотрит
+}
+
+type PollOptionDTO struct {
+	Text   string  `json:"text"`
+	Votes  int     `json:"votes"`
+	Voters []int64 `json:"voters,omitempty"` // только в открытом (не анонимном) опросе
+}
+
+type SyncPollDTO struct {
+	MessageID int64    `json:"message_id"`
+	GroupID   int64    `json:"group_id"`
+	Poll      *PollDTO `json:"poll"`
+}
+
+type PollCreateRequest struct {
+	GroupID    int64    `json:"group_id"`
+	FromUserID int64    `json:"from_user_id"`
+	Question   string   `json:"question"`
+	Options    []string `json:"options"`
+	Multiple   bool     `json:"multiple,omitempty"`
+	Anonymous  bool     `json:"anonymous,omitempty"`
+	ClosesAt   string   `json:"closes_at,omitempty"` // RFC3339, в будущем
+}
+
+type PollVoteRequest struct {
+	UserID    int64 `json:"user_id"`
+	MessageID int64 `json:"message_id"`
+	Options   []int `json:"options"` // номера вариантов с 0; пустой — отозвать голос
+}
+
+type PollCloseRequest struct {
+	UserID    int64 `json:"user_id"`
+	MessageID int64 `json:"message_id"`
+}
+
+func (s *Server) handlePollCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req PollCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	if req.GroupID == 0 || req.FromUserID == 0 {
+		http.Error(w, "group_id and from_user_id required", http.StatusBadRequest)
+		return
+	}
+	question, options, err := validatePoll(req.Question, req.Options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var closesAt string
+	if req.ClosesAt != "" {
+		t, err := time.Parse(time.RFC3339, req.ClosesAt)
+		if err != nil || !t.After(time.Now()) {
+			http.Error(w, "closes_at must be a future RFC3339 time", http.StatusBadRequest)
+			return
+		}
+		closesAt = t.UTC().Format(time.RFC3339)
+	}
+
+	if _, err := s.groups.GetByID(req.GroupID); err != nil {
+		http.Error(w, "group not found", http.StatusBadRequest)
+		return
+	}
+	isMember, err := s.groupMembers.IsMember(req.GroupID, req.FromUserID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !isMember {
+		http.Error(w, "forbidden: not a group member", http.StatusForbidden)
+		return
+	}
+
+	created, err := s.sendGroupMessage(&GroupMessage{
+		GroupID:    req.GroupID,
+		FromUserID: req.FromUserID,
+		Text:       pollText(question, options),
+		Poll: &Poll{
+			Options:   len(options),
+			Multiple:  req.Multiple,
+			Anonymous: req.Anonymous,
+			ClosesAt:  closesAt,
+		},
+	})
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(GroupSendResponse{ID: created.ID})
+}
+
+func (s *Server) handlePollVote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req PollVoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == 0 || req.MessageID == 0 {
+		http.Error(w, "user_id and message_id required", http.StatusBadRequest)
+		return
+	}
+
+	p, ok := s.pollForMember(w, req.MessageID, req.UserID)
+	if !ok {
+		return
+	}
+	options, err := validateVote(p, req.Options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = s.polls.Vote(req.MessageID, req.UserID, options, time.Now())
+	switch {
+	case errors.Is(err, ErrNotAPoll):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, ErrPollClosed):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	s.updates.notify()
+	s.writePoll(w, req.MessageID, req.UserID)
+}
+
+func (s *Server) handlePollClose(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req PollCloseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == 0 || req.MessageID == 0 {
+		http.Error(w, "user_id and message_id required", http.StatusBadRequest)
+		return
+	}
+
+	p, ok := s.pollForMember(w, req.MessageID, req.UserID)
+	if !ok {
+		return
+	}
+	msgs, err := s.groupMessages.ListByIDs([]int64{req.MessageID})
+	if err != nil || len(msgs) == 0 {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if msgs[0].FromUserID != req.UserID {
+		role, err := s.groupMembers.Role(p.GroupID, req.UserID)
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if !canModerate(role) {
+			http.Error(w, "forbidden: only the author or group admins can close a poll", http.StatusForbidden)
+			return
+		}
+	}
+
+	changed, err := s.polls.Close(req.MessageID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if changed {
+		s.updates.notify()
+	}
+	s.writePoll(w, req.MessageID, req.UserID)
+}
+
+// pollForMember — опрос, если пользователь участник его беседы; иначе пишет ошибку.
+func (s *Server) pollForMember(w http.ResponseWriter, messageID, userID int64) (*Poll, bool) {
+	polls, err := s.polls.ListFor([]int64{messageID})
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil, false
+	}
+	p := polls[messageID]
+	if p == nil {
+		http.Error(w, ErrNotAPoll.Error(), http.StatusNotFound)
+		return nil, false
+	}
+	isMember, err := s.groupMembers.IsMember(p.GroupID, userID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if !isMember {
+		http.Error(w, "forbidden: not a group member", http.StatusForbidden)
+		return nil, false
+	}
+	return p, true
+}
+
+// writePoll отвечает актуальными итогами опроса.
+func (s *Server) writePoll(w http.ResponseWriter, messageID, viewerID int64) {
+	out, err := s.syncPollDTOs([]PollChange{{MessageID: messageID}}, pollViewer{userID: viewerID, posted: true})
+	if err != nil || len(out) == 0 {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out[0])
+}
+
+// ===== Отложенные сообщения (scheduled.go) =====
+
+type ScheduledCreateRequest struct {
+	FromUserID  int64    `json:"from_user_id"`
+	Kind        string   `json:"kind"` // direct | group
+	ToUserID    int64    `json:"to_user_id,omitempty"`
+	GroupID     int64    `json:"group_id,omitempty"`
+	Text        string   `json:"text"`
+	Attachments []string `json:"attachments,omitempty"`
+	ReplyTo     int64    `json:"reply_to,omitempty"`
+	SendAt      string   `json:"send_at"` // RFC3339, в будущем
+}
+
+type ScheduledCancelRequest struct {
+	UserID int64 `json:"user_id"`
+	ID     int64 `json:"id"`
+}
+
+type ScheduledDTO struct {
+	ID          int64           `json:"id"`
+	Kind        string          `json:"kind"`
+	ToUserID    int64           `json:"to_user_id,omitempty"`
+	GroupID     int64           `json:"group_id,omitempty"`
+	Text        string          `json:"text"`
+	Attachments []AttachmentDTO `json:"attachments,omitempty"` // пока не отправлено
+	ReplyTo     int64           `json:"reply_to,omitempty"`
+	SendAt      string          `json:"send_at"`
+	Status      string          `json:"status"`               // pending | sending | sent | failed | canceled
+	MessageID   int64           `json:"message_id,omitempty"` // отправленное сообщение
+	Error       string          `json:"error,omitempty"`
+	CreatedAt   string          `json:"created_at"`
+}
+
+func (s *Server) handleScheduledCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ScheduledCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	if req.FromUserID == 0 || (strings.TrimSpace(req.Text) == "" && len(req.Attachments) == 0) {
+		http.Error(w, "missing fields", http.StatusBadRequest)
+		return
+	}
+	sendAt, err := time.Parse(time.RFC3339, req.SendAt)
+	if err != nil || !sendAt.After(time.Now()) || sendAt.After(time.Now().Add(maxScheduleAhead)) {
+		http.Error(w, "send_at must be a future RFC3339 time within a year", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := s.users.GetByID(req.FromUserID); err != nil {
+		http.Error(w, "from_user not found", http.StatusBadRequest)
+		return
+	}
+	var convID int64
+	switch req.Kind {
+	case plainMessagesTable.kind:
+		if req.ToUserID == 0 {
+			http.Error(w, "to_user_id required", http.StatusBadRequest)
+			return
+		}
+		if _, err := s.users.GetByID(req.ToUserID); err != nil {
+			http.Error(w, "to_user not found", http.StatusBadRequest)
+			return
+		}
+		convID = req.ToUserID
+	case groupMessagesTable.kind:
+		if req.GroupID == 0 {
+			http.Error(w, "group_id required", http.StatusBadRequest)
+			return
+		}
+		if _, err := s.groups.GetByID(req.GroupID); err != nil {
+			http.Error(w, "group not found", http.StatusBadRequest)
+			return
+		}
+		isMember, err := s.groupMembers.IsMember(req.GroupID, req.FromUserID)
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if !isMember {
+			http.Error(w, "forbidden: not a group member", http.StatusForbidden)
+			return
+		}
+		convID = req.GroupID
+	default:
+		http.Error(w, "kind must be direct or group", http.StatusBadRequest)
+		return
+	}
+
+	created, err := s.scheduled.Create(&ScheduledMessage{
+		Kind:        req.Kind,
+		FromUserID:  req.FromUserID,
+		ConvID:      convID,
+		Text:        req.Text,
+		Attachments: req.Attachments,
+		ReplyTo:     req.ReplyTo,
+		SendAt:      sendAt.UTC().Format(time.RFC3339),
+	})
+	if errors.Is(err, ErrBadAttachment) || errors.Is(err, ErrBadReply) || errors.Is(err, ErrTooManyScheduled) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	s.writeScheduled(w, []*ScheduledMessage{created}, false)
+}
+
+func (s *Server) handleScheduledList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	uid := mustInt64(q.Get("user_id"))
+	if uid <= 0 {
+		http.Error(w, "user_id required", http.StatusBadRequest)
+		return
+	}
+
+	var convID int64
+	switch kind := q.Get("kind"); kind {
+	case "":
+	case plainMessagesTable.kind:
+		convID = mustInt64(q.Get("peer_id"))
+		if convID <= 0 {
+			http.Error(w, "peer_id required", http.StatusBadRequest)
+			return
+		}
+	case groupMessagesTable.kind:
+		convID = mustInt64(q.Get("group_id"))
+		if convID <= 0 {
+			http.Error(w, "group_id required", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "kind must be direct or group", http.StatusBadRequest)
+		return
+	}
+
+	list, err := s.scheduled.ListByUser(uid, q.Get("kind"), convID, q.Get("all") == "1", maxScheduledList)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	s.writeScheduled(w, list, true)
+}
+
+func (s *Server) handleScheduledCancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ScheduledCancelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == 0 || req.ID == 0 {
+		http.Error(w, "user_id and id required", http.StatusBadRequest)
+		return
+	}
+
+	ok, err := s.scheduled.Cancel(req.ID, req.UserID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, ErrNotScheduled.Error(), http.StatusNotFound)
+		return
+	}
+	list, err := s.scheduled.ListByIDs([]int64{req.ID})
+	if err != nil || len(list) == 0 {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	s.writeScheduled(w, list, false)
+}
+
+// writeScheduled — список или (asList = false) одно отложенное сообщение.
+func (s *Server) writeScheduled(w http.ResponseWriter, list []*ScheduledMessage, asList bool) {
+	out, err := s.scheduledDTOs(list)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if asList {
+		_ = json.NewEncoder(w).Encode(out)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(out[0])
+}
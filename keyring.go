@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// ===== Мастер-ключи сервера (envelope encryption) =====
+//
+// Каждый блоб шифруется своим случайным ключом данных (DEK), а DEK — мастер-ключом
+// определённой версии. Ротация мастер-ключа = перешифровать только DEK, сами блобы не трогаем.
+//
+// Раскладка на диске:
+//   server_media_key.bin  — старый единственный ключ, считается версией 1
+//   server_keys/v<N>.key  — версии, созданные ротацией
+
+const (
+	legacyMediaKeyPath = "server_media_key.bin"
+	serverKeysDir      = "server_keys"
+	masterKeySize      = 32
+)
+
+var ErrKeyVersionNotFound = errors.New("master key version not found")
+
+type Keyring struct {
+	dir     string
+	keys    map[uint32][]byte
+	current uint32
+}
+
+func loadKeyring(legacyPath, dir string) (*Keyring, error) {
+	k := &Keyring{dir: dir, keys: map[uint32][]byte{}}
+
+	key, err := os.ReadFile(legacyPath)
+	switch {
+	case err == nil:
+		if len(key) != masterKeySize {
+			return nil, fmt.Errorf("%s: expected %d bytes, got %d", legacyPath, masterKeySize, len(key))
+		}
+		k.keys[1] = key
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, e := range entries {
+		var version uint32
+		if _, err := fmt.Sscanf(e.Name(), "v%d.key", &version); err != nil || version == 0 {
+			continue
+		}
+		if _, dup := k.keys[version]; dup {
+			return nil, fmt.Errorf("master key version %d defined twice", version)
+		}
+		path := filepath.Join(dir, e.Name())
+		key, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(key) != masterKeySize {
+			return nil, fmt.Errorf("%s: expected %d bytes, got %d", path, masterKeySize, len(key))
+		}
+		k.keys[version] = key
+	}
+
+	for v := range k.keys {
+		if v > k.current {
+			k.current = v
+		}
+	}
+	return k, nil
+}
+
+func (k *Keyring) Empty() bool { return len(k.keys) == 0 }
+
+func (k *Keyring) CurrentVersion() uint32 { return k.current }
+
+func (k *Keyring) Versions() []uint32 {
+	out := make([]uint32, 0, len(k.keys))
+	for v := range k.keys {
+		out = append(out, v)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+func (k *Keyring) Key(version uint32) ([]byte, error) {
+	key, ok := k.keys[version]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrKeyVersionNotFound, version)
+	}
+	return key, nil
+}
+
+// Generate создаёт следующую версию мастер-ключа и делает её текущей.
+// Файл создаётся с O_EXCL, чтобы случайно не перезаписать существующий ключ.
+func (k *Keyring) Generate() (uint32, error) {
+	version := k.current + 1
+	key, err := generateRandomBytes(masterKeySize)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(k.dir, 0700); err != nil {
+		return 0, err
+	}
+	path := filepath.Join(k.dir, fmt.Sprintf("v%d.key", version))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Write(key); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	k.keys[version] = key
+	k.current = version
+	return version, nil
+}
+
+// Envelope — зашифрованные данные вместе с обёрнутым ключом данных.
+type Envelope struct {
+	Ciphertext []byte
+	Nonce      []byte
+	WrappedKey []byte
+	WrapNonce  []byte
+	KeyVersion uint32
+}
+
+// AAD обёртки включает версию мастер-ключа и AAD самой записи:
+// обёрнутый DEK нельзя переставить в другую запись.
+func dataKeyAAD(keyVersion uint32, recordAAD []byte) []byte {
+	aad := []byte("mollysage-dek")
+	aad = binary.BigEndian.AppendUint32(aad, keyVersion)
+	return append(aad, recordAAD...)
+}
+
+func (k *Keyring) WrapDataKey(dek, recordAAD []byte) (wrapped, nonce []byte, version uint32, err error) {
+	master, err := k.Key(k.current)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	wrapped, nonce, err = aesGCMEncrypt(master, dek, dataKeyAAD(k.current, recordAAD))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return wrapped, nonce, k.current, nil
+}
+
+func (k *Keyring) UnwrapDataKey(wrapped, nonce []byte, version uint32, recordAAD []byte) ([]byte, error) {
+	master, err := k.Key(version)
+	if err != nil {
+		return nil, err
+	}
+	return aesGCMDecrypt(master, wrapped, nonce, dataKeyAAD(version, recordAAD))
+}
+
+func (k *Keyring) Seal(plaintext, aad []byte) (*Envelope, error) {
+	dek, err := generateRandomBytes(32)
+	if err != nil {
+		return nil, err
+	}
+	ct, nonce, err := aesGCMEncrypt(dek, plaintext, aad)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, wrapNonce, version, err := k.WrapDataKey(dek, aad)
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{
+		Ciphertext: ct,
+		Nonce:      nonce,
+		WrappedKey: wrapped,
+		WrapNonce:  wrapNonce,
+		KeyVersion: version,
+	}, nil
+}
+
+func (k *Keyring) Open(env *Envelope, aad []byte) ([]byte, error) {
+	dek, err := k.UnwrapDataKey(env.WrappedKey, env.WrapNonce, env.KeyVersion, aad)
+	if err != nil {
+		return nil, err
+	}
+	return aesGCMDecrypt(dek, env.Ciphertext, env.Nonce, aad)
+}
+
+// Rewrap перешифровывает DEK текущим мастер-ключом; Ciphertext не меняется.
+func (k *Keyring) Rewrap(env *Envelope, aad []byte) error {
+	dek, err := k.UnwrapDataKey(env.WrappedKey, env.WrapNonce, env.KeyVersion, aad)
+	if err != nil {
+		return err
+	}
+	wrapped, wrapNonce, version, err := k.WrapDataKey(dek, aad)
+	if err != nil {
+		return err
+	}
+	env.WrappedKey, env.WrapNonce, env.KeyVersion = wrapped, wrapNonce, version
+	return nil
+}
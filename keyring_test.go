@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyringSealOpen(t *testing.T) {
+	k := newTestKeyring(t)
+	aad := textAAD("direct", 1, 4, 5)
+
+	env, err := k.Seal([]byte("secret"), aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.KeyVersion != k.CurrentVersion() {
+		t.Fatalf("sealed under v%d, current is v%d", env.KeyVersion, k.CurrentVersion())
+	}
+	plain, err := k.Open(env, aad)
+	if err != nil || string(plain) != "secret" {
+		t.Fatalf("open: %q, %v", plain, err)
+	}
+}
+
+func TestKeyringTamper(t *testing.T) {
+	k := newTestKeyring(t)
+	aad := textAAD("direct", 1, 4, 5)
+	env, err := k.Seal([]byte("secret"), aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.Generate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// запись с другим id, автором или беседой
+	for name, wrong := range map[string][]byte{
+		"id":    textAAD("direct", 2, 4, 5),
+		"from":  textAAD("direct", 1, 5, 5),
+		"conv":  textAAD("direct", 1, 4, 6),
+		"kind":  textAAD("group", 1, 4, 5),
+		"empty": nil,
+	} {
+		if _, err := k.Open(env, wrong); err == nil {
+			t.Errorf("%s: opened with wrong AAD", name)
+		}
+	}
+
+	// версия ключа входит в AAD обёртки: DEK не откроется другой версией
+	moved := *env
+	moved.KeyVersion = 2
+	if _, err := k.Open(&moved, aad); err == nil {
+		t.Error("opened with another key version")
+	}
+	moved.KeyVersion = 9
+	if _, err := k.Open(&moved, aad); !errors.Is(err, ErrKeyVersionNotFound) {
+		t.Errorf("unknown key version: got %v", err)
+	}
+
+	// DEK одной записи в другой
+	other, err := k.Seal([]byte("other"), textAAD("direct", 2, 4, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	swapped := *env
+	swapped.WrappedKey, swapped.WrapNonce, swapped.KeyVersion = other.WrappedKey, other.WrapNonce, other.KeyVersion
+	if _, err := k.Open(&swapped, aad); err == nil {
+		t.Error("opened with a data key wrapped for another record")
+	}
+}
+
+func TestKeyringRotateRewrap(t *testing.T) {
+	dir := t.TempDir()
+	legacy, keysDir := filepath.Join(dir, "legacy.key"), filepath.Join(dir, "keys")
+	if err := os.WriteFile(legacy, bytes.Repeat([]byte{7}, masterKeySize), 0600); err != nil {
+		t.Fatal(err)
+	}
+	k, err := loadKeyring(legacy, keysDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.CurrentVersion() != 1 {
+		t.Fatalf("legacy key must be v1, current is v%d", k.CurrentVersion())
+	}
+
+	aad := textAAD("group", 3, 4, 10)
+	env, err := k.Seal([]byte("hello"), aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct := append([]byte(nil), env.Ciphertext...)
+
+	if v, err := k.Generate(); err != nil || v != 2 {
+		t.Fatalf("generate: v%d, %v", v, err)
+	}
+	if err := k.Rewrap(env, aad); err != nil {
+		t.Fatal(err)
+	}
+	if env.KeyVersion != 2 || !bytes.Equal(env.Ciphertext, ct) {
+		t.Fatalf("rewrap: key v%d, ciphertext changed: %v", env.KeyVersion, !bytes.Equal(env.Ciphertext, ct))
+	}
+	if err := k.Rewrap(env, textAAD("group", 4, 4, 10)); err == nil {
+		t.Error("rewrap with wrong AAD succeeded")
+	}
+
+	// после ротации старый ключ можно убрать: с диска читается только новый
+	if err := os.Remove(legacy); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := loadKeyring(legacy, keysDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.Versions(); len(got) != 1 || got[0] != 2 {
+		t.Fatalf("versions on disk: %v", got)
+	}
+	plain, err := reloaded.Open(env, aad)
+	if err != nil || string(plain) != "hello" {
+		t.Fatalf("open after rotation: %q, %v", plain, err)
+	}
+}
+
+func TestLoadKeyringRejectsBadKeys(t *testing.T) {
+	dir := t.TempDir()
+	legacy := filepath.Join(dir, "legacy.key")
+	if err := os.WriteFile(legacy, []byte("short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadKeyring(legacy, filepath.Join(dir, "keys")); err == nil {
+		t.Error("short legacy key accepted")
+	}
+
+	keysDir := filepath.Join(dir, "keys2")
+	if err := os.MkdirAll(keysDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(keysDir, "v1.key"), []byte("short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadKeyring(filepath.Join(dir, "none"), keysDir); err == nil {
+		t.Error("short versioned key accepted")
+	}
+}
+
+// legacyMedia — запись старого формата version: v1 без AAD, v2 с AAD, обе
+// напрямую ключом v1; v3 — envelope целиком в одном блобе.
+func legacyMedia(t *testing.T, k *Keyring, blobs BlobStore, version int, plain []byte) *PlainMedia {
+	t.Helper()
+	m := &PlainMedia{ID: 42, Kind: "direct", FromUserID: 4, ContentType: "image/png", EncVersion: version}
+	aad := mediaAAD(version, m.ID, m.Kind, m.FromUserID, m.ContentType)
+
+	var ct []byte
+	if version >= mediaEncVersionEnvelope {
+		env, err := k.Seal(plain, aad)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ct, m.Nonce = env.Ciphertext, env.Nonce
+		m.DEKWrapped, m.DEKNonce, m.KeyVersion = env.WrappedKey, env.WrapNonce, env.KeyVersion
+	} else {
+		key, err := k.Key(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct, m.Nonce, err = aesGCMEncrypt(key, plain, aad); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.BlobKey, m.BlobSize = putTestBlob(t, blobs, ct)
+	return m
+}
+
+func putTestBlob(t *testing.T, blobs BlobStore, data []byte) (string, int64) {
+	t.Helper()
+	key, size, err := putBlob(blobs, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, size
+}
+
+func TestMediaReadPaths(t *testing.T) {
+	k := newTestKeyring(t)
+	blobs := newTestBlobs(t)
+	plain := bytes.Repeat([]byte("0123456789"), 20000) // больше одного сегмента
+
+	segmented := &PlainMedia{ID: 42, Kind: "direct", FromUserID: 4, ContentType: "image/png"}
+	if _, err := sealMediaWith(k, blobs, segmented, bytes.NewReader(plain)); err != nil {
+		t.Fatal(err)
+	}
+	records := map[int]*PlainMedia{
+		mediaEncVersionLegacy:    legacyMedia(t, k, blobs, mediaEncVersionLegacy, plain),
+		mediaEncVersionAAD:       legacyMedia(t, k, blobs, mediaEncVersionAAD, plain),
+		mediaEncVersionEnvelope:  legacyMedia(t, k, blobs, mediaEncVersionEnvelope, plain),
+		mediaEncVersionSegmented: segmented,
+	}
+
+	for version, m := range records {
+		got, err := openMediaWith(k, blobs, m)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("v%d: read %d bytes, %v", version, len(got), err)
+		}
+
+		// у версий с AAD запись с другим id не читается
+		moved := *m
+		moved.ID++
+		_, err = openMediaWith(k, blobs, &moved)
+		if version == mediaEncVersionLegacy {
+			if err != nil {
+				t.Errorf("v1 has no AAD and must still read: %v", err)
+			}
+		} else if err == nil {
+			t.Errorf("v%d: read with another media id", version)
+		}
+	}
+}
+
+func TestRewrapAllMedia(t *testing.T) {
+	db := newTestDB(t)
+	store := NewPlainMediaStore(db)
+	blobs := newTestBlobs(t)
+	dir := t.TempDir()
+	legacyKey := filepath.Join(dir, "legacy.key")
+	if err := os.WriteFile(legacyKey, bytes.Repeat([]byte{3}, masterKeySize), 0600); err != nil {
+		t.Fatal(err)
+	}
+	k, err := loadKeyring(legacyKey, filepath.Join(dir, "keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain := []byte("image bytes")
+	create := func(publicID string) *PlainMedia {
+		m, err := store.Create(&PlainMedia{
+			PublicID: publicID, Kind: "direct", FromUserID: 4, ToUserID: sql.NullInt64{Int64: 5, Valid: true},
+			ContentType: "image/png", Size: int64(len(plain)),
+		}, nil, func(m *PlainMedia) error {
+			_, err := sealMediaWith(k, blobs, m, bytes.NewReader(plain))
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	current := create("00000000000000000000000000000001")
+
+	// вторая запись — в старом формате v2 (напрямую ключом v1, без DEK)
+	old := create("00000000000000000000000000000002")
+	aad := mediaAAD(mediaEncVersionAAD, old.ID, old.Kind, old.FromUserID, old.ContentType)
+	ct, nonce, err := aesGCMEncrypt(bytes.Repeat([]byte{3}, masterKeySize), plain, aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.EncVersion, old.Nonce, old.DEKWrapped, old.DEKNonce, old.KeyVersion = mediaEncVersionAAD, nonce, nil, nil, 0
+	old.BlobKey, old.BlobSize = putTestBlob(t, blobs, ct)
+	if err := store.UpdateCrypto(old); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := k.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	rewrapped, converted, err := rewrapAllMedia(store, k, blobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewrapped != 1 || converted != 1 {
+		t.Fatalf("rewrapped %d, converted %d; want 1 and 1", rewrapped, converted)
+	}
+
+	for _, id := range []int64{current.ID, old.ID} {
+		m, err := store.GetByID(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.KeyVersion != 2 || m.EncVersion != mediaEncVersionSegmented {
+			t.Errorf("media %d: key v%d, enc v%d after rewrap", id, m.KeyVersion, m.EncVersion)
+		}
+		got, err := openMediaWith(k, blobs, m)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("media %d after rewrap: %q, %v", id, got, err)
+		}
+	}
+}
+
+// Без ключа на непустой базе новый ключ не создаётся: иначе всё зашифрованное
+// раньше молча становится нечитаемым.
+func TestOpenServerKeyringRefusesLostKey(t *testing.T) {
+	fresh := func(t *testing.T) (string, string) {
+		dir := t.TempDir()
+		return filepath.Join(dir, "legacy.key"), filepath.Join(dir, "keys")
+	}
+
+	t.Run("empty database", func(t *testing.T) {
+		legacy, dir := fresh(t)
+		k, err := openServerKeyring(newTestDB(t), legacy, dir)
+		if err != nil || k.CurrentVersion() != 1 {
+			t.Fatalf("got %v, %v", k, err)
+		}
+	})
+
+	for name, insert := range map[string]string{
+		"message texts": `INSERT INTO plain_messages (from_user_id, to_user_id, text, text_ct) VALUES (4, 5, '', x'01')`,
+		"group texts":   `INSERT INTO group_messages (group_id, from_user_id, text, text_ct) VALUES (1, 4, '', x'01')`,
+		"scheduled texts": `INSERT INTO scheduled_messages (kind, from_user_id, conv_id, send_at, text_ct)
+			VALUES ('direct', 4, 5, '2030-01-01T00:00:00Z', x'01')`,
+		"pending upload keys": `INSERT INTO media_uploads (id, kind, from_user_id, original_name, content_type, size, key_wrapped, key_nonce, key_version)
+			VALUES ('u1', 'direct', 4, 'a.bin', 'application/octet-stream', 1, x'01', x'01', 1)`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			db := newTestDB(t)
+			if _, err := db.Exec(insert); err != nil {
+				t.Fatal(err)
+			}
+			legacy, dir := fresh(t)
+			if _, err := openServerKeyring(db, legacy, dir); err == nil {
+				t.Fatal("generated a new master key over existing encrypted data")
+			}
+			if _, err := os.Stat(dir); !os.IsNotExist(err) {
+				t.Fatalf("key directory was created: %v", err)
+			}
+		})
+	}
+}
+
+func TestIndexKeyRefusesLostKey(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := db.Exec(`INSERT INTO message_search_index (kind, message_id, token) VALUES ('direct', 1, x'01')`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadOrCreateIndexKey(db, t.TempDir()); err == nil {
+		t.Fatal("generated a new index key over an existing search index")
+	}
+}
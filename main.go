@@ -2,8 +2,12 @@ package main
 
 import (
 	"database/sql"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -28,7 +32,14 @@ CREATE TABLE IF NOT EXISTS users (
     enc_private_key BLOB NOT NULL,
     enc_private_key_nonce BLOB NOT NULL,
 
-    last_seen DATETIME
+    sign_public_key BLOB,
+    enc_sign_private_key BLOB,
+    enc_sign_private_key_nonce BLOB,
+
+    last_seen DATETIME,              -- пишется из памяти раз в presenceFlushInterval (presence.go)
+    status TEXT NOT NULL DEFAULT 'online', -- online | away | busy | invisible
+    status_text TEXT NOT NULL DEFAULT '',
+    media_quota INTEGER              -- байты; NULL — -media-quota (media_quota.go)
 );
 
 CREATE TABLE IF NOT EXISTS messages (
@@ -37,33 +48,126 @@ CREATE TABLE IF NOT EXISTS messages (
     to_user_id   INTEGER NOT NULL,
     ciphertext   BLOB NOT NULL,
     nonce        BLOB NOT NULL,
+    client_msg_id TEXT,
+    signature    BLOB,
+    version      INTEGER NOT NULL DEFAULT 1,
     created_at   TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
+-- text пустой: сам текст зашифрован в text_ct (envelope, см. message_crypto.go)
 CREATE TABLE IF NOT EXISTS plain_messages (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     from_user_id INTEGER NOT NULL,
     to_user_id   INTEGER NOT NULL,
     text         TEXT NOT NULL,
+    reply_to     INTEGER,          -- ответ на сообщение этой же беседы (replies.go)
+    forwarded_from      INTEGER,   -- автор пересланного оригинала (forward.go)
+    forwarded_from_name TEXT,
+    text_ct      BLOB,
+    text_nonce   BLOB,
+    dek_wrapped  BLOB,
+    dek_nonce    BLOB,
+    key_version  INTEGER NOT NULL DEFAULT 0,
     created_at   TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
 CREATE TABLE IF NOT EXISTS plain_media (
   id INTEGER PRIMARY KEY AUTOINCREMENT,
+  public_id TEXT,                  -- случайный id для вложений, см. media.go
 
   kind TEXT NOT NULL,              -- "direct" | "group"
   from_user_id INTEGER NOT NULL,
   to_user_id INTEGER,              -- для личных
   group_id INTEGER,                -- для групп
 
-  ciphertext BLOB NOT NULL,
+  ciphertext BLOB NOT NULL,        -- пустой: шифртекст в BlobStore под blob_key (старые записи переносятся при старте)
+  blob_key TEXT,
+  blob_size INTEGER NOT NULL DEFAULT 0,
   nonce BLOB NOT NULL,
+  enc_version INTEGER NOT NULL DEFAULT 1,
+  dek_wrapped BLOB,                -- envelope: ключ данных, обёрнутый мастер-ключом
+  dek_nonce BLOB,
+  key_version INTEGER NOT NULL DEFAULT 0,
 
   content_type TEXT NOT NULL,
   original_name TEXT NOT NULL,
+  numeric_markers INTEGER NOT NULL DEFAULT 1, -- 1 — в старых текстах могут быть маркеры с порядковым id (message_attachments.go)
+  size INTEGER NOT NULL DEFAULT 0, -- размер открытого файла
+  width INTEGER NOT NULL DEFAULT 0,
+  height INTEGER NOT NULL DEFAULT 0,
+  thumb_blob_key TEXT,             -- миниатюра, тем же DEK (media.go)
+  thumb_blob_size INTEGER NOT NULL DEFAULT 0,
+  thumb_nonce BLOB,
+  thumb_content_type TEXT NOT NULL DEFAULT '',
+  content_hash BLOB,               -- HMAC(беседа, sha256 файла) для дедупликации (media_gc.go)
+  refs_tracked INTEGER NOT NULL DEFAULT 0, -- 1 — ссылки из сообщений посчитаны, можно собирать GC
+  touched_at TEXT,                 -- последний раз выдано дедупликацией
+  duration_ms INTEGER NOT NULL DEFAULT 0, -- аудио: длительность и волна (media_audio.go)
+  waveform BLOB,
+  created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now'))
+);
+
+-- вложения сообщений (message_attachments.go); медиа без вложений удаляет GC (media_gc.go)
+CREATE TABLE IF NOT EXISTS message_attachments (
+  message_kind TEXT NOT NULL,      -- "direct" | "group"
+  message_id INTEGER NOT NULL,
+  position INTEGER NOT NULL,       -- порядок вложений в сообщении
+  media_id INTEGER NOT NULL,
+  PRIMARY KEY (message_kind, message_id, position)
+);
+CREATE INDEX IF NOT EXISTS idx_message_attachments_media ON message_attachments (media_id);
+
+-- реакции на сообщения (reactions.go): у пользователя одна реакция каждым эмодзи
+CREATE TABLE IF NOT EXISTS reactions (
+  message_kind TEXT NOT NULL,      -- "direct" | "group"
+  message_id INTEGER NOT NULL,
+  user_id INTEGER NOT NULL,
+  emoji TEXT NOT NULL,
+  created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now')),
+  PRIMARY KEY (message_kind, message_id, user_id, emoji)
+);
+
+-- у каких сообщений менялись реакции: по id /sync отдаёт их заново (sync.go)
+CREATE TABLE IF NOT EXISTS reaction_log (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  message_kind TEXT NOT NULL,
+  message_id INTEGER NOT NULL,
+  created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now'))
+);
+
+-- вложения CLI: сервер хранит только непрозрачный шифртекст,
+-- ключ и хэш лежат внутри E2E-сообщения
+CREATE TABLE IF NOT EXISTS e2e_media (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  from_user_id INTEGER NOT NULL,
+  to_user_id INTEGER NOT NULL,
+  blob BLOB NOT NULL,              -- пустой: шифртекст в BlobStore под blob_key (старые записи переносятся при старте)
+  blob_key TEXT,
+  size INTEGER NOT NULL,
   created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now'))
 );
 
+-- незавершённые загрузки по частям (media_upload.go). Части лежат во временном
+-- файле, зашифрованные ключом загрузки (обёрнут мастер-ключом, как DEK).
+CREATE TABLE IF NOT EXISTS media_uploads (
+  id TEXT PRIMARY KEY,             -- случайный, он же пропуск к загрузке
+  kind TEXT NOT NULL,
+  from_user_id INTEGER NOT NULL,
+  to_user_id INTEGER,
+  group_id INTEGER,
+  original_name TEXT NOT NULL,
+  content_type TEXT NOT NULL,
+  size INTEGER NOT NULL,           -- заявленный размер файла
+  received INTEGER NOT NULL DEFAULT 0,   -- сколько байт файла принято
+  staged_len INTEGER NOT NULL DEFAULT 0, -- длина временного файла после последней принятой части
+  key_wrapped BLOB NOT NULL,
+  key_nonce BLOB NOT NULL,
+  key_version INTEGER NOT NULL,
+  media_public_id TEXT,            -- после finalize: что получилось (повторный finalize вернёт то же)
+  created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now')),
+  updated_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now'))
+);
+
 CREATE TABLE IF NOT EXISTS groups (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     name TEXT NOT NULL,
@@ -74,31 +178,397 @@ CREATE TABLE IF NOT EXISTS groups (
 CREATE TABLE IF NOT EXISTS group_members (
     group_id INTEGER NOT NULL,
     user_id  INTEGER NOT NULL,
+    role TEXT NOT NULL DEFAULT 'member', -- member | admin; владелец — groups.owner_user_id
     PRIMARY KEY (group_id, user_id)
 );
 
+-- кого и когда добавили в беседу: по id /sync отдаёт изменения состава (sync.go)
+CREATE TABLE IF NOT EXISTS group_member_log (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    group_id INTEGER NOT NULL,
+    user_id  INTEGER NOT NULL,
+    created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now'))
+);
+
 CREATE TABLE IF NOT EXISTS group_messages (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     group_id INTEGER NOT NULL,
     from_user_id INTEGER NOT NULL,
     text TEXT NOT NULL,
+    reply_to INTEGER,
+    forwarded_from INTEGER,
+    forwarded_from_name TEXT,
+    mention_all INTEGER NOT NULL DEFAULT 0,
+    text_ct BLOB,
+    text_nonce BLOB,
+    dek_wrapped BLOB,
+    dek_nonce BLOB,
+    key_version INTEGER NOT NULL DEFAULT 0,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
+
+-- слепой индекс для поиска: HMAC слов сообщения (kind = direct | group)
+CREATE TABLE IF NOT EXISTS message_search_index (
+    kind TEXT NOT NULL,
+    message_id INTEGER NOT NULL,
+    token BLOB NOT NULL,
+    PRIMARY KEY (kind, message_id, token)
+);
+CREATE INDEX IF NOT EXISTS idx_message_search_token ON message_search_index (kind, token);
+
+-- упоминания в беседах (mentions.go): via_all — через @all, read — видел ли упомянутый
+CREATE TABLE IF NOT EXISTS mentions (
+    message_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    group_id INTEGER NOT NULL,
+    via_all INTEGER NOT NULL DEFAULT 0,
+    read INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (message_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS idx_mentions_user ON mentions (user_id, read, message_id);
+
+-- опросы в беседах (polls.go): вопрос и варианты — в тексте сообщения (шифруются
+-- как текст), здесь число вариантов, настройки и голоса; poll_log — для /sync
+CREATE TABLE IF NOT EXISTS polls (
+    message_id INTEGER PRIMARY KEY,
+    group_id INTEGER NOT NULL,
+    options INTEGER NOT NULL,
+    multiple INTEGER NOT NULL DEFAULT 0,
+    anonymous INTEGER NOT NULL DEFAULT 0,
+    closes_at TEXT,
+    closed_at TEXT
+);
+CREATE TABLE IF NOT EXISTS poll_votes (
+    message_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    option INTEGER NOT NULL,
+    created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now')),
+    PRIMARY KEY (message_id, user_id, option)
+);
+CREATE TABLE IF NOT EXISTS poll_log (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    message_id INTEGER NOT NULL,
+    created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now'))
+);
+
+-- закреплённые сообщения (pins.go); scope — conversationScope беседы, position — порядок
+CREATE TABLE IF NOT EXISTS pinned_messages (
+    message_kind TEXT NOT NULL,
+    message_id INTEGER NOT NULL,
+    scope TEXT NOT NULL,
+    position INTEGER NOT NULL,
+    pinned_by INTEGER NOT NULL,
+    pinned_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now')),
+    PRIMARY KEY (message_kind, message_id)
+);
+CREATE INDEX IF NOT EXISTS idx_pinned_messages_scope ON pinned_messages (scope, position);
+
+-- отложенные сообщения (scheduled.go): текст шифруется как у сообщений,
+-- вложения — в message_attachments с message_kind = 'scheduled'
+CREATE TABLE IF NOT EXISTS scheduled_messages (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    kind TEXT NOT NULL,              -- direct | group
+    from_user_id INTEGER NOT NULL,
+    conv_id INTEGER NOT NULL,        -- to_user_id | group_id
+    text TEXT NOT NULL DEFAULT '',
+    reply_to INTEGER,
+    send_at TEXT NOT NULL,           -- UTC, RFC3339
+    status TEXT NOT NULL DEFAULT 'pending', -- pending | sending | sent | failed | canceled
+    message_id INTEGER,
+    error TEXT,
+    text_ct BLOB,
+    text_nonce BLOB,
+    dek_wrapped BLOB,
+    dek_nonce BLOB,
+    key_version INTEGER NOT NULL DEFAULT 0,
+    created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now'))
+);
+CREATE INDEX IF NOT EXISTS idx_scheduled_messages_due ON scheduled_messages (status, send_at);
+CREATE INDEX IF NOT EXISTS idx_scheduled_messages_user ON scheduled_messages (from_user_id, status);
 `
 	if _, err := db.Exec(schema); err != nil {
 		return nil, err
 	}
 
+	if err := migrateDB(db); err != nil {
+		return nil, err
+	}
+
 	return db, nil
 }
 
+// CREATE TABLE IF NOT EXISTS не трогает уже существующие таблицы,
+// поэтому новые колонки для старых баз добавляем здесь.
+func migrateDB(db *sql.DB) error {
+	columns := []struct{ table, column, decl string }{
+		{"users", "sign_public_key", "BLOB"},
+		{"users", "enc_sign_private_key", "BLOB"},
+		{"users", "enc_sign_private_key_nonce", "BLOB"},
+		{"users", "media_quota", "INTEGER"},
+		{"users", "status", "TEXT NOT NULL DEFAULT 'online'"},
+		{"users", "status_text", "TEXT NOT NULL DEFAULT ''"},
+		{"group_members", "role", "TEXT NOT NULL DEFAULT 'member'"},
+		{"group_messages", "mention_all", "INTEGER NOT NULL DEFAULT 0"},
+		{"messages", "client_msg_id", "TEXT"},
+		{"messages", "signature", "BLOB"},
+		{"messages", "version", "INTEGER NOT NULL DEFAULT 1"},
+		{"plain_media", "enc_version", "INTEGER NOT NULL DEFAULT 1"},
+		{"plain_media", "dek_wrapped", "BLOB"},
+		{"plain_media", "dek_nonce", "BLOB"},
+		{"plain_media", "key_version", "INTEGER NOT NULL DEFAULT 0"},
+		{"plain_media", "public_id", "TEXT"},
+		{"plain_media", "numeric_markers", "INTEGER NOT NULL DEFAULT 1"},
+		{"plain_media", "size", "INTEGER NOT NULL DEFAULT 0"},
+		{"plain_media", "blob_key", "TEXT"},
+		{"plain_media", "blob_size", "INTEGER NOT NULL DEFAULT 0"},
+		{"plain_media", "width", "INTEGER NOT NULL DEFAULT 0"},
+		{"plain_media", "height", "INTEGER NOT NULL DEFAULT 0"},
+		{"plain_media", "thumb_blob_key", "TEXT"},
+		{"plain_media", "thumb_blob_size", "INTEGER NOT NULL DEFAULT 0"},
+		{"plain_media", "thumb_nonce", "BLOB"},
+		{"plain_media", "thumb_content_type", "TEXT NOT NULL DEFAULT ''"},
+		{"plain_media", "content_hash", "BLOB"},
+		{"plain_media", "refs_tracked", "INTEGER NOT NULL DEFAULT 0"},
+		{"plain_media", "touched_at", "TEXT"},
+		{"plain_media", "duration_ms", "INTEGER NOT NULL DEFAULT 0"},
+		{"plain_media", "waveform", "BLOB"},
+		{"e2e_media", "blob_key", "TEXT"},
+	}
+	for _, table := range []string{"plain_messages", "group_messages"} {
+		columns = append(columns,
+			struct{ table, column, decl string }{table, "text_ct", "BLOB"},
+			struct{ table, column, decl string }{table, "text_nonce", "BLOB"},
+			struct{ table, column, decl string }{table, "dek_wrapped", "BLOB"},
+			struct{ table, column, decl string }{table, "dek_nonce", "BLOB"},
+			struct{ table, column, decl string }{table, "key_version", "INTEGER NOT NULL DEFAULT 0"},
+			struct{ table, column, decl string }{table, "reply_to", "INTEGER"},
+			struct{ table, column, decl string }{table, "forwarded_from", "INTEGER"},
+			struct{ table, column, decl string }{table, "forwarded_from_name", "TEXT"},
+		)
+	}
+	for _, c := range columns {
+		if err := ensureColumn(db, c.table, c.column, c.decl); err != nil {
+			return err
+		}
+	}
+
+	// старым медиа — случайные публичные id (randomblob в sqlite — криптостойкий ГПСЧ)
+	if _, err := db.Exec(`UPDATE plain_media SET public_id = lower(hex(randomblob(16))) WHERE public_id IS NULL`); err != nil {
+		return err
+	}
+	// размер старых записей: шифртекст AES-GCM длиннее открытого текста на 16 байт тега
+	if _, err := db.Exec(`UPDATE plain_media SET size = length(ciphertext) - 16 WHERE size = 0 AND length(ciphertext) > 16`); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_plain_media_public_id ON plain_media (public_id)`); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_plain_media_content_hash ON plain_media (content_hash)`); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_plain_media_from_user ON plain_media (from_user_id)`); err != nil {
+		return err
+	}
+	for _, table := range []string{"plain_messages", "group_messages"} {
+		if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_` + table + `_reply_to ON ` + table + ` (reply_to)`); err != nil {
+			return err
+		}
+	}
+	// @all раньше было видно только по строкам mentions с via_all = 1
+	if _, err := db.Exec(
+		`UPDATE group_messages SET mention_all = 1
+		 WHERE mention_all = 0 AND id IN (SELECT message_id FROM mentions WHERE via_all = 1)`,
+	); err != nil {
+		return err
+	}
+	return migrateMediaRefs(db)
+}
+
+// migrateMediaRefs: media_refs (ссылки маркерами из текста) заменила message_attachments.
+// Переносим только ссылки на медиа из той же беседы — остальные маркеры были просто текстом.
+func migrateMediaRefs(db *sql.DB) error {
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'media_refs'`).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		INSERT OR IGNORE INTO message_attachments (message_kind, message_id, position, media_id)
+		SELECT r.message_kind, r.message_id,
+		       ROW_NUMBER() OVER (PARTITION BY r.message_kind, r.message_id ORDER BY r.media_id) - 1,
+		       r.media_id
+		FROM media_refs r
+		JOIN plain_media m ON m.id = r.media_id
+		LEFT JOIN plain_messages pm ON r.message_kind = 'direct' AND pm.id = r.message_id
+		LEFT JOIN group_messages gm ON r.message_kind = 'group' AND gm.id = r.message_id
+		WHERE (m.kind = 'direct' AND pm.id IS NOT NULL
+		       AND ((m.from_user_id = pm.from_user_id AND m.to_user_id = pm.to_user_id)
+		         OR (m.from_user_id = pm.to_user_id AND m.to_user_id = pm.from_user_id)))
+		   OR (m.kind = 'group' AND gm.id IS NOT NULL AND m.group_id = gm.group_id)`,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DROP TABLE media_refs`); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func ensureColumn(db *sql.DB, table, column, decl string) error {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + decl)
+	return err
+}
+
 func main() {
+	rotateMediaKey := flag.Bool("rotate-media-key", false, "create a new master key version, re-wrap all media and message keys under it and exit (run with the server stopped)")
+	rewrapMedia := flag.Bool("rewrap-media", false, "re-wrap all media and message keys under the current master key and exit (run with the server stopped)")
+	mediaAllow := flag.String("media-allow", defaultMediaAllow, "comma-separated MIME patterns allowed for uploads (image/*, application/pdf, *)")
+	mediaDeny := flag.String("media-deny", defaultMediaDeny, "comma-separated MIME patterns rejected for uploads; deny wins over allow")
+	mediaLimits := flag.String("media-limits", defaultMediaLimits, "per-type upload size limits in MiB, first match wins (image/*=20,*=50)")
+	mediaQuota := flag.Int64("media-quota", defaultMediaQuotaMiB, "default per-user media storage quota in MiB (0 = unlimited); admins can override it per user")
+	admins := flag.String("admins", "", "comma-separated usernames allowed to use /admin/* endpoints")
+	mediaGCGrace := flag.Duration("media-gc-grace", defaultMediaGCGrace, "delete media not referenced by any message after this long (0 disables media GC)")
+	blobBackend := flag.String("blob-store", "local", "where media ciphertexts are stored: local or s3")
+	blobDir := flag.String("blob-dir", "media_blobs", "directory for -blob-store=local")
+	s3Endpoint := flag.String("s3-endpoint", "", "S3-compatible endpoint for -blob-store=s3, e.g. http://localhost:9000 (credentials: AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY)")
+	s3Region := flag.String("s3-region", "us-east-1", "S3 region")
+	s3Bucket := flag.String("s3-bucket", "", "S3 bucket")
+	s3Prefix := flag.String("s3-prefix", "media", "key prefix inside the S3 bucket")
+	flag.Parse()
+
+	mediaPolicy, err := parseMediaPolicy(*mediaAllow, *mediaDeny, *mediaLimits)
+	if err != nil {
+		log.Fatalf("bad media policy: %v", err)
+	}
+
 	db, err := initDB("secure_chat.db")
 	if err != nil {
 		log.Fatalf("failed to init db: %v", err)
 	}
 
-	s := NewServer(db)
+	keyring, err := openServerKeyring(db, legacyMediaKeyPath, serverKeysDir)
+	if err != nil {
+		log.Fatalf("failed to load master keys: %v", err)
+	}
+
+	var blobs BlobStore
+	switch *blobBackend {
+	case "local":
+		blobs, err = NewLocalBlobStore(*blobDir)
+	case "s3":
+		blobs, err = NewS3BlobStore(S3Config{
+			Endpoint:  *s3Endpoint,
+			Region:    *s3Region,
+			Bucket:    *s3Bucket,
+			Prefix:    *s3Prefix,
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		})
+	default:
+		err = fmt.Errorf("unknown -blob-store %q", *blobBackend)
+	}
+	if err != nil {
+		log.Fatalf("failed to open blob store: %v", err)
+	}
+
+	// шифртексты, лежавшие прямо в plain_media, переносим в хранилище
+	if n, err := moveInlineMediaToBlobs(NewPlainMediaStore(db), blobs); err != nil {
+		log.Fatalf("failed to move media to blob store after %d rows: %v", n, err)
+	} else if n > 0 {
+		log.Printf("moved %d media ciphertexts from the database to the blob store", n)
+	}
+	if n, err := moveInlineE2EMediaToBlobs(NewE2EMediaStore(db), blobs); err != nil {
+		log.Fatalf("failed to move e2e media to blob store after %d rows: %v", n, err)
+	} else if n > 0 {
+		log.Printf("moved %d e2e media blobs from the database to the blob store", n)
+	}
+
+	indexKey, err := loadOrCreateIndexKey(db, serverKeysDir)
+	if err != nil {
+		log.Fatalf("failed to load search index key: %v", err)
+	}
+	sealer := NewTextSealer(keyring, indexKey)
+
+	// тексты, записанные до шифрования, шифруем при старте
+	for _, t := range []textTable{plainMessagesTable, groupMessagesTable} {
+		n, err := encryptLegacyTexts(db, sealer, t)
+		if err != nil {
+			log.Fatalf("failed to encrypt %s: %v", t.name, err)
+		}
+		if n > 0 {
+			log.Printf("encrypted %d legacy rows in %s", n, t.name)
+		}
+	}
+
+	// маркеры [[img:id]] в уже отправленных сообщениях — во вложения (один раз после обновления)
+	if n, err := backfillLegacyAttachments(db, sealer); err != nil {
+		log.Fatalf("failed to backfill message attachments: %v", err)
+	} else if n > 0 {
+		log.Printf("converted media markers to attachments in %d existing messages", n)
+	}
+
+	if *rotateMediaKey || *rewrapMedia {
+		if *rotateMediaKey {
+			version, err := keyring.Generate()
+			if err != nil {
+				log.Fatalf("failed to create master key: %v", err)
+			}
+			log.Printf("created master key v%d", version)
+		}
+		rewrapped, converted, err := rewrapAllMedia(NewPlainMediaStore(db), keyring, blobs)
+		if err != nil {
+			log.Fatalf("rewrap failed after %d re-wrapped, %d converted: %v", rewrapped, converted, err)
+		}
+		log.Printf("media now under master key v%d: %d re-wrapped, %d converted from legacy format", keyring.CurrentVersion(), rewrapped, converted)
+		for _, t := range sealedTextTables {
+			n, err := rewrapTexts(db, keyring, t)
+			if err != nil {
+				log.Fatalf("rewrap %s failed after %d rows: %v", t.name, n, err)
+			}
+			log.Printf("%s: %d re-wrapped", t.name, n)
+		}
+		log.Printf("master key versions on disk: %v (old versions can be removed once nothing references them)", keyring.Versions())
+		return
+	}
+
+	s := NewServer(db, keyring, sealer, mediaPolicy, blobs)
+	s.defaultMediaQuota = *mediaQuota << 20
+	s.admins = parseAdmins(*admins)
+	go s.runUploadJanitor(time.Hour)
+	go s.runPresenceFlush(presenceFlushInterval)
+	go s.runScheduler(scheduledInterval)
+	if *mediaGCGrace > 0 {
+		go s.runMediaGC(time.Hour, *mediaGCGrace)
+	}
 
 	// JSON API
 	http.HandleFunc("/register", s.handleRegister)
@@ -110,19 +580,53 @@ func main() {
 	http.HandleFunc("/chat/send", s.handleChatSend)
 	http.HandleFunc("/chat/messages", s.handleChatMessages)
 	http.HandleFunc("/chat/inbox", s.handleChatInbox)
+	http.HandleFunc("/chat/search", s.handleChatSearch)
+	http.HandleFunc("/chat/thread", s.handleChatThread)
+	http.HandleFunc("/sync", s.handleSync)
+	http.HandleFunc("/messages/forward", s.handleForward)
+	http.HandleFunc("/polls/create", s.handlePollCreate)
+	http.HandleFunc("/polls/vote", s.handlePollVote)
+	http.HandleFunc("/polls/close", s.handlePollClose)
+	http.HandleFunc("/scheduled/create", s.handleScheduledCreate)
+	http.HandleFunc("/scheduled/list", s.handleScheduledList)
+	http.HandleFunc("/scheduled/cancel", s.handleScheduledCancel)
+	http.HandleFunc("/mentions", s.handleMentions)
+	http.HandleFunc("/mentions/unread", s.handleMentionsUnread)
+	http.HandleFunc("/mentions/read", s.handleMentionsRead)
+	http.HandleFunc("/reactions/add", s.handleReactionAdd)
+	http.HandleFunc("/reactions/remove", s.handleReactionRemove)
+	http.HandleFunc("/pins/pin", s.handlePin)
+	http.HandleFunc("/pins/unpin", s.handleUnpin)
+	http.HandleFunc("/pins/list", s.handlePinsList)
 
 	http.HandleFunc("/groups/create", s.handleCreateGroup)
 	http.HandleFunc("/groups/add_member", s.handleAddGroupMember)
 	http.HandleFunc("/groups/send", s.handleGroupSend)
 	http.HandleFunc("/groups/messages", s.handleGroupMessages)
+	http.HandleFunc("/groups/thread", s.handleGroupThread)
 	http.HandleFunc("/groups/by_user", s.handleGroupsByUser)
+	http.HandleFunc("/groups/set_role", s.handleGroupSetRole)
 
 	http.HandleFunc("/api/plain_media/upload", s.handlePlainMediaUpload)
 	http.HandleFunc("/api/plain_media/get", s.handlePlainMediaGet)
+	http.HandleFunc("/api/plain_media/info", s.handlePlainMediaInfo)
+	http.HandleFunc("/api/plain_media/upload/create", s.handleUploadCreate)
+	http.HandleFunc("/api/plain_media/upload/status", s.handleUploadStatus)
+	http.HandleFunc("/api/plain_media/upload/chunk", s.handleUploadChunk)
+	http.HandleFunc("/api/plain_media/upload/finalize", s.handleUploadFinalize)
+
+	http.HandleFunc("/api/e2e_media/upload", s.handleE2EMediaUpload)
+	http.HandleFunc("/api/e2e_media/get", s.handleE2EMediaGet)
 
 	// Presence (БЕЗ srv)
+	http.HandleFunc("/account/usage", s.handleAccountUsage)
+	http.HandleFunc("/admin/media_quota", s.handleAdminMediaQuota)
+
+	http.HandleFunc("/typing", s.handleTyping)
 	http.HandleFunc("/presence/ping", s.handlePresencePing)
 	http.HandleFunc("/presence/online", s.handlePresenceOnline)
+	http.HandleFunc("/presence/contacts", s.handlePresenceContacts)
+	http.HandleFunc("/presence/status", s.handlePresenceStatus)
 
 	// Статика
 	fs := http.FileServer(http.Dir("static"))
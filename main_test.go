@@ -0,0 +1,87 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Общие заготовки тестов: база во временном каталоге и свой набор ключей.
+
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := initDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// newTestKeyring — пустой каталог ключей и одна сгенерированная версия.
+func newTestKeyring(t *testing.T) *Keyring {
+	t.Helper()
+	dir := t.TempDir()
+	k, err := loadKeyring(filepath.Join(dir, "legacy.key"), filepath.Join(dir, "keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func newTestBlobs(t *testing.T) *LocalBlobStore {
+	t.Helper()
+	blobs, err := NewLocalBlobStore(filepath.Join(t.TempDir(), "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blobs
+}
+
+// newTestServer — сервер на тестовой базе с политикой медиа по умолчанию.
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	db := newTestDB(t)
+	policy, err := parseMediaPolicy(defaultMediaAllow, defaultMediaDeny, defaultMediaLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealer := NewTextSealer(newTestKeyring(t), make([]byte, 32))
+	return NewServer(db, sealer.keyring, sealer, policy, newTestBlobs(t))
+}
+
+// newTestUser — пользователь с ключами-заглушками: хендлерам, которые тут
+// проверяются, настоящие не нужны.
+func newTestUser(t *testing.T, s *Server, name string) int64 {
+	t.Helper()
+	u, err := s.users.CreateUser(&User{
+		Username:           name,
+		PasswordSalt:       []byte("salt"),
+		PasswordHash:       []byte(fmt.Sprintf("hash-%s", name)),
+		PublicKey:          []byte("pk"),
+		EncPrivateKey:      []byte("sk"),
+		EncPrivateKeyNonce: []byte("nonce"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.ID
+}
+
+// chdirTemp — временные файлы загрузок лежат относительно рабочего каталога.
+func chdirTemp(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// ===== Доступ к plain_media =====
+
+const mediaPublicIDLen = 32 // hex от 16 байт
+
+// newMediaPublicID — 128 бит случайности: id вложений нельзя перебрать.
+func newMediaPublicID() (string, error) {
+	b, err := generateRandomBytes(16)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// canAccessMedia: отправитель, получатель личного сообщения или участник беседы,
+// куда медиа загружено, — или любой, кто видит сообщение с этим вложением
+// (пересланное в другую беседу).
+func (s *Server) canAccessMedia(m *PlainMedia, userID int64) (bool, error) {
+	if userID <= 0 {
+		return false, nil
+	}
+	if m.FromUserID == userID {
+		return true, nil
+	}
+	switch m.Kind {
+	case "direct":
+		if m.ToUserID.Valid && m.ToUserID.Int64 == userID {
+			return true, nil
+		}
+	case "group":
+		if m.GroupID.Valid {
+			ok, err := s.groupMembers.IsMember(m.GroupID.Int64, userID)
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+	}
+	return s.attachments.VisibleTo(m.ID, userID)
+}
+
+// ===== Шифрование plain_media =====
+
+// sealMedia шифрует содержимое r для уже вставленной записи (m.ID известен):
+// свой DEK на каждый блоб, DEK обёрнут текущим мастер-ключом, сам блоб —
+// сегментами (media_stream.go) потоком в BlobStore. Возвращает размер открытого текста.
+func (s *Server) sealMedia(m *PlainMedia, r io.Reader) (int64, error) {
+	return sealMediaWith(s.keyring, s.blobs, m, r)
+}
+
+func sealMediaWith(keyring *Keyring, blobs BlobStore, m *PlainMedia, r io.Reader) (int64, error) {
+	m.EncVersion = mediaEncVersionSegmented
+	aad := mediaAAD(m.EncVersion, m.ID, m.Kind, m.FromUserID, m.ContentType)
+
+	dek, err := generateRandomBytes(32)
+	if err != nil {
+		return 0, err
+	}
+	prefix, err := generateRandomBytes(mediaNoncePrefixSize)
+	if err != nil {
+		return 0, err
+	}
+
+	key, size, n, err := sealSegmentedBlob(blobs, dek, prefix, aad, r)
+	if err != nil {
+		return n, err
+	}
+
+	wrapped, wrapNonce, version, err := keyring.WrapDataKey(dek, aad)
+	if err != nil {
+		return n, err
+	}
+	m.BlobKey, m.BlobSize, m.Nonce = key, size, prefix
+	m.DEKWrapped, m.DEKNonce, m.KeyVersion = wrapped, wrapNonce, version
+	return n, nil
+}
+
+func sealSegmentedBlob(blobs BlobStore, dek, prefix, aad []byte, r io.Reader) (key string, size, n int64, err error) {
+	key, size, err = putBlob(blobs, func(w io.Writer) error {
+		sw, err := newSegmentWriter(w, dek, prefix, aad)
+		if err != nil {
+			return err
+		}
+		if n, err = io.Copy(sw, r); err != nil {
+			return err
+		}
+		return sw.Close()
+	})
+	return key, size, n, err
+}
+
+func openSegmentedBlob(blobs BlobStore, key string, size int64, dek, prefix, aad []byte) (io.ReadSeekCloser, error) {
+	open := func(offset, length int64) (io.ReadCloser, error) {
+		return blobs.OpenRange(key, offset, length)
+	}
+	return newSegmentedContent(open, size, dek, prefix, aad)
+}
+
+// Миниатюра шифруется DEK оригинала (ротация ключей покрывает обе), но со своим
+// nonce-префиксом и AAD: подменить миниатюру оригиналом или чужой миниатюрой нельзя.
+func mediaThumbAAD(m *PlainMedia) []byte {
+	return append(mediaAAD(m.EncVersion, m.ID, m.Kind, m.FromUserID, m.ContentType), "/thumb"...)
+}
+
+// sealMediaThumb — после sealMedia, когда у записи уже есть DEK.
+func (s *Server) sealMediaThumb(m *PlainMedia, thumb []byte, contentType string) error {
+	aad := mediaAAD(m.EncVersion, m.ID, m.Kind, m.FromUserID, m.ContentType)
+	dek, err := s.keyring.UnwrapDataKey(m.DEKWrapped, m.DEKNonce, m.KeyVersion, aad)
+	if err != nil {
+		return err
+	}
+	prefix, err := generateRandomBytes(mediaNoncePrefixSize)
+	if err != nil {
+		return err
+	}
+	key, size, _, err := sealSegmentedBlob(s.blobs, dek, prefix, mediaThumbAAD(m), bytes.NewReader(thumb))
+	if err != nil {
+		return err
+	}
+	m.ThumbBlobKey, m.ThumbBlobSize, m.ThumbNonce, m.ThumbContentType = key, size, prefix, contentType
+	return nil
+}
+
+func (s *Server) openMediaThumb(m *PlainMedia) (io.ReadSeekCloser, error) {
+	aad := mediaAAD(m.EncVersion, m.ID, m.Kind, m.FromUserID, m.ContentType)
+	dek, err := s.keyring.UnwrapDataKey(m.DEKWrapped, m.DEKNonce, m.KeyVersion, aad)
+	if err != nil {
+		return nil, err
+	}
+	return openSegmentedBlob(s.blobs, m.ThumbBlobKey, m.ThumbBlobSize, dek, m.ThumbNonce, mediaThumbAAD(m))
+}
+
+// createMedia вставляет запись и шифрует body (и миниатюру, если есть).
+// m.Size должен быть заранее известен: прочитанное сверяется с ним.
+// charge — проверка квоты при вставке; nil, если место зарезервировано заранее.
+func (s *Server) createMedia(m *PlainMedia, body io.Reader, img *processedImage, charge quotaCharge) (*PlainMedia, error) {
+	if img != nil {
+		m.Width, m.Height = img.Width, img.Height
+	}
+	created, err := s.plainMedia.Create(m, charge, func(m *PlainMedia) error {
+		n, err := s.sealMedia(m, body)
+		if err != nil {
+			return err
+		}
+		if n != m.Size {
+			return fmt.Errorf("media: read %d bytes, expected %d", n, m.Size)
+		}
+		if img != nil && img.Thumb != nil {
+			return s.sealMediaThumb(m, img.Thumb, img.ThumbContentType)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.updates.notify()
+	return created, nil
+}
+
+type nopReadSeekCloser struct{ io.ReadSeeker }
+
+func (nopReadSeekCloser) Close() error { return nil }
+
+// openMediaContent — открытый текст как ReadSeeker: у сегментированных записей
+// расшифровываются только читаемые сегменты, старые форматы читаются целиком.
+func (s *Server) openMediaContent(m *PlainMedia) (io.ReadSeekCloser, error) {
+	return openMediaContentWith(s.keyring, s.blobs, m)
+}
+
+func openMediaContentWith(keyring *Keyring, blobs BlobStore, m *PlainMedia) (io.ReadSeekCloser, error) {
+	aad := mediaAAD(m.EncVersion, m.ID, m.Kind, m.FromUserID, m.ContentType)
+	if m.EncVersion >= mediaEncVersionSegmented {
+		dek, err := keyring.UnwrapDataKey(m.DEKWrapped, m.DEKNonce, m.KeyVersion, aad)
+		if err != nil {
+			return nil, err
+		}
+		return openSegmentedBlob(blobs, m.BlobKey, m.BlobSize, dek, m.Nonce, aad)
+	}
+
+	ciphertext, err := readBlob(blobs, m.BlobKey)
+	if err != nil {
+		return nil, err
+	}
+	var raw []byte
+	if m.EncVersion >= mediaEncVersionEnvelope {
+		raw, err = keyring.Open(&Envelope{
+			Ciphertext: ciphertext,
+			Nonce:      m.Nonce,
+			WrappedKey: m.DEKWrapped,
+			WrapNonce:  m.DEKNonce,
+			KeyVersion: m.KeyVersion,
+		}, aad)
+	} else {
+		// старые форматы зашифрованы напрямую единственным ключом (версия 1)
+		var legacy []byte
+		if legacy, err = keyring.Key(1); err == nil {
+			raw, err = aesGCMDecrypt(legacy, ciphertext, m.Nonce, aad)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nopReadSeekCloser{bytes.NewReader(raw)}, nil
+}
+
+// openMedia — файл целиком в памяти (ротация, обработка картинок).
+func (s *Server) openMedia(m *PlainMedia) ([]byte, error) {
+	return openMediaWith(s.keyring, s.blobs, m)
+}
+
+func openMediaWith(keyring *Keyring, blobs BlobStore, m *PlainMedia) ([]byte, error) {
+	content, err := openMediaContentWith(keyring, blobs, m)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	return io.ReadAll(content)
+}
+
+// moveInlineMediaToBlobs переносит шифртексты, хранившиеся в plain_media.ciphertext,
+// в BlobStore как есть (без перешифрования) и очищает колонку.
+func moveInlineMediaToBlobs(store *PlainMediaStore, blobs BlobStore) (int, error) {
+	moved := 0
+	for {
+		batch, err := store.ListInline(20)
+		if err != nil {
+			return moved, err
+		}
+		if len(batch) == 0 {
+			return moved, nil
+		}
+		for _, im := range batch {
+			key, size, err := putBlob(blobs, func(w io.Writer) error {
+				_, err := w.Write(im.Ciphertext)
+				return err
+			})
+			if err != nil {
+				return moved, fmt.Errorf("media %d: %w", im.ID, err)
+			}
+			if err := store.SetBlob(im.ID, key, size); err != nil {
+				return moved, err
+			}
+			moved++
+		}
+	}
+}
+
+// moveInlineE2EMediaToBlobs — то же для E2E-вложений CLI: шифртекст непрозрачный,
+// переносится как есть.
+func moveInlineE2EMediaToBlobs(store *E2EMediaStore, blobs BlobStore) (int, error) {
+	moved := 0
+	for {
+		batch, err := store.ListInline(20)
+		if err != nil {
+			return moved, err
+		}
+		if len(batch) == 0 {
+			return moved, nil
+		}
+		for _, im := range batch {
+			key, _, err := putBlob(blobs, func(w io.Writer) error {
+				_, err := w.Write(im.Ciphertext)
+				return err
+			})
+			if err != nil {
+				return moved, fmt.Errorf("e2e media %d: %w", im.ID, err)
+			}
+			if err := store.SetBlob(im.ID, key); err != nil {
+				return moved, err
+			}
+			moved++
+		}
+	}
+}
+
+// rewrapAllMedia переводит все записи под текущий мастер-ключ:
+// у envelope-записей перешифровывается только DEK, старые форматы
+// перешифровываются целиком в сегментированный. Запускается при остановленном сервере.
+func rewrapAllMedia(store *PlainMediaStore, keyring *Keyring, blobs BlobStore) (rewrapped, converted int, err error) {
+	current := keyring.CurrentVersion()
+	var afterID int64
+	for {
+		ids, err := store.ListIDsNotUnderKey(current, afterID, 100)
+		if err != nil {
+			return rewrapped, converted, err
+		}
+		if len(ids) == 0 {
+			return rewrapped, converted, nil
+		}
+
+		for _, id := range ids {
+			afterID = id
+			m, err := store.GetByID(id)
+			if err != nil {
+				return rewrapped, converted, err
+			}
+
+			oldBlob := m.BlobKey
+			if m.EncVersion >= mediaEncVersionEnvelope {
+				aad := mediaAAD(m.EncVersion, m.ID, m.Kind, m.FromUserID, m.ContentType)
+				env := &Envelope{WrappedKey: m.DEKWrapped, WrapNonce: m.DEKNonce, KeyVersion: m.KeyVersion}
+				if err := keyring.Rewrap(env, aad); err != nil {
+					return rewrapped, converted, fmt.Errorf("media %d: %w", id, err)
+				}
+				m.DEKWrapped, m.DEKNonce, m.KeyVersion = env.WrappedKey, env.WrapNonce, env.KeyVersion
+				rewrapped++
+			} else {
+				raw, err := openMediaWith(keyring, blobs, m)
+				if err != nil {
+					return rewrapped, converted, fmt.Errorf("media %d: %w", id, err)
+				}
+				if _, err := sealMediaWith(keyring, blobs, m, bytes.NewReader(raw)); err != nil {
+					return rewrapped, converted, err
+				}
+				converted++
+			}
+
+			if err := store.UpdateCrypto(m); err != nil {
+				return rewrapped, converted, err
+			}
+			if m.BlobKey != oldBlob {
+				if err := blobs.Delete(oldBlob); err != nil {
+					log.Printf("media %d: old blob not removed: %v", id, err)
+				}
+			}
+		}
+	}
+}
+
+// openServerKeyring загружает мастер-ключи. Новый ключ создаётся только для
+// пустой базы: если под ключами уже что-то зашифровано (медиа, тексты сообщений,
+// ключи незавершённых загрузок), а ключей нет — это потеря ключа, а не первый запуск.
+func openServerKeyring(db *sql.DB, legacyPath, dir string) (*Keyring, error) {
+	keyring, err := loadKeyring(legacyPath, dir)
+	if err != nil {
+		return nil, err
+	}
+	if !keyring.Empty() {
+		return keyring, nil
+	}
+
+	sealed, err := countSealed(db, keyringDependents())
+	if err != nil {
+		return nil, err
+	}
+	if sealed != "" {
+		return nil, fmt.Errorf("no master key found (%s, %s/) but database has %s; restore the key instead of generating a new one",
+			legacyPath, dir, sealed)
+	}
+
+	version, err := keyring.Generate()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("generated master key v%d in %s/", version, dir)
+	return keyring, nil
+}
+
+type sealedQuery struct {
+	what  string
+	query string // SELECT COUNT(*) ...
+}
+
+// keyringDependents — всё, что зашифровано под мастер-ключами.
+func keyringDependents() []sealedQuery {
+	q := []sealedQuery{{"encrypted media", `SELECT COUNT(*) FROM plain_media`}}
+	for _, t := range sealedTextTables {
+		q = append(q, sealedQuery{t.name + " texts", `SELECT COUNT(*) FROM ` + t.name + ` WHERE text_ct IS NOT NULL`})
+	}
+	return append(q, sealedQuery{"pending upload keys", `SELECT COUNT(*) FROM media_uploads WHERE media_public_id IS NULL`})
+}
+
+// countSealed — «12 encrypted media, 3 plain_messages texts» по непустым запросам; "" — ничего нет.
+func countSealed(db *sql.DB, queries []sealedQuery) (string, error) {
+	var parts []string
+	for _, q := range queries {
+		var n int64
+		if err := db.QueryRow(q.query).Scan(&n); err != nil {
+			return "", err
+		}
+		if n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", n, q.what))
+		}
+	}
+	return strings.Join(parts, ", "), nil
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// ===== Голосовые сообщения: длительность и «волна» =====
+//
+// Декодеров Opus/Vorbis/MP3 в стандартной библиотеке нет, поэтому звук не
+// декодируется. Длительность берётся из контейнера, а волна — из размеров
+// пакетов: Opus и Vorbis кодируют с переменным битрейтом, и тишина занимает
+// единицы байт, а речь — десятки. У MP3 вместо размера кадра (он постоянный при
+// CBR) берётся part2_3_length — сколько бит ушло на сам звук в кадре.
+// Файл читается одним потоком, целиком в память не загружается.
+
+const waveformBars = 64
+
+var ErrBadAudio = errors.New("bad audio")
+
+type audioInfo struct {
+	DurationMS int64
+	Waveform   []byte // waveformBars значений 0–255
+}
+
+func isVoiceAudio(contentType string) bool {
+	switch contentType {
+	case "audio/ogg", "audio/opus", "audio/webm", "audio/mpeg":
+		return true
+	}
+	return false
+}
+
+func analyzeAudio(r io.Reader, contentType string) (*audioInfo, error) {
+	br := bufio.NewReaderSize(r, 64<<10)
+	var durationMS int64
+	var levels []float64
+	var err error
+	switch contentType {
+	case "audio/ogg", "audio/opus":
+		durationMS, levels, err = analyzeOgg(br)
+	case "audio/webm":
+		durationMS, levels, err = analyzeWebM(br)
+	case "audio/mpeg":
+		durationMS, levels, err = analyzeMP3(br)
+	default:
+		return nil, ErrBadAudio
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(levels) == 0 || durationMS <= 0 {
+		return nil, ErrBadAudio
+	}
+	return &audioInfo{DurationMS: durationMS, Waveform: waveform(levels)}, nil
+}
+
+// waveform сжимает уровни до waveformBars столбиков (среднее по корзине)
+// и нормирует по самому громкому.
+func waveform(levels []float64) []byte {
+	bars := make([]float64, waveformBars)
+	peak := 0.0
+	for i := range bars {
+		from := i * len(levels) / waveformBars
+		to := max((i+1)*len(levels)/waveformBars, from+1)
+		if from >= len(levels) {
+			from, to = len(levels)-1, len(levels)
+		}
+		sum := 0.0
+		for _, v := range levels[from:to] {
+			sum += v
+		}
+		bars[i] = sum / float64(to-from)
+		peak = max(peak, bars[i])
+	}
+	out := make([]byte, waveformBars)
+	if peak == 0 {
+		return out
+	}
+	for i, v := range bars {
+		out[i] = byte(math.Round(v / peak * 255))
+	}
+	return out
+}
+
+// ===== Ogg (Opus, Vorbis) =====
+//
+// Страница: "OggS", версия, флаги, granule (int64 LE), serial, номер, crc,
+// число сегментов, таблица сегментов. Пакет заканчивается сегментом короче 255.
+// Длительность — granule последней страницы минус pre-skip, делённое на частоту.
+
+func analyzeOgg(br *bufio.Reader) (int64, []float64, error) {
+	var (
+		serial       uint32
+		packetLen    int
+		packet       []byte // только первые байты пакета: хватает для заголовков
+		packets      int
+		headers      = 2 // у Opus два заголовочных пакета, у Vorbis три
+		rate         = int64(48000)
+		preSkip      int64
+		lastGranule  int64 = -1
+		levels       []float64
+		pages        int
+		codecChecked bool
+	)
+	var hdr [27]byte
+	for {
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			if err == io.EOF && pages > 0 {
+				break
+			}
+			return 0, nil, ErrBadAudio
+		}
+		if string(hdr[:4]) != "OggS" || hdr[4] != 0 {
+			return 0, nil, ErrBadAudio
+		}
+		granule := int64(binary.LittleEndian.Uint64(hdr[6:14]))
+		pageSerial := binary.LittleEndian.Uint32(hdr[14:18])
+		segTable := make([]byte, hdr[26])
+		if _, err := io.ReadFull(br, segTable); err != nil {
+			return 0, nil, ErrBadAudio
+		}
+		if pages == 0 {
+			serial = pageSerial
+		}
+		pages++
+		if pageSerial != serial { // другие логические потоки пропускаем
+			total := 0
+			for _, l := range segTable {
+				total += int(l)
+			}
+			if _, err := br.Discard(total); err != nil {
+				return 0, nil, ErrBadAudio
+			}
+			continue
+		}
+
+		for _, l := range segTable {
+			if len(packet) < 64 {
+				chunk := make([]byte, min(int(l), 64-len(packet)))
+				if _, err := io.ReadFull(br, chunk); err != nil {
+					return 0, nil, ErrBadAudio
+				}
+				packet = append(packet, chunk...)
+				if _, err := br.Discard(int(l) - len(chunk)); err != nil {
+					return 0, nil, ErrBadAudio
+				}
+			} else if _, err := br.Discard(int(l)); err != nil {
+				return 0, nil, ErrBadAudio
+			}
+			packetLen += int(l)
+			if l == 255 {
+				continue
+			}
+
+			// пакет закончился
+			if !codecChecked {
+				switch {
+				case bytes.HasPrefix(packet, []byte("OpusHead")) && len(packet) >= 12:
+					preSkip = int64(binary.LittleEndian.Uint16(packet[10:12]))
+				case bytes.HasPrefix(packet, []byte("\x01vorbis")) && len(packet) >= 16:
+					headers = 3
+					rate = int64(binary.LittleEndian.Uint32(packet[12:16]))
+				default:
+					return 0, nil, ErrBadAudio
+				}
+				codecChecked = true
+			}
+			if packets >= headers {
+				levels = append(levels, float64(packetLen))
+			}
+			packets++
+			packet, packetLen = packet[:0], 0
+		}
+		if granule >= 0 && packets > headers {
+			lastGranule = granule
+		}
+	}
+	if lastGranule < 0 || rate <= 0 {
+		return 0, nil, ErrBadAudio
+	}
+	return max(0, lastGranule-preSkip) * 1000 / rate, levels, nil
+}
+
+// ===== WebM (Matroska) =====
+//
+// Дерево EBML читается плоско: в нужные контейнеры (Segment, Info, Cluster,
+// BlockGroup) просто «входим», не пропуская их содержимое, остальное пропускаем.
+// Так работают и элементы неизвестной длины, которые пишет MediaRecorder.
+
+const (
+	ebmlIDHeader        = 0x1A45DFA3
+	ebmlIDDocType       = 0x4282
+	ebmlIDSegment       = 0x18538067
+	ebmlIDInfo          = 0x1549A966
+	ebmlIDTimecodeScale = 0x2AD7B1
+	ebmlIDDuration      = 0x4489
+	ebmlIDCluster       = 0x1F43B675
+	ebmlIDTimecode      = 0xE7
+	ebmlIDSimpleBlock   = 0xA3
+	ebmlIDBlockGroup    = 0xA0
+	ebmlIDBlock         = 0xA1
+)
+
+const ebmlUnknownSize = -1
+
+func readEBMLVint(br *bufio.Reader, keepMarker bool) (int64, error) {
+	first, err := br.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	n := 1
+	for mask := byte(0x80); n <= 8 && first&mask == 0; mask >>= 1 {
+		n++
+	}
+	if n > 8 {
+		return 0, ErrBadAudio
+	}
+	v := int64(first)
+	if !keepMarker {
+		v &= int64(0xFF >> n)
+	}
+	allOnes := v == int64(0xFF>>n)
+	for i := 1; i < n; i++ {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, ErrBadAudio
+		}
+		v = v<<8 | int64(b)
+		allOnes = allOnes && b == 0xFF
+	}
+	if !keepMarker && allOnes {
+		return ebmlUnknownSize, nil
+	}
+	return v, nil
+}
+
+func readEBMLPayload(br *bufio.Reader, size int64, limit int64) ([]byte, error) {
+	if size < 0 || size > limit {
+		return nil, ErrBadAudio
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		return nil, ErrBadAudio
+	}
+	return buf, nil
+}
+
+func ebmlUint(b []byte) int64 {
+	var v int64
+	for _, c := range b {
+		v = v<<8 | int64(c)
+	}
+	return v
+}
+
+func analyzeWebM(br *bufio.Reader) (int64, []float64, error) {
+	var (
+		timecodeScale   = int64(1_000_000) // нс на тик
+		duration        float64            // в тиках, 0 — не указана
+		clusterTimecode int64
+		lastBlock       int64 = -1
+		levels          []float64
+		sawHeader       bool
+	)
+	for {
+		id, err := readEBMLVint(br, true)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, nil, ErrBadAudio
+		}
+		size, err := readEBMLVint(br, false)
+		if err != nil {
+			return 0, nil, ErrBadAudio
+		}
+
+		switch id {
+		case ebmlIDHeader, ebmlIDSegment, ebmlIDInfo, ebmlIDCluster, ebmlIDBlockGroup:
+			if id == ebmlIDHeader {
+				sawHeader = true
+			}
+			continue // входим внутрь
+		case ebmlIDDocType:
+			b, err := readEBMLPayload(br, size, 64)
+			if err != nil {
+				return 0, nil, err
+			}
+			if doc := string(bytes.TrimRight(b, "\x00")); doc != "webm" && doc != "matroska" {
+				return 0, nil, ErrBadAudio
+			}
+		case ebmlIDTimecodeScale:
+			b, err := readEBMLPayload(br, size, 8)
+			if err != nil {
+				return 0, nil, err
+			}
+			if v := ebmlUint(b); v > 0 {
+				timecodeScale = v
+			}
+		case ebmlIDDuration:
+			b, err := readEBMLPayload(br, size, 8)
+			if err != nil {
+				return 0, nil, err
+			}
+			switch len(b) {
+			case 4:
+				duration = float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+			case 8:
+				duration = math.Float64frombits(binary.BigEndian.Uint64(b))
+			}
+		case ebmlIDTimecode:
+			b, err := readEBMLPayload(br, size, 8)
+			if err != nil {
+				return 0, nil, err
+			}
+			clusterTimecode = ebmlUint(b)
+		case ebmlIDSimpleBlock, ebmlIDBlock:
+			// номер дорожки (vint), int16 смещение от кластера, флаги, дальше кадр
+			if size < 4 {
+				return 0, nil, ErrBadAudio
+			}
+			head, err := br.Peek(min(int(size), 9))
+			if err != nil {
+				return 0, nil, ErrBadAudio
+			}
+			n := 1
+			for mask := byte(0x80); n <= 8 && head[0]&mask == 0; mask >>= 1 {
+				n++
+			}
+			if n+3 > len(head) {
+				return 0, nil, ErrBadAudio
+			}
+			rel := int64(int16(binary.BigEndian.Uint16(head[n:])))
+			lastBlock = max(lastBlock, clusterTimecode+rel)
+			levels = append(levels, float64(size-int64(n)-3))
+			if _, err := br.Discard(int(size)); err != nil {
+				return 0, nil, ErrBadAudio
+			}
+		default:
+			if size == ebmlUnknownSize {
+				return 0, nil, ErrBadAudio
+			}
+			if _, err := br.Discard(int(size)); err != nil {
+				return 0, nil, ErrBadAudio
+			}
+		}
+	}
+	if !sawHeader {
+		return 0, nil, ErrBadAudio
+	}
+
+	ticks := duration
+	if ticks <= 0 && lastBlock >= 0 {
+		// MediaRecorder не пишет Duration: берём время последнего блока плюс
+		// средний шаг между блоками (длительность последнего кадра)
+		ticks = float64(lastBlock)
+		if len(levels) > 1 {
+			ticks += float64(lastBlock) / float64(len(levels)-1)
+		}
+	}
+	return int64(ticks * float64(timecodeScale) / 1e6), levels, nil
+}
+
+// ===== MP3 (MPEG-1/2/2.5 Layer III) =====
+
+var (
+	mp3BitratesV1 = [16]int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, -1}
+	mp3BitratesV2 = [16]int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, -1}
+	mp3Rates      = map[uint32][3]int{3: {44100, 48000, 32000}, 2: {22050, 24000, 16000}, 0: {11025, 12000, 8000}}
+)
+
+type mp3Frame struct {
+	length, samples, rate int
+	part23                int // part2_3_length первой гранулы первого канала
+}
+
+func parseMP3Frame(b []byte) (mp3Frame, bool) {
+	h := binary.BigEndian.Uint32(b)
+	if h>>21 != 0x7FF {
+		return mp3Frame{}, false
+	}
+	version := (h >> 19) & 3 // 3 — MPEG1, 2 — MPEG2, 0 — MPEG2.5
+	layer := (h >> 17) & 3   // 1 — Layer III
+	rates, ok := mp3Rates[version]
+	if !ok || layer != 1 {
+		return mp3Frame{}, false
+	}
+	bitrateIdx, rateIdx := (h>>12)&0xF, (h>>10)&3
+	if rateIdx == 3 {
+		return mp3Frame{}, false
+	}
+	f := mp3Frame{rate: rates[rateIdx], samples: 576}
+	kbps := mp3BitratesV2[bitrateIdx]
+	if version == 3 {
+		kbps, f.samples = mp3BitratesV1[bitrateIdx], 1152
+	}
+	if kbps <= 0 { // free format не поддерживаем
+		return mp3Frame{}, false
+	}
+	padding := int((h >> 9) & 1)
+	f.length = f.samples/8*kbps*1000/f.rate + padding
+
+	// side info: после заголовка (и CRC, если бит защиты сброшен)
+	off := 4
+	if (h>>16)&1 == 0 {
+		off += 2
+	}
+	mono := (h>>6)&3 == 3
+	var skip int // бит до part2_3_length
+	switch {
+	case version == 3 && mono:
+		skip = 9 + 5 + 4
+	case version == 3:
+		skip = 9 + 3 + 8
+	case mono:
+		skip = 8 + 1
+	default:
+		skip = 8 + 2
+	}
+	if off+(skip+12+7)/8 <= len(b) {
+		var bits uint64
+		for i := 0; i < 8 && off+i < len(b); i++ {
+			bits |= uint64(b[off+i]) << (56 - 8*i)
+		}
+		f.part23 = int(bits >> (64 - skip - 12) & 0xFFF)
+	}
+	return f, true
+}
+
+func analyzeMP3(br *bufio.Reader) (int64, []float64, error) {
+	// ID3v2 в начале: "ID3", версия (2), флаги, размер (4 байта по 7 бит)
+	if head, err := br.Peek(10); err == nil && string(head[:3]) == "ID3" {
+		size := int(head[6])<<21 | int(head[7])<<14 | int(head[8])<<7 | int(head[9])
+		if head[5]&0x10 != 0 {
+			size += 10
+		}
+		if _, err := br.Discard(10 + size); err != nil {
+			return 0, nil, ErrBadAudio
+		}
+	}
+
+	var (
+		samples int64
+		rate    int
+		levels  []float64
+		junk    int
+	)
+	for {
+		b, err := br.Peek(4 + 2 + 8)
+		if len(b) < 4 {
+			break
+		}
+		f, ok := parseMP3Frame(b)
+		if ok && rate == 0 {
+			// первый кадр: синхрослово легко встретить случайно, так что за ним
+			// должен идти ещё один кадр с той же частотой
+			next, _ := br.Peek(f.length + 4)
+			nf, nok := mp3Frame{}, false
+			if len(next) == f.length+4 {
+				nf, nok = parseMP3Frame(next[f.length:])
+			}
+			ok = nok && nf.rate == f.rate
+		}
+		if !ok || (rate != 0 && f.rate != rate) {
+			if err != nil || len(levels) > 0 && string(b[:3]) == "TAG" {
+				break // ID3v1 в конце
+			}
+			// между кадрами мусор: ищем следующую синхронизацию, но недолго
+			if junk++; junk > 64<<10 {
+				return 0, nil, ErrBadAudio
+			}
+			br.Discard(1)
+			continue
+		}
+		rate = f.rate
+		samples += int64(f.samples)
+		levels = append(levels, float64(f.part23))
+		if _, err := br.Discard(f.length); err != nil {
+			break // обрезанный последний кадр
+		}
+	}
+	if rate == 0 || len(levels) < 2 {
+		return 0, nil, ErrBadAudio
+	}
+	return samples * 1000 / int64(rate), levels, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// oggPage — страница с одним пакетом короче 255 байт; CRC сервер не проверяет.
+func oggPage(granule int64, seq uint32, packet []byte) []byte {
+	p := []byte("OggS\x00\x00")
+	p = binary.LittleEndian.AppendUint64(p, uint64(granule))
+	p = binary.LittleEndian.AppendUint32(p, 0x1234) // serial
+	p = binary.LittleEndian.AppendUint32(p, seq)
+	p = append(p, 0, 0, 0, 0, 1, byte(len(packet)))
+	return append(p, packet...)
+}
+
+// testOpus — секунда Opus по 20 мс: первая половина тихая, вторая громкая.
+func testOpus() []byte {
+	head := []byte("OpusHead\x01\x01")
+	head = binary.LittleEndian.AppendUint16(head, 312) // pre-skip
+	head = binary.LittleEndian.AppendUint32(head, 48000)
+	head = append(head, 0, 0, 0)
+
+	out := oggPage(0, 0, head)
+	out = append(out, oggPage(0, 1, []byte("OpusTags"))...)
+	for i := 0; i < 50; i++ {
+		size := 5
+		if i >= 25 {
+			size = 80
+		}
+		out = append(out, oggPage(312+int64(i+1)*960, uint32(i+2), make([]byte, size))...)
+	}
+	return out
+}
+
+// testMP3 — n кадров MPEG1 Layer III 128 кбит/с 44,1 кГц.
+func testMP3(n int) []byte {
+	frame := make([]byte, 417)
+	copy(frame, []byte{0xFF, 0xFB, 0x90, 0x00})
+	return bytes.Repeat(frame, n)
+}
+
+func ebmlElement(id []byte, payload []byte) []byte {
+	return append(append(append([]byte{}, id...), 0x80|byte(len(payload))), payload...)
+}
+
+// testWebM — как у MediaRecorder: сегмент и кластер неизвестной длины, без Duration.
+func testWebM() []byte {
+	out := ebmlElement([]byte{0x1A, 0x45, 0xDF, 0xA3}, ebmlElement([]byte{0x42, 0x82}, []byte("webm")))
+	out = append(out, 0x18, 0x53, 0x80, 0x67, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+	out = append(out, 0x1F, 0x43, 0xB6, 0x75, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+	out = append(out, ebmlElement([]byte{0xE7}, []byte{0})...)
+	for i := 0; i < 50; i++ {
+		block := binary.BigEndian.AppendUint16([]byte{0x81}, uint16(i*20))
+		block = append(block, 0x80)
+		block = append(block, make([]byte, 10+i)...)
+		out = append(out, ebmlElement([]byte{0xA3}, block)...)
+	}
+	return out
+}
+
+func TestAnalyzeAudio(t *testing.T) {
+	cases := []struct {
+		name       string
+		raw        []byte
+		ct         string
+		durationMS int64
+	}{
+		{"opus", testOpus(), "audio/ogg", 1000},
+		{"opus as audio/opus", testOpus(), "audio/opus", 1000},
+		{"mp3", testMP3(100), "audio/mpeg", 100 * 1152 * 1000 / 44100},
+		{"mp3 with id3", append([]byte("ID3\x03\x00\x00\x00\x00\x00\x04tags"), testMP3(10)...), "audio/mpeg", 10 * 1152 * 1000 / 44100},
+		{"mp3 with junk", append(append(testMP3(5), "junk"...), testMP3(5)...), "audio/mpeg", 10 * 1152 * 1000 / 44100},
+		{"webm", testWebM(), "audio/webm", 1000},
+	}
+	for _, c := range cases {
+		info, err := analyzeAudio(bytes.NewReader(c.raw), c.ct)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if info.DurationMS != c.durationMS {
+			t.Errorf("%s: %d ms, want %d", c.name, info.DurationMS, c.durationMS)
+		}
+		if len(info.Waveform) != waveformBars {
+			t.Errorf("%s: %d bars", c.name, len(info.Waveform))
+		}
+	}
+}
+
+func TestAnalyzeAudioWaveform(t *testing.T) {
+	info, err := analyzeAudio(bytes.NewReader(testOpus()), "audio/ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// тихая половина ~5/80 от громкой, громкая нормирована в 255
+	if w := info.Waveform; w[0] > 20 || w[waveformBars-1] != 255 {
+		t.Fatalf("waveform %v", w)
+	}
+
+	info, err = analyzeAudio(bytes.NewReader(testWebM()), "audio/webm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := info.Waveform; w[0] >= w[waveformBars-1] {
+		t.Fatalf("growing blocks, waveform %v", w)
+	}
+}
+
+func TestAnalyzeAudioRejects(t *testing.T) {
+	opus := testOpus()
+	cases := map[string]struct {
+		raw []byte
+		ct  string
+	}{
+		"empty":            {nil, "audio/ogg"},
+		"not ogg":          {[]byte("RIFF....WAVE"), "audio/ogg"},
+		"headers only":     {opus[:2*27+2+19+8], "audio/ogg"},
+		"truncated page":   {opus[:len(opus)-10], "audio/ogg"},
+		"unknown codec":    {oggPage(0, 0, []byte("Speex   ")), "audio/ogg"},
+		"single mp3 frame": {testMP3(1), "audio/mpeg"},
+		"random bytes":     {bytes.Repeat([]byte{0xFF, 0x00}, 1000), "audio/mpeg"},
+		"webm no header":   {testWebM()[15:], "audio/webm"},
+		"wav":              {opus, "audio/wav"},
+	}
+	for name, c := range cases {
+		if _, err := analyzeAudio(bytes.NewReader(c.raw), c.ct); !errors.Is(err, ErrBadAudio) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func FuzzAnalyzeAudio(f *testing.F) {
+	f.Add(testOpus(), "audio/ogg")
+	f.Add(testMP3(3), "audio/mpeg")
+	f.Add(testWebM(), "audio/webm")
+
+	f.Fuzz(func(t *testing.T, raw []byte, ct string) {
+		info, err := analyzeAudio(bytes.NewReader(raw), ct)
+		if err != nil {
+			if !errors.Is(err, ErrBadAudio) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			return
+		}
+		if info.DurationMS <= 0 || len(info.Waveform) != waveformBars {
+			t.Fatalf("%d ms, %d bars", info.DurationMS, len(info.Waveform))
+		}
+	})
+}
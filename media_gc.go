@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// ===== Дедупликация медиа и сборка мусора =====
+//
+// Дедупликация: у новой записи хранится content_hash = HMAC(ключ, беседа || sha256 файла).
+// Тот же файл, загруженный в ту же беседу ещё раз (переслали, отправили повторно),
+// не шифруется заново — upload возвращает уже существующее медиа. Беседа входит
+// в HMAC, так что по совпадению хэшей нельзя узнать, что такой же файл есть у
+// кого-то ещё, а ключ не даёт проверить догадку о содержимом перебором.
+//
+// GC раз в час удаляет медиа, которое не приложено ни к одному сообщению
+// (message_attachments.go) и которое не трогали дольше grace: брошенные загрузки
+// и файлы, сообщения с которыми исчезли.
+
+const defaultMediaGCGrace = 24 * time.Hour
+
+// mediaDedupKey выводится из ключа слепого индекса: он тоже не ротируется,
+// иначе после ротации одинаковые файлы перестали бы совпадать.
+func mediaDedupKey(indexKey []byte) []byte {
+	mac := hmac.New(sha256.New, indexKey)
+	mac.Write([]byte("mollysage-media-dedup"))
+	return mac.Sum(nil)
+}
+
+// conversationScope — беседа (kind = direct | group); у лички не зависит от того,
+// кто из двоих отправил.
+func conversationScope(kind string, fromID, convID int64) string {
+	if kind == "direct" {
+		a, b := fromID, convID
+		if a > b {
+			a, b = b, a
+		}
+		return fmt.Sprintf("direct:%d:%d", a, b)
+	}
+	return fmt.Sprintf("group:%d", convID)
+}
+
+// mediaScope — беседа, в которую загружено медиа.
+func mediaScope(m *PlainMedia) string {
+	if m.Kind == "direct" {
+		return conversationScope(m.Kind, m.FromUserID, m.ToUserID.Int64)
+	}
+	return conversationScope(m.Kind, m.FromUserID, m.GroupID.Int64)
+}
+
+func (s *Server) mediaContentHash(m *PlainMedia, r io.Reader) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, s.dedupKey)
+	mac.Write([]byte(mediaScope(m)))
+	mac.Write([]byte{0})
+	mac.Write(h.Sum(nil))
+	return mac.Sum(nil), nil
+}
+
+// duplicateMedia — уже загруженное в эту беседу медиа с тем же содержимым или nil.
+// Найденное «трогаем», чтобы GC не удалил его, пока клиент отправляет сообщение.
+func (s *Server) duplicateMedia(contentHash []byte) *PlainMedia {
+	m, err := s.plainMedia.GetByContentHash(contentHash)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Printf("media dedup: %v", err)
+		return nil
+	}
+	touched, err := s.plainMedia.Touch(m.ID)
+	if err != nil {
+		log.Printf("media dedup: %v", err)
+		return nil
+	}
+	if !touched { // GC успел удалить
+		return nil
+	}
+	return m
+}
+
+// runMediaGC раз в interval удаляет медиа без ссылок старше grace вместе с блобами.
+func (s *Server) runMediaGC(interval, grace time.Duration) {
+	for {
+		n, err := s.collectMediaGarbage(grace)
+		if err != nil {
+			log.Printf("media gc: %v", err)
+		}
+		if n > 0 {
+			log.Printf("media gc: removed %d unreferenced media", n)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (s *Server) collectMediaGarbage(grace time.Duration) (int, error) {
+	removed := 0
+	for {
+		ids, err := s.plainMedia.ListUnreferenced(grace, 100)
+		if err != nil {
+			return removed, err
+		}
+		if len(ids) == 0 {
+			return removed, nil
+		}
+		for _, id := range ids {
+			// условия проверяются ещё раз при удалении: за это время могли сослаться или тронуть
+			m, deleted, err := s.plainMedia.DeleteUnreferenced(id, grace)
+			if err != nil {
+				return removed, err
+			}
+			if !deleted {
+				continue
+			}
+			for _, key := range []string{m.BlobKey, m.ThumbBlobKey} {
+				if key == "" {
+					continue
+				}
+				if inUse, err := s.plainMedia.BlobInUse(key); err != nil || inUse {
+					continue
+				}
+				if err := s.blobs.Delete(key); err != nil {
+					log.Printf("media gc: delete blob %s: %v", key, err)
+				}
+			}
+			removed++
+		}
+		if len(ids) < 100 {
+			return removed, nil
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newHashedMedia — файл с content_hash, как после upload: в личке from→to или в беседе gid.
+func newHashedMedia(t *testing.T, s *Server, from, to, gid int64, body string) *PlainMedia {
+	t.Helper()
+	publicID, err := newMediaPublicID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm := &PlainMedia{
+		PublicID: publicID, Kind: "direct", FromUserID: from,
+		ContentType: "application/pdf", OriginalName: "a.pdf", Size: int64(len(body)),
+	}
+	if to != 0 {
+		pm.ToUserID = sql.NullInt64{Int64: to, Valid: true}
+	} else {
+		pm.Kind, pm.GroupID = "group", sql.NullInt64{Int64: gid, Valid: true}
+	}
+	if pm.ContentHash, err = s.mediaContentHash(pm, strings.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+	m, err := s.createMedia(pm, strings.NewReader(body), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// contentHashIn — хэш того же содержимого, будто его загружают в беседу from→to (или gid).
+func contentHashIn(t *testing.T, s *Server, from, to, gid int64, body string) []byte {
+	t.Helper()
+	pm := &PlainMedia{Kind: "direct", FromUserID: from, ToUserID: sql.NullInt64{Int64: to, Valid: true}}
+	if to == 0 {
+		pm.Kind, pm.ToUserID, pm.GroupID = "group", sql.NullInt64{}, sql.NullInt64{Int64: gid, Valid: true}
+	}
+	hash, err := s.mediaContentHash(pm, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestDuplicateMedia(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob, carol := newTestUser(t, s, "alice"), newTestUser(t, s, "bob"), newTestUser(t, s, "carol")
+	gid := newTestGroup(t, s, alice, bob)
+	m := newHashedMedia(t, s, alice, bob, 0, "%PDF-1.4 отчёт")
+
+	cases := []struct {
+		name          string
+		from, to, gid int64
+		body          string
+		hit           bool
+	}{
+		{"same sender", alice, bob, 0, "%PDF-1.4 отчёт", true},
+		{"other side of the same chat", bob, alice, 0, "%PDF-1.4 отчёт", true},
+		{"other content", alice, bob, 0, "%PDF-1.4 другой", false},
+		{"other chat", alice, carol, 0, "%PDF-1.4 отчёт", false},
+		{"group of the same people", alice, 0, gid, "%PDF-1.4 отчёт", false},
+	}
+	for _, c := range cases {
+		dup := s.duplicateMedia(contentHashIn(t, s, c.from, c.to, c.gid, c.body))
+		if c.hit != (dup != nil) || dup != nil && dup.ID != m.ID {
+			t.Errorf("%s: duplicate %v", c.name, dup)
+		}
+	}
+
+	// найденное «трогается» — GC его не заберёт, пока клиент отправляет сообщение
+	var touched sql.NullString
+	if err := s.plainMedia.db.QueryRow(`SELECT touched_at FROM plain_media WHERE id = ?`, m.ID).Scan(&touched); err != nil || !touched.Valid {
+		t.Fatalf("touched_at %v, %v", touched, err)
+	}
+}
+
+func TestCollectMediaGarbage(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob := newTestUser(t, s, "alice"), newTestUser(t, s, "bob")
+	db := s.plainMedia.db
+
+	attached := newHashedMedia(t, s, alice, bob, 0, "attached")
+	orphan := newHashedMedia(t, s, alice, bob, 0, "orphan")
+	shared := newHashedMedia(t, s, alice, bob, 0, "shared blob")
+	fresh := newHashedMedia(t, s, alice, bob, 0, "fresh")
+	if _, err := s.plainMessages.Create(&PlainMessage{FromUserID: alice, ToUserID: bob, Text: "file", Attachments: []string{attached.PublicID}}); err != nil {
+		t.Fatal(err)
+	}
+	// блоб shared нужен ещё одной записи (как общий шифртекст миниатюры)
+	if _, err := db.Exec(`UPDATE plain_media SET thumb_blob_key = ? WHERE id = ?`, shared.BlobKey, attached.ID); err != nil {
+		t.Fatal(err)
+	}
+	// все, кроме fresh, загружены давно
+	old := time.Now().UTC().Add(-48 * time.Hour).Format("2006-01-02T15:04:05.000Z")
+	if _, err := db.Exec(`UPDATE plain_media SET created_at = ? WHERE id != ?`, old, fresh.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := s.plainMedia.ListUnreferenced(defaultMediaGCGrace, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 || ids[0] != orphan.ID || ids[1] != shared.ID {
+		t.Fatalf("unreferenced %v, want [%d %d]", ids, orphan.ID, shared.ID)
+	}
+	// приложенное не удаляется, даже если его id попал в список до отправки сообщения
+	if _, deleted, err := s.plainMedia.DeleteUnreferenced(attached.ID, defaultMediaGCGrace); err != nil || deleted {
+		t.Fatalf("attached media deleted: %v, %v", deleted, err)
+	}
+
+	if n, err := s.collectMediaGarbage(defaultMediaGCGrace); err != nil || n != 2 {
+		t.Fatalf("removed %d, %v", n, err)
+	}
+	for _, c := range []struct {
+		name string
+		m    *PlainMedia
+		row  bool
+		blob bool
+	}{
+		{"attached", attached, true, true},
+		{"fresh", fresh, true, true},
+		{"orphan", orphan, false, false},
+		{"orphan with a shared blob", shared, false, true},
+	} {
+		_, err := s.plainMedia.GetByID(c.m.ID)
+		if row := err == nil; row != c.row {
+			t.Errorf("%s: row kept %v, %v", c.name, row, err)
+		}
+		_, err = readBlob(s.blobs, c.m.BlobKey)
+		if blob := err == nil; blob != c.blob {
+			t.Errorf("%s: blob kept %v, %v", c.name, blob, err)
+		}
+	}
+	if inUse, err := s.plainMedia.BlobInUse(shared.BlobKey); err != nil || !inUse {
+		t.Errorf("shared blob in use %v, %v", inUse, err)
+	}
+	if inUse, err := s.plainMedia.BlobInUse(orphan.BlobKey); err != nil || inUse {
+		t.Errorf("orphan blob in use %v, %v", inUse, err)
+	}
+
+	// второй проход ничего не находит
+	if n, err := s.collectMediaGarbage(defaultMediaGCGrace); err != nil || n != 0 {
+		t.Fatalf("second pass removed %d, %v", n, err)
+	}
+}
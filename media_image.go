@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+)
+
+// ===== Картинки: миниатюры и вычистка метаданных =====
+//
+// Для JPEG/PNG/GIF при загрузке:
+//   - из оригинала вырезаются EXIF (в т.ч. GPS), XMP, IPTC, комментарии и текстовые
+//     чанки — без перекодирования, кроме JPEG с поворотом в EXIF (см. ниже);
+//   - считается ширина/высота с учётом поворота;
+//   - если картинка больше thumbMaxSide, делается миниатюра (JPEG, или PNG при прозрачности).
+// Остальные image/* (webp, heic...) хранятся как есть.
+
+const (
+	thumbMaxSide   = 320
+	maxImagePixels = 50_000_000 // защита от «бомб»: 10 KiB PNG на 50000x50000
+	jpegQuality    = 90
+)
+
+var ErrBadImage = errors.New("bad image")
+
+type processedImage struct {
+	Original         []byte // без метаданных
+	Width, Height    int
+	Thumb            []byte // nil, если картинка и так маленькая
+	ThumbContentType string
+}
+
+func isProcessableImage(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+func processImage(raw []byte, contentType string) (*processedImage, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(raw))
+	if err != nil || "image/"+format != contentType {
+		return nil, ErrBadImage
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > maxImagePixels {
+		return nil, ErrBadImage
+	}
+
+	var original []byte
+	orientation := 1
+	switch format {
+	case "jpeg":
+		orientation = jpegOrientation(raw)
+		original, err = stripJPEGMetadata(raw)
+	case "png":
+		original, err = stripPNGMetadata(raw)
+	case "gif":
+		original, err = stripGIFMetadata(raw)
+	}
+	if err != nil {
+		return nil, ErrBadImage
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, ErrBadImage
+	}
+
+	// поворот жил в EXIF, который мы вырезали: применяем его к пикселям
+	if orientation != 1 {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, orientImage(img, orientation), &jpeg.Options{Quality: jpegQuality}); err != nil {
+			return nil, err
+		}
+		original = buf.Bytes()
+	}
+
+	p := &processedImage{Original: original, Width: cfg.Width, Height: cfg.Height}
+	if orientation >= 5 {
+		p.Width, p.Height = cfg.Height, cfg.Width
+	}
+
+	if cfg.Width <= thumbMaxSide && cfg.Height <= thumbMaxSide {
+		return p, nil
+	}
+	tw, th := thumbSize(cfg.Width, cfg.Height)
+	thumb := orientImage(resizeArea(img, tw, th), orientation)
+
+	var buf bytes.Buffer
+	if hasAlpha(thumb) {
+		err = png.Encode(&buf, thumb)
+		p.ThumbContentType = "image/png"
+	} else {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: jpegQuality - 10})
+		p.ThumbContentType = "image/jpeg"
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.Thumb = buf.Bytes()
+	return p, nil
+}
+
+func thumbSize(w, h int) (int, int) {
+	if w >= h {
+		return thumbMaxSide, max(1, h*thumbMaxSide/w)
+	}
+	return max(1, w*thumbMaxSide/h), thumbMaxSide
+}
+
+// resizeArea — уменьшение усреднением по площади: каждый пиксель миниатюры —
+// среднее своего прямоугольника исходника. Для уменьшения этого достаточно.
+func resizeArea(src image.Image, w, h int) *image.RGBA {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*sh/h, b.Min.Y+(y+1)*sh/h
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*sw/w, b.Min.X+(x+1)*sw/w
+			if x1 == x0 {
+				x1++
+			}
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8(r / n >> 8), G: uint8(g / n >> 8), B: uint8(bl / n >> 8), A: uint8(a / n >> 8),
+			})
+		}
+	}
+	return dst
+}
+
+func hasAlpha(img *image.RGBA) bool {
+	for i := 3; i < len(img.Pix); i += 4 {
+		if img.Pix[i] != 0xff {
+			return true
+		}
+	}
+	return false
+}
+
+// orientImage применяет EXIF Orientation (1–8) к пикселям.
+func orientImage(src image.Image, orientation int) *image.RGBA {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			sx, sy := x, y
+			switch orientation {
+			case 2:
+				sx = w - 1 - x
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sy = h - 1 - y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			dst.Set(x, y, src.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+// ===== JPEG =====
+
+// jpegOrientation — тег 0x0112 из IFD0 сегмента APP1 Exif; 1, если его нет.
+func jpegOrientation(raw []byte) int {
+	orientation := 1
+	_ = walkJPEGSegments(raw, func(marker byte, payload []byte) bool {
+		if marker != 0xE1 || !bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+			return true
+		}
+		tiff := payload[6:]
+		if len(tiff) < 8 {
+			return false
+		}
+		var bo binary.ByteOrder
+		switch string(tiff[:2]) {
+		case "II":
+			bo = binary.LittleEndian
+		case "MM":
+			bo = binary.BigEndian
+		default:
+			return false
+		}
+		ifd := int(bo.Uint32(tiff[4:8]))
+		if ifd+2 > len(tiff) {
+			return false
+		}
+		n := int(bo.Uint16(tiff[ifd:]))
+		for i := 0; i < n; i++ {
+			e := ifd + 2 + i*12
+			if e+12 > len(tiff) {
+				break
+			}
+			if bo.Uint16(tiff[e:]) == 0x0112 {
+				if v := int(bo.Uint16(tiff[e+8:])); v >= 1 && v <= 8 {
+					orientation = v
+				}
+				break
+			}
+		}
+		return false
+	})
+	return orientation
+}
+
+// walkJPEGSegments вызывает fn для каждого сегмента до SOS; fn возвращает false, чтобы остановиться.
+func walkJPEGSegments(raw []byte, fn func(marker byte, payload []byte) bool) error {
+	if len(raw) < 2 || raw[0] != 0xFF || raw[1] != 0xD8 {
+		return ErrBadImage
+	}
+	i := 2
+	for i+4 <= len(raw) {
+		if raw[i] != 0xFF {
+			return ErrBadImage
+		}
+		marker := raw[i+1]
+		if marker == 0xDA { // дальше сжатые данные
+			return nil
+		}
+		n := int(binary.BigEndian.Uint16(raw[i+2:]))
+		if n < 2 || i+2+n > len(raw) {
+			return ErrBadImage
+		}
+		if !fn(marker, raw[i+4:i+2+n]) {
+			return nil
+		}
+		i += 2 + n
+	}
+	return ErrBadImage
+}
+
+// stripJPEGMetadata оставляет APP0 (JFIF), APP2 (ICC-профиль), APP14 (Adobe, нужен
+// для CMYK) и все не-APP сегменты; выкидывает EXIF/XMP (APP1), IPTC (APP13),
+// прочие APPn и комментарии.
+func stripJPEGMetadata(raw []byte) ([]byte, error) {
+	out := make([]byte, 0, len(raw))
+	out = append(out, 0xFF, 0xD8)
+	i := 2
+	for i+4 <= len(raw) {
+		if raw[i] != 0xFF {
+			return nil, ErrBadImage
+		}
+		marker := raw[i+1]
+		if marker == 0xDA {
+			return append(out, raw[i:]...), nil
+		}
+		n := int(binary.BigEndian.Uint16(raw[i+2:]))
+		if n < 2 || i+2+n > len(raw) {
+			return nil, ErrBadImage
+		}
+		isApp := marker >= 0xE0 && marker <= 0xEF
+		keep := (!isApp && marker != 0xFE) || marker == 0xE0 || marker == 0xE2 || marker == 0xEE
+		if keep {
+			out = append(out, raw[i:i+2+n]...)
+		}
+		i += 2 + n
+	}
+	return nil, ErrBadImage
+}
+
+// ===== PNG =====
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// stripPNGMetadata убирает текстовые чанки, eXIf и tIME; CRC остальных не меняется.
+func stripPNGMetadata(raw []byte) ([]byte, error) {
+	if !bytes.HasPrefix(raw, pngSignature) {
+		return nil, ErrBadImage
+	}
+	out := make([]byte, 0, len(raw))
+	out = append(out, pngSignature...)
+	i := len(pngSignature)
+	for i+12 <= len(raw) {
+		n := int(binary.BigEndian.Uint32(raw[i:]))
+		if n < 0 || i+12+n > len(raw) {
+			return nil, ErrBadImage
+		}
+		typ := string(raw[i+4 : i+8])
+		switch typ {
+		case "tEXt", "zTXt", "iTXt", "eXIf", "tIME":
+		default:
+			out = append(out, raw[i:i+12+n]...)
+		}
+		i += 12 + n
+		if typ == "IEND" {
+			return out, nil
+		}
+	}
+	return nil, ErrBadImage
+}
+
+// ===== GIF =====
+
+// stripGIFMetadata убирает комментарии и application-расширения (XMP и т.п.),
+// кроме NETSCAPE2.0/ANIMEXTS1.0 — в них число повторов анимации.
+func stripGIFMetadata(raw []byte) ([]byte, error) {
+	if len(raw) < 13 || (string(raw[:6]) != "GIF87a" && string(raw[:6]) != "GIF89a") {
+		return nil, ErrBadImage
+	}
+	i := 13
+	if raw[10]&0x80 != 0 { // глобальная палитра
+		i += 3 << (raw[10]&0x07 + 1)
+	}
+	if i > len(raw) {
+		return nil, ErrBadImage
+	}
+	out := make([]byte, 0, len(raw))
+	out = append(out, raw[:i]...)
+
+	// subBlocks возвращает конец цепочки подблоков, начинающейся с j
+	subBlocks := func(j int) (int, error) {
+		for j < len(raw) {
+			n := int(raw[j])
+			j++
+			if n == 0 {
+				return j, nil
+			}
+			j += n
+		}
+		return 0, ErrBadImage
+	}
+
+	for i < len(raw) {
+		switch raw[i] {
+		case 0x3B: // трейлер
+			return append(out, 0x3B), nil
+		case 0x21: // расширение
+			if i+2 > len(raw) {
+				return nil, ErrBadImage
+			}
+			end, err := subBlocks(i + 2)
+			if err != nil {
+				return nil, err
+			}
+			keep := true
+			switch raw[i+1] {
+			case 0xFE:
+				keep = false
+			case 0xFF:
+				id := raw[i+2 : min(i+14, len(raw))]
+				keep = bytes.HasPrefix(id, []byte("\x0bNETSCAPE2.0")) || bytes.HasPrefix(id, []byte("\x0bANIMEXTS1.0"))
+			}
+			if keep {
+				out = append(out, raw[i:end]...)
+			}
+			i = end
+		case 0x2C: // кадр
+			j := i + 10
+			if j > len(raw) {
+				return nil, ErrBadImage
+			}
+			if raw[i+9]&0x80 != 0 { // локальная палитра
+				j += 3 << (raw[i+9]&0x07 + 1)
+			}
+			end, err := subBlocks(j + 1) // +1: минимальный размер кода LZW
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, raw[i:end]...)
+			i = end
+		default:
+			return nil, ErrBadImage
+		}
+	}
+	return nil, ErrBadImage
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// twoTone — левая половина красная, правая синяя: по ней видно, куда повернули.
+func twoTone(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{R: 255, A: 255}
+			if x >= w/2 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func encodeJPEG(t testing.TB, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodePNG(t testing.TB, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// exifSegment — APP1 Exif с тегом Orientation и «координатами» следом за IFD.
+func exifSegment(orientation uint16) []byte {
+	tiff := []byte("II*\x00\x08\x00\x00\x00")
+	tiff = binary.LittleEndian.AppendUint16(tiff, 1) // одна запись в IFD0
+	tiff = binary.LittleEndian.AppendUint16(tiff, 0x0112)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 3) // SHORT
+	tiff = binary.LittleEndian.AppendUint32(tiff, 1)
+	tiff = binary.LittleEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0)
+	tiff = append(tiff, "GPSLatitude 55.7558 N"...)
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	return jpegSegment(0xE1, payload)
+}
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	seg := []byte{0xFF, marker}
+	seg = binary.BigEndian.AppendUint16(seg, uint16(len(payload)+2))
+	return append(seg, payload...)
+}
+
+// withSegments вставляет сегменты сразу после SOI.
+func withSegments(raw []byte, segs ...[]byte) []byte {
+	out := append([]byte{}, raw[:2]...)
+	for _, s := range segs {
+		out = append(out, s...)
+	}
+	return append(out, raw[2:]...)
+}
+
+func pngChunk(typ string, data []byte) []byte {
+	c := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	c = append(c, typ...)
+	c = append(c, data...)
+	return binary.BigEndian.AppendUint32(c, crc32.ChecksumIEEE(c[4:]))
+}
+
+// withPNGChunks вставляет чанки после IHDR.
+func withPNGChunks(raw []byte, chunks ...[]byte) []byte {
+	ihdrEnd := len(pngSignature) + 12 + 13
+	out := append([]byte{}, raw[:ihdrEnd]...)
+	for _, c := range chunks {
+		out = append(out, c...)
+	}
+	return append(out, raw[ihdrEnd:]...)
+}
+
+func TestProcessImageStripsJPEGMetadata(t *testing.T) {
+	clean := encodeJPEG(t, twoTone(40, 20))
+	raw := withSegments(clean,
+		exifSegment(1),
+		jpegSegment(0xED, []byte("Photoshop 3.0\x00IPTC city")),
+		jpegSegment(0xFE, []byte("comment: taken at home")),
+	)
+
+	p, err := processImage(raw, "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// без поворота не перекодируем: ровно исходные байты без метаданных
+	if !bytes.Equal(p.Original, clean) {
+		t.Fatalf("original is %d bytes, want the %d clean bytes", len(p.Original), len(clean))
+	}
+	for _, leak := range []string{"Exif", "GPSLatitude", "IPTC", "taken at home"} {
+		if bytes.Contains(p.Original, []byte(leak)) {
+			t.Errorf("%q left in the image", leak)
+		}
+	}
+	if p.Width != 40 || p.Height != 20 || p.Thumb != nil {
+		t.Fatalf("%dx%d, thumb %d bytes", p.Width, p.Height, len(p.Thumb))
+	}
+}
+
+func TestProcessImageKeepsICCProfile(t *testing.T) {
+	clean := encodeJPEG(t, twoTone(8, 8))
+	icc := jpegSegment(0xE2, []byte("ICC_PROFILE\x00\x01\x01profile"))
+	p, err := processImage(withSegments(clean, icc, exifSegment(1)), "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p.Original, withSegments(clean, icc)) {
+		t.Fatal("ICC profile not kept as is")
+	}
+}
+
+// Orientation 6 (повернуть на 90° по часовой): EXIF вырезан, поворот применён к пикселям.
+func TestProcessImageAppliesOrientation(t *testing.T) {
+	raw := withSegments(encodeJPEG(t, twoTone(40, 20)), exifSegment(6))
+	if o := jpegOrientation(raw); o != 6 {
+		t.Fatalf("orientation %d", o)
+	}
+
+	p, err := processImage(raw, "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Width != 20 || p.Height != 40 {
+		t.Fatalf("reported %dx%d, want 20x40", p.Width, p.Height)
+	}
+	if bytes.Contains(p.Original, []byte("Exif")) {
+		t.Fatal("EXIF left in the rotated image")
+	}
+	img, err := jpeg.Decode(bytes.NewReader(p.Original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 20 || b.Dy() != 40 {
+		t.Fatalf("pixels %dx%d, want 20x40", b.Dx(), b.Dy())
+	}
+	// левая (красная) половина ушла наверх
+	if r, _, b, _ := img.At(10, 5).RGBA(); r < b {
+		t.Error("top is not red")
+	}
+	if r, _, b, _ := img.At(10, 35).RGBA(); b < r {
+		t.Error("bottom is not blue")
+	}
+}
+
+func TestOrientImageAllOrientations(t *testing.T) {
+	// 2x1: красный, синий
+	src := twoTone(2, 1)
+	red, blue := color.RGBA{R: 255, A: 255}, color.RGBA{B: 255, A: 255}
+	cases := map[int][]color.RGBA{ // пиксели результата построчно
+		1: {red, blue},
+		2: {blue, red},
+		3: {blue, red},
+		4: {red, blue},
+		5: {red, blue},
+		6: {red, blue},
+		7: {blue, red},
+		8: {blue, red},
+	}
+	for o, want := range cases {
+		dst := orientImage(src, o)
+		var got []color.RGBA
+		for y := 0; y < dst.Bounds().Dy(); y++ {
+			for x := 0; x < dst.Bounds().Dx(); x++ {
+				got = append(got, dst.RGBAAt(x, y))
+			}
+		}
+		if o >= 5 && dst.Bounds().Dx() != 1 {
+			t.Errorf("orientation %d: not transposed", o)
+		}
+		if len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+			t.Errorf("orientation %d: got %v", o, got)
+		}
+	}
+}
+
+func TestProcessImageRotatedThumb(t *testing.T) {
+	raw := withSegments(encodeJPEG(t, twoTone(640, 320)), exifSegment(6))
+	p, err := processImage(raw, "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ThumbContentType != "image/jpeg" {
+		t.Fatalf("thumb type %q", p.ThumbContentType)
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(p.Thumb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != 160 || cfg.Height != 320 {
+		t.Fatalf("thumb %dx%d, want 160x320", cfg.Width, cfg.Height)
+	}
+}
+
+func TestProcessImageStripsPNGMetadata(t *testing.T) {
+	clean := encodePNG(t, twoTone(10, 10))
+	raw := withPNGChunks(clean,
+		pngChunk("tEXt", []byte("Comment\x00GPS 55.75 37.61")),
+		pngChunk("eXIf", []byte("MM\x00*")),
+		pngChunk("tIME", []byte{0x07, 0xE8, 1, 2, 3, 4, 5}),
+	)
+	p, err := processImage(raw, "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p.Original, clean) {
+		t.Fatalf("original is %d bytes, want the %d clean bytes", len(p.Original), len(clean))
+	}
+}
+
+func TestProcessImagePNGAlphaThumb(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 400, 400)) // прозрачная
+	p, err := processImage(encodePNG(t, img), "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ThumbContentType != "image/png" {
+		t.Fatalf("transparent thumb as %q", p.ThumbContentType)
+	}
+}
+
+func TestProcessImageStripsGIFComments(t *testing.T) {
+	pal := color.Palette{color.Black, color.White}
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, image.NewPaletted(image.Rect(0, 0, 4, 4), pal), nil); err != nil {
+		t.Fatal(err)
+	}
+	clean := buf.Bytes()
+	i := 13
+	if clean[10]&0x80 != 0 {
+		i += 3 << (clean[10]&0x07 + 1)
+	}
+	comment := append([]byte{0x21, 0xFE, 10}, "secret gps"...)
+	comment = append(comment, 0)
+	raw := append(append(append([]byte{}, clean[:i]...), comment...), clean[i:]...)
+
+	p, err := processImage(raw, "image/gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(p.Original, []byte("secret gps")) {
+		t.Fatal("gif comment left")
+	}
+	if _, err := gif.Decode(bytes.NewReader(p.Original)); err != nil {
+		t.Fatalf("stripped gif: %v", err)
+	}
+}
+
+func TestProcessImageRejects(t *testing.T) {
+	// IHDR на 60000x60000: одна конфигурация, без пикселей
+	ihdr := binary.BigEndian.AppendUint32(nil, 60000)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, 60000)
+	ihdr = append(ihdr, 8, 2, 0, 0, 0)
+	bomb := append(append([]byte{}, pngSignature...), pngChunk("IHDR", ihdr)...)
+
+	cases := map[string]struct {
+		raw []byte
+		ct  string
+	}{
+		"png declared as jpeg": {encodePNG(t, twoTone(4, 4)), "image/jpeg"},
+		"too many pixels":      {bomb, "image/png"},
+		"truncated jpeg":       {encodeJPEG(t, twoTone(4, 4))[:20], "image/jpeg"},
+		"not an image":         {[]byte("hello"), "image/png"},
+	}
+	for name, c := range cases {
+		if _, err := processImage(c.raw, c.ct); !errors.Is(err, ErrBadImage) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func FuzzProcessImage(f *testing.F) {
+	f.Add(withSegments(encodeJPEG(f, twoTone(8, 4)), exifSegment(6)), "image/jpeg")
+	f.Add(withPNGChunks(encodePNG(f, twoTone(8, 4)), pngChunk("tEXt", []byte("k\x00v"))), "image/png")
+	var buf bytes.Buffer
+	_ = gif.Encode(&buf, image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.Black, color.White}), nil)
+	f.Add(buf.Bytes(), "image/gif")
+
+	f.Fuzz(func(t *testing.T, raw []byte, ct string) {
+		if !isProcessableImage(ct) {
+			return
+		}
+		// во время фаззинга большие картинки только тормозят
+		if cfg, _, err := image.DecodeConfig(bytes.NewReader(raw)); err == nil && cfg.Width*cfg.Height > 1<<20 {
+			return
+		}
+		p, err := processImage(raw, ct)
+		if err != nil {
+			return
+		}
+		cfg, format, err := image.DecodeConfig(bytes.NewReader(p.Original))
+		if err != nil {
+			t.Fatalf("processed original does not decode: %v", err)
+		}
+		if "image/"+format != ct {
+			t.Fatalf("format changed to %s", format)
+		}
+		if p.Width <= 0 || p.Height <= 0 || cfg.Width*cfg.Height != p.Width*p.Height {
+			t.Fatalf("reported %dx%d, decoded %dx%d", p.Width, p.Height, cfg.Width, cfg.Height)
+		}
+		if ct == "image/jpeg" && jpegOrientation(p.Original) != 1 {
+			t.Fatal("orientation left in the original")
+		}
+	})
+}
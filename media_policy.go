@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ===== Какие файлы можно загружать в plain_media =====
+//
+// Шаблоны MIME: "application/pdf", "image/*" или "*". Настраиваются флагами
+// -media-allow, -media-deny и -media-limits (см. main.go).
+
+const (
+	defaultMediaAllow = "*"
+	// html и svg браузер исполняет прямо с нашего origin, исполняемые файлы — просто незачем
+	defaultMediaDeny   = "text/html,application/xhtml+xml,image/svg+xml,application/x-msdownload,application/x-dosexec,application/x-executable,application/x-sh"
+	defaultMediaLimits = "image/*=20,*=50"
+)
+
+var (
+	ErrMediaTypeNotAllowed = errors.New("file type not allowed")
+	ErrMediaTooLarge       = errors.New("file too large")
+)
+
+type mediaSizeLimit struct {
+	pattern string
+	max     int64
+}
+
+type MediaPolicy struct {
+	allow  []string
+	deny   []string
+	limits []mediaSizeLimit // первый подходящий шаблон выигрывает
+}
+
+// parseMediaPolicy: allow и deny — списки шаблонов через запятую,
+// limits — "шаблон=MiB" через запятую, например "image/*=20,video/*=200,*=50".
+func parseMediaPolicy(allow, deny, limits string) (*MediaPolicy, error) {
+	p := &MediaPolicy{
+		allow: splitMIMEPatterns(allow),
+		deny:  splitMIMEPatterns(deny),
+	}
+	for _, item := range strings.Split(limits, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pattern, size, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("media limit %q: expected pattern=MiB", item)
+		}
+		mib, err := strconv.ParseInt(strings.TrimSpace(size), 10, 64)
+		if err != nil || mib <= 0 {
+			return nil, fmt.Errorf("media limit %q: bad size", item)
+		}
+		p.limits = append(p.limits, mediaSizeLimit{pattern: strings.ToLower(strings.TrimSpace(pattern)), max: mib << 20})
+	}
+	if len(p.limits) == 0 {
+		return nil, errors.New("no media size limits configured")
+	}
+	return p, nil
+}
+
+func splitMIMEPatterns(list string) []string {
+	var out []string
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.ToLower(strings.TrimSpace(s)); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func matchMIME(pattern, contentType string) bool {
+	if pattern == "*" || pattern == contentType {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return strings.HasPrefix(contentType, prefix+"/")
+	}
+	return false
+}
+
+func matchAnyMIME(patterns []string, contentType string) bool {
+	for _, p := range patterns {
+		if matchMIME(p, contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check возвращает лимит размера для типа или ErrMediaTypeNotAllowed.
+// Запрет сильнее разрешения; тип без подходящего лимита тоже не пускаем.
+func (p *MediaPolicy) Check(contentType string) (int64, error) {
+	if matchAnyMIME(p.deny, contentType) || !matchAnyMIME(p.allow, contentType) {
+		return 0, ErrMediaTypeNotAllowed
+	}
+	for _, l := range p.limits {
+		if matchMIME(l.pattern, contentType) {
+			return l.max, nil
+		}
+	}
+	return 0, ErrMediaTypeNotAllowed
+}
+
+// MaxSize — самый большой из лимитов: столько максимум читаем из тела запроса.
+func (p *MediaPolicy) MaxSize() int64 {
+	var max int64
+	for _, l := range p.limits {
+		if l.max > max {
+			max = l.max
+		}
+	}
+	return max
+}
+
+// normalizeContentType: без параметров и в нижнем регистре. Пустой или
+// application/octet-stream от браузера уточняем по расширению. Это только то,
+// что заявил клиент; настоящий тип определяет detectContentType по байтам.
+func normalizeContentType(declared, filename string) string {
+	ct := ""
+	if mt, _, err := mime.ParseMediaType(declared); err == nil {
+		ct = strings.ToLower(mt)
+	}
+	if ct == "" || ct == "application/octet-stream" {
+		if byExt := mime.TypeByExtension(strings.ToLower(filepath.Ext(filename))); byExt != "" {
+			if mt, _, err := mime.ParseMediaType(byExt); err == nil {
+				return strings.ToLower(mt)
+			}
+		}
+	}
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	return ct
+}
+
+// ===== Тип по содержимому =====
+//
+// Заявленному клиентом типу не верим: браузер отдаст файл с тем типом, который
+// мы сохранили, и html или svg под видом картинки исполнится с нашего origin.
+// Поэтому тип берём из байтов (http.DetectContentType), а заявленный используем
+// только там, где байты неоднозначны: текст (csv, json, markdown), zip-контейнеры
+// (docx, apk), ogg/webm без видео. Разметку html/svg не принимаем вовсе.
+
+var ErrActiveContent = errors.New("html/svg content is not allowed")
+
+// sniffLen — сколько первых байт смотрит http.DetectContentType
+const sniffLen = 512
+
+// isActiveContentType — типы, которые браузер исполняет, если открыть файл напрямую.
+// Такие записи (загруженные до проверки по байтам) отдаются как octet-stream.
+func isActiveContentType(ct string) bool {
+	switch ct {
+	case "text/html", "application/xhtml+xml", "image/svg+xml",
+		"text/xml", "application/xml", "text/xsl",
+		"text/javascript", "application/javascript", "application/ecmascript":
+		return true
+	}
+	return strings.HasSuffix(ct, "+xml")
+}
+
+// looksLikeActiveMarkup ловит то, что DetectContentType не считает html:
+// svg, xhtml и html с нестандартным началом.
+func looksLikeActiveMarkup(head []byte) bool {
+	h := bytes.ToLower(bytes.TrimLeft(bytes.TrimPrefix(head, []byte("\xef\xbb\xbf")), " \t\r\n"))
+	if !bytes.HasPrefix(h, []byte("<")) {
+		return false
+	}
+	for _, tag := range []string{"<svg", "<html", "<script", "<!doctype html", "http://www.w3.org/1999/xhtml"} {
+		if bytes.Contains(h, []byte(tag)) {
+			return true
+		}
+	}
+	return false
+}
+
+// уточнения, которые заявленный тип может внести в тип по байтам
+var sniffRefinements = map[string][]string{
+	"application/ogg": {"audio/ogg", "video/ogg", "audio/opus"},
+	"video/webm":      {"audio/webm"},
+	"video/mp4":       {"audio/mp4"},
+	"audio/mpeg":      {"audio/mp3"},
+}
+
+// detectContentType — тип файла по первым байтам (head) с учётом заявленного.
+func detectContentType(declared, filename string, head []byte) (string, error) {
+	if len(head) > sniffLen {
+		head = head[:sniffLen]
+	}
+	if looksLikeActiveMarkup(head) {
+		return "", ErrActiveContent
+	}
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if sniffed == "text/html" {
+		return "", ErrActiveContent
+	}
+	hint := normalizeContentType(declared, filename)
+
+	switch sniffed {
+	case "text/plain":
+		if (strings.HasPrefix(hint, "text/") || hint == "application/json") && !isActiveContentType(hint) {
+			return hint, nil
+		}
+		return sniffed, nil
+	case "application/octet-stream", "application/zip":
+		// байты не опознаны или это контейнер: берём заявленный тип, но не даём
+		// бинарю назваться картинкой, текстом или разметкой
+		if strings.HasPrefix(hint, "image/") || strings.HasPrefix(hint, "text/") || isActiveContentType(hint) {
+			return sniffed, nil
+		}
+		return hint, nil
+	}
+	for _, alt := range sniffRefinements[sniffed] {
+		if hint == alt {
+			return hint, nil
+		}
+	}
+	// картинки, аудио, видео, pdf, архивы — как определилось по байтам
+	return sniffed, nil
+}
+
+// sanitizeFilename — имя файла для базы и Content-Disposition: без пути,
+// управляющих символов и кавычек, не длиннее maxFilenameLen байт.
+const maxFilenameLen = 200
+
+func sanitizeFilename(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == '"' || r == utf8.RuneError || unicode.Is(unicode.Bidi_Control, r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.Trim(name, " .")
+	for len(name) > maxFilenameLen {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	if name == "" {
+		return "file"
+	}
+	return name
+}
+
+// contentDisposition — inline/attachment с именем; FormatMediaType сам кодирует
+// не-ASCII по RFC 2231, а если не справился — отдаём без имени.
+func contentDisposition(disposition, filename string) string {
+	if v := mime.FormatMediaType(disposition, map[string]string{"filename": sanitizeFilename(filename)}); v != "" {
+		return v
+	}
+	return disposition
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+var (
+	pngHead  = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	jpegHead = []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00")
+	pdfHead  = []byte("%PDF-1.7\n")
+	zipHead  = []byte("PK\x03\x04\x14\x00\x00\x00")
+	oggHead  = []byte("OggS\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00")
+)
+
+func TestDetectContentType(t *testing.T) {
+	cases := []struct {
+		name, declared, filename string
+		head                     []byte
+		want                     string
+	}{
+		{"png as declared", "image/png", "a.png", pngHead, "image/png"},
+		{"png declared as jpeg", "image/jpeg", "a.jpg", pngHead, "image/png"},
+		{"jpeg without declared type", "", "photo", jpegHead, "image/jpeg"},
+		{"pdf declared as image", "image/png", "doc.png", pdfHead, "application/pdf"},
+		{"csv text", "text/csv", "t.csv", []byte("a,b\n1,2\n"), "text/csv"},
+		{"json text", "application/json", "x.json", []byte(`{"a": 1}`), "application/json"},
+		{"text claiming javascript", "application/javascript", "x.js", []byte("alert(1)"), "text/plain"},
+		{"docx in zip", "application/vnd.openxmlformats-officedocument.wordprocessingml.document", "a.docx", zipHead,
+			"application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+		{"zip claiming image", "image/png", "a.png", zipHead, "application/zip"},
+		{"unknown bytes claiming text", "text/plain", "a.txt", []byte("\x00\x01\x02\x03"), "application/octet-stream"},
+		{"unknown bytes claiming svg", "image/svg+xml", "a.svg", []byte("\x00\x01\x02\x03"), "application/octet-stream"},
+		{"unknown bytes as declared", "application/x-custom", "a.bin", []byte("\x00\x01\x02\x03"), "application/x-custom"},
+		{"ogg refined to opus", "audio/opus", "v.opus", oggHead, "audio/opus"},
+		{"ogg with foreign hint", "image/png", "v.png", oggHead, "application/ogg"},
+		{"octet-stream uses extension", "application/octet-stream", "a.png", pngHead, "image/png"},
+	}
+	for _, c := range cases {
+		got, err := detectContentType(c.declared, c.filename, c.head)
+		if err != nil || got != c.want {
+			t.Errorf("%s: got %q, %v; want %q", c.name, got, err, c.want)
+		}
+	}
+}
+
+// html и svg, переименованные в картинку, отклоняются при любом заявленном типе.
+func TestDetectContentTypeRejectsMarkup(t *testing.T) {
+	cases := map[string]string{
+		"html":            "<html><body><script>alert(1)</script></body></html>",
+		"doctype":         "<!DOCTYPE html><p>hi",
+		"svg":             `<svg xmlns="http://www.w3.org/2000/svg" onload="alert(1)"/>`,
+		"svg after xml":   `<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"/>`,
+		"svg with bom":    "\xef\xbb\xbf  <svg/>",
+		"xhtml":           `<?xml version="1.0"?><html xmlns="http://www.w3.org/1999/xhtml">`,
+		"script only":     "<script>alert(1)</script>",
+		"uppercase":       "\r\n\t<SVG ONLOAD=alert(1)>",
+		"sniffed as html": "<!-- comment --><body>x",
+	}
+	for name, body := range cases {
+		for _, declared := range []string{"image/png", "text/plain", ""} {
+			if _, err := detectContentType(declared, "pic.png", []byte(body)); !errors.Is(err, ErrActiveContent) {
+				t.Errorf("%s declared %q: %v", name, declared, err)
+			}
+		}
+	}
+}
+
+func TestLooksLikeActiveMarkup(t *testing.T) {
+	cases := []struct {
+		head string
+		want bool
+	}{
+		{"<svg/>", true},
+		{"  \n<html>", true},
+		{"\xef\xbb\xbf<svg>", true},
+		{"<?xml version='1.0'?><svg>", true},
+		{"<!doctype HTML>", true},
+		{"<root xmlns='http://www.w3.org/1999/xhtml'/>", true},
+		{"<?xml version='1.0'?><note>plain xml</note>", false},
+		{"text that mentions <svg> later", false},
+		{"\x89PNG\r\n\x1a\n<svg>", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		if got := looksLikeActiveMarkup([]byte(c.head)); got != c.want {
+			t.Errorf("%q: got %v, want %v", c.head, got, c.want)
+		}
+	}
+}
+
+func TestIsActiveContentType(t *testing.T) {
+	for ct, want := range map[string]bool{
+		"text/html":                true,
+		"image/svg+xml":            true,
+		"application/atom+xml":     true,
+		"text/javascript":          true,
+		"image/png":                false,
+		"text/plain":               false,
+		"application/octet-stream": false,
+	} {
+		if got := isActiveContentType(ct); got != want {
+			t.Errorf("%s: got %v", ct, got)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ===== Квоты на медиа =====
+//
+// Занято пользователем = сумма размеров его файлов в plain_media (то, что он
+// загрузил сам; дубликаты, выданные дедупликацией, не считаются), его E2E-вложений
+// в e2e_media плюс заявленные размеры его незавершённых загрузок по частям — они
+// уже занимают место на диске.
+// Квота — users.media_quota, если админ её задал, иначе -media-quota. 0 — без ограничений.
+//
+// Файл больше всей квоты — 413 (не поместится никогда), не влезает в остаток — 507.
+//
+// checkMediaQuota — только ранний ответ с понятной ошибкой. Окончательно квота
+// проверяется в транзакции, которая вставляет запись (quotaCharge): запись уже
+// вставлена и входит в занятое, так что две параллельные загрузки не проскочат
+// в один и тот же остаток. Загрузка по частям резервирует место при create,
+// finalize квоту уже не проверяет.
+
+const defaultMediaQuotaMiB = 1024
+
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// quotaCharge проверяет квоту userID внутри транзакции, где его новая запись уже вставлена.
+type quotaCharge func(tx *sql.Tx, userID int64) error
+
+type MediaUsage struct {
+	Used    int64 // загруженные файлы и E2E-вложения
+	Pending int64 // незавершённые загрузки по частям
+	Files   int64
+	Quota   int64 // 0 — без ограничений
+	Custom  bool  // квота задана админом, а не по умолчанию
+}
+
+// Free — сколько ещё можно загрузить; -1 — без ограничений.
+func (u *MediaUsage) Free() int64 {
+	if u.Quota == 0 {
+		return -1
+	}
+	return max(0, u.Quota-u.Used-u.Pending)
+}
+
+func (s *Server) mediaUsage(userID int64) (*MediaUsage, error) {
+	used, files, err := s.plainMedia.UsageByUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	e2eUsed, e2eFiles, err := s.e2eMedia.UsageByUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	used, files = used+e2eUsed, files+e2eFiles
+	pending, err := s.mediaUploads.PendingBytes(userID)
+	if err != nil {
+		return nil, err
+	}
+	custom, err := s.users.MediaQuota(userID)
+	if err != nil {
+		return nil, err
+	}
+	u := &MediaUsage{Used: used, Pending: pending, Files: files, Quota: s.defaultMediaQuota}
+	if custom.Valid {
+		u.Quota, u.Custom = custom.Int64, true
+	}
+	return u, nil
+}
+
+// checkMediaQuota — влезет ли ещё size байт; ответ об ошибке уже записан, если false.
+func (s *Server) checkMediaQuota(w http.ResponseWriter, userID, size int64) bool {
+	u, err := s.mediaUsage(userID)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return false
+	}
+	if u.Quota == 0 {
+		return true
+	}
+	if size > u.Quota {
+		http.Error(w, fmt.Sprintf("file exceeds your storage quota (%.1f MiB)", mib(u.Quota)), http.StatusRequestEntityTooLarge)
+		return false
+	}
+	if size > u.Free() {
+		http.Error(w, fmt.Sprintf("storage quota exceeded: %.1f of %.1f MiB used", mib(u.Used+u.Pending), mib(u.Quota)), http.StatusInsufficientStorage)
+		return false
+	}
+	return true
+}
+
+// chargeMediaQuota — quotaCharge с квотой по умолчанию этого сервера.
+func (s *Server) chargeMediaQuota(tx *sql.Tx, userID int64) error {
+	used, quota, err := mediaUsageTx(tx, userID, s.defaultMediaQuota)
+	if err != nil {
+		return err
+	}
+	if quota > 0 && used > quota {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// writeQuotaExceeded — ответ, когда запись не прошла проверку в транзакции.
+func writeQuotaExceeded(w http.ResponseWriter) {
+	http.Error(w, "storage quota exceeded", http.StatusInsufficientStorage)
+}
+
+func mib(n int64) float64 { return float64(n) / (1 << 20) }
+
+// parseAdmins — список username через запятую из -admins.
+func parseAdmins(list string) map[string]bool {
+	admins := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			admins[name] = true
+		}
+	}
+	return admins
+}
+
+// authenticateAdmin: у API нет сессий, поэтому админские запросы несут логин и
+// пароль админа и проверяются так же, как /login.
+func (s *Server) authenticateAdmin(w http.ResponseWriter, username, password string) *User {
+	if !s.admins[username] || password == "" {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return nil
+	}
+	user, err := s.users.GetByUsername(username)
+	if err != nil {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return nil
+	}
+	if !secureEqual(deriveKeyFromPassword(password, user.PasswordSalt, s.crypto), user.PasswordHash) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return nil
+	}
+	return user
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// Параллельные загрузки по частям не должны вместе занять больше квоты:
+// проверка и резервирование идут в одной транзакции.
+func TestMediaQuotaConcurrentReserve(t *testing.T) {
+	s := newTestServer(t)
+	s.defaultMediaQuota = 100
+	alice, bob := newTestUser(t, s, "alice"), newTestUser(t, s, "bob")
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	ok, rejected := 0, 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			u := &MediaUpload{
+				ID: fmt.Sprintf("upload-%d", i), Kind: "direct", FromUserID: alice, Size: 30,
+				ContentType: "application/pdf", KeyWrapped: []byte("k"), KeyNonce: []byte("n"),
+			}
+			u.ToUserID.Int64, u.ToUserID.Valid = bob, true
+			err := s.mediaUploads.Create(u, s.chargeMediaQuota)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				ok++
+			case errors.Is(err, ErrQuotaExceeded):
+				rejected++
+			default:
+				t.Errorf("create %d: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if ok != 3 || rejected != 7 {
+		t.Fatalf("%d reserved, %d rejected; want 3 and 7", ok, rejected)
+	}
+	u, err := s.mediaUsage(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Pending != 90 {
+		t.Fatalf("pending %d, want 90", u.Pending)
+	}
+}
+
+func TestMediaQuotaChargesE2EMedia(t *testing.T) {
+	s := newTestServer(t)
+	s.defaultMediaQuota = 1000
+	alice, bob := newTestUser(t, s, "alice"), newTestUser(t, s, "bob")
+
+	upload := func(size int) int {
+		rec := httptest.NewRecorder()
+		s.handleE2EMediaUpload(rec, httptest.NewRequest(http.MethodPost,
+			fmt.Sprintf("/api/e2e_media/upload?from_user_id=%d&to_user_id=%d", alice, bob),
+			bytes.NewReader(bytes.Repeat([]byte{1}, size))))
+		return rec.Code
+	}
+	if code := upload(600); code != http.StatusOK {
+		t.Fatalf("first upload: %d", code)
+	}
+	u, err := s.mediaUsage(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Used != 600 || u.Files != 1 {
+		t.Fatalf("used %d in %d files, want 600 in 1", u.Used, u.Files)
+	}
+	if code := upload(600); code != http.StatusInsufficientStorage {
+		t.Fatalf("over quota: %d", code)
+	}
+	// получателю чужая загрузка в квоту не идёт
+	if u, err := s.mediaUsage(bob); err != nil || u.Used != 0 {
+		t.Fatalf("recipient usage: %+v, %v", u, err)
+	}
+}
+
+// Без Content-Length ранней проверки нет — квота всё равно держится при записи.
+func TestMediaQuotaE2EChunkedBody(t *testing.T) {
+	s := newTestServer(t)
+	s.defaultMediaQuota = 100
+	alice, bob := newTestUser(t, s, "alice"), newTestUser(t, s, "bob")
+
+	req := httptest.NewRequest(http.MethodPost,
+		fmt.Sprintf("/api/e2e_media/upload?from_user_id=%d&to_user_id=%d", alice, bob),
+		bytes.NewReader(make([]byte, 200)))
+	req.ContentLength = -1
+	rec := httptest.NewRecorder()
+	s.handleE2EMediaUpload(rec, req)
+	if rec.Code != http.StatusInsufficientStorage {
+		t.Fatalf("got %d", rec.Code)
+	}
+	var n int
+	if err := s.e2eMedia.db.QueryRow(`SELECT COUNT(*) FROM e2e_media`).Scan(&n); err != nil || n != 0 {
+		t.Fatalf("rows left: %d, %v", n, err)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// ===== Сегментированное шифрование медиа (enc_version 4) =====
+//
+// Открытый текст режется на сегменты по mediaSegmentSize, каждый сегмент —
+// отдельный AES-GCM под DEK записи. Nonce сегмента = 7 байт префикса || номер
+// сегмента (uint32) || флаг последнего сегмента. Поэтому сегменты нельзя
+// переставить, а файл нельзя незаметно обрезать: последний сегмент помечен.
+// Пустой сегмент бывает только у пустого файла.
+
+const (
+	mediaSegmentSize     = 64 << 10
+	mediaSegmentOverhead = 16 // тег GCM
+	mediaNoncePrefixSize = 7
+)
+
+var ErrMediaCorrupt = errors.New("media ciphertext corrupted or truncated")
+
+func segmentNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, 0, 12)
+	nonce = append(nonce, prefix[:mediaNoncePrefixSize]...)
+	nonce = binary.BigEndian.AppendUint32(nonce, index)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+func newMediaGCM(dek []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(dek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// segmentWriter шифрует всё, что в него пишут; Close дописывает последний сегмент.
+type segmentWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	aad    []byte
+	buf    []byte
+	index  uint32
+	out    []byte
+}
+
+func newSegmentWriter(w io.Writer, dek, noncePrefix, aad []byte) (*segmentWriter, error) {
+	aead, err := newMediaGCM(dek)
+	if err != nil {
+		return nil, err
+	}
+	return &segmentWriter{
+		w:      w,
+		aead:   aead,
+		prefix: noncePrefix,
+		aad:    aad,
+		buf:    make([]byte, 0, mediaSegmentSize),
+	}, nil
+}
+
+func (sw *segmentWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		// полный сегмент сбрасываем только когда пришли следующие байты:
+		// иначе не знаем, последний он или нет
+		if len(sw.buf) == mediaSegmentSize {
+			if err := sw.flush(false); err != nil {
+				return n, err
+			}
+		}
+		k := copy(sw.buf[len(sw.buf):mediaSegmentSize], p)
+		sw.buf = sw.buf[:len(sw.buf)+k]
+		p = p[k:]
+		n += k
+	}
+	return n, nil
+}
+
+func (sw *segmentWriter) flush(last bool) error {
+	sw.out = sw.aead.Seal(sw.out[:0], segmentNonce(sw.prefix, sw.index, last), sw.buf, sw.aad)
+	if _, err := sw.w.Write(sw.out); err != nil {
+		return err
+	}
+	sw.buf = sw.buf[:0]
+	sw.index++
+	return nil
+}
+
+func (sw *segmentWriter) Close() error {
+	return sw.flush(true)
+}
+
+// segmentedPlainSize — размер открытого текста по размеру шифртекста.
+func segmentedPlainSize(ctSize int64) int64 {
+	full := int64(mediaSegmentSize + mediaSegmentOverhead)
+	segments := (ctSize + full - 1) / full
+	if segments == 0 {
+		segments = 1
+	}
+	return ctSize - segments*mediaSegmentOverhead
+}
+
+// segmentedContent — io.ReadSeeker по открытому тексту поверх блоба: для Range
+// читаются и расшифровываются только нужные сегменты (http.ServeContent).
+type segmentedContent struct {
+	open   func(offset, length int64) (io.ReadCloser, error) // диапазон шифртекста
+	aead   cipher.AEAD
+	prefix []byte
+	aad    []byte
+	ctSize int64
+	size   int64
+
+	pos     int64
+	stream  io.ReadCloser // шифртекст начиная с сегмента nextSeg
+	nextSeg int64
+	in      []byte
+	out     []byte
+	plain   []byte // расшифрованные байты, начиная с pos
+}
+
+func newSegmentedContent(open func(offset, length int64) (io.ReadCloser, error), ctSize int64, dek, noncePrefix, aad []byte) (*segmentedContent, error) {
+	aead, err := newMediaGCM(dek)
+	if err != nil {
+		return nil, err
+	}
+	if ctSize < mediaSegmentOverhead {
+		return nil, ErrMediaCorrupt
+	}
+	return &segmentedContent{
+		open:   open,
+		aead:   aead,
+		prefix: noncePrefix,
+		aad:    aad,
+		ctSize: ctSize,
+		size:   segmentedPlainSize(ctSize),
+		in:     make([]byte, mediaSegmentSize+mediaSegmentOverhead),
+	}, nil
+}
+
+func (c *segmentedContent) Size() int64 { return c.size }
+
+func (c *segmentedContent) Read(p []byte) (int, error) {
+	if len(c.plain) == 0 {
+		if c.pos >= c.size {
+			return 0, io.EOF
+		}
+		if err := c.load(c.pos / mediaSegmentSize); err != nil {
+			return 0, err
+		}
+		c.plain = c.plain[c.pos%mediaSegmentSize:]
+	}
+	n := copy(p, c.plain)
+	c.plain = c.plain[n:]
+	c.pos += int64(n)
+	return n, nil
+}
+
+// load расшифровывает сегмент seg; поток шифртекста переоткрывается только при прыжке.
+func (c *segmentedContent) load(seg int64) error {
+	full := int64(mediaSegmentSize + mediaSegmentOverhead)
+	if c.stream == nil || c.nextSeg != seg {
+		if c.stream != nil {
+			c.stream.Close()
+		}
+		stream, err := c.open(seg*full, c.ctSize-seg*full)
+		if err != nil {
+			return err
+		}
+		c.stream, c.nextSeg = stream, seg
+	}
+
+	segLen := min(full, c.ctSize-seg*full)
+	if _, err := io.ReadFull(c.stream, c.in[:segLen]); err != nil {
+		return ErrMediaCorrupt
+	}
+	last := seg*full+segLen == c.ctSize
+	plain, err := c.aead.Open(c.out[:0], segmentNonce(c.prefix, uint32(seg), last), c.in[:segLen], c.aad)
+	if err != nil {
+		return ErrMediaCorrupt
+	}
+	c.out, c.plain = plain, plain
+	c.nextSeg++
+	return nil
+}
+
+func (c *segmentedContent) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += c.pos
+	case io.SeekEnd:
+		offset += c.size
+	default:
+		return 0, errors.New("bad whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset != c.pos {
+		c.pos = offset
+		c.plain = nil
+	}
+	return offset, nil
+}
+
+func (c *segmentedContent) Close() error {
+	if c.stream != nil {
+		return c.stream.Close()
+	}
+	return nil
+}
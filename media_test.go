@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// newTestMedia — картинка в личке from→to (или в беседе gid, если to == 0).
+func newTestMedia(t *testing.T, s *Server, from, to, gid int64) *PlainMedia {
+	t.Helper()
+	publicID, err := newMediaPublicID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm := &PlainMedia{PublicID: publicID, Kind: "direct", FromUserID: from, ContentType: "image/png", OriginalName: "a.png"}
+	if to != 0 {
+		pm.ToUserID = sql.NullInt64{Int64: to, Valid: true}
+	} else {
+		pm.Kind, pm.GroupID = "group", sql.NullInt64{Int64: gid, Valid: true}
+	}
+	m, err := s.plainMedia.Create(pm, nil, func(m *PlainMedia) error {
+		_, err := s.sealMedia(m, strings.NewReader("png"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func getMedia(s *Server, ref string, uid int64) int {
+	rec := httptest.NewRecorder()
+	s.handlePlainMediaGet(rec, httptest.NewRequest(http.MethodGet,
+		fmt.Sprintf("/api/plain_media/get?id=%s&user_id=%d", url.QueryEscape(ref), uid), nil))
+	return rec.Code
+}
+
+func TestMediaAccess(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob, eve := newTestUser(t, s, "alice"), newTestUser(t, s, "bob"), newTestUser(t, s, "eve")
+	g, err := s.groups.Create("team", alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uid := range []int64{alice, bob} {
+		if err := s.groupMembers.AddMember(g.ID, uid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	direct := newTestMedia(t, s, alice, bob, 0)
+	group := newTestMedia(t, s, bob, 0, g.ID)
+
+	cases := []struct {
+		name string
+		m    *PlainMedia
+		uid  int64
+		want int
+	}{
+		{"uploader", direct, alice, http.StatusOK},
+		{"recipient", direct, bob, http.StatusOK},
+		{"stranger", direct, eve, http.StatusNotFound},
+		{"group member", group, alice, http.StatusOK},
+		{"not a group member", group, eve, http.StatusNotFound},
+	}
+	for _, c := range cases {
+		if got := getMedia(s, c.m.PublicID, c.uid); got != c.want {
+			t.Errorf("%s: %d, want %d", c.name, got, c.want)
+		}
+	}
+}
+
+// Пересланное вложение открывает тот, кому переслали, — но только через сообщение.
+func TestMediaAccessForwarded(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob, carol := newTestUser(t, s, "alice"), newTestUser(t, s, "bob"), newTestUser(t, s, "carol")
+	m := newTestMedia(t, s, alice, bob, 0)
+	msg, err := s.sendChatMessage(&PlainMessage{FromUserID: alice, ToUserID: bob, Text: "file", Attachments: []string{m.PublicID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := getMedia(s, m.PublicID, carol); got != http.StatusNotFound {
+		t.Fatalf("before forward: %d", got)
+	}
+	body, _ := json.Marshal(ForwardRequest{UserID: bob, Kind: plainMessagesTable.kind, MessageID: msg.ID, ToUserID: carol})
+	rec := httptest.NewRecorder()
+	s.handleForward(rec, httptest.NewRequest(http.MethodPost, "/messages/forward", bytes.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("forward: %d %s", rec.Code, rec.Body)
+	}
+	if got := getMedia(s, m.PublicID, carol); got != http.StatusOK {
+		t.Fatalf("after forward: %d", got)
+	}
+}
+
+// Порядковый id не принимается ни на чтение, ни во вложения — даже от владельца.
+func TestMediaNumericIDRejected(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob := newTestUser(t, s, "alice"), newTestUser(t, s, "bob")
+	m := newTestMedia(t, s, alice, bob, 0)
+
+	ref := fmt.Sprint(m.ID)
+
+	if got := getMedia(s, ref, alice); got != http.StatusNotFound {
+		t.Errorf("get by numeric id: %d", got)
+	}
+	_, err := s.plainMessages.Create(&PlainMessage{FromUserID: alice, ToUserID: bob, Text: "x", Attachments: []string{ref}})
+	if !errors.Is(err, ErrBadAttachment) {
+		t.Errorf("attach by numeric id: %v", err)
+	}
+}
+
+// Маркер [[img:N]] старого сообщения при старте становится вложением и
+// переписывается на public_id; маркер чужого медиа остаётся текстом.
+func TestBackfillRewritesNumericMarkers(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob, eve := newTestUser(t, s, "alice"), newTestUser(t, s, "bob"), newTestUser(t, s, "eve")
+	own := newTestMedia(t, s, bob, alice, 0) // загружено собеседником — та же беседа
+	foreign := newTestMedia(t, s, eve, bob, 0)
+	text := fmt.Sprintf("смотри [[img:%d]] и [[img:%d]]", own.ID, foreign.ID)
+	msg, err := s.plainMessages.Create(&PlainMessage{FromUserID: alice, ToUserID: bob, Text: text})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// как база до обновления
+	db, sealer := s.plainMessages.db, s.plainMessages.sealer
+	if _, err := db.Exec(`UPDATE plain_media SET refs_tracked = 0, numeric_markers = 1`); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := backfillLegacyAttachments(db, sealer); err != nil || n != 1 {
+		t.Fatalf("converted %d, %v", n, err)
+	}
+	msgs, err := s.plainMessages.ListBetween(alice, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("смотри [[img:%s]] и [[img:%d]]", own.PublicID, foreign.ID)
+	if len(msgs) != 1 || msgs[0].ID != msg.ID || msgs[0].Text != want {
+		t.Fatalf("messages %+v, want text %q", msgs, want)
+	}
+	atts, err := s.attachments.ListFor(plainMessagesTable.kind, []int64{msg.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(atts[msg.ID]) != 1 || atts[msg.ID][0].ID != own.ID {
+		t.Fatalf("attachments %v", atts[msg.ID])
+	}
+	if got := stripAttachmentMarkers(msgs[0].Text, atts[msg.ID]); strings.Contains(got, own.PublicID) {
+		t.Fatalf("marker of own attachment not stripped: %q", got)
+	}
+	// поиск видит новый текст: токены пересобраны
+	found, err := s.plainMessages.Search(alice, own.PublicID, 10)
+	if err != nil || len(found) != 1 {
+		t.Fatalf("search by public id: %d, %v", len(found), err)
+	}
+
+	// второй запуск ничего не делает
+	if n, err := backfillLegacyAttachments(db, sealer); err != nil || n != 0 {
+		t.Fatalf("second pass converted %d, %v", n, err)
+	}
+}
+
+// База, где вложения уже посчитаны прежней версией: маркер только переписывается.
+func TestBackfillRewritesAfterEarlierBackfill(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob := newTestUser(t, s, "alice"), newTestUser(t, s, "bob")
+	m := newTestMedia(t, s, alice, bob, 0)
+	msg, err := s.plainMessages.Create(&PlainMessage{
+		FromUserID: alice, ToUserID: bob, Text: fmt.Sprintf("[[img:%d]]", m.ID), Attachments: []string{m.PublicID},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, sealer := s.plainMessages.db, s.plainMessages.sealer
+	if _, err := db.Exec(`UPDATE plain_media SET numeric_markers = 1`); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := backfillLegacyAttachments(db, sealer); err != nil || n != 0 {
+		t.Fatalf("converted %d, %v", n, err)
+	}
+	msgs, err := s.plainMessages.ListBetween(alice, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[[img:" + m.PublicID + "]]"; len(msgs) != 1 || msgs[0].ID != msg.ID || msgs[0].Text != want {
+		t.Fatalf("messages %+v, want text %q", msgs, want)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ===== Загрузка больших файлов по частям =====
+//
+// create → PUT частей с offset → finalize. Принятые части дописываются во временный
+// файл media_uploads/<id>.part, каждая — отдельной записью AES-GCM под ключом
+// загрузки (он обёрнут мастер-ключом и лежит в media_uploads.key_wrapped):
+//
+//	uint32 длина шифртекста || nonce (12) || шифртекст
+//
+// В AAD записи входит offset части, так что части нельзя переставить. Прогресс
+// (received, staged_len) пишется в базу после fsync файла: если клиент отвалился
+// посреди части, она просто не засчитана, и клиент продолжает с offset из status.
+// finalize читает временный файл потоком и шифрует его в обычный формат медиа.
+
+const (
+	mediaUploadsDir    = "media_uploads"
+	maxUploadChunkSize = 8 << 20
+	mediaUploadTTL     = 24 * time.Hour
+)
+
+var ErrUploadStagingCorrupt = errors.New("upload staging file corrupted")
+
+// uploadLocks — части одной загрузки пишутся по одной (файл и staged_len должны
+// сойтись), а разные загрузки друг друга не ждут. Запись о замке живёт, пока
+// его кто-то держит или ждёт.
+type uploadLocks struct {
+	mu    sync.Mutex
+	locks map[string]*uploadLock
+}
+
+type uploadLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newUploadLocks() *uploadLocks {
+	return &uploadLocks{locks: make(map[string]*uploadLock)}
+}
+
+// lock ждёт замок загрузки id; вернувшаяся функция его отпускает.
+func (l *uploadLocks) lock(id string) (unlock func()) {
+	l.mu.Lock()
+	ul := l.locks[id]
+	if ul == nil {
+		ul = &uploadLock{}
+		l.locks[id] = ul
+	}
+	ul.refs++
+	l.mu.Unlock()
+
+	ul.Lock()
+	return func() {
+		ul.Unlock()
+		l.mu.Lock()
+		if ul.refs--; ul.refs == 0 {
+			delete(l.locks, id)
+		}
+		l.mu.Unlock()
+	}
+}
+
+func newUploadID() (string, error) {
+	b, err := generateRandomBytes(16)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func uploadKeyAAD(uploadID string) []byte {
+	return []byte("mollysage-upload-key:" + uploadID)
+}
+
+func uploadChunkAAD(uploadID string, offset int64) []byte {
+	aad := []byte("mollysage-upload-chunk:" + uploadID)
+	return binary.BigEndian.AppendUint64(aad, uint64(offset))
+}
+
+func stagedUploadPath(uploadID string) string {
+	return filepath.Join(mediaUploadsDir, uploadID+".part")
+}
+
+// newUploadKey — ключ для временного файла, сразу обёрнутый мастер-ключом.
+func (s *Server) newUploadKey(u *MediaUpload) error {
+	key, err := generateRandomBytes(32)
+	if err != nil {
+		return err
+	}
+	u.KeyWrapped, u.KeyNonce, u.KeyVersion, err = s.keyring.WrapDataKey(key, uploadKeyAAD(u.ID))
+	return err
+}
+
+func (s *Server) uploadKey(u *MediaUpload) ([]byte, error) {
+	return s.keyring.UnwrapDataKey(u.KeyWrapped, u.KeyNonce, u.KeyVersion, uploadKeyAAD(u.ID))
+}
+
+// stageChunk дописывает часть во временный файл и возвращает его новую длину.
+// Всё, что лежит в файле после staged_len (недописанная прошлая часть), отрезается.
+func (s *Server) stageChunk(u *MediaUpload, data []byte) (int64, error) {
+	key, err := s.uploadKey(u)
+	if err != nil {
+		return 0, err
+	}
+	ct, nonce, err := aesGCMEncrypt(key, data, uploadChunkAAD(u.ID, u.Received))
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.MkdirAll(mediaUploadsDir, 0700); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(stagedUploadPath(u.ID), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if err := f.Truncate(u.StagedLen); err != nil {
+		return 0, err
+	}
+	record := binary.BigEndian.AppendUint32(nil, uint32(len(ct)))
+	record = append(record, nonce...)
+	record = append(record, ct...)
+	if _, err := f.WriteAt(record, u.StagedLen); err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	return u.StagedLen + int64(len(record)), nil
+}
+
+// stagedReader отдаёт открытый текст временного файла по порядку частей.
+type stagedReader struct {
+	r        io.Reader
+	key      []byte
+	uploadID string
+	offset   int64 // сколько байт файла уже отдано
+	plain    []byte
+}
+
+func (s *Server) openStagedUpload(u *MediaUpload) (io.ReadCloser, error) {
+	key, err := s.uploadKey(u)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(stagedUploadPath(u.ID))
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: &stagedReader{r: io.LimitReader(f, u.StagedLen), key: key, uploadID: u.ID},
+		Closer: f,
+	}, nil
+}
+
+func (sr *stagedReader) Read(p []byte) (int, error) {
+	for len(sr.plain) == 0 {
+		var hdr [4 + 12]byte
+		if _, err := io.ReadFull(sr.r, hdr[:]); err != nil {
+			if err == io.EOF {
+				return 0, io.EOF
+			}
+			return 0, ErrUploadStagingCorrupt
+		}
+		n := binary.BigEndian.Uint32(hdr[:4])
+		if n > maxUploadChunkSize+16 {
+			return 0, ErrUploadStagingCorrupt
+		}
+		ct := make([]byte, n)
+		if _, err := io.ReadFull(sr.r, ct); err != nil {
+			return 0, ErrUploadStagingCorrupt
+		}
+		plain, err := aesGCMDecrypt(sr.key, ct, hdr[4:], uploadChunkAAD(sr.uploadID, sr.offset))
+		if err != nil {
+			return 0, ErrUploadStagingCorrupt
+		}
+		sr.plain = plain
+		sr.offset += int64(len(plain))
+	}
+	k := copy(p, sr.plain)
+	sr.plain = sr.plain[k:]
+	return k, nil
+}
+
+// finalizeUpload шифрует принятый файл в plain_media. Вызывается после ClaimFinalize,
+// поэтому второй параллельный finalize сюда не попадёт.
+func (s *Server) finalizeUpload(u *MediaUpload, mediaPublicID string) (*PlainMedia, error) {
+	staged, err := s.openStagedUpload(u)
+	if err != nil {
+		return nil, err
+	}
+	defer staged.Close()
+
+	// при create был только заявленный тип — теперь проверяем его по байтам
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(staged, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	head = head[:n]
+	contentType, err := detectContentType(u.ContentType, u.OriginalName, head)
+	if err != nil {
+		return nil, err
+	}
+	maxSize, err := s.mediaPolicy.Check(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, contentType)
+	}
+	if u.Size > maxSize {
+		return nil, fmt.Errorf("%w (max %d MiB for %s)", ErrMediaTooLarge, maxSize>>20, contentType)
+	}
+
+	pm := &PlainMedia{
+		PublicID:     mediaPublicID,
+		Kind:         u.Kind,
+		FromUserID:   u.FromUserID,
+		ToUserID:     u.ToUserID,
+		GroupID:      u.GroupID,
+		ContentType:  contentType,
+		OriginalName: u.OriginalName,
+		Size:         u.Size,
+	}
+
+	if pm.ContentHash, err = s.stagedContentHash(u, pm); err != nil {
+		return nil, err
+	}
+	if dup := s.duplicateMedia(pm.ContentHash); dup != nil {
+		if err := s.mediaUploads.SetMediaPublicID(u.ID, dup.PublicID); err != nil {
+			return nil, err
+		}
+		_ = os.Remove(stagedUploadPath(u.ID))
+		return dup, nil
+	}
+
+	if isVoiceAudio(contentType) {
+		var info *audioInfo
+		err := s.readStaged(u, func(r io.Reader) (err error) {
+			info, err = analyzeAudio(r, contentType)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		pm.DurationMS, pm.Waveform = info.DurationMS, info.Waveform
+	}
+
+	var body io.Reader = io.MultiReader(bytes.NewReader(head), staged)
+	var img *processedImage
+	if isProcessableImage(contentType) {
+		// картинки ограничены политикой (по умолчанию 20 MiB) — их можно держать в памяти
+		raw, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(raw)) != u.Size {
+			return nil, fmt.Errorf("upload %s: staged %d bytes, expected %d", u.ID, len(raw), u.Size)
+		}
+		if img, err = processImage(raw, contentType); err != nil {
+			return nil, err
+		}
+		body, pm.Size = bytes.NewReader(img.Original), int64(len(img.Original))
+	}
+	// место зарезервировано при create
+	created, err := s.createMedia(pm, body, img, nil)
+	if err != nil {
+		return nil, err
+	}
+	_ = os.Remove(stagedUploadPath(u.ID))
+	return created, nil
+}
+
+// readStaged — отдельный проход по временному файлу (хэш, разбор аудио),
+// чтобы не держать большой файл в памяти.
+func (s *Server) readStaged(u *MediaUpload, fn func(r io.Reader) error) error {
+	staged, err := s.openStagedUpload(u)
+	if err != nil {
+		return err
+	}
+	defer staged.Close()
+	return fn(staged)
+}
+
+func (s *Server) stagedContentHash(u *MediaUpload, pm *PlainMedia) (hash []byte, err error) {
+	err = s.readStaged(u, func(r io.Reader) error {
+		hash, err = s.mediaContentHash(pm, r)
+		return err
+	})
+	return hash, err
+}
+
+// removeStaleUpload — под замком загрузки: часть, которая пишется прямо сейчас,
+// не останется без файла.
+func (s *Server) removeStaleUpload(id string) {
+	unlock := s.stageLocks.lock(id)
+	defer unlock()
+	if err := os.Remove(stagedUploadPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("upload janitor: %v", err)
+		return
+	}
+	if err := s.mediaUploads.Delete(id); err != nil {
+		log.Printf("upload janitor: %v", err)
+	}
+}
+
+// runUploadJanitor раз в interval удаляет брошенные и давно завершённые загрузки.
+func (s *Server) runUploadJanitor(interval time.Duration) {
+	for {
+		ids, err := s.mediaUploads.ListStale(mediaUploadTTL)
+		if err != nil {
+			log.Printf("upload janitor: %v", err)
+		}
+		for _, id := range ids {
+			s.removeStaleUpload(id)
+		}
+		time.Sleep(interval)
+	}
+}
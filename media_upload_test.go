@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+)
+
+type testUpload struct {
+	s        *Server
+	id       string
+	uid      int64
+	contents []byte
+}
+
+func newTestUpload(t *testing.T, contents []byte) *testUpload {
+	t.Helper()
+	chdirTemp(t)
+	s := newTestServer(t)
+	alice, bob := newTestUser(t, s, "alice"), newTestUser(t, s, "bob")
+
+	body, _ := json.Marshal(CreateUploadRequest{
+		Kind: "direct", FromUserID: alice, ToUserID: bob, Name: "doc.pdf", Size: int64(len(contents)), ContentType: "application/pdf",
+	})
+	rec := httptest.NewRecorder()
+	s.handleUploadCreate(rec, httptest.NewRequest(http.MethodPost, "/api/plain_media/upload/create", bytes.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("create: %d %s", rec.Code, rec.Body)
+	}
+	var st UploadStatusDTO
+	if err := json.NewDecoder(rec.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+	return &testUpload{s: s, id: st.UploadID, uid: alice, contents: contents}
+}
+
+func (u *testUpload) put(offset int64, data []byte) (int, UploadStatusDTO) {
+	rec := httptest.NewRecorder()
+	u.s.handleUploadChunk(rec, httptest.NewRequest(http.MethodPut,
+		fmt.Sprintf("/api/plain_media/upload/chunk?upload_id=%s&user_id=%d&offset=%d", u.id, u.uid, offset), bytes.NewReader(data)))
+	var st UploadStatusDTO
+	_ = json.NewDecoder(rec.Body).Decode(&st)
+	return rec.Code, st
+}
+
+func (u *testUpload) finalize() (int, MediaInfoDTO) {
+	rec := httptest.NewRecorder()
+	u.s.handleUploadFinalize(rec, httptest.NewRequest(http.MethodPost,
+		fmt.Sprintf("/api/plain_media/upload/finalize?upload_id=%s&user_id=%d", u.id, u.uid), nil))
+	var info MediaInfoDTO
+	_ = json.NewDecoder(rec.Body).Decode(&info)
+	return rec.Code, info
+}
+
+// stored — расшифрованное содержимое созданного медиа.
+func (u *testUpload) stored(t *testing.T, publicID string) []byte {
+	t.Helper()
+	m, err := u.s.plainMedia.GetByPublicID(publicID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := u.s.openMediaContent(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(rc); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+var testPDF = append([]byte("%PDF-1.4\n"), bytes.Repeat([]byte("0123456789"), 300)...)
+
+// Сервер упал посреди записи части: в файле хвост недописанной записи, в базе
+// прогресс до неё. Клиент повторяет часть с offset из status — хвост отрезается.
+func TestUploadResumeAfterTruncatedRecord(t *testing.T) {
+	u := newTestUpload(t, testPDF)
+	if code, _ := u.put(0, testPDF[:1000]); code != http.StatusOK {
+		t.Fatalf("first chunk: %d", code)
+	}
+	f, err := os.OpenFile(stagedUploadPath(u.id), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{0, 0, 3, 232, 1, 2, 3, 4, 5}); err != nil { // заголовок на 1000 байт и обрыв
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if code, st := u.put(1000, testPDF[1000:]); code != http.StatusOK || st.Offset != int64(len(testPDF)) {
+		t.Fatalf("resumed chunk: %d, offset %d", code, st.Offset)
+	}
+	code, info := u.finalize()
+	if code != http.StatusOK {
+		t.Fatalf("finalize: %d", code)
+	}
+	if got := u.stored(t, info.ID); !bytes.Equal(got, testPDF) {
+		t.Fatalf("stored %d bytes, want %d", len(got), len(testPDF))
+	}
+}
+
+func TestUploadOutOfOrderOffsets(t *testing.T) {
+	u := newTestUpload(t, testPDF)
+	if code, _ := u.put(0, testPDF[:1000]); code != http.StatusOK {
+		t.Fatalf("first chunk: %d", code)
+	}
+	for _, offset := range []int64{2000, 500, 0} { // забежали вперёд, повтор старой части
+		code, st := u.put(offset, testPDF[offset:offset+100])
+		if code != http.StatusConflict || st.Offset != 1000 {
+			t.Errorf("offset %d: %d, status offset %d", offset, code, st.Offset)
+		}
+	}
+	if code, _ := u.put(1000, testPDF[1000:]); code != http.StatusOK {
+		t.Fatalf("next chunk: %d", code)
+	}
+	code, info := u.finalize()
+	if code != http.StatusOK || !bytes.Equal(u.stored(t, info.ID), testPDF) {
+		t.Fatalf("finalize: %d", code)
+	}
+}
+
+func TestUploadDuplicateFinalize(t *testing.T) {
+	u := newTestUpload(t, testPDF)
+	if code, _ := u.finalize(); code != http.StatusConflict {
+		t.Fatalf("finalize before all chunks: %d", code)
+	}
+	if code, _ := u.put(0, testPDF); code != http.StatusOK {
+		t.Fatal(code)
+	}
+
+	var wg sync.WaitGroup
+	ids := make([]string, 4)
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			code, info := u.finalize()
+			if code != http.StatusOK {
+				t.Errorf("finalize %d: %d", i, code)
+			}
+			ids[i] = info.ID
+		}(i)
+	}
+	wg.Wait()
+	for _, id := range ids[1:] {
+		if id != ids[0] {
+			t.Fatalf("finalize returned different media: %v", ids)
+		}
+	}
+	var n int
+	if err := u.s.plainMedia.db.QueryRow(`SELECT COUNT(*) FROM plain_media`).Scan(&n); err != nil || n != 1 {
+		t.Fatalf("%d media rows, %v", n, err)
+	}
+	if code, _ := u.put(int64(len(testPDF)), []byte("x")); code != http.StatusConflict {
+		t.Fatalf("chunk after finalize: %d", code)
+	}
+}
+
+func TestUploadCorruptedStaging(t *testing.T) {
+	corrupt := map[string]func(data []byte) []byte{
+		"flipped byte": func(data []byte) []byte { data[len(data)-1] ^= 1; return data },
+		"truncated":    func(data []byte) []byte { return data[:len(data)-10] },
+		"bad length":   func(data []byte) []byte { data[0] = 0xff; return data },
+	}
+	for name, fn := range corrupt {
+		t.Run(name, func(t *testing.T) {
+			u := newTestUpload(t, testPDF)
+			if code, _ := u.put(0, testPDF); code != http.StatusOK {
+				t.Fatal(code)
+			}
+			data, err := os.ReadFile(stagedUploadPath(u.id))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(stagedUploadPath(u.id), fn(data), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if code, _ := u.finalize(); code != http.StatusInternalServerError {
+				t.Fatalf("finalize: %d", code)
+			}
+			var n int
+			if err := u.s.plainMedia.db.QueryRow(`SELECT COUNT(*) FROM plain_media`).Scan(&n); err != nil || n != 0 {
+				t.Fatalf("%d media rows, %v", n, err)
+			}
+			// загрузка не застряла в «finalize in progress»
+			up, err := u.s.mediaUploads.GetByID(u.id)
+			if err != nil || up.MediaPublicID.Valid {
+				t.Fatalf("upload after failed finalize: %+v, %v", up, err)
+			}
+		})
+	}
+}
+
+// Параллельные PUT одной части: засчитывается ровно одна.
+func TestUploadConcurrentChunks(t *testing.T) {
+	u := newTestUpload(t, testPDF)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	codes := map[int]int{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			code, _ := u.put(0, testPDF[:1000])
+			mu.Lock()
+			codes[code]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if codes[http.StatusOK] != 1 || codes[http.StatusConflict] != 7 {
+		t.Fatalf("codes %v", codes)
+	}
+	if len(u.s.stageLocks.locks) != 0 {
+		t.Fatalf("%d upload locks left", len(u.s.stageLocks.locks))
+	}
+}
+
+// Замок одной загрузки не держит другие.
+func TestUploadLocksIndependent(t *testing.T) {
+	l := newUploadLocks()
+	unlockA := l.lock("a")
+	done := make(chan struct{})
+	go func() {
+		l.lock("b")()
+		close(done)
+	}()
+	<-done
+	unlockA()
+	if len(l.locks) != 0 {
+		t.Fatalf("%d locks left", len(l.locks))
+	}
+}
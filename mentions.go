@@ -0,0 +1,87 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// ===== Упоминания в беседах =====
+//
+// При отправке в беседу @username сверяется с участниками (без учёта регистра),
+// найденные пишутся в mentions в одной транзакции с сообщением. @all (или
+// @everyone) упоминает всех участников, кроме автора, но только от владельца и
+// админов беседы — у остальных это просто текст. В пересланных сообщениях
+// упоминания не разбираются: уведомлять о чужом тексте незачем.
+//
+// У каждого упоминания есть отметка «прочитано»: /mentions — лента упоминаний
+// пользователя, /mentions/unread — сколько непрочитанных по беседам,
+// /mentions/read — отметить прочитанными (клиент шлёт, открыв беседу).
+
+const (
+	maxMentionsFeed     = 100
+	defaultMentionsFeed = 50
+)
+
+// имя — буквы, цифры и _ . -; точка или дефис в конце — уже пунктуация
+var mentionRe = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_@])@([\p{L}\p{N}_.\-]+)`)
+
+var mentionAllNames = map[string]bool{"all": true, "everyone": true}
+
+// parseMentions — имена из @упоминаний в тексте (в нижнем регистре, без повторов).
+func parseMentions(text string) []string {
+	if !strings.Contains(text, "@") {
+		return nil
+	}
+	seen := map[string]bool{}
+	var out []string
+	for _, m := range mentionRe.FindAllStringSubmatch(text, -1) {
+		name := strings.ToLower(strings.TrimRight(m[1], ".-"))
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		out = append(out, name)
+	}
+	return out
+}
+
+// resolveMentions заполняет msg.Mentions и msg.MentionAll по тексту сообщения.
+// Участник с именем all важнее @all: имя участника — обычное упоминание.
+func (s *Server) resolveMentions(msg *GroupMessage) error {
+	names := parseMentions(msg.Text)
+	if len(names) == 0 {
+		return nil
+	}
+	members, err := s.groupMembers.MemberNames(msg.GroupID)
+	if err != nil {
+		return err
+	}
+
+	wantAll := false
+	for _, name := range names {
+		if id, ok := members[name]; ok {
+			if id != msg.FromUserID {
+				msg.Mentions = append(msg.Mentions, id)
+			}
+			continue
+		}
+		if mentionAllNames[name] {
+			wantAll = true
+		}
+	}
+	if wantAll {
+		role, err := s.groupMembers.Role(msg.GroupID, msg.FromUserID)
+		if err != nil {
+			return err
+		}
+		msg.MentionAll = canModerate(role)
+	}
+	return nil
+}
+
+func mentionFields(mm *MessageMentions) ([]int64, bool) {
+	if mm == nil {
+		return nil, false
+	}
+	return mm.UserIDs, mm.All
+}
@@ -0,0 +1,86 @@
+package main
+
+import "testing"
+
+// newTestGroup — беседа с владельцем owner и участниками members.
+func newTestGroup(t *testing.T, s *Server, owner int64, members ...int64) int64 {
+	t.Helper()
+	g, err := s.groups.Create("team", owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uid := range append([]int64{owner}, members...) {
+		if err := s.groupMembers.AddMember(g.ID, uid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return g.ID
+}
+
+func TestMentionAllKeptOnMessage(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob := newTestUser(t, s, "alice"), newTestUser(t, s, "bob")
+	gid := newTestGroup(t, s, alice, bob)
+	solo := newTestGroup(t, s, bob)
+
+	cases := []struct {
+		name      string
+		gid, from int64
+		text      string
+		all       bool
+		mentioned []int64
+	}{
+		{"all", gid, alice, "@all привет", true, nil},
+		// все, кроме автора, упомянуты ещё и по имени — строк via_all нет
+		{"all and everyone by name", gid, alice, "@all и @bob", true, []int64{bob}},
+		// в беседе никого, кроме автора, — упоминать некого
+		{"alone", solo, bob, "@everyone", true, nil},
+		{"not an admin", gid, bob, "@all", false, nil},
+		{"by name", gid, bob, "@alice", false, []int64{alice}},
+	}
+	for _, c := range cases {
+		msg, err := s.sendGroupMessage(&GroupMessage{GroupID: c.gid, FromUserID: c.from, Text: c.text})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dtos, err := s.groupMessageDTOs([]*GroupMessage{msg}, pollViewer{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := dtos[0]
+		if d.MentionAll != c.all || len(d.Mentions) != len(c.mentioned) {
+			t.Errorf("%s: mention_all %v, mentions %v", c.name, d.MentionAll, d.Mentions)
+			continue
+		}
+		for i, id := range c.mentioned {
+			if d.Mentions[i] != id {
+				t.Errorf("%s: mentions %v, want %v", c.name, d.Mentions, c.mentioned)
+			}
+		}
+	}
+}
+
+// Сообщения, записанные до колонки mention_all, получают её из via_all при миграции.
+func TestMigrateMentionAll(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob := newTestUser(t, s, "alice"), newTestUser(t, s, "bob")
+	gid := newTestGroup(t, s, alice, bob)
+	msg, err := s.sendGroupMessage(&GroupMessage{GroupID: gid, FromUserID: alice, Text: "@all"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := s.groupMessages.db
+	if _, err := db.Exec(`UPDATE group_messages SET mention_all = 0`); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	}
+	mm, err := s.mentions.ListFor([]int64{msg.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mm[msg.ID] == nil || !mm[msg.ID].All {
+		t.Fatalf("mentions %+v", mm[msg.ID])
+	}
+}
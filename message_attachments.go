@@ -0,0 +1,299 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ===== Вложения сообщений =====
+//
+// Раньше картинка попадала в чат текстом [[img:id]] после загрузки, и такой текст
+// мог набрать кто угодно. Теперь вложения — отдельная связь message_attachments:
+// /chat/send и /groups/send принимают attachments (public_id загруженных медиа),
+// сервер проверяет, что медиа загружено в эту же беседу, и пишет связь в одной
+// транзакции с сообщением — либо всё, либо ничего. Маркер в тексте теперь просто текст.
+//
+// Старые сообщения с маркерами переводятся на вложения один раз при старте
+// (backfillLegacyAttachments); сами маркеры из их текста убираются при выдаче.
+
+const maxAttachments = 10
+
+var ErrBadAttachment = errors.New("bad attachment")
+
+// маркеры старых сообщений
+var mediaMarkerRe = regexp.MustCompile(`\[\[(?:img|file|voice):([A-Za-z0-9]+)\]\]`)
+
+// resolveAttachment — id медиа по public_id, если оно загружено в беседу scope.
+// Чужое и несуществующее неотличимы: по ответу нельзя проверить, есть ли такой id.
+func resolveAttachment(tx *sql.Tx, ref, scope string) (int64, error) {
+	var m PlainMedia
+	err := tx.QueryRow(`SELECT id, kind, from_user_id, to_user_id, group_id FROM plain_media WHERE public_id = ?`, ref).
+		Scan(&m.ID, &m.Kind, &m.FromUserID, &m.ToUserID, &m.GroupID)
+	if err == sql.ErrNoRows || (err == nil && mediaScope(&m) != scope) {
+		return 0, fmt.Errorf("%w: media %s not found", ErrBadAttachment, ref)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return m.ID, nil
+}
+
+func insertAttachment(tx *sql.Tx, kind string, messageID int64, position int, mediaID int64) error {
+	_, err := tx.Exec(`
+		INSERT OR IGNORE INTO message_attachments (message_kind, message_id, position, media_id)
+		VALUES (?, ?, ?, ?)`,
+		kind, messageID, position, mediaID,
+	)
+	return err
+}
+
+// attachMedia — как insertSearchTokens: вызывается в транзакции создания сообщения.
+// Любое неподходящее вложение откатывает всё сообщение.
+func attachMedia(tx *sql.Tx, kind string, messageID int64, scope string, refs []string) error {
+	if len(refs) > maxAttachments {
+		return fmt.Errorf("%w: at most %d attachments per message", ErrBadAttachment, maxAttachments)
+	}
+	seen := map[int64]bool{}
+	for i, ref := range refs {
+		mediaID, err := resolveAttachment(tx, ref, scope)
+		if err != nil {
+			return err
+		}
+		if seen[mediaID] {
+			return fmt.Errorf("%w: media %s attached twice", ErrBadAttachment, ref)
+		}
+		seen[mediaID] = true
+		if err := insertAttachment(tx, kind, messageID, i, mediaID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attachmentKind — как клиенту показывать вложение.
+func attachmentKind(m *PlainMedia) string {
+	switch {
+	case strings.HasPrefix(m.ContentType, "image/"):
+		return "image"
+	case m.DurationMS > 0:
+		return "voice"
+	default:
+		return "file"
+	}
+}
+
+// stripAttachmentMarkers убирает из текста старого сообщения маркеры его же
+// вложений. Маркеры без вложения (набранные руками) остаются как есть.
+func stripAttachmentMarkers(text string, atts []*PlainMedia) string {
+	if len(atts) == 0 || !strings.Contains(text, "[[") {
+		return text
+	}
+	attached := map[string]bool{}
+	for _, m := range atts {
+		attached[m.PublicID] = true
+	}
+	out := mediaMarkerRe.ReplaceAllStringFunc(text, func(marker string) string {
+		if attached[mediaMarkerRe.FindStringSubmatch(marker)[1]] {
+			return ""
+		}
+		return marker
+	})
+	return strings.TrimSpace(out)
+}
+
+// backfillLegacyAttachments переводит маркеры в текстах уже отправленных сообщений
+// во вложения — только если медиа загружено в ту же беседу. Пока у медиа
+// refs_tracked = 0, GC его не трогает: вложения на него ещё не посчитаны.
+//
+// Маркеры со старым порядковым id ([[img:5]]) переписываются в тексте на public_id,
+// если это медиа приложено к тому же сообщению. Дальше сервер числовой id нигде
+// не принимает: номера идут подряд, и по ним перебирались бы чужие файлы.
+// Пока есть медиа с numeric_markers = 1 (записанные до этого), проход повторяется,
+// поэтому тексты переписываются и там, где вложения уже были посчитаны.
+func backfillLegacyAttachments(db *sql.DB, sealer *TextSealer) (int, error) {
+	var untracked, numeric, maxID int64
+	if err := db.QueryRow(`
+		SELECT COALESCE(SUM(refs_tracked = 0), 0), COALESCE(SUM(numeric_markers = 1), 0), COALESCE(MAX(id), 0)
+		FROM plain_media`).Scan(&untracked, &numeric, &maxID); err != nil {
+		return 0, err
+	}
+	if untracked == 0 && numeric == 0 {
+		return 0, nil
+	}
+
+	converted := 0
+	for _, t := range []textTable{plainMessagesTable, groupMessagesTable} {
+		var afterID int64
+		for {
+			rows, err := db.Query(`SELECT id, from_user_id, `+t.convCol+`, text, `+encryptedTextCols+`
+				FROM `+t.name+` WHERE id > ? ORDER BY id LIMIT 200`, afterID)
+			if err != nil {
+				return converted, err
+			}
+			var batch []legacyMessage
+			n := 0
+			for rows.Next() {
+				var m legacyMessage
+				var plain string
+				var e encryptedText
+				if err := rows.Scan(append([]any{&m.id, &m.from, &m.conv, &plain}, e.scanDest()...)...); err != nil {
+					rows.Close()
+					return converted, err
+				}
+				n++
+				afterID = m.id
+				if m.text, err = sealer.openRow(t.kind, m.id, m.from, m.conv, plain, &e); err != nil {
+					rows.Close()
+					return converted, fmt.Errorf("%s %d: %w", t.name, m.id, err)
+				}
+				for _, sub := range mediaMarkerRe.FindAllStringSubmatch(m.text, -1) {
+					m.refs = append(m.refs, sub[1])
+				}
+				if len(m.refs) > 0 {
+					batch = append(batch, m)
+				}
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return converted, err
+			}
+			if n == 0 {
+				break
+			}
+
+			tx, err := db.Begin()
+			if err != nil {
+				return converted, err
+			}
+			for _, m := range batch {
+				if untracked > 0 {
+					attached, err := attachLegacyRefs(tx, t.kind, &m)
+					if err != nil {
+						tx.Rollback()
+						return converted, err
+					}
+					if attached {
+						converted++
+					}
+				}
+				if numeric > 0 {
+					if err := rewriteNumericMarkers(tx, sealer, t, &m); err != nil {
+						tx.Rollback()
+						return converted, err
+					}
+				}
+			}
+			if err := tx.Commit(); err != nil {
+				return converted, err
+			}
+		}
+	}
+
+	_, err := db.Exec(`UPDATE plain_media SET refs_tracked = 1, numeric_markers = 0 WHERE id <= ?`, maxID)
+	return converted, err
+}
+
+type legacyMessage struct {
+	id, from, conv int64
+	text           string
+	refs           []string
+}
+
+// legacyMediaRef — порядковый id из маркера старого сообщения (число не длины public_id).
+func legacyMediaRef(ref string) (int64, bool) {
+	if len(ref) == mediaPublicIDLen {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(ref, 10, 64)
+	return id, err == nil && id > 0
+}
+
+// attachLegacyRefs — маркеры сообщения во вложения; чужое или удалённое медиа
+// пропускается, маркер останется текстом.
+func attachLegacyRefs(tx *sql.Tx, kind string, m *legacyMessage) (bool, error) {
+	scope := conversationScope(kind, m.from, m.conv)
+	position := 0
+	seen := map[int64]bool{}
+	for _, ref := range m.refs {
+		// старый id переводится в public_id только здесь, при старте
+		if id, ok := legacyMediaRef(ref); ok {
+			err := tx.QueryRow(`SELECT COALESCE(public_id, '') FROM plain_media WHERE id = ?`, id).Scan(&ref)
+			if err == sql.ErrNoRows {
+				continue
+			}
+			if err != nil {
+				return false, err
+			}
+		}
+		mediaID, err := resolveAttachment(tx, ref, scope)
+		if errors.Is(err, ErrBadAttachment) || seen[mediaID] {
+			continue
+		}
+		seen[mediaID] = true
+		if err == nil {
+			err = insertAttachment(tx, kind, m.id, position, mediaID)
+		}
+		if err != nil {
+			return false, err
+		}
+		position++
+	}
+	return position > 0, nil
+}
+
+// rewriteNumericMarkers заменяет в тексте [[img:<порядковый id>]] на public_id
+// вложений этого сообщения и шифрует текст заново (с поисковыми токенами).
+func rewriteNumericMarkers(tx *sql.Tx, sealer *TextSealer, t textTable, m *legacyMessage) error {
+	rows, err := tx.Query(`
+		SELECT plain_media.id, plain_media.public_id FROM message_attachments
+		JOIN plain_media ON plain_media.id = message_attachments.media_id
+		WHERE message_kind = ? AND message_id = ? AND plain_media.public_id IS NOT NULL`, t.kind, m.id)
+	if err != nil {
+		return err
+	}
+	publicIDs := map[string]string{}
+	for rows.Next() {
+		var id int64
+		var publicID string
+		if err := rows.Scan(&id, &publicID); err != nil {
+			rows.Close()
+			return err
+		}
+		publicIDs[strconv.FormatInt(id, 10)] = publicID
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	text := mediaMarkerRe.ReplaceAllStringFunc(m.text, func(marker string) string {
+		ref := mediaMarkerRe.FindStringSubmatch(marker)[1]
+		if _, ok := legacyMediaRef(ref); !ok || publicIDs[ref] == "" {
+			return marker
+		}
+		return strings.TrimSuffix(marker, ref+"]]") + publicIDs[ref] + "]]"
+	})
+	if text == m.text {
+		return nil
+	}
+
+	env, err := sealer.Seal(t.kind, m.id, m.from, m.conv, text)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE `+t.name+`
+		SET text = '', text_ct = ?, text_nonce = ?, dek_wrapped = ?, dek_nonce = ?, key_version = ?
+		WHERE id = ?`,
+		env.Ciphertext, env.Nonce, env.WrappedKey, env.WrapNonce, env.KeyVersion, m.id,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM message_search_index WHERE kind = ? AND message_id = ?`, t.kind, m.id); err != nil {
+		return err
+	}
+	return insertSearchTokens(tx, t.kind, m.id, sealer.BlindTokens(t.kind, text))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func postJSON(handler http.HandlerFunc, target string, req any) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(req)
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body)))
+	return rec
+}
+
+// Плохое вложение отклоняет всё сообщение: ни строки сообщения, ни вложений.
+func TestSendRejectsBadAttachments(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob, eve := newTestUser(t, s, "alice"), newTestUser(t, s, "bob"), newTestUser(t, s, "eve")
+	gid := newTestGroup(t, s, alice, bob)
+	own := newTestMedia(t, s, alice, bob, 0)
+	foreign := newTestMedia(t, s, eve, bob, 0) // личка eve и bob
+	inGroup := newTestMedia(t, s, bob, 0, gid)
+	many := make([]string, maxAttachments+1)
+	for i := range many {
+		many[i] = newTestMedia(t, s, alice, bob, 0).PublicID
+	}
+
+	cases := []struct {
+		name string
+		refs []string
+		want string
+	}{
+		{"foreign media", []string{own.PublicID, foreign.PublicID}, "not found"},
+		{"media from another conversation", []string{inGroup.PublicID}, "not found"},
+		{"unknown id", []string{strings.Repeat("0", mediaPublicIDLen)}, "not found"},
+		{"too many", many, "at most"},
+		{"duplicate", []string{own.PublicID, own.PublicID}, "twice"},
+	}
+	for _, c := range cases {
+		rec := postJSON(s.handleChatSend, "/chat/send", ChatSendRequest{FromUserID: alice, ToUserID: bob, Text: "x", Attachments: c.refs})
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), c.want) {
+			t.Errorf("%s: %d %s", c.name, rec.Code, rec.Body)
+		}
+	}
+	// в беседе — то же самое: личное медиа туда не прикладывается
+	rec := postJSON(s.handleGroupSend, "/groups/send", GroupSendRequest{GroupID: gid, FromUserID: alice, Text: "x", Attachments: []string{own.PublicID}})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("direct media in a group: %d %s", rec.Code, rec.Body)
+	}
+
+	var msgs, atts int
+	db := s.plainMessages.db
+	if err := db.QueryRow(`SELECT (SELECT COUNT(*) FROM plain_messages) + (SELECT COUNT(*) FROM group_messages),
+		(SELECT COUNT(*) FROM message_attachments)`).Scan(&msgs, &atts); err != nil {
+		t.Fatal(err)
+	}
+	if msgs != 0 || atts != 0 {
+		t.Fatalf("%d messages and %d attachments left after rejected sends", msgs, atts)
+	}
+
+	// ровно maxAttachments — можно, в том порядке, в каком пришли
+	rec = postJSON(s.handleChatSend, "/chat/send", ChatSendRequest{FromUserID: bob, ToUserID: alice, Attachments: many[:maxAttachments]})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("max attachments: %d %s", rec.Code, rec.Body)
+	}
+	var sent ChatSendResponse
+	if err := json.NewDecoder(rec.Body).Decode(&sent); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.attachments.ListFor(plainMessagesTable.kind, []int64{sent.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got[sent.ID]) != maxAttachments {
+		t.Fatalf("%d attachments", len(got[sent.ID]))
+	}
+	for i, m := range got[sent.ID] {
+		if m.PublicID != many[i] {
+			t.Fatalf("attachment %d: %s, want %s", i, m.PublicID, many[i])
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// ===== Шифрование текстов сообщений (plain_messages, group_messages) =====
+//
+// Тот же envelope, что и у медиа: свой DEK на сообщение, DEK обёрнут мастер-ключом.
+// Для поиска рядом хранится слепой индекс — HMAC от каждого слова под отдельным
+// ключом (server_keys/index.key): сервер находит совпадения, не храня сами слова.
+
+const searchIndexKeyFile = "index.key"
+
+type TextSealer struct {
+	keyring  *Keyring
+	indexKey []byte
+}
+
+func NewTextSealer(keyring *Keyring, indexKey []byte) *TextSealer {
+	return &TextSealer{keyring: keyring, indexKey: indexKey}
+}
+
+// kind — "direct" или "group", convID — to_user_id или group_id.
+func textAAD(kind string, id, fromUserID, convID int64) []byte {
+	aad := []byte("mollysage-text:" + kind)
+	aad = binary.BigEndian.AppendUint64(aad, uint64(id))
+	aad = binary.BigEndian.AppendUint64(aad, uint64(fromUserID))
+	aad = binary.BigEndian.AppendUint64(aad, uint64(convID))
+	return aad
+}
+
+func (t *TextSealer) Seal(kind string, id, fromUserID, convID int64, text string) (*Envelope, error) {
+	return t.keyring.Seal([]byte(text), textAAD(kind, id, fromUserID, convID))
+}
+
+func (t *TextSealer) Open(kind string, id, fromUserID, convID int64, env *Envelope) (string, error) {
+	raw, err := t.keyring.Open(env, textAAD(kind, id, fromUserID, convID))
+	if err != nil {
+		return "", err
+	}
+	return string(raw), nil
+}
+
+// encryptedText — колонки envelope в строке сообщения; TextCT == nil — строка
+// ещё не прошла миграцию и текст лежит в колонке text открыто.
+type encryptedText struct {
+	TextCT     []byte
+	TextNonce  []byte
+	DEKWrapped []byte
+	DEKNonce   []byte
+	KeyVersion uint32
+}
+
+func (e *encryptedText) envelope() *Envelope {
+	return &Envelope{
+		Ciphertext: e.TextCT,
+		Nonce:      e.TextNonce,
+		WrappedKey: e.DEKWrapped,
+		WrapNonce:  e.DEKNonce,
+		KeyVersion: e.KeyVersion,
+	}
+}
+
+func (t *TextSealer) openRow(kind string, id, fromUserID, convID int64, plain string, e *encryptedText) (string, error) {
+	if e.TextCT == nil {
+		return plain, nil
+	}
+	return t.Open(kind, id, fromUserID, convID, e.envelope())
+}
+
+const maxIndexTokensPerMessage = 64
+
+// searchTokens: слова в нижнем регистре, не короче 2 символов, без повторов.
+func searchTokens(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	seen := map[string]bool{}
+	var out []string
+	for _, f := range fields {
+		if len([]rune(f)) < 2 || seen[f] {
+			continue
+		}
+		seen[f] = true
+		out = append(out, f)
+		if len(out) == maxIndexTokensPerMessage {
+			break
+		}
+	}
+	return out
+}
+
+// BlindTokens — HMAC слов; kind входит в HMAC, чтобы токены личек и бесед не совпадали.
+func (t *TextSealer) BlindTokens(kind, text string) [][]byte {
+	words := searchTokens(text)
+	out := make([][]byte, 0, len(words))
+	for _, w := range words {
+		mac := hmac.New(sha256.New, t.indexKey)
+		mac.Write([]byte(kind))
+		mac.Write([]byte{0})
+		mac.Write([]byte(w))
+		out = append(out, mac.Sum(nil)[:16])
+	}
+	return out
+}
+
+func insertSearchTokens(tx *sql.Tx, kind string, messageID int64, tokens [][]byte) error {
+	for _, tok := range tokens {
+		if _, err := tx.Exec(
+			`INSERT OR IGNORE INTO message_search_index (kind, message_id, token) VALUES (?, ?, ?)`,
+			kind, messageID, tok,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadOrCreateIndexKey: ключ индекса не ротируется вместе с мастер-ключами —
+// иначе пришлось бы пересчитывать весь индекс. Новый создаётся только если от
+// него ещё ничего не зависит: ни индекс, ни хэши дедупликации медиа (media_gc.go).
+func loadOrCreateIndexKey(db *sql.DB, dir string) ([]byte, error) {
+	path := filepath.Join(dir, searchIndexKeyFile)
+	key, err := os.ReadFile(path)
+	if err == nil {
+		if len(key) != masterKeySize {
+			return nil, fmt.Errorf("%s: expected %d bytes, got %d", path, masterKeySize, len(key))
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	sealed, err := countSealed(db, indexKeyDependents)
+	if err != nil {
+		return nil, err
+	}
+	if sealed != "" {
+		return nil, fmt.Errorf("%s is missing but the database has %s; restore the key", path, sealed)
+	}
+
+	key, err = generateRandomBytes(masterKeySize)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, key, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ===== Миграция и ротация для обеих таблиц сообщений =====
+
+type textTable struct {
+	name    string // plain_messages | group_messages | scheduled_messages
+	kind    string // direct | group | scheduled
+	convCol string // to_user_id | group_id | conv_id
+}
+
+var (
+	plainMessagesTable = textTable{name: "plain_messages", kind: "direct", convCol: "to_user_id"}
+	groupMessagesTable = textTable{name: "group_messages", kind: "group", convCol: "group_id"}
+	// отложенные (scheduled.go): в поиск не попадают, пока не отправлены
+	scheduledMessagesTable = textTable{name: "scheduled_messages", kind: "scheduled", convCol: "conv_id"}
+
+	// все таблицы, где тексты зашифрованы под мастер-ключами
+	sealedTextTables = []textTable{plainMessagesTable, groupMessagesTable, scheduledMessagesTable}
+)
+
+var indexKeyDependents = []sealedQuery{
+	{"search index entries", `SELECT COUNT(*) FROM message_search_index`},
+	{"media dedup hashes", `SELECT COUNT(*) FROM plain_media WHERE content_hash IS NOT NULL`},
+}
+
+// encryptLegacyTexts шифрует строки, записанные до шифрования (text_ct IS NULL),
+// заполняет для них индекс и стирает открытый текст. secure_delete — чтобы старый
+// текст не остался в освободившемся месте страниц базы; прагма действует на
+// соединение, поэтому включается в каждой транзакции.
+func encryptLegacyTexts(db *sql.DB, sealer *TextSealer, t textTable) (int, error) {
+	done := 0
+	for {
+		rows, err := db.Query(`SELECT id, from_user_id, ` + t.convCol + `, text FROM ` + t.name + `
+			WHERE text_ct IS NULL ORDER BY id LIMIT 100`)
+		if err != nil {
+			return done, err
+		}
+		type legacyRow struct {
+			id, from, conv int64
+			text           string
+		}
+		var batch []legacyRow
+		for rows.Next() {
+			var r legacyRow
+			if err := rows.Scan(&r.id, &r.from, &r.conv, &r.text); err != nil {
+				rows.Close()
+				return done, err
+			}
+			batch = append(batch, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return done, err
+		}
+		if len(batch) == 0 {
+			return done, nil
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return done, err
+		}
+		if _, err := tx.Exec(`PRAGMA secure_delete = ON`); err != nil {
+			tx.Rollback()
+			return done, err
+		}
+		for _, r := range batch {
+			env, err := sealer.Seal(t.kind, r.id, r.from, r.conv, r.text)
+			if err != nil {
+				tx.Rollback()
+				return done, err
+			}
+			if _, err := tx.Exec(`UPDATE `+t.name+`
+				SET text = '', text_ct = ?, text_nonce = ?, dek_wrapped = ?, dek_nonce = ?, key_version = ?
+				WHERE id = ?`,
+				env.Ciphertext, env.Nonce, env.WrappedKey, env.WrapNonce, env.KeyVersion, r.id,
+			); err != nil {
+				tx.Rollback()
+				return done, err
+			}
+			if err := insertSearchTokens(tx, t.kind, r.id, sealer.BlindTokens(t.kind, r.text)); err != nil {
+				tx.Rollback()
+				return done, err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return done, err
+		}
+		done += len(batch)
+	}
+}
+
+// rewrapTexts — как rewrapAllMedia, но для текстов: перешифровывается только DEK.
+func rewrapTexts(db *sql.DB, keyring *Keyring, t textTable) (int, error) {
+	current := keyring.CurrentVersion()
+	done := 0
+	var afterID int64
+	for {
+		rows, err := db.Query(`SELECT id, from_user_id, `+t.convCol+`, dek_wrapped, dek_nonce, key_version FROM `+t.name+`
+			WHERE id > ? AND text_ct IS NOT NULL AND key_version != ? ORDER BY id LIMIT 100`, afterID, current)
+		if err != nil {
+			return done, err
+		}
+		type wrappedRow struct {
+			id, from, conv int64
+			env            Envelope
+		}
+		var batch []wrappedRow
+		for rows.Next() {
+			var r wrappedRow
+			if err := rows.Scan(&r.id, &r.from, &r.conv, &r.env.WrappedKey, &r.env.WrapNonce, &r.env.KeyVersion); err != nil {
+				rows.Close()
+				return done, err
+			}
+			batch = append(batch, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return done, err
+		}
+		if len(batch) == 0 {
+			return done, nil
+		}
+
+		for _, r := range batch {
+			afterID = r.id
+			if err := keyring.Rewrap(&r.env, textAAD(t.kind, r.id, r.from, r.conv)); err != nil {
+				return done, fmt.Errorf("%s %d: %w", t.name, r.id, err)
+			}
+			if _, err := db.Exec(`UPDATE `+t.name+` SET dek_wrapped = ?, dek_nonce = ?, key_version = ? WHERE id = ?`,
+				r.env.WrappedKey, r.env.WrapNonce, r.env.KeyVersion, r.id); err != nil {
+				return done, err
+			}
+			done++
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestSealer(t *testing.T) *TextSealer {
+	t.Helper()
+	return NewTextSealer(newTestKeyring(t), bytes.Repeat([]byte{7}, 32))
+}
+
+func TestTextSealerRoundTrip(t *testing.T) {
+	sealer := newTestSealer(t)
+	for _, text := range []string{"привет", "", "смотри [[img:abc]]\nвторая строка"} {
+		env, err := sealer.Seal("direct", 1, 2, 3, text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if text != "" && bytes.Contains(env.Ciphertext, []byte(text)) {
+			t.Fatalf("%q: plaintext in ciphertext", text)
+		}
+		got, err := sealer.Open("direct", 1, 2, 3, env)
+		if err != nil || got != text {
+			t.Fatalf("%q: got %q, %v", text, got, err)
+		}
+	}
+}
+
+// Текст привязан к сообщению: шифртекст, переставленный в другую строку или
+// беседу, не открывается.
+func TestTextSealerAAD(t *testing.T) {
+	sealer := newTestSealer(t)
+	env, err := sealer.Seal("direct", 10, 1, 2, "секрет")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name             string
+		kind             string
+		id, from, convID int64
+	}{
+		{"other message id", "direct", 11, 1, 2},
+		{"other conversation", "direct", 10, 1, 3},
+		{"other sender", "direct", 10, 5, 2},
+		{"group instead of direct", "group", 10, 1, 2},
+	}
+	for _, c := range cases {
+		if _, err := sealer.Open(c.kind, c.id, c.from, c.convID, env); err == nil {
+			t.Errorf("%s: opened", c.name)
+		}
+	}
+}
+
+// Строки до шифрования: после миграции колонка text пуста, текст читается и
+// ищется, а открытого текста нет даже в файле базы.
+func TestEncryptLegacyTexts(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	db, err := initDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	sealer := newTestSealer(t)
+
+	const word = "Zanzibarcheesecake"
+	for i := 0; i < 3; i++ {
+		if _, err := db.Exec(`INSERT INTO plain_messages (from_user_id, to_user_id, text) VALUES (1, 2, ?)`, word+" личка"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec(`INSERT INTO group_messages (group_id, from_user_id, text) VALUES (7, 1, ?)`, word+" беседа"); err != nil {
+		t.Fatal(err)
+	}
+
+	for table, want := range map[textTable]int{plainMessagesTable: 3, groupMessagesTable: 1} {
+		if n, err := encryptLegacyTexts(db, sealer, table); err != nil || n != want {
+			t.Fatalf("%s: encrypted %d, %v", table.name, n, err)
+		}
+		// второй запуск ничего не делает
+		if n, err := encryptLegacyTexts(db, sealer, table); err != nil || n != 0 {
+			t.Fatalf("%s: second pass encrypted %d, %v", table.name, n, err)
+		}
+		var plain int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM ` + table.name + ` WHERE text != '' OR text_ct IS NULL`).Scan(&plain); err != nil || plain != 0 {
+			t.Fatalf("%s: %d rows not encrypted, %v", table.name, plain, err)
+		}
+	}
+
+	msgs, err := NewPlainMessageStore(db, sealer).Search(1, word, 10)
+	if err != nil || len(msgs) != 3 || msgs[0].Text != word+" личка" {
+		t.Fatalf("search: %d, %v", len(msgs), err)
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte(word)) {
+		t.Fatal("plaintext left in the database file")
+	}
+}
+
+// Поиск по слепому индексу находит слово в своих беседах и никогда — в чужих.
+func TestSearchBlindIndex(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob := newTestUser(t, s, "alice"), newTestUser(t, s, "bob")
+	carol, dave := newTestUser(t, s, "carol"), newTestUser(t, s, "dave")
+	own, err := s.plainMessages.Create(&PlainMessage{FromUserID: alice, ToUserID: bob, Text: "Пароль от wifi: гусь"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.plainMessages.Create(&PlainMessage{FromUserID: carol, ToUserID: dave, Text: "пароль гусь"}); err != nil {
+		t.Fatal(err)
+	}
+	gid := newTestGroup(t, s, carol, dave)
+	if _, err := s.groupMessages.Create(&GroupMessage{GroupID: gid, FromUserID: carol, Text: "пароль гусь"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, q := range []string{"пароль", "ГУСЬ", "wifi пароль"} {
+		got, err := s.plainMessages.Search(alice, q, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || got[0].ID != own.ID {
+			t.Errorf("%q: %d messages", q, len(got))
+		}
+		groups, err := s.groupMessages.Search(alice, q, 10)
+		if err != nil || len(groups) != 0 {
+			t.Errorf("%q: %d group messages of another conversation, %v", q, len(groups), err)
+		}
+	}
+	// слово целиком, а не подстрока
+	if got, _ := s.plainMessages.Search(alice, "паро", 10); len(got) != 0 {
+		t.Errorf("prefix matched %d messages", len(got))
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import "errors"
+
+// ===== Закреплённые сообщения =====
+//
+// В личке закреплять и откреплять может любой из двух собеседников, в беседе —
+// владелец и админы (group_members.role). Закреплённые хранятся по беседе
+// (conversationScope) с порядком: новое закреплённое — наверху, повторное
+// закрепление поднимает сообщение наверх. Клиент показывает верхнее баннером над
+// чатом и перечитывает список /pins/list при открытии чата и по таймеру.
+
+const maxPins = 50 // на беседу
+
+var (
+	ErrTooManyPins   = errors.New("too many pinned messages in this conversation")
+	ErrNotGroupAdmin = errors.New("forbidden: group admins only")
+)
+
+var groupRoles = map[string]bool{"admin": true, "member": true}
+
+// canModerate — владелец или админ беседы.
+func canModerate(role string) bool {
+	return role == "owner" || role == "admin"
+}
+
+// pinScope — беседа сообщения, если пользователь может менять в ней закреплённые:
+// видеть сообщение (checkMessageAccess), а в беседе ещё и быть владельцем или админом.
+func (s *Server) pinScope(kind string, messageID, userID int64) (string, error) {
+	if err := s.checkMessageAccess(kind, messageID, userID); err != nil {
+		return "", err
+	}
+	if kind == plainMessagesTable.kind {
+		from, to, err := s.plainMessages.Participants(messageID)
+		if err != nil {
+			return "", err
+		}
+		return conversationScope(kind, from, to), nil
+	}
+	groupID, err := s.groupMessages.GroupOf(messageID)
+	if err != nil {
+		return "", err
+	}
+	role, err := s.groupMembers.Role(groupID, userID)
+	if err != nil {
+		return "", err
+	}
+	if !canModerate(role) {
+		return "", ErrNotGroupAdmin
+	}
+	return conversationScope(kind, 0, groupID), nil
+}
+
+// pinDTOs — закреплённые с цитатами сообщений (как у ответов).
+func (s *Server) pinDTOs(kind string, pins []Pin) ([]PinDTO, error) {
+	out := make([]PinDTO, 0, len(pins))
+	if len(pins) == 0 {
+		return out, nil
+	}
+	ids := make([]int64, 0, len(pins))
+	for _, p := range pins {
+		ids = append(ids, p.MessageID)
+	}
+	atts, err := s.attachments.ListFor(kind, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	previews := make(map[int64]ReplyPreviewDTO, len(pins))
+	if kind == plainMessagesTable.kind {
+		msgs, err := s.plainMessages.ListByIDs(ids)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			previews[m.ID] = ReplyPreviewDTO{
+				ID:          m.ID,
+				FromUserID:  m.FromUserID,
+				Text:        replySnippet(stripAttachmentMarkers(m.Text, atts[m.ID])),
+				Attachments: len(atts[m.ID]),
+			}
+		}
+	} else {
+		msgs, err := s.groupMessages.ListByIDs(ids)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			previews[m.ID] = ReplyPreviewDTO{
+				ID:           m.ID,
+				FromUserID:   m.FromUserID,
+				FromUsername: m.FromUsername,
+				Text:         replySnippet(stripAttachmentMarkers(m.Text, atts[m.ID])),
+				Attachments:  len(atts[m.ID]),
+			}
+		}
+	}
+
+	for _, p := range pins {
+		msg, ok := previews[p.MessageID]
+		if !ok {
+			continue
+		}
+		out = append(out, PinDTO{
+			MessageID: p.MessageID,
+			Position:  p.Position,
+			PinnedBy:  p.PinnedBy,
+			PinnedAt:  p.PinnedAt,
+			Message:   msg,
+		})
+	}
+	return out, nil
+}
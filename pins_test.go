@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPinScope(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob, carol, eve := newTestUser(t, s, "alice"), newTestUser(t, s, "bob"), newTestUser(t, s, "carol"), newTestUser(t, s, "eve")
+	gid := newTestGroup(t, s, alice, bob, carol)
+	if err := s.groupMembers.SetRole(gid, carol, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	direct, err := s.plainMessages.Create(&PlainMessage{FromUserID: alice, ToUserID: bob, Text: "адрес"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	group, err := s.groupMessages.Create(&GroupMessage{GroupID: gid, FromUserID: bob, Text: "правила"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		kind    string
+		message int64
+		user    int64
+		want    error
+	}{
+		{"sender", "direct", direct.ID, alice, nil},
+		{"recipient", "direct", direct.ID, bob, nil},
+		{"stranger in a chat", "direct", direct.ID, eve, ErrNotParticipant},
+		{"group owner", "group", group.ID, alice, nil},
+		{"group admin", "group", group.ID, carol, nil},
+		{"group member, even the author", "group", group.ID, bob, ErrNotGroupAdmin},
+		{"not a group member", "group", group.ID, eve, ErrNotParticipant},
+		{"no such message", "group", group.ID + 100, alice, ErrMessageNotFound},
+	}
+	for _, c := range cases {
+		scope, err := s.pinScope(c.kind, c.message, c.user)
+		if !errors.Is(err, c.want) || err != nil && c.want == nil {
+			t.Errorf("%s: %v, want %v", c.name, err, c.want)
+			continue
+		}
+		if err == nil && scope == "" {
+			t.Errorf("%s: empty scope", c.name)
+		}
+	}
+	// у лички одна беседа, кто бы ни закреплял
+	a, _ := s.pinScope("direct", direct.ID, alice)
+	b, _ := s.pinScope("direct", direct.ID, bob)
+	if a != b {
+		t.Errorf("scopes %q and %q", a, b)
+	}
+}
+
+func TestPinOrderAndLimit(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob := newTestUser(t, s, "alice"), newTestUser(t, s, "bob")
+	var ids []int64
+	for i := 0; i < maxPins+1; i++ {
+		m, err := s.plainMessages.Create(&PlainMessage{FromUserID: alice, ToUserID: bob, Text: "сообщение"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, m.ID)
+	}
+	scope := conversationScope("direct", alice, bob)
+	order := func() []int64 {
+		t.Helper()
+		pins, err := s.pins.List(scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []int64
+		for _, p := range pins {
+			out = append(out, p.MessageID)
+		}
+		return out
+	}
+
+	for _, id := range ids[:3] {
+		if err := s.pins.Pin("direct", id, scope, alice); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := order(); len(got) != 3 || got[0] != ids[2] || got[1] != ids[1] || got[2] != ids[0] {
+		t.Fatalf("order %v", got)
+	}
+	// повторное закрепление поднимает наверх, а не дублирует
+	if err := s.pins.Pin("direct", ids[0], scope, bob); err != nil {
+		t.Fatal(err)
+	}
+	if got := order(); len(got) != 3 || got[0] != ids[0] || got[1] != ids[2] || got[2] != ids[1] {
+		t.Fatalf("order after re-pin %v", got)
+	}
+
+	for _, id := range ids[3:maxPins] {
+		if err := s.pins.Pin("direct", id, scope, alice); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.pins.Pin("direct", ids[maxPins], scope, alice); !errors.Is(err, ErrTooManyPins) {
+		t.Fatalf("pin over the limit: %v", err)
+	}
+	// уже закреплённое поднять можно и на пределе
+	if err := s.pins.Pin("direct", ids[1], scope, alice); err != nil {
+		t.Fatalf("re-pin at the limit: %v", err)
+	}
+	if got := order(); len(got) != maxPins || got[0] != ids[1] {
+		t.Fatalf("%d pins, top %v", len(got), got[:1])
+	}
+	// открепили одно — место освободилось
+	if ok, err := s.pins.Unpin("direct", ids[2]); err != nil || !ok {
+		t.Fatalf("unpin: %v, %v", ok, err)
+	}
+	if err := s.pins.Pin("direct", ids[maxPins], scope, alice); err != nil {
+		t.Fatalf("pin after unpin: %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ===== Опросы в беседах =====
+//
+// Опрос — обычное групповое сообщение плюс строка в polls. Вопрос и варианты
+// лежат в тексте сообщения построчно (вопрос, затем по варианту на строку): так
+// они шифруются, ищутся и переживают ротацию ключей вместе с остальными текстами,
+// а в цитатах и пересылке выглядят как обычный текст. В polls — число вариантов,
+// один или несколько вариантов можно выбрать, анонимный ли опрос и до какого
+// времени он открыт; в poll_votes — голоса.
+//
+// Голосовать могут участники беседы, пока опрос открыт; повторный голос заменяет
+// прежний, пустой — отзывает. Закрыть досрочно может автор или админ беседы.
+// Итоги приходят в GroupMessageDTO.poll, а каждое изменение (голос, закрытие) —
+// в /sync списком polls с актуальными итогами.
+
+const (
+	maxPollQuestion = 300 // символов
+	maxPollOption   = 100
+	minPollOptions  = 2
+	maxPollOptions  = 10
+)
+
+var (
+	ErrNotAPoll   = errors.New("poll not found")
+	ErrPollClosed = errors.New("poll is closed")
+	ErrBadPoll    = errors.New("bad poll")
+)
+
+// pollText — текст сообщения-опроса.
+func pollText(question string, options []string) string {
+	return question + "\n" + strings.Join(options, "\n")
+}
+
+// validatePoll чистит вопрос и варианты; переводы строк внутри запрещены — они
+// разделяют варианты в тексте сообщения.
+func validatePoll(question string, options []string) (string, []string, error) {
+	question = strings.TrimSpace(question)
+	if question == "" || utf8.RuneCountInString(question) > maxPollQuestion || strings.ContainsAny(question, "\r\n") {
+		return "", nil, fmt.Errorf("%w: question must be 1-%d characters on one line", ErrBadPoll, maxPollQuestion)
+	}
+	if len(options) < minPollOptions || len(options) > maxPollOptions {
+		return "", nil, fmt.Errorf("%w: %d-%d options required", ErrBadPoll, minPollOptions, maxPollOptions)
+	}
+	seen := map[string]bool{}
+	out := make([]string, 0, len(options))
+	for _, o := range options {
+		o = strings.TrimSpace(o)
+		if o == "" || utf8.RuneCountInString(o) > maxPollOption || strings.ContainsAny(o, "\r\n") {
+			return "", nil, fmt.Errorf("%w: options must be 1-%d characters on one line", ErrBadPoll, maxPollOption)
+		}
+		if seen[strings.ToLower(o)] {
+			return "", nil, fmt.Errorf("%w: duplicate option %q", ErrBadPoll, o)
+		}
+		seen[strings.ToLower(o)] = true
+		out = append(out, o)
+	}
+	return question, out, nil
+}
+
+// validateVote — номера вариантов (с 0) без повторов; в опросе с одним ответом — не больше одного.
+func validateVote(p *Poll, options []int) ([]int, error) {
+	if !p.Multiple && len(options) > 1 {
+		return nil, fmt.Errorf("%w: only one option allowed", ErrBadPoll)
+	}
+	seen := map[int]bool{}
+	out := make([]int, 0, len(options))
+	for _, o := range options {
+		if o < 0 || o >= p.Options {
+			return nil, fmt.Errorf("%w: no option %d", ErrBadPoll, o)
+		}
+		if !seen[o] {
+			seen[o] = true
+			out = append(out, o)
+		}
+	}
+	return out, nil
+}
+
+func pollClosed(closesAt, closedAt string, now time.Time) bool {
+	if closedAt != "" {
+		return true
+	}
+	if closesAt == "" {
+		return false
+	}
+	t, err := time.Parse(time.RFC3339, closesAt)
+	return err == nil && !now.Before(t)
+}
+
+// pollViewer — кому отдаётся my_votes. Свои голоса видны только участнику
+// беседы, а в анонимном опросе — только в ответе на vote и close. Авторизации
+// нет, user_id в GET-запросах (/groups/messages, /sync, ветка, лента упоминаний)
+// может подставить кто угодно: перебором участников анонимность снималась бы.
+type pollViewer struct {
+	userID int64 // 0 — my_votes не отдаётся
+	posted bool  // ответ на vote/close этого userID
+}
+
+// pollViewerIn — viewer для опроса из беседы groupID: не участнику my_votes не положен.
+// members — уже проверенные беседы, на один ответ.
+func (s *Server) pollViewerIn(v pollViewer, groupID int64, members map[int64]bool) (pollViewer, error) {
+	if v.userID == 0 {
+		return v, nil
+	}
+	isMember, ok := members[groupID]
+	if !ok {
+		var err error
+		if isMember, err = s.groupMembers.IsMember(groupID, v.userID); err != nil {
+			return pollViewer{}, err
+		}
+		members[groupID] = isMember
+	}
+	if !isMember {
+		return pollViewer{}, nil
+	}
+	return v, nil
+}
+
+// pollDTO — вопрос и итоги опроса из текста сообщения. viewer — для my_votes,
+// уже проверенный pollViewerIn.
+func pollDTO(p *Poll, text string, viewer pollViewer, now time.Time) (string, *PollDTO) {
+	question, options := text, []string(nil)
+	if lines := strings.Split(text, "\n"); len(lines) == p.Options+1 {
+		question, options = lines[0], lines[1:]
+	}
+
+	d := &PollDTO{
+		Options:     make([]PollOptionDTO, p.Options),
+		Multiple:    p.Multiple,
+		Anonymous:   p.Anonymous,
+		ClosesAt:    p.ClosesAt,
+		Closed:      pollClosed(p.ClosesAt, p.ClosedAt, now),
+		TotalVoters: len(p.Votes),
+	}
+	for i := range d.Options {
+		if i < len(options) {
+			d.Options[i].Text = options[i]
+		}
+	}
+	for uid, votes := range p.Votes {
+		for _, o := range votes {
+			if o < 0 || o >= len(d.Options) {
+				continue
+			}
+			d.Options[o].Votes++
+			if !p.Anonymous {
+				d.Options[o].Voters = append(d.Options[o].Voters, uid)
+			}
+		}
+	}
+	for i := range d.Options {
+		slices.Sort(d.Options[i].Voters)
+	}
+	if viewer.userID != 0 && (!p.Anonymous || viewer.posted) {
+		d.MyVotes = p.Votes[viewer.userID]
+	}
+	return question, d
+}
+
+// syncPollDTOs — по опросу на каждое изменённое (повторы схлопываются), с итогами.
+func (s *Server) syncPollDTOs(changes []PollChange, viewer pollViewer) ([]SyncPollDTO, error) {
+	seen := map[int64]bool{}
+	var ids []int64
+	for _, c := range changes {
+		if !seen[c.MessageID] {
+			seen[c.MessageID] = true
+			ids = append(ids, c.MessageID)
+		}
+	}
+	msgs, err := s.groupMessages.ListByIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+	polls, err := s.polls.ListFor(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	members := map[int64]bool{}
+	out := make([]SyncPollDTO, 0, len(msgs))
+	for _, m := range msgs {
+		p := polls[m.ID]
+		if p == nil {
+			continue
+		}
+		v, err := s.pollViewerIn(viewer, m.GroupID, members)
+		if err != nil {
+			return nil, err
+		}
+		_, poll := pollDTO(p, m.Text, v, now)
+		out = append(out, SyncPollDTO{MessageID: m.ID, GroupID: m.GroupID, Poll: poll})
+	}
+	return out, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPollMyVotes(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob, eve := newTestUser(t, s, "alice"), newTestUser(t, s, "bob"), newTestUser(t, s, "eve")
+	gid := newTestGroup(t, s, alice, bob)
+
+	newPoll := func(anonymous bool) int64 {
+		msg, err := s.sendGroupMessage(&GroupMessage{
+			GroupID: gid, FromUserID: alice, Text: "обед?\nда\nнет",
+			Poll: &Poll{Options: 2, Anonymous: anonymous},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.polls.Vote(msg.ID, bob, []int{1}, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		return msg.ID
+	}
+	open, anon := newPoll(false), newPoll(true)
+
+	myVotes := func(messageID int64, v pollViewer) []int {
+		t.Helper()
+		msgs, err := s.groupMessages.ListByIDs([]int64{messageID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dtos, err := s.groupMessageDTOs(msgs, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// /sync и ответ голосования идут через syncPollDTOs — там то же правило
+		polls, err := s.syncPollDTOs([]PollChange{{MessageID: messageID}}, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(dtos[0].Poll.MyVotes, polls[0].Poll.MyVotes) {
+			t.Fatalf("messages %v, sync %v", dtos[0].Poll.MyVotes, polls[0].Poll.MyVotes)
+		}
+		return dtos[0].Poll.MyVotes
+	}
+
+	cases := []struct {
+		name    string
+		poll    int64
+		viewer  pollViewer
+		visible bool
+	}{
+		{"voter", open, pollViewer{userID: bob}, true},
+		{"voter, anonymous, vote response", anon, pollViewer{userID: bob, posted: true}, true},
+		{"voter, anonymous, user_id in GET", anon, pollViewer{userID: bob}, false},
+		{"not a member", open, pollViewer{userID: eve, posted: true}, false},
+		{"nobody", open, pollViewer{}, false},
+	}
+	for _, c := range cases {
+		got := myVotes(c.poll, c.viewer)
+		if c.visible != slices.Equal(got, []int{1}) || !c.visible && got != nil {
+			t.Errorf("%s: my_votes %v", c.name, got)
+		}
+	}
+
+	// /groups/messages?user_id= — кто угодно может подставить чужой id
+	rec := httptest.NewRecorder()
+	s.handleGroupMessages(rec, httptest.NewRequest(http.MethodGet,
+		fmt.Sprintf("/groups/messages?group_id=%d&user_id=%d", gid, bob), nil))
+	var out []GroupMessageDTO
+	if err := json.NewDecoder(rec.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range out {
+		if d.ID == anon && d.Poll.MyVotes != nil {
+			t.Errorf("anonymous poll in /groups/messages: my_votes %v", d.Poll.MyVotes)
+		}
+		if d.ID == open && !slices.Equal(d.Poll.MyVotes, []int{1}) {
+			t.Errorf("open poll in /groups/messages: my_votes %v", d.Poll.MyVotes)
+		}
+	}
+}
+
+// Чужой user_id в GET-запросах не раскрывает голос в анонимном опросе: ни в
+// ветке, ни в ленте упоминаний, ни в /sync. Свой голос виден только в ответе на vote.
+func TestAnonymousPollVotesNotLeaked(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob := newTestUser(t, s, "alice"), newTestUser(t, s, "bob")
+	gid := newTestGroup(t, s, alice, bob)
+	head, err := s.syncs.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	poll, err := s.sendGroupMessage(&GroupMessage{
+		GroupID: gid, FromUserID: alice, Text: "@bob обед?\nда\nнет",
+		Poll: &Poll{Options: 2, Anonymous: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := json.Marshal(PollVoteRequest{UserID: bob, MessageID: poll.ID, Options: []int{1}})
+	rec := httptest.NewRecorder()
+	s.handlePollVote(rec, httptest.NewRequest(http.MethodPost, "/polls/vote", bytes.NewReader(body)))
+	var voted SyncPollDTO
+	if err := json.NewDecoder(rec.Body).Decode(&voted); err != nil {
+		t.Fatalf("vote: %d, %v", rec.Code, err)
+	}
+	if !slices.Equal(voted.Poll.MyVotes, []int{1}) {
+		t.Fatalf("vote response: my_votes %v", voted.Poll.MyVotes)
+	}
+
+	get := func(handler http.HandlerFunc, target string, out any) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", target, rec.Code, rec.Body)
+		}
+		if err := json.NewDecoder(rec.Body).Decode(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(path string, dtos []GroupMessageDTO) {
+		t.Helper()
+		found := false
+		for _, d := range dtos {
+			if d.ID != poll.ID {
+				continue
+			}
+			found = true
+			if d.Poll == nil || d.Poll.MyVotes != nil {
+				t.Errorf("%s: poll %+v", path, d.Poll)
+			}
+		}
+		if !found {
+			t.Errorf("%s: poll message missing", path)
+		}
+	}
+
+	var thread GroupThreadResponse
+	get(s.handleGroupThread, fmt.Sprintf("/groups/thread?message_id=%d&user_id=%d", poll.ID, bob), &thread)
+	check("thread", append(thread.Replies, thread.Parent))
+
+	var mentions []MentionDTO
+	get(s.handleMentions, fmt.Sprintf("/mentions?user_id=%d", bob), &mentions)
+	var mentioned []GroupMessageDTO
+	for _, m := range mentions {
+		mentioned = append(mentioned, m.Message)
+	}
+	check("mentions", mentioned)
+
+	var sync SyncResponse
+	get(s.handleSync, fmt.Sprintf("/sync?user_id=%d&token=%s", bob, url.QueryEscape(head.token(bob))), &sync)
+	check("sync", sync.Group)
+	if len(sync.Polls) != 1 || sync.Polls[0].Poll.MyVotes != nil {
+		t.Errorf("sync polls: %+v", sync.Polls)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ===== Присутствие (presence) =====
+//
+// Пинги живут в памяти: раньше каждый пинг каждой вкладки писал last_seen в
+// SQLite, а /presence/online перебирал всю таблицу users. Теперь пинг — запись в
+// map, а last_seen сбрасывается в базу раз в presenceFlushInterval одной
+// транзакцией (при падении теряется не больше этого интервала).
+//
+// Статус (online | away | busy | invisible) и текст статуса меняются редко и
+// пишутся в users сразу. Онлайн — кто пинговал за onlineWindow; остальные
+// offline с last_seen. Invisible для других выглядит как offline, и его last_seen
+// не двигается, пока он невидим.
+//
+// Присутствие видно только контактам: с кем была переписка или общая беседа
+// (UserStore.ListContacts). Список контактов кэшируется на presenceContactsTTL
+// и сбрасывается, когда появляется новый собеседник или участник беседы.
+
+const (
+	onlineWindow          = 15 * time.Second
+	presenceFlushInterval = 30 * time.Second
+	presenceContactsTTL   = 30 * time.Second
+	maxStatusText         = 80 // символов
+)
+
+var presenceStatuses = map[string]bool{"online": true, "away": true, "busy": true, "invisible": true}
+
+type presenceEntry struct {
+	username   string
+	status     string
+	statusText string
+	lastPing   time.Time // нулевой — с запуска сервера не пинговал
+	lastSeen   time.Time // то, что видят другие; у invisible не двигается
+	dirty      bool      // lastSeen ещё не в базе
+}
+
+type contactsCache struct {
+	ids []int64
+	at  time.Time
+}
+
+type presenceRegistry struct {
+	users *UserStore
+
+	mu       sync.Mutex
+	entries  map[int64]*presenceEntry
+	contacts map[int64]contactsCache
+}
+
+func newPresenceRegistry(users *UserStore) *presenceRegistry {
+	return &presenceRegistry{
+		users:    users,
+		entries:  make(map[int64]*presenceEntry),
+		contacts: make(map[int64]contactsCache),
+	}
+}
+
+// remember кладёт пользователя из базы в память, если его там ещё нет: свежие
+// пинги и статус из памяти важнее прочитанного из базы. Вызывать под mu.
+func (p *presenceRegistry) remember(row PresenceRow) *presenceEntry {
+	if e, ok := p.entries[row.ID]; ok {
+		return e
+	}
+	e := &presenceEntry{username: row.Username, status: row.Status, statusText: row.StatusText}
+	if row.LastSeen.Valid {
+		e.lastSeen = parseLastSeen(row.LastSeen.String)
+	}
+	p.entries[row.ID] = e
+	return e
+}
+
+// entry — пользователь из памяти, при первом обращении читается из базы.
+func (p *presenceRegistry) entry(userID int64) (*presenceEntry, error) {
+	p.mu.Lock()
+	e, ok := p.entries[userID]
+	p.mu.Unlock()
+	if ok {
+		return e, nil
+	}
+
+	row, err := p.users.PresenceRow(userID)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.remember(*row), nil
+}
+
+func (p *presenceRegistry) ping(userID int64) error {
+	e, err := p.entry(userID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	p.mu.Lock()
+	e.lastPing = now
+	if e.status != "invisible" {
+		e.lastSeen = now
+		e.dirty = true
+	}
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *presenceRegistry) setStatus(userID int64, status, text string) error {
+	e, err := p.entry(userID)
+	if err != nil {
+		return err
+	}
+	if err := p.users.SetStatus(userID, status, text); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	e.status, e.statusText = status, text
+	p.mu.Unlock()
+	return nil
+}
+
+// view — как пользователя видят другие.
+func (p *presenceRegistry) view(id int64, e *presenceEntry, now time.Time) PresenceDTO {
+	d := PresenceDTO{ID: id, Username: e.username, Status: "offline", StatusText: e.statusText}
+	if now.Sub(e.lastPing) <= onlineWindow && e.status != "invisible" {
+		d.Status = e.status
+	}
+	if d.Status == "offline" && !e.lastSeen.IsZero() {
+		d.LastSeen = e.lastSeen.UTC().Format(time.RFC3339)
+	}
+	return d
+}
+
+// self — свой статус как есть (invisible виден только самому).
+func (p *presenceRegistry) self(userID int64) (PresenceDTO, error) {
+	e, err := p.entry(userID)
+	if err != nil {
+		return PresenceDTO{}, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return PresenceDTO{ID: userID, Username: e.username, Status: e.status, StatusText: e.statusText}, nil
+}
+
+// contactsOf — присутствие контактов пользователя. База трогается, только когда
+// кэш контактов устарел.
+func (p *presenceRegistry) contactsOf(userID int64) ([]PresenceDTO, error) {
+	now := time.Now()
+	p.mu.Lock()
+	c, ok := p.contacts[userID]
+	p.mu.Unlock()
+
+	if !ok || now.Sub(c.at) > presenceContactsTTL {
+		rows, err := p.users.ListContacts(userID)
+		if err != nil {
+			return nil, err
+		}
+		c = contactsCache{ids: make([]int64, 0, len(rows)), at: now}
+		p.mu.Lock()
+		for _, row := range rows {
+			p.remember(row)
+			c.ids = append(c.ids, row.ID)
+		}
+		p.contacts[userID] = c
+		p.mu.Unlock()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]PresenceDTO, 0, len(c.ids))
+	for _, id := range c.ids {
+		if e, ok := p.entries[id]; ok {
+			out = append(out, p.view(id, e, now))
+		}
+	}
+	return out, nil
+}
+
+// forgetContacts сбрасывает кэш контактов у ids (без ids — у всех): новый
+// собеседник или участник беседы должен появиться сразу, а не через TTL.
+func (p *presenceRegistry) forgetContacts(ids ...int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(ids) == 0 {
+		clear(p.contacts)
+		return
+	}
+	for _, id := range ids {
+		delete(p.contacts, id)
+	}
+}
+
+// flush пишет изменившиеся last_seen в базу.
+func (p *presenceRegistry) flush() error {
+	p.mu.Lock()
+	seen := make(map[int64]time.Time)
+	for id, e := range p.entries {
+		if e.dirty {
+			seen[id] = e.lastSeen
+			e.dirty = false
+		}
+	}
+	p.mu.Unlock()
+	if len(seen) == 0 {
+		return nil
+	}
+
+	if err := p.users.SaveLastSeen(seen); err != nil {
+		// не записалось — попробуем в следующий раз
+		p.mu.Lock()
+		for id := range seen {
+			if e, ok := p.entries[id]; ok {
+				e.dirty = true
+			}
+		}
+		p.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (s *Server) runPresenceFlush(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := s.presence.flush(); err != nil {
+			log.Printf("presence flush: %v", err)
+		}
+	}
+}
+
+func validStatusText(text string) bool {
+	return utf8.ValidString(text) && utf8.RuneCountInString(text) <= maxStatusText
+}
+
+// parseLastSeen понимает и то, что драйвер отдаёт для DATETIME, и старый формат datetime('now').
+func parseLastSeen(v string) time.Time {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05"} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
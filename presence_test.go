@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPresenceInvisible(t *testing.T) {
+	s := newTestServer(t)
+	alice := newTestUser(t, s, "alice")
+	p := s.presence
+	if err := p.ping(alice); err != nil {
+		t.Fatal(err)
+	}
+	e, err := p.entry(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if d := p.view(alice, e, now); d.Status != "online" || d.LastSeen != "" {
+		t.Fatalf("online: %+v", d)
+	}
+	seen := e.lastSeen
+
+	if err := p.setStatus(alice, "invisible", "в отпуске"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.ping(alice); err != nil {
+		t.Fatal(err)
+	}
+	// для других — offline с last_seen до невидимости, хоть пинги и идут
+	d := p.view(alice, e, time.Now())
+	if d.Status != "offline" || d.LastSeen != seen.UTC().Format(time.RFC3339) || d.StatusText != "в отпуске" {
+		t.Fatalf("invisible: %+v", d)
+	}
+	if !e.lastSeen.Equal(seen) {
+		t.Fatalf("last_seen moved to %v", e.lastSeen)
+	}
+	if self, err := p.self(alice); err != nil || self.Status != "invisible" {
+		t.Fatalf("self %+v, %v", self, err)
+	}
+
+	// away видно как есть, пока пинги свежие
+	if err := p.setStatus(alice, "away", ""); err != nil {
+		t.Fatal(err)
+	}
+	if d := p.view(alice, e, time.Now()); d.Status != "away" {
+		t.Fatalf("away: %+v", d)
+	}
+	if d := p.view(alice, e, time.Now().Add(onlineWindow+time.Second)); d.Status != "offline" || d.LastSeen == "" {
+		t.Fatalf("no pings: %+v", d)
+	}
+}
+
+// Присутствие видно только тем, с кем была переписка или общая беседа.
+func TestPresenceContacts(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob, carol, eve := newTestUser(t, s, "alice"), newTestUser(t, s, "bob"), newTestUser(t, s, "carol"), newTestUser(t, s, "eve")
+	newTestGroup(t, s, alice, carol)
+	if _, err := s.plainMessages.Create(&PlainMessage{FromUserID: bob, ToUserID: alice, Text: "привет"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int64{alice, bob, carol, eve} {
+		if err := s.presence.ping(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ids := func(uid int64) []int64 {
+		t.Helper()
+		list, err := s.presence.contactsOf(uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []int64
+		for _, d := range list {
+			out = append(out, d.ID)
+		}
+		return out
+	}
+	if got := ids(alice); len(got) != 2 || got[0] != bob || got[1] != carol {
+		t.Fatalf("alice contacts %v, want [%d %d]", got, bob, carol)
+	}
+	if got := ids(bob); len(got) != 1 || got[0] != alice {
+		t.Fatalf("bob contacts %v", got)
+	}
+	if got := ids(eve); len(got) != 0 {
+		t.Fatalf("eve contacts %v", got)
+	}
+
+	// новый собеседник появляется после forgetContacts, не дожидаясь TTL
+	if _, err := s.plainMessages.Create(&PlainMessage{FromUserID: eve, ToUserID: alice, Text: "привет"}); err != nil {
+		t.Fatal(err)
+	}
+	s.presence.forgetContacts(alice, eve)
+	if got := ids(alice); len(got) != 3 || got[2] != eve {
+		t.Fatalf("alice contacts after eve wrote %v", got)
+	}
+	if got := ids(eve); len(got) != 1 || got[0] != alice {
+		t.Fatalf("eve contacts %v", got)
+	}
+}
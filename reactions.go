@@ -0,0 +1,94 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ===== Реакции на сообщения =====
+//
+// Реакция — эмодзи от пользователя на личное или групповое сообщение; ставить
+// могут только участники беседы. В DTO сообщений реакции приходят уже
+// сгруппированными (эмодзи, сколько, кто), изменения — через /sync: каждое
+// добавление и снятие пишется в reaction_log, и /sync отдаёт сообщение с
+// актуальным списком реакций.
+
+const (
+	maxReactionsPerUser = 10 // разных эмодзи от одного пользователя на сообщение
+	maxEmojiBytes       = 32 // эмодзи с модификаторами и ZWJ-последовательности длинные
+)
+
+var (
+	ErrTooManyReactions = errors.New("too many reactions on this message")
+	ErrMessageNotFound  = errors.New("message not found")
+	ErrNotParticipant   = errors.New("forbidden: not a participant")
+)
+
+// validEmoji — не пытаемся знать все эмодзи, но и текст реакцией не пропускаем:
+// короткая строка без пробелов, управляющих символов, букв любого алфавита
+// («привет», «你好» — не реакция) и цифр (цифры — только ASCII в keycap вроде 1️⃣).
+func validEmoji(e string) bool {
+	if e == "" || len(e) > maxEmojiBytes || !utf8.ValidString(e) {
+		return false
+	}
+	keycap := strings.ContainsRune(e, '\u20e3')
+	for _, r := range e {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || unicode.IsLetter(r) {
+			return false
+		}
+		if unicode.IsDigit(r) && !(keycap && r < 0x80) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkMessageAccess — может ли пользователь видеть сообщение (kind = direct | group):
+// в личке он отправитель или получатель, в беседе — участник.
+func (s *Server) checkMessageAccess(kind string, messageID, userID int64) error {
+	switch kind {
+	case plainMessagesTable.kind:
+		from, to, err := s.plainMessages.Participants(messageID)
+		if err == sql.ErrNoRows {
+			return ErrMessageNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if userID != from && userID != to {
+			return ErrNotParticipant
+		}
+		return nil
+	case groupMessagesTable.kind:
+		groupID, err := s.groupMessages.GroupOf(messageID)
+		if err == sql.ErrNoRows {
+			return ErrMessageNotFound
+		}
+		if err != nil {
+			return err
+		}
+		isMember, err := s.groupMembers.IsMember(groupID, userID)
+		if err != nil {
+			return err
+		}
+		if !isMember {
+			return ErrNotParticipant
+		}
+		return nil
+	}
+	return ErrMessageNotFound
+}
+
+func reactionDTOs(list []Reaction) []ReactionDTO {
+	if len(list) == 0 {
+		return nil
+	}
+	out := make([]ReactionDTO, 0, len(list))
+	for _, r := range list {
+		out = append(out, ReactionDTO{Emoji: r.Emoji, Count: len(r.UserIDs), UserIDs: r.UserIDs})
+	}
+	return out
+}
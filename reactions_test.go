@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestValidEmoji(t *testing.T) {
+	for _, e := range []string{"👍", "❤️", "👍🏽", "👨‍👩‍👧", "🇷🇺", "1️⃣", "#️⃣", "©️"} {
+		if !validEmoji(e) {
+			t.Errorf("%q rejected", e)
+		}
+	}
+	for _, e := range []string{"", "a", "ok", "привет", "你好", "ß", "5", "١", "👍 ", "\n", "١⃣", strings.Repeat("👍", 9)} {
+		if validEmoji(e) {
+			t.Errorf("%q accepted", e)
+		}
+	}
+}
+
+type reactionResponse struct {
+	Changed   bool          `json:"changed"`
+	Reactions []ReactionDTO `json:"reactions"`
+}
+
+func react(t *testing.T, s *Server, add bool, req ReactionRequest) (int, reactionResponse) {
+	t.Helper()
+	handler, target := s.handleReactionAdd, "/reactions/add"
+	if !add {
+		handler, target = s.handleReactionRemove, "/reactions/remove"
+	}
+	rec := postJSON(handler, target, req)
+	var out reactionResponse
+	if rec.Code == http.StatusOK {
+		if err := json.NewDecoder(rec.Body).Decode(&out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.Code, out
+}
+
+// Реакцию ставят только участники беседы.
+func TestReactionAccess(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob, eve := newTestUser(t, s, "alice"), newTestUser(t, s, "bob"), newTestUser(t, s, "eve")
+	gid := newTestGroup(t, s, alice, bob)
+	direct, err := s.plainMessages.Create(&PlainMessage{FromUserID: alice, ToUserID: bob, Text: "привет"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	group, err := s.groupMessages.Create(&GroupMessage{GroupID: gid, FromUserID: alice, Text: "всем привет"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		req  ReactionRequest
+		want int
+	}{
+		{"recipient", ReactionRequest{UserID: bob, Kind: "direct", MessageID: direct.ID, Emoji: "👍"}, http.StatusOK},
+		{"group member", ReactionRequest{UserID: bob, Kind: "group", MessageID: group.ID, Emoji: "👍"}, http.StatusOK},
+		{"stranger in a chat", ReactionRequest{UserID: eve, Kind: "direct", MessageID: direct.ID, Emoji: "👍"}, http.StatusForbidden},
+		{"not a group member", ReactionRequest{UserID: eve, Kind: "group", MessageID: group.ID, Emoji: "👍"}, http.StatusForbidden},
+		{"no such message", ReactionRequest{UserID: eve, Kind: "group", MessageID: group.ID + 100, Emoji: "👍"}, http.StatusNotFound},
+		{"text instead of emoji", ReactionRequest{UserID: bob, Kind: "direct", MessageID: direct.ID, Emoji: "привет"}, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		if code, _ := react(t, s, true, c.req); code != c.want {
+			t.Errorf("%s: %d, want %d", c.name, code, c.want)
+		}
+	}
+	list, err := s.reactions.ListFor("direct", []int64{direct.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := list[direct.ID]; len(got) != 1 || len(got[0].UserIDs) != 1 || got[0].UserIDs[0] != bob {
+		t.Fatalf("reactions %+v", got)
+	}
+}
+
+// Добавление и снятие видны участникам в ReactionChange (/sync), повтор — нет.
+func TestReactionChanges(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob, eve := newTestUser(t, s, "alice"), newTestUser(t, s, "bob"), newTestUser(t, s, "eve")
+	msg, err := s.plainMessages.Create(&PlainMessage{FromUserID: alice, ToUserID: bob, Text: "привет"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := ReactionRequest{UserID: bob, Kind: "direct", MessageID: msg.ID, Emoji: "🔥"}
+
+	changes := func(uid, after int64) []ReactionChange {
+		t.Helper()
+		out, err := s.reactions.ChangedSince(uid, after, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	code, out := react(t, s, true, req)
+	if code != http.StatusOK || !out.Changed || len(out.Reactions) != 1 || out.Reactions[0].Count != 1 {
+		t.Fatalf("add: %d %+v", code, out)
+	}
+	added := changes(alice, 0)
+	if len(added) != 1 || added[0].MessageID != msg.ID || added[0].FromUserID != alice || added[0].ToUserID != bob {
+		t.Fatalf("changes after add: %+v", added)
+	}
+	if got := changes(eve, 0); len(got) != 0 {
+		t.Fatalf("stranger sees %d changes", len(got))
+	}
+
+	// та же реакция ещё раз — ничего не меняется
+	if code, out := react(t, s, true, req); code != http.StatusOK || out.Changed {
+		t.Fatalf("repeat: %d %+v", code, out)
+	}
+	if got := changes(alice, added[0].ID); len(got) != 0 {
+		t.Fatalf("repeat logged %d changes", len(got))
+	}
+
+	code, out = react(t, s, false, req)
+	if code != http.StatusOK || !out.Changed || len(out.Reactions) != 0 {
+		t.Fatalf("remove: %d %+v", code, out)
+	}
+	removed := changes(bob, added[0].ID)
+	if len(removed) != 1 || removed[0].MessageID != msg.ID {
+		t.Fatalf("changes after remove: %+v", removed)
+	}
+	list, err := s.reactions.ListFor("direct", []int64{msg.ID})
+	if err != nil || len(list[msg.ID]) != 0 {
+		t.Fatalf("reactions after remove: %+v, %v", list[msg.ID], err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"unicode/utf8"
+)
+
+// ===== Ответы и цитаты =====
+//
+// Сообщение может быть ответом на другое (reply_to) — только из той же беседы,
+// это проверяется в транзакции отправки. В DTO ответа приходит цитата родителя
+// (кто и начало текста), у родителя — сколько на него ответили; ветка целиком —
+// /chat/thread и /groups/thread.
+
+const replySnippetRunes = 120
+
+var ErrBadReply = errors.New("bad reply_to: no such message in this conversation")
+
+func nullID(id int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: id, Valid: id != 0}
+}
+
+// checkReplyParent — родитель существует и из той же беседы (scope — conversationScope
+// нового сообщения). Чужое и несуществующее сообщение — одна и та же ошибка.
+func checkReplyParent(tx *sql.Tx, t textTable, parentID int64, scope string) error {
+	if parentID == 0 {
+		return nil
+	}
+	var from, conv int64
+	err := tx.QueryRow(`SELECT from_user_id, `+t.convCol+` FROM `+t.name+` WHERE id = ?`, parentID).Scan(&from, &conv)
+	if err == sql.ErrNoRows {
+		return ErrBadReply
+	}
+	if err != nil {
+		return err
+	}
+	if conversationScope(t.kind, from, conv) != scope {
+		return ErrBadReply
+	}
+	return nil
+}
+
+func replySnippet(text string) string {
+	if utf8.RuneCountInString(text) <= replySnippetRunes {
+		return text
+	}
+	r := []rune(text)
+	return string(r[:replySnippetRunes]) + "…"
+}
+
+// replyInfo — цитаты родителей и число ответов для сообщений из таблицы t.
+// replyTo — id сообщения → id родителя (0 — не ответ). Родителей и их вложения
+// дочитывает сам, по запросу на каждое: вложения страницы, которые у вызывающего,
+// не трогает.
+func (s *Server) replyInfo(t textTable, replyTo map[int64]int64) (map[int64]*ReplyPreviewDTO, map[int64]int, error) {
+	ids := make([]int64, 0, len(replyTo))
+	var parentIDs []int64
+	seen := map[int64]bool{}
+	for id, parent := range replyTo {
+		ids = append(ids, id)
+		if parent != 0 && !seen[parent] {
+			seen[parent] = true
+			parentIDs = append(parentIDs, parent)
+		}
+	}
+
+	previews := map[int64]*ReplyPreviewDTO{}
+	if len(parentIDs) > 0 {
+		parents, err := s.replies.Parents(t, parentIDs)
+		if err != nil {
+			return nil, nil, err
+		}
+		atts, err := s.attachments.ListFor(t.kind, parentIDs)
+		if err != nil {
+			return nil, nil, err
+		}
+		for id, parent := range replyTo {
+			p := parents[parent]
+			if p == nil {
+				continue
+			}
+			previews[id] = &ReplyPreviewDTO{
+				ID:           p.ID,
+				FromUserID:   p.FromUserID,
+				FromUsername: p.FromUsername,
+				Text:         replySnippet(stripAttachmentMarkers(p.Text, atts[p.ID])),
+				Attachments:  len(atts[p.ID]),
+			}
+		}
+	}
+
+	counts, err := s.replies.Counts(t, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	return previews, counts, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReplyPreviewDirect(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob := newTestUser(t, s, "alice"), newTestUser(t, s, "bob")
+	m := newTestMedia(t, s, alice, bob, 0)
+	parent, err := s.sendChatMessage(&PlainMessage{FromUserID: alice, ToUserID: bob, Text: "смотри", Attachments: []string{m.PublicID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := s.sendChatMessage(&PlainMessage{FromUserID: bob, ToUserID: alice, Text: "ага", ReplyTo: parent.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// родителя на странице нет — дочитывается вместе с вложениями
+	dtos, err := s.chatMessageDTOs([]*PlainMessage{reply})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := dtos[0].ReplyTo
+	if p == nil || p.ID != parent.ID || p.FromUserID != alice || p.FromUsername != "alice" {
+		t.Fatalf("preview %+v", p)
+	}
+	if p.Text != "смотри" || p.Attachments != 1 {
+		t.Fatalf("preview text %q, %d attachments", p.Text, p.Attachments)
+	}
+	// вложения родителя не приписываются ответу
+	if len(dtos[0].Attachments) != 0 {
+		t.Fatalf("reply got %d attachments", len(dtos[0].Attachments))
+	}
+
+	// родитель на той же странице
+	dtos, err = s.chatMessageDTOs([]*PlainMessage{parent, reply})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dtos[0].ReplyCount != 1 || dtos[0].ReplyTo != nil || len(dtos[0].Attachments) != 1 {
+		t.Fatalf("parent %+v", dtos[0])
+	}
+	if dtos[1].ReplyTo == nil || dtos[1].ReplyTo.Attachments != 1 || len(dtos[1].Attachments) != 0 {
+		t.Fatalf("reply %+v", dtos[1])
+	}
+}
+
+func TestReplyPreviewGroup(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob := newTestUser(t, s, "alice"), newTestUser(t, s, "bob")
+	g, err := s.groups.Create("team", alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uid := range []int64{alice, bob} {
+		if err := s.groupMembers.AddMember(g.ID, uid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	long := strings.Repeat("я", replySnippetRunes+10)
+	parent, err := s.sendGroupMessage(&GroupMessage{GroupID: g.ID, FromUserID: alice, Text: long})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replies []*GroupMessage
+	for i := 0; i < 2; i++ {
+		r, err := s.sendGroupMessage(&GroupMessage{GroupID: g.ID, FromUserID: bob, Text: "да", ReplyTo: parent.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		replies = append(replies, r)
+	}
+
+	dtos, err := s.groupMessageDTOs(append([]*GroupMessage{parent}, replies...), pollViewer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dtos[0].ReplyCount != 2 {
+		t.Fatalf("reply count %d", dtos[0].ReplyCount)
+	}
+	for _, d := range dtos[1:] {
+		p := d.ReplyTo
+		if p == nil || p.ID != parent.ID || p.FromUsername != "alice" {
+			t.Fatalf("preview %+v", p)
+		}
+		if p.Text != strings.Repeat("я", replySnippetRunes)+"…" {
+			t.Fatalf("snippet %q", p.Text)
+		}
+	}
+
+	// ответ на сообщение, которого уже нет, — без цитаты
+	if _, err := s.groupMessages.db.Exec(`DELETE FROM group_messages WHERE id = ?`, parent.ID); err != nil {
+		t.Fatal(err)
+	}
+	dtos, err = s.groupMessageDTOs(replies, pollViewer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dtos[0].ReplyTo != nil {
+		t.Fatalf("preview of a deleted parent %+v", dtos[0].ReplyTo)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// ===== Отложенные сообщения =====
+//
+// /scheduled/create проверяет всё то же, что /chat/send и /groups/send (получатель,
+// участие в беседе, ответ, вложения), и кладёт сообщение в scheduled_messages.
+// Горутина runScheduler раз в scheduledInterval берёт наступившие и отправляет их
+// тем же путём, что и обработчики (sendChatMessage / sendGroupMessage): с /sync,
+// упоминаниями и всем остальным. Очередь живёт в базе, поэтому переживает
+// перезапуск: просроченные за время простоя уйдут сразу после старта.
+//
+// Перед отправкой строка переводится в sending. Если сервер остановился между
+// этим и отметкой sent, при старте такая строка помечается failed, а не
+// отправляется ещё раз: лучше не отправить, чем задвоить.
+//
+// Ко времени отправки условия проверяются заново: вышедший из беседы в неё уже не
+// пишет — сообщение остаётся failed с причиной в error.
+
+const (
+	scheduledInterval   = time.Second
+	maxScheduleAhead    = 365 * 24 * time.Hour
+	maxPendingScheduled = 100 // на пользователя
+	maxScheduledList    = 200
+)
+
+var (
+	ErrTooManyScheduled = errors.New("too many scheduled messages")
+	ErrNotScheduled     = errors.New("scheduled message not found or already sent")
+)
+
+const errScheduleInterrupted = "interrupted by server restart"
+
+// runScheduler — как runMediaGC: при старте разбирается с прерванными, дальше
+// раз в interval отправляет наступившие.
+func (s *Server) runScheduler(interval time.Duration) {
+	if n, err := s.scheduled.FailInterrupted(); err != nil {
+		log.Printf("scheduler: %v", err)
+	} else if n > 0 {
+		log.Printf("scheduler: %d messages were being sent at shutdown, marked failed", n)
+	}
+	for {
+		s.sendDueScheduled(time.Now())
+		time.Sleep(interval)
+	}
+}
+
+func (s *Server) sendDueScheduled(now time.Time) {
+	for {
+		due, err := s.scheduled.Due(now, 100)
+		if err != nil {
+			log.Printf("scheduler: %v", err)
+			return
+		}
+		for _, m := range due {
+			claimed, err := s.scheduled.Claim(m.ID)
+			if err != nil {
+				log.Printf("scheduler: %v", err)
+				return
+			}
+			if !claimed { // отменили, пока выбирали
+				continue
+			}
+			messageID, reason, err := s.deliverScheduled(m)
+			switch {
+			case err != nil:
+				// база: попробуем на следующем круге
+				log.Printf("scheduler: send %d: %v", m.ID, err)
+				if err := s.scheduled.Release(m.ID); err != nil {
+					log.Printf("scheduler: %v", err)
+				}
+				return
+			case reason != "":
+				err = s.scheduled.MarkFailed(m.ID, reason)
+			default:
+				err = s.scheduled.MarkSent(m.ID, messageID)
+			}
+			if err != nil {
+				log.Printf("scheduler: %v", err)
+			}
+		}
+		if len(due) < 100 {
+			return
+		}
+	}
+}
+
+// deliverScheduled отправляет сообщение. reason — почему отправить нельзя в
+// принципе (повторять незачем), err — ошибка базы.
+func (s *Server) deliverScheduled(m *ScheduledMessage) (int64, string, error) {
+	atts, err := s.attachments.ListFor(scheduledMessagesTable.kind, []int64{m.ID})
+	if err != nil {
+		return 0, "", err
+	}
+	var media []int64
+	for _, a := range atts[m.ID] {
+		media = append(media, a.ID)
+	}
+
+	var created int64
+	switch m.Kind {
+	case plainMessagesTable.kind:
+		if _, err := s.users.GetByID(m.ConvID); err != nil {
+			return 0, "to_user not found", nil
+		}
+		msg, err := s.sendChatMessage(&PlainMessage{
+			FromUserID:     m.FromUserID,
+			ToUserID:       m.ConvID,
+			Text:           m.Text,
+			ReplyTo:        m.ReplyTo,
+			ForwardedMedia: media,
+		})
+		if errors.Is(err, ErrBadReply) {
+			return 0, err.Error(), nil
+		}
+		if err != nil {
+			return 0, "", err
+		}
+		created = msg.ID
+	case groupMessagesTable.kind:
+		isMember, err := s.groupMembers.IsMember(m.ConvID, m.FromUserID)
+		if err != nil {
+			return 0, "", err
+		}
+		if !isMember {
+			return 0, "not a group member", nil
+		}
+		msg, err := s.sendGroupMessage(&GroupMessage{
+			GroupID:        m.ConvID,
+			FromUserID:     m.FromUserID,
+			Text:           m.Text,
+			ReplyTo:        m.ReplyTo,
+			ForwardedMedia: media,
+		})
+		if errors.Is(err, ErrBadReply) {
+			return 0, err.Error(), nil
+		}
+		if err != nil {
+			return 0, "", err
+		}
+		created = msg.ID
+	default:
+		return 0, "unknown kind " + m.Kind, nil
+	}
+	return created, "", nil
+}
+
+// scheduledDTOs — отложенные с вложениями (пока ждут отправки).
+func (s *Server) scheduledDTOs(list []*ScheduledMessage) ([]ScheduledDTO, error) {
+	ids := make([]int64, 0, len(list))
+	for _, m := range list {
+		ids = append(ids, m.ID)
+	}
+	atts, err := s.attachments.ListFor(scheduledMessagesTable.kind, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]ScheduledDTO, 0, len(list))
+	for _, m := range list {
+		d := ScheduledDTO{
+			ID:          m.ID,
+			Kind:        m.Kind,
+			Text:        m.Text,
+			Attachments: attachmentDTOs(atts[m.ID]),
+			ReplyTo:     m.ReplyTo,
+			SendAt:      m.SendAt,
+			Status:      m.Status,
+			MessageID:   m.MessageID,
+			Error:       m.Error,
+			CreatedAt:   m.CreatedAt,
+		}
+		if m.Kind == groupMessagesTable.kind {
+			d.GroupID = m.ConvID
+		} else {
+			d.ToUserID = m.ConvID
+		}
+		out = append(out, d)
+	}
+	return out, nil
+}
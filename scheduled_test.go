@@ -0,0 +1,126 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func schedule(t *testing.T, s *Server, m *ScheduledMessage, at time.Time) *ScheduledMessage {
+	t.Helper()
+	m.SendAt = at.UTC().Format(time.RFC3339)
+	created, err := s.scheduled.Create(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return created
+}
+
+func scheduledByID(t *testing.T, s *Server, id int64) *ScheduledMessage {
+	t.Helper()
+	list, err := s.scheduled.ListByIDs([]int64{id})
+	if err != nil || len(list) != 1 {
+		t.Fatalf("scheduled %d: %v, %v", id, list, err)
+	}
+	return list[0]
+}
+
+func TestSendDueScheduled(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob := newTestUser(t, s, "alice"), newTestUser(t, s, "bob")
+	gid := newTestGroup(t, s, alice, bob)
+	now := time.Now()
+	m := newTestMedia(t, s, alice, bob, 0)
+
+	direct := schedule(t, s, &ScheduledMessage{Kind: "direct", FromUserID: alice, ConvID: bob, Text: "с днём рождения", Attachments: []string{m.PublicID}}, now.Add(-time.Minute))
+	group := schedule(t, s, &ScheduledMessage{Kind: "group", FromUserID: bob, ConvID: gid, Text: "созвон через час"}, now.Add(-time.Second))
+	later := schedule(t, s, &ScheduledMessage{Kind: "direct", FromUserID: alice, ConvID: bob, Text: "завтра"}, now.Add(time.Hour))
+
+	s.sendDueScheduled(now)
+
+	d := scheduledByID(t, s, direct.ID)
+	if d.Status != "sent" || d.MessageID == 0 {
+		t.Fatalf("direct: %s %d %s", d.Status, d.MessageID, d.Error)
+	}
+	msgs, err := s.plainMessages.ListByIDs([]int64{d.MessageID})
+	if err != nil || len(msgs) != 1 || msgs[0].Text != "с днём рождения" || msgs[0].FromUserID != alice {
+		t.Fatalf("direct message %+v, %v", msgs, err)
+	}
+	// вложение переехало к отправленному сообщению
+	atts, err := s.attachments.ListFor(plainMessagesTable.kind, []int64{d.MessageID})
+	if err != nil || len(atts[d.MessageID]) != 1 || atts[d.MessageID][0].ID != m.ID {
+		t.Fatalf("attachments %v, %v", atts[d.MessageID], err)
+	}
+	if left, err := s.attachments.ListFor(scheduledMessagesTable.kind, []int64{direct.ID}); err != nil || len(left[direct.ID]) != 0 {
+		t.Fatalf("scheduled attachments left: %v, %v", left[direct.ID], err)
+	}
+
+	g := scheduledByID(t, s, group.ID)
+	if g.Status != "sent" {
+		t.Fatalf("group: %s %s", g.Status, g.Error)
+	}
+	gm, err := s.groupMessages.ListByIDs([]int64{g.MessageID})
+	if err != nil || len(gm) != 1 || gm[0].GroupID != gid || gm[0].Text != "созвон через час" {
+		t.Fatalf("group message %+v, %v", gm, err)
+	}
+
+	if l := scheduledByID(t, s, later.ID); l.Status != "pending" {
+		t.Fatalf("future message: %s", l.Status)
+	}
+	// второй проход ничего не шлёт повторно
+	s.sendDueScheduled(now)
+	if all, err := s.plainMessages.ListBetween(alice, bob); err != nil || len(all) != 1 {
+		t.Fatalf("%d direct messages after the second pass, %v", len(all), err)
+	}
+}
+
+// Строка, застрявшая в sending на остановке сервера, помечается failed и не
+// отправляется ещё раз.
+func TestScheduledFailInterrupted(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob := newTestUser(t, s, "alice"), newTestUser(t, s, "bob")
+	now := time.Now()
+	m := schedule(t, s, &ScheduledMessage{Kind: "direct", FromUserID: alice, ConvID: bob, Text: "может, уже ушло"}, now.Add(-time.Minute))
+	pending := schedule(t, s, &ScheduledMessage{Kind: "direct", FromUserID: alice, ConvID: bob, Text: "ещё ждёт"}, now.Add(time.Hour))
+	if ok, err := s.scheduled.Claim(m.ID); err != nil || !ok {
+		t.Fatalf("claim: %v, %v", ok, err)
+	}
+
+	if n, err := s.scheduled.FailInterrupted(); err != nil || n != 1 {
+		t.Fatalf("failed %d, %v", n, err)
+	}
+	s.sendDueScheduled(now)
+
+	got := scheduledByID(t, s, m.ID)
+	if got.Status != "failed" || got.Error != errScheduleInterrupted || got.MessageID != 0 {
+		t.Fatalf("interrupted: %s %q %d", got.Status, got.Error, got.MessageID)
+	}
+	if p := scheduledByID(t, s, pending.ID); p.Status != "pending" {
+		t.Fatalf("pending message: %s", p.Status)
+	}
+	if msgs, err := s.plainMessages.ListBetween(alice, bob); err != nil || len(msgs) != 0 {
+		t.Fatalf("%d messages sent, %v", len(msgs), err)
+	}
+}
+
+// Вышедший из беседы в неё уже не пишет, даже отложенным сообщением.
+func TestScheduledSenderLeftGroup(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob := newTestUser(t, s, "alice"), newTestUser(t, s, "bob")
+	gid := newTestGroup(t, s, alice, bob)
+	now := time.Now()
+	m := schedule(t, s, &ScheduledMessage{Kind: "group", FromUserID: bob, ConvID: gid, Text: "всем пока"}, now.Add(-time.Second))
+	// выхода из беседы в API нет — убираем участника в базе
+	if _, err := s.groupMessages.db.Exec(`DELETE FROM group_members WHERE group_id = ? AND user_id = ?`, gid, bob); err != nil {
+		t.Fatal(err)
+	}
+
+	s.sendDueScheduled(now)
+
+	got := scheduledByID(t, s, m.ID)
+	if got.Status != "failed" || got.Error != "not a group member" {
+		t.Fatalf("status %s %q", got.Status, got.Error)
+	}
+	if msgs, err := s.groupMessages.ListSince(alice, 0, 10); err != nil || len(msgs) != 0 {
+		t.Fatalf("%d group messages, %v", len(msgs), err)
+	}
+}
@@ -4,6 +4,7 @@ let selfPass = null;
 
 const conversations = {}; // key -> {type, title, peerName, peerID, groupID, lastRead, lastKnown, unread}
 let activeKey = null;
+let activeMsgs = []; // история открытого чата: грузится при открытии, дальше дополняется из /sync
 let pollTimer = null;
 
 const chatListEl = document.getElementById('chatList');
@@ -17,9 +18,11 @@ const idsInfo = document.getElementById('idsInfo');
 const messagesEl = document.getElementById('messages');
 const msgInput = document.getElementById('msgInput');
 const sendBtn = document.getElementById('sendBtn');
+const scheduleBtn = document.getElementById('scheduleBtn');
 
 const attachBtn = document.getElementById('attachBtn');
 const fileInput = document.getElementById('fileInput');
+const voiceBtn = document.getElementById('voiceBtn');
 
 const peerSearch = document.getElementById('peerSearch');
 const openByNameBtn = document.getElementById('openByNameBtn');
@@ -28,11 +31,27 @@ const refreshBtn = document.getElementById('refreshBtn');
 const logoutBtn = document.getElementById('logoutBtn');
 
 const addMemberBtn = document.getElementById('addMemberBtn');
+const pollBtn = document.getElementById('pollBtn');
+
+const replyBar = document.getElementById('replyBar');
+const replyBarWho = document.getElementById('replyBarWho');
+const replyBarText = document.getElementById('replyBarText');
+const replyCancelBtn = document.getElementById('replyCancelBtn');
+const threadPanel = document.getElementById('threadPanel');
+const threadMessagesEl = document.getElementById('threadMessages');
+const threadCloseBtn = document.getElementById('threadCloseBtn');
+
+const pinBanner = document.getElementById('pinBanner');
+const pinBannerBody = document.getElementById('pinBannerBody');
+const pinBannerLabel = document.getElementById('pinBannerLabel');
+const pinBannerText = document.getElementById('pinBannerText');
+const pinUnpinBtn = document.getElementById('pinUnpinBtn');
 
 const onlineListEl = document.getElementById('onlineList');
 const onlineCountEl = document.getElementById('onlineCount');
 
-const ONLINE_WINDOW_SEC = 15;
+const myStatusEl = document.getElementById('myStatus');
+const myStatusTextEl = document.getElementById('myStatusText');
 
 // id -> username cache (чтобы хоть как-то подписывать сообщения в беседах)
 const idToName = new Map();
@@ -128,26 +147,36 @@ async function ensureLogin() {
   clearAllUI();
   loadState();
 
-  await bootstrapConversations();
+  // токен берём до загрузки историй: всё, что придёт после, получим дельтой
+  const head = await apiJSON('/sync?user_id=' + encodeURIComponent(selfID), 'GET');
+  syncToken = head.token;
+
+  await pollOnce();
   renderChatList();
 
   if (activeKey && conversations[activeKey]) {
     await setActiveConversation(activeKey);
   }
 
+  loadMyStatus().catch(() => {});
   startPolling();
+  startSync();
 }
 
 function clearAllUI() {
   chatTitle.textContent = 'Чат не выбран';
   chatSubtitle.textContent = 'Открой диалог по нику или выбери чат слева';
+  chatSubtitle.classList.remove('typing');
   idsInfo.textContent = '';
   messagesEl.innerHTML = '';
   msgInput.value = '';
   msgInput.disabled = true;
   sendBtn.disabled = true;
+  scheduleBtn.disabled = true;
   if (attachBtn) attachBtn.disabled = true;
+  if (voiceBtn) voiceBtn.disabled = true;
   if (addMemberBtn) addMemberBtn.style.display = 'none';
+  if (pollBtn) pollBtn.style.display = 'none';
 }
 
 function logout() {
@@ -205,6 +234,14 @@ function renderChatList() {
     item.appendChild(av);
     item.appendChild(text);
 
+    if ((conv.mentions || 0) > 0) {
+      const badge = document.createElement('div');
+      badge.className = 'badge mention-badge';
+      badge.textContent = '@' + conv.mentions;
+      badge.title = 'Непрочитанные упоминания';
+      item.appendChild(badge);
+    }
+
     if ((conv.unread || 0) > 0) {
       const badge = document.createElement('div');
       badge.className = 'badge';
@@ -217,19 +254,616 @@ function renderChatList() {
   }
 }
 
-function renderMessageBody(container, text) {
-  const s = String(text || '');
-  const m = s.match(/^\[\[img:(\d+)\]\]$/);
-  if (m) {
-    const id = m[1];
-    const img = document.createElement('img');
-    img.src = '/api/plain_media/get?id=' + encodeURIComponent(id);
-    img.loading = 'lazy';
-    img.className = 'msg-img';
-    container.appendChild(img);
+function mediaURL(path, id) {
+  return '/api/plain_media/' + path + '?id=' + encodeURIComponent(id) + '&user_id=' + encodeURIComponent(selfID);
+}
+
+function formatSize(bytes) {
+  if (!(bytes > 0)) return '';
+  const units = ['Б', 'КБ', 'МБ', 'ГБ'];
+  let v = bytes, i = 0;
+  while (v >= 1024 && i < units.length - 1) { v /= 1024; i++; }
+  return (i === 0 ? String(v) : v.toFixed(1)) + ' ' + units[i];
+}
+
+// карточка файла: имя и размер приходят вместе с сообщением, ссылка качает файл
+function renderFileCard(container, a) {
+  const card = document.createElement('a');
+  card.className = 'file-card';
+  card.href = mediaURL('get', a.id);
+  card.download = '';
+
+  const icon = document.createElement('span');
+  icon.className = 'file-icon';
+  icon.textContent = '📄';
+  const name = document.createElement('span');
+  name.className = 'file-name';
+  name.textContent = a.name || 'файл';
+  const size = document.createElement('span');
+  size.className = 'file-size';
+  size.textContent = formatSize(a.size);
+
+  card.appendChild(icon);
+  card.appendChild(name);
+  card.appendChild(size);
+  container.appendChild(card);
+}
+
+// в ленте — миниатюра, по клику — оригинал в новой вкладке
+function renderImage(container, a) {
+  const link = document.createElement('a');
+  link.href = mediaURL('get', a.id);
+  link.target = '_blank';
+  link.rel = 'noopener';
+  const img = document.createElement('img');
+  img.src = mediaURL('get', a.id) + (a.has_thumb ? '&size=thumb' : '');
+  img.loading = 'lazy';
+  img.className = 'msg-img';
+  link.appendChild(img);
+  container.appendChild(link);
+}
+
+function formatDuration(ms) {
+  const sec = Math.round((ms || 0) / 1000);
+  return Math.floor(sec / 60) + ':' + String(sec % 60).padStart(2, '0');
+}
+
+// плееры голосовых живут между перерисовками ленты (она перерисовывается на каждом poll),
+// иначе воспроизведение обрывалось бы каждые полторы секунды
+const voicePlayers = new Map();
+
+// голосовое: кнопка, волна (0..255) и длительность; клик по волне — перемотка
+function renderVoice(container, a) {
+  const cached = voicePlayers.get(a.id);
+  if (cached) {
+    container.appendChild(cached);
     return;
   }
-  container.textContent = s;
+
+  const box = document.createElement('div');
+  box.className = 'voice-msg';
+  const play = document.createElement('button');
+  play.type = 'button';
+  play.className = 'voice-play';
+  play.textContent = '▶';
+  const wave = document.createElement('div');
+  wave.className = 'voice-wave';
+  const dur = document.createElement('span');
+  dur.className = 'voice-duration';
+
+  const durationMS = a.duration_ms || 0;
+  dur.textContent = formatDuration(durationMS);
+  for (const v of (Array.isArray(a.waveform) ? a.waveform : [])) {
+    const bar = document.createElement('span');
+    bar.style.height = Math.max(2, Math.round(v / 255 * 24)) + 'px';
+    wave.appendChild(bar);
+  }
+
+  box.appendChild(play);
+  box.appendChild(wave);
+  box.appendChild(dur);
+  container.appendChild(box);
+  voicePlayers.set(a.id, box);
+
+  const audio = new Audio();
+  audio.preload = 'none';
+  audio.src = mediaURL('get', a.id);
+
+  play.addEventListener('click', () => {
+    if (audio.paused) audio.play().catch(err => setStatus('Ошибка воспроизведения: ' + err.message, false));
+    else audio.pause();
+  });
+  audio.addEventListener('play', () => { play.textContent = '⏸'; });
+  audio.addEventListener('pause', () => { play.textContent = '▶'; });
+  audio.addEventListener('timeupdate', () => {
+    const bars = wave.children;
+    const played = durationMS ? audio.currentTime * 1000 / durationMS : 0;
+    for (let i = 0; i < bars.length; i++) bars[i].classList.toggle('played', i / bars.length < played);
+    if (!audio.ended) dur.textContent = formatDuration(audio.currentTime * 1000);
+  });
+  audio.addEventListener('ended', () => { dur.textContent = formatDuration(durationMS); });
+  wave.addEventListener('click', (e) => {
+    if (!durationMS) return;
+    const r = wave.getBoundingClientRect();
+    audio.currentTime = (e.clientX - r.left) / r.width * durationMS / 1000;
+    if (audio.paused) audio.play().catch(() => {});
+  });
+}
+
+// текст сообщения — всегда просто текст; вложения приходят отдельным списком
+function renderMessageBody(container, m) {
+  const atts = Array.isArray(m.attachments) ? m.attachments : [];
+  if (!atts.length) {
+    appendMessageText(container, String(m.text || ''), m);
+    return;
+  }
+  if (m.text) {
+    const text = document.createElement('div');
+    appendMessageText(text, String(m.text), m);
+    container.appendChild(text);
+  }
+  for (const a of atts) {
+    const box = document.createElement('div');
+    box.className = 'msg-attachment';
+    if (a.kind === 'image') renderImage(box, a);
+    else if (a.kind === 'voice') renderVoice(box, a);
+    else renderFileCard(box, a);
+    container.appendChild(box);
+  }
+}
+
+// ===== mentions =====
+const MENTION_RE = /(^|[^\p{L}\p{N}_@])@([\p{L}\p{N}_.\-]+)/gu;
+
+// упомянут ли я в чужом сообщении беседы (по имени или через @all)
+function mentionsMe(m) {
+  if (!m || m.from_user_id === selfID) return false;
+  return !!m.mention_all || (m.mentions || []).includes(selfID);
+}
+
+// текст с подсветкой @упоминаний, которые сервер признал упоминаниями
+function appendMessageText(container, text, m) {
+  const names = new Set((m.mentions || []).map(id => String(id === selfID ? selfUser : nameByID(id)).toLowerCase()));
+  if (m.mention_all) {
+    names.add('all');
+    names.add('everyone');
+  }
+  if (!names.size || !text.includes('@')) {
+    container.appendChild(document.createTextNode(text));
+    return;
+  }
+  let last = 0;
+  for (const match of text.matchAll(MENTION_RE)) {
+    const name = match[2].replace(/[.\-]+$/, '');
+    if (!names.has(name.toLowerCase())) continue;
+    const start = match.index + match[1].length;
+    container.appendChild(document.createTextNode(text.slice(last, start)));
+    const span = document.createElement('span');
+    const mine = name.toLowerCase() === String(selfUser).toLowerCase() ||
+      (m.mention_all && (name.toLowerCase() === 'all' || name.toLowerCase() === 'everyone'));
+    span.className = 'mention' + (mine ? ' me' : '');
+    span.textContent = '@' + name;
+    container.appendChild(span);
+    last = start + 1 + name.length;
+  }
+  container.appendChild(document.createTextNode(text.slice(last)));
+}
+
+// счётчики непрочитанных упоминаний по беседам
+async function mentionsFetch() {
+  const data = await apiJSON('/mentions/unread?user_id=' + encodeURIComponent(selfID), 'GET');
+  const counts = new Map((data.groups || []).map(g => [g.group_id, g.count]));
+  for (const key of Object.keys(conversations)) {
+    const conv = conversations[key];
+    if (conv.type === 'group') conv.mentions = counts.get(conv.groupID) || 0;
+  }
+  renderChatList();
+}
+
+async function markMentionsRead(conv, upTo) {
+  conv.mentions = 0;
+  await apiJSON('/mentions/read', 'POST', { user_id: selfID, group_id: conv.groupID, up_to_message_id: upTo || 0 });
+}
+
+// ===== reactions =====
+const QUICK_REACTIONS = ['👍', '❤️', '😂', '😮', '😢', '🔥'];
+
+function renderReactions(m, conv, inThread) {
+  const row = document.createElement('div');
+  row.className = 'msg-reactions';
+
+  if (!inThread && m.reply_count) {
+    const thread = document.createElement('button');
+    thread.type = 'button';
+    thread.className = 'reaction-chip thread-link';
+    thread.textContent = '💬 ' + m.reply_count;
+    thread.title = 'Открыть ветку';
+    thread.addEventListener('click', () => {
+      openThread(conv, m.id).catch(err => setStatus('Ошибка ветки: ' + err.message, false));
+    });
+    row.appendChild(thread);
+  }
+
+  for (const r of (m.reactions || [])) {
+    const chip = document.createElement('button');
+    chip.type = 'button';
+    chip.className = 'reaction-chip' + ((r.user_ids || []).includes(selfID) ? ' mine' : '');
+    chip.textContent = r.emoji + ' ' + r.count;
+    chip.title = (r.user_ids || []).map(nameByID).join(', ');
+    chip.addEventListener('click', () => {
+      toggleReaction(conv, m, r.emoji).catch(err => setStatus('Ошибка реакции: ' + err.message, false));
+    });
+    row.appendChild(chip);
+  }
+
+  const add = document.createElement('button');
+  add.type = 'button';
+  add.className = 'reaction-chip reaction-add';
+  add.textContent = '☺+';
+  add.title = 'Реакция';
+  add.addEventListener('click', () => {
+    const open = row.querySelector('.reaction-picker');
+    if (open) {
+      open.remove();
+      add.classList.remove('open');
+      return;
+    }
+    const picker = document.createElement('div');
+    picker.className = 'reaction-picker';
+    for (const e of QUICK_REACTIONS) {
+      const b = document.createElement('button');
+      b.type = 'button';
+      b.textContent = e;
+      b.addEventListener('click', () => {
+        toggleReaction(conv, m, e).catch(err => setStatus('Ошибка реакции: ' + err.message, false));
+      });
+      picker.appendChild(b);
+    }
+    add.classList.add('open');
+    row.appendChild(picker);
+  });
+  row.appendChild(add);
+
+  const reply = document.createElement('button');
+  reply.type = 'button';
+  reply.className = 'reaction-chip reaction-add';
+  reply.textContent = '↩';
+  reply.title = 'Ответить';
+  reply.addEventListener('click', () => setReplyTarget(m));
+  row.appendChild(reply);
+
+  const fwd = document.createElement('button');
+  fwd.type = 'button';
+  fwd.className = 'reaction-chip reaction-add';
+  fwd.textContent = '↪';
+  fwd.title = 'Переслать';
+  fwd.addEventListener('click', () => {
+    const open = row.querySelector('.forward-picker');
+    if (open) {
+      open.remove();
+      return;
+    }
+    row.appendChild(renderForwardPicker(conv, m));
+  });
+  row.appendChild(fwd);
+
+  if (canPin(conv)) {
+    const pinned = isPinned(m.id);
+    const pin = document.createElement('button');
+    pin.type = 'button';
+    pin.className = 'reaction-chip reaction-add' + (pinned ? ' mine' : '');
+    pin.textContent = '📌';
+    pin.title = pinned ? 'Открепить' : 'Закрепить';
+    pin.addEventListener('click', () => {
+      togglePin(conv, m.id).catch(err => setStatus('Ошибка закрепления: ' + err.message, false));
+    });
+    row.appendChild(pin);
+  }
+  return row;
+}
+
+// своя реакция есть — снимаем, нет — ставим; остальные увидят изменение через /sync
+async function toggleReaction(conv, m, emoji) {
+  const mine = (m.reactions || []).some(r => r.emoji === emoji && (r.user_ids || []).includes(selfID));
+  const data = await apiJSON(mine ? '/reactions/remove' : '/reactions/add', 'POST', {
+    user_id: selfID,
+    kind: conv.type === 'group' ? 'group' : 'direct',
+    message_id: m.id,
+    emoji
+  });
+  m.reactions = data.reactions || [];
+  if (conversations[activeKey] !== conv) return;
+  // сообщение может быть и в чате, и в открытой ветке — это разные объекты
+  const inChat = activeMsgs.find(x => x.id === m.id);
+  if (inChat) inChat.reactions = m.reactions;
+  renderMessages(activeMsgs, conv, true);
+  if (threadState) {
+    const inThread = threadState.msgs.find(x => x.id === m.id);
+    if (inThread) inThread.reactions = m.reactions;
+    renderThread();
+  }
+}
+
+// ===== forwarding =====
+// список чатов, куда переслать; само сообщение там появится через /sync
+function renderForwardPicker(conv, m) {
+  const picker = document.createElement('div');
+  picker.className = 'forward-picker';
+  for (const key of Object.keys(conversations)) {
+    const target = conversations[key];
+    const b = document.createElement('button');
+    b.type = 'button';
+    b.textContent = (target.type === 'group' ? '👥 ' : '👤 ') + target.title;
+    b.addEventListener('click', () => {
+      picker.remove();
+      forwardMessage(conv, m, target)
+        .then(() => setStatus('Переслано: ' + target.title, true))
+        .catch(err => setStatus('Ошибка пересылки: ' + err.message, false));
+    });
+    picker.appendChild(b);
+  }
+  return picker;
+}
+
+async function forwardMessage(conv, m, target) {
+  const body = { user_id: selfID, kind: conv.type === 'group' ? 'group' : 'direct', message_id: m.id };
+  if (target.type === 'group') {
+    body.group_id = target.groupID;
+  } else {
+    if (!target.peerID) {
+      const data = await apiJSON('/public_key?username=' + encodeURIComponent(target.peerName), 'GET');
+      target.peerID = data.id;
+      idToName.set(target.peerID, target.peerName);
+    }
+    body.to_user_id = target.peerID;
+  }
+  await apiJSON('/messages/forward', 'POST', body);
+}
+
+// ===== replies & threads =====
+let replyTarget = null; // {id, who, text}
+let threadState = null; // {key, parentID, msgs}
+
+function messageSnippet(m) {
+  const text = String(m.text || '').trim();
+  if (text) return text.length > 120 ? text.slice(0, 120) + '…' : text;
+  const n = Array.isArray(m.attachments) ? m.attachments.length : (m.attachments || 0);
+  return n ? '📎 вложение' : '';
+}
+
+function renderQuote(q, conv) {
+  const box = document.createElement('div');
+  box.className = 'msg-quote';
+  const who = document.createElement('div');
+  who.className = 'msg-quote-who';
+  who.textContent = messageAuthor(q);
+  const text = document.createElement('div');
+  text.textContent = messageSnippet(q);
+  box.appendChild(who);
+  box.appendChild(text);
+  box.title = 'К сообщению';
+  box.addEventListener('click', () => {
+    const el = messagesEl.querySelector(`[data-id="${q.id}"]`);
+    if (el) {
+      el.scrollIntoView({ behavior: 'smooth', block: 'center' });
+      el.classList.add('flash');
+      setTimeout(() => el.classList.remove('flash'), 1200);
+    } else {
+      openThread(conv, q.id).catch(err => setStatus('Ошибка ветки: ' + err.message, false));
+    }
+  });
+  return box;
+}
+
+function setReplyTarget(m) {
+  replyTarget = { id: m.id, who: messageAuthor(m), text: messageSnippet(m) };
+  replyBarWho.textContent = replyTarget.who;
+  replyBarText.textContent = replyTarget.text;
+  replyBar.style.display = 'flex';
+  msgInput.focus();
+}
+
+function clearReplyTarget() {
+  replyTarget = null;
+  replyBar.style.display = 'none';
+}
+
+// replyFields — reply_to для отправки; ответ отправляется один раз
+function replyFields() {
+  if (!replyTarget) return {};
+  const f = { reply_to: replyTarget.id };
+  clearReplyTarget();
+  return f;
+}
+
+async function openThread(conv, parentID) {
+  const key = activeKey;
+  const url = (conv.type === 'group')
+    ? '/groups/thread?user_id=' + encodeURIComponent(selfID) + '&message_id=' + parentID
+    : '/chat/thread?user_id=' + encodeURIComponent(selfID) + '&message_id=' + parentID;
+  const data = await apiJSON(url, 'GET');
+  if (activeKey !== key) return;
+  threadState = { key, parentID, msgs: [data.parent, ...(data.replies || [])] };
+  threadPanel.style.display = 'flex';
+  renderThread();
+}
+
+function renderThread() {
+  if (!threadState) return;
+  const conv = conversations[threadState.key];
+  threadMessagesEl.innerHTML = '';
+  threadState.msgs.forEach((m, i) => {
+    // у ответов в ветке цитата родителя лишняя — он первым сообщением
+    const el = buildMessageEl(i === 0 ? m : { ...m, reply_to: null }, conv, true);
+    if (i === 0) el.classList.add('thread-parent');
+    threadMessagesEl.appendChild(el);
+  });
+  threadMessagesEl.scrollTop = threadMessagesEl.scrollHeight;
+}
+
+function closeThread() {
+  threadState = null;
+  threadPanel.style.display = 'none';
+  threadMessagesEl.innerHTML = '';
+}
+
+// ===== pinned messages =====
+let pinState = { key: null, list: [], index: 0 }; // list — с сервера, последнее закреплённое первым
+
+// в личке закрепляют оба, в беседе — владелец и админы
+function canPin(conv) {
+  if (!conv) return false;
+  return conv.type !== 'group' || conv.role === 'owner' || conv.role === 'admin';
+}
+
+function isPinned(id) {
+  return pinState.key === activeKey && pinState.list.some(p => p.message_id === id);
+}
+
+function pinsKind(conv) {
+  return conv.type === 'group' ? 'group' : 'direct';
+}
+
+async function fetchPins() {
+  const key = activeKey;
+  const conv = conversations[key];
+  if (!conv || (conv.type !== 'group' && !conv.peerID)) return;
+  const url = '/pins/list?user_id=' + encodeURIComponent(selfID) + '&kind=' + pinsKind(conv) +
+    (conv.type === 'group' ? '&group_id=' + conv.groupID : '&peer_id=' + conv.peerID);
+  const list = await apiJSON(url, 'GET');
+  if (activeKey !== key) return;
+  applyPins(key, Array.isArray(list) ? list : []);
+}
+
+function applyPins(key, list) {
+  const before = pinState.key === key ? pinState.list.map(p => p.message_id).join(',') : null;
+  const index = pinState.key === key ? pinState.index : 0;
+  pinState = { key, list, index: Math.min(index, Math.max(0, list.length - 1)) };
+  renderPinBanner();
+  // кнопки 📌 у сообщений зависят от списка — перерисовываем, только если он поменялся
+  if (before !== list.map(p => p.message_id).join(',')) {
+    renderMessages(activeMsgs, conversations[key], true);
+  }
+}
+
+function renderPinBanner() {
+  const conv = conversations[activeKey];
+  if (!conv || pinState.key !== activeKey || !pinState.list.length) {
+    pinBanner.style.display = 'none';
+    return;
+  }
+  const p = pinState.list[pinState.index];
+  const n = pinState.list.length;
+  pinBannerLabel.textContent = '📌 Закреплённое' + (n > 1 ? ` ${pinState.index + 1}/${n}` : '');
+  pinBannerText.textContent = messageAuthor(p.message) + ': ' + messageSnippet(p.message);
+  pinUnpinBtn.style.display = canPin(conv) ? '' : 'none';
+  pinBanner.style.display = 'flex';
+}
+
+// клик по баннеру — к сообщению и дальше по списку
+function showPinned() {
+  if (pinState.key !== activeKey || !pinState.list.length) return;
+  const p = pinState.list[pinState.index];
+  const el = messagesEl.querySelector(`[data-id="${p.message_id}"]`);
+  if (el) {
+    el.scrollIntoView({ behavior: 'smooth', block: 'center' });
+    el.classList.add('flash');
+    setTimeout(() => el.classList.remove('flash'), 1200);
+  }
+  pinState.index = (pinState.index + 1) % pinState.list.length;
+  renderPinBanner();
+}
+
+async function togglePin(conv, messageID) {
+  const key = activeKey;
+  const list = await apiJSON(isPinned(messageID) ? '/pins/unpin' : '/pins/pin', 'POST', {
+    user_id: selfID,
+    kind: pinsKind(conv),
+    message_id: messageID
+  });
+  if (activeKey !== key) return;
+  pinState.index = 0;
+  applyPins(key, Array.isArray(list) ? list : []);
+}
+
+function clearPins() {
+  pinState = { key: null, list: [], index: 0 };
+  pinBanner.style.display = 'none';
+}
+
+// ===== опросы =====
+// голос уходит сразу по клику; итоги у всех обновляет /sync (polls)
+function renderPoll(m, conv) {
+  const poll = m.poll;
+  const box = document.createElement('div');
+  box.className = 'poll' + (poll.closed ? ' closed' : '');
+  const mine = new Set(poll.my_votes || []);
+  const total = poll.options.reduce((n, o) => n + (o.votes || 0), 0);
+
+  poll.options.forEach((o, i) => {
+    const row = document.createElement('button');
+    row.type = 'button';
+    row.className = 'poll-option' + (mine.has(i) ? ' mine' : '');
+    row.disabled = !!poll.closed;
+    const pct = total ? Math.round((o.votes || 0) * 100 / total) : 0;
+    row.style.setProperty('--pct', pct + '%');
+
+    const label = document.createElement('span');
+    label.textContent = (poll.multiple ? (mine.has(i) ? '☑ ' : '☐ ') : (mine.has(i) ? '◉ ' : '○ ')) + o.text;
+    const count = document.createElement('span');
+    count.className = 'poll-count';
+    count.textContent = (o.votes || 0) + ' · ' + pct + '%';
+    row.appendChild(label);
+    row.appendChild(count);
+    if (o.voters && o.voters.length) row.title = o.voters.map(id => id === selfID ? 'Ты' : nameByID(id)).join(', ');
+
+    row.addEventListener('click', () => {
+      let next;
+      if (poll.multiple) next = mine.has(i) ? [...mine].filter(x => x !== i) : [...mine, i];
+      else next = mine.has(i) ? [] : [i];
+      votePoll(m, conv, next).catch(err => setStatus('Ошибка голосования: ' + err.message, false));
+    });
+    box.appendChild(row);
+  });
+
+  const foot = document.createElement('div');
+  foot.className = 'poll-foot';
+  const parts = [(poll.anonymous ? 'Анонимный' : 'Открытый') + (poll.multiple ? ', несколько ответов' : ''),
+    'проголосовали: ' + (poll.total_voters || 0)];
+  if (poll.closed) parts.push('опрос закрыт');
+  else if (poll.closes_at) parts.push('до ' + new Date(poll.closes_at).toLocaleString());
+  foot.textContent = parts.join(' · ');
+  if (!poll.closed && (m.from_user_id === selfID || canPin(conv))) {
+    const closeBtn = document.createElement('button');
+    closeBtn.type = 'button';
+    closeBtn.className = 'poll-close';
+    closeBtn.textContent = 'Закрыть';
+    closeBtn.addEventListener('click', () => {
+      closePoll(m, conv).catch(err => setStatus('Ошибка опроса: ' + err.message, false));
+    });
+    foot.appendChild(closeBtn);
+  }
+  box.appendChild(foot);
+  return box;
+}
+
+function applyPoll(conv, res) {
+  if (!res || !res.poll || conversations[activeKey] !== conv) return;
+  const m = activeMsgs.find(x => x.id === res.message_id);
+  if (!m) return;
+  m.poll = res.poll;
+  renderMessages(activeMsgs, conv, true);
+}
+
+async function votePoll(m, conv, options) {
+  const res = await apiJSON('/polls/vote', 'POST', { user_id: selfID, message_id: m.id, options });
+  applyPoll(conv, res);
+}
+
+async function closePoll(m, conv) {
+  if (!confirm('Закрыть опрос? Голосовать больше будет нельзя.')) return;
+  const res = await apiJSON('/polls/close', 'POST', { user_id: selfID, message_id: m.id });
+  applyPoll(conv, res);
+}
+
+async function createPollInActiveGroup() {
+  if (!activeKey) return;
+  const conv = conversations[activeKey];
+  if (!conv || conv.type !== 'group') return;
+
+  const question = prompt('Вопрос опроса', '');
+  if (!question || !question.trim()) return;
+  const raw = prompt('Варианты ответа через ;', '');
+  if (!raw) return;
+  const options = raw.split(';').map(x => x.trim()).filter(Boolean);
+  const multiple = confirm('Можно выбрать несколько вариантов?');
+  const anonymous = confirm('Анонимный опрос (не показывать, кто как голосовал)?');
+  const hours = parseFloat(prompt('Закрыть через N часов (пусто — без срока)', '') || '');
+  const req = { group_id: conv.groupID, from_user_id: selfID, question: question.trim(), options, multiple, anonymous };
+  if (hours > 0) req.closes_at = new Date(Date.now() + hours * 3600 * 1000).toISOString().replace(/\.\d+Z$/, 'Z');
+
+  await apiJSON('/polls/create', 'POST', req);
+  await pollOnce();
 }
 
 function nameByID(id) {
@@ -237,7 +871,49 @@ function nameByID(id) {
   return 'user#' + id;
 }
 
-function renderMessages(msgs, conv) {
+function messageAuthor(m) {
+  // group может не давать from_username — используем кэш по id
+  if (m.from_username && String(m.from_username).trim()) return m.from_username;
+  return (m.from_user_id === selfID) ? 'Ты' : nameByID(m.from_user_id);
+}
+
+// buildMessageEl — одно сообщение: цитата, текст с вложениями, реакции и ответы
+function buildMessageEl(m, conv, inThread) {
+  const mid = (typeof m.id === 'number' ? m.id : 0);
+  const wrapper = document.createElement('div');
+  const meta = document.createElement('div');
+  const body = document.createElement('div');
+
+  const isSelf = (m.from_user_id === selfID);
+  wrapper.className = 'msg ' + (isSelf ? 'self' : 'peer') + (mentionsMe(m) ? ' mentioned' : '');
+  if (mid) wrapper.dataset.id = String(mid);
+  meta.className = 'msg-meta';
+
+  const who = messageAuthor(m);
+  meta.textContent = m.created_at ? (who + ' · ' + m.created_at) : who;
+
+  body.className = 'msg-body';
+  if (m.forwarded_from) {
+    const fwd = document.createElement('div');
+    fwd.className = 'msg-forwarded';
+    fwd.textContent = '↪ Переслано от ' + (m.forwarded_from.username || nameByID(m.forwarded_from.user_id));
+    body.appendChild(fwd);
+  }
+  if (m.reply_to) body.appendChild(renderQuote(m.reply_to, conv));
+  const content = document.createElement('div');
+  renderMessageBody(content, m);
+  body.appendChild(content);
+  if (m.poll) body.appendChild(renderPoll(m, conv));
+
+  wrapper.appendChild(meta);
+  wrapper.appendChild(body);
+  if (mid) wrapper.appendChild(renderReactions(m, conv, inThread));
+  return wrapper;
+}
+
+// keepScroll — перерисовка без новых сообщений (реакции): не прыгать вниз
+function renderMessages(msgs, conv, keepScroll) {
+  const scrollTop = messagesEl.scrollTop;
   messagesEl.innerHTML = '';
   if (!Array.isArray(msgs)) return 0;
 
@@ -246,31 +922,10 @@ function renderMessages(msgs, conv) {
   for (const m of msgs) {
     const mid = (typeof m.id === 'number' ? m.id : 0);
     if (mid > maxID) maxID = mid;
-
-    const wrapper = document.createElement('div');
-    const meta = document.createElement('div');
-    const body = document.createElement('div');
-
-    const isSelf = (m.from_user_id === selfID);
-    wrapper.className = 'msg ' + (isSelf ? 'self' : 'peer');
-    meta.className = 'msg-meta';
-
-    // group может не давать from_username — используем кэш по id
-    const who =
-      (m.from_username && String(m.from_username).trim())
-        ? m.from_username
-        : (isSelf ? 'Ты' : nameByID(m.from_user_id));
-
-    meta.textContent = m.created_at ? (who + ' · ' + m.created_at) : who;
-
-    renderMessageBody(body, m.text);
-
-    wrapper.appendChild(meta);
-    wrapper.appendChild(body);
-    messagesEl.appendChild(wrapper);
+    messagesEl.appendChild(buildMessageEl(m, conv, false));
   }
 
-  messagesEl.scrollTop = messagesEl.scrollHeight;
+  messagesEl.scrollTop = keepScroll ? scrollTop : messagesEl.scrollHeight;
   return maxID;
 }
 
@@ -318,12 +973,14 @@ async function bootstrapConversations() {
             type: 'group',
             title: g.name || ('group #' + g.id),
             groupID: g.id,
+            role: g.role || 'member',
             lastRead: 0,
             lastKnown: 0,
             unread: 0
           };
         } else {
           conversations[key].groupID = g.id;
+          conversations[key].role = g.role || 'member';
           conversations[key].title = conversations[key].title || g.name || ('group #' + g.id);
         }
       }
@@ -353,7 +1010,7 @@ async function fetchDirectMessages(conv) {
 }
 
 async function fetchGroupMessages(conv) {
-  const msgs = await apiJSON('/groups/messages?group_id=' + encodeURIComponent(conv.groupID), 'GET');
+  const msgs = await apiJSON('/groups/messages?group_id=' + encodeURIComponent(conv.groupID) + '&user_id=' + encodeURIComponent(selfID), 'GET');
   return Array.isArray(msgs) ? msgs : [];
 }
 
@@ -381,7 +1038,7 @@ function recomputeUnreadFromMsgs(conv, msgs) {
   conv.unread = Math.max(0, unread);
 }
 
-// ===== polling =====
+// ===== polling: только presence, сообщения приходят через /sync =====
 function stopPolling() {
   if (pollTimer) {
     clearInterval(pollTimer);
@@ -391,28 +1048,25 @@ function stopPolling() {
 
 function startPolling() {
   stopPolling();
-  pollTimer = setInterval(() => {
-    pollOnce().catch(() => {});
-  }, 1500);
+  const tick = () => {
+    presencePing().catch(() => {});
+    presenceFetchContacts().catch(() => {});
+    // в event-stream «печатает» приходит само, без него — опрашиваем
+    if (!syncSource) typingFetch().catch(() => {});
+    // закреплённые в /sync не приходят — перечитываем у открытого чата
+    if (activeKey) fetchPins().catch(() => {});
+  };
+  tick();
+  pollTimer = setInterval(tick, 3000);
 }
 
+// полное обновление: списки чатов, непрочитанные по всем чатам и открытый чат.
+// Нужно при входе, по кнопке и когда /sync принёс сообщение из незнакомого диалога
 async function pollOnce() {
   if (!selfID) return;
 
-  // presence
-  presencePing().catch(() => {});
-  if (!pollOnce._tOnline || Date.now() - pollOnce._tOnline > 3000) {
-    pollOnce._tOnline = Date.now();
-    presenceFetchOnline().catch(() => {});
-  }
-
-  // обновить списки чатов из inbox/groups (чтобы появлялись новые диалоги и новые группы)
-  if (!pollOnce._tBoot || Date.now() - pollOnce._tBoot > 5000) {
-    pollOnce._tBoot = Date.now();
-    await bootstrapConversations().catch(() => {});
-  }
+  await bootstrapConversations().catch(() => {});
 
-  // пересчитать unread по всем чатам
   const keys = Object.keys(conversations);
   for (const key of keys) {
     const conv = conversations[key];
@@ -430,12 +1084,175 @@ async function pollOnce() {
     if (key === activeKey) {
       conv.lastRead = conv.lastKnown;
       conv.unread = 0;
-      renderMessages(msgs, conv);
+      activeMsgs = msgs;
+      renderMessages(activeMsgs, conv);
     }
   }
 
   renderChatList();
   saveState();
+  mentionsFetch().catch(() => {});
+}
+
+// ===== sync: дельты из /sync (event-stream, если можно, иначе long-poll) =====
+let syncToken = null;
+let syncSource = null;
+let syncStopped = true;
+
+function syncURL(extra) {
+  return '/sync?user_id=' + encodeURIComponent(selfID) +
+    (syncToken ? '&token=' + encodeURIComponent(syncToken) : '') + (extra || '');
+}
+
+function stopSync() {
+  syncStopped = true;
+  if (syncSource) {
+    syncSource.close();
+    syncSource = null;
+  }
+}
+
+function startSync() {
+  stopSync();
+  syncStopped = false;
+  if (!window.EventSource) {
+    longPollLoop();
+    return;
+  }
+  syncSource = new EventSource(syncURL());
+  syncSource.addEventListener('sync', (e) => {
+    try { applySync(JSON.parse(e.data)); } catch (_) {}
+  });
+  syncSource.addEventListener('typing', (e) => {
+    try { applyTyping(JSON.parse(e.data)); } catch (_) {}
+  });
+  // обрывы EventSource переживает сам (и продолжает с Last-Event-ID); закрылся
+  // насовсем — поток не проходит через прокси, переходим на long-poll
+  syncSource.addEventListener('error', () => {
+    if (syncSource && syncSource.readyState === EventSource.CLOSED) {
+      syncSource = null;
+      longPollLoop();
+    }
+  });
+}
+
+async function longPollLoop() {
+  let failures = 0;
+  while (!syncStopped) {
+    try {
+      applySync(await apiJSON(syncURL('&timeout=25'), 'GET'));
+      failures = 0;
+    } catch (_) {
+      await new Promise(r => setTimeout(r, Math.min(30000, 1000 * 2 ** failures++)));
+    }
+  }
+}
+
+// deliverMessage — новое сообщение из /sync: в открытый чат или в счётчик непрочитанных
+function deliverMessage(key, m, incoming) {
+  const conv = conversations[key];
+  conv.lastKnown = Math.max(conv.lastKnown || 0, m.id || 0);
+  if (key === activeKey) {
+    conv.lastRead = conv.lastKnown;
+    if (!activeMsgs.some(x => x.id === m.id)) {
+      activeMsgs.push(m);
+      if (m.reply_to) {
+        const parent = activeMsgs.find(x => x.id === m.reply_to.id);
+        if (parent) parent.reply_count = (parent.reply_count || 0) + 1;
+        if (threadState && threadState.key === key && threadState.parentID === m.reply_to.id) {
+          threadState.msgs.push(m);
+          renderThread();
+        }
+      }
+      return true;
+    }
+  } else if (incoming && m.id > (conv.lastRead || 0)) {
+    conv.unread = (conv.unread || 0) + 1;
+  }
+  return false;
+}
+
+function applySync(d) {
+  if (!d) return;
+  if (d.token) syncToken = d.token;
+
+  let unknown = false;
+  let activeChanged = false;
+  let reactionsChanged = false;
+
+  for (const m of (d.direct || [])) {
+    const peerID = (m.from_user_id === selfID) ? m.to_user_id : m.from_user_id;
+    const key = idToName.has(peerID) ? convKeyUser(idToName.get(peerID)) : null;
+    if (!key || !conversations[key]) {
+      unknown = true;
+      continue;
+    }
+    if (deliverMessage(key, m, m.to_user_id === selfID)) activeChanged = true;
+  }
+
+  for (const m of (d.group || [])) {
+    if (m.from_username) idToName.set(m.from_user_id, m.from_username);
+    const key = convKeyGroup(m.group_id);
+    if (!conversations[key]) {
+      unknown = true;
+      continue;
+    }
+    if (deliverMessage(key, m, m.from_user_id !== selfID)) activeChanged = true;
+    if (mentionsMe(m)) {
+      if (key === activeKey) markMentionsRead(conversations[key], m.id).catch(() => {});
+      else conversations[key].mentions = (conversations[key].mentions || 0) + 1;
+    }
+  }
+
+  // реакции: у сообщения приходит актуальный список целиком
+  for (const ch of (d.reactions || [])) {
+    let key = null;
+    if (ch.conversation === 'group') {
+      key = convKeyGroup(ch.group_id);
+    } else {
+      const peerID = (ch.from_user_id === selfID) ? ch.to_user_id : ch.from_user_id;
+      if (idToName.has(peerID)) key = convKeyUser(idToName.get(peerID));
+    }
+    if (key !== activeKey) continue; // остальные чаты перечитаются при открытии
+    const m = activeMsgs.find(x => x.id === ch.message_id);
+    if (m) {
+      m.reactions = ch.reactions;
+      reactionsChanged = true;
+    }
+  }
+
+  // опросы: приходят актуальные итоги целиком
+  for (const p of (d.polls || [])) {
+    if (convKeyGroup(p.group_id) !== activeKey) continue;
+    const m = activeMsgs.find(x => x.id === p.message_id);
+    if (m) {
+      m.poll = p.poll;
+      reactionsChanged = true;
+    }
+  }
+
+  // нас добавили в беседу — она сразу появляется в списке
+  for (const ev of (d.members || [])) {
+    if (ev.username) idToName.set(ev.user_id, ev.username);
+    const key = convKeyGroup(ev.group_id);
+    if (ev.user_id === selfID && !conversations[key]) {
+      conversations[key] = {
+        type: 'group',
+        title: ev.group_name || ('group #' + ev.group_id),
+        groupID: ev.group_id,
+        lastRead: 0,
+        lastKnown: 0,
+        unread: 0
+      };
+    }
+  }
+
+  if (activeChanged || reactionsChanged) renderMessages(activeMsgs, conversations[activeKey], !activeChanged);
+  renderChatList();
+  saveState();
+
+  // новый диалог: его истории у нас нет — обновляемся целиком
+  if (unknown) pollOnce().catch(() => {});
 }
 
 // ===== actions =====
@@ -448,30 +1265,41 @@ async function setActiveConversation(key) {
 
   if (conv.type === 'group') {
     chatTitle.textContent = conv.title;
-    chatSubtitle.textContent = 'Групповая беседа';
     idsInfo.textContent = `Ты: ${selfID} · group_id: ${conv.groupID}`;
     addMemberBtn.style.display = 'inline-flex';
+    pollBtn.style.display = 'inline-flex';
   } else {
     chatTitle.textContent = 'Диалог с ' + conv.title;
-    chatSubtitle.textContent = 'Личный чат';
     idsInfo.textContent = `Ты: ${selfID} · peer: ${conv.peerName}`;
     addMemberBtn.style.display = 'none';
+    pollBtn.style.display = 'none';
   }
+  stopTyping();
+  renderTyping();
+  clearReplyTarget();
+  closeThread();
+  clearPins();
 
   msgInput.disabled = false;
   sendBtn.disabled = false;
+  scheduleBtn.disabled = false;
   if (attachBtn) attachBtn.disabled = false;
+  if (voiceBtn) voiceBtn.disabled = false;
 
-  let msgs = [];
-  msgs = (conv.type === 'group') ? await fetchGroupMessages(conv) : await fetchDirectMessages(conv);
+  activeMsgs = [];
+  const msgs = (conv.type === 'group') ? await fetchGroupMessages(conv) : await fetchDirectMessages(conv);
+  if (activeKey !== key) return; // пока грузили, открыли другой чат
+  activeMsgs = msgs;
 
   recomputeUnreadFromMsgs(conv, msgs);
   conv.lastRead = conv.lastKnown;
   conv.unread = 0;
+  if (conv.type === 'group' && conv.mentions) markMentionsRead(conv).catch(() => {});
 
-  renderMessages(msgs, conv);
+  renderMessages(activeMsgs, conv);
   renderChatList();
   saveState();
+  fetchPins().catch(() => {});
 }
 
 // ===== send text =====
@@ -485,18 +1313,87 @@ async function sendMessage() {
   await ensureLogin();
 
   if (conv.type === 'group') {
-    await apiJSON('/groups/send', 'POST', { group_id: conv.groupID, from_user_id: selfID, text });
+    await apiJSON('/groups/send', 'POST', { group_id: conv.groupID, from_user_id: selfID, text, ...replyFields() });
   } else {
-    if (!conv.peerID) {
-      const data = await apiJSON('/public_key?username=' + encodeURIComponent(conv.peerName), 'GET');
-      conv.peerID = data.id;
-      idToName.set(conv.peerID, conv.peerName);
-    }
-    await apiJSON('/chat/send', 'POST', { from_user_id: selfID, to_user_id: conv.peerID, text });
+    await ensurePeerID(conv);
+    await apiJSON('/chat/send', 'POST', { from_user_id: selfID, to_user_id: conv.peerID, text, ...replyFields() });
   }
 
+  // само сообщение придёт через /sync; «печатает» сервер снимает сам
+  typingSentAt = 0;
+  typingTarget = null;
   msgInput.value = '';
-  await pollOnce();
+}
+
+async function ensurePeerID(conv) {
+  if (conv.peerID) return;
+  const data = await apiJSON('/public_key?username=' + encodeURIComponent(conv.peerName), 'GET');
+  conv.peerID = data.id;
+  idToName.set(conv.peerID, conv.peerName);
+}
+
+// ===== отложенная отправка =====
+// «ЧЧ:ММ» — сегодня (или завтра, если уже прошло), число — через столько минут
+function parseSendAt(input) {
+  const s = String(input || '').trim();
+  const hm = s.match(/^(\d{1,2}):(\d{2})$/);
+  if (hm) {
+    const d = new Date();
+    d.setHours(+hm[1], +hm[2], 0, 0);
+    if (d <= new Date()) d.setDate(d.getDate() + 1);
+    return d;
+  }
+  const mins = parseFloat(s);
+  return mins > 0 ? new Date(Date.now() + mins * 60 * 1000) : null;
+}
+
+function scheduledTarget(conv) {
+  return conv.type === 'group'
+    ? { kind: 'group', group_id: conv.groupID }
+    : { kind: 'direct', to_user_id: conv.peerID };
+}
+
+// с текстом в поле — запланировать его, с пустым — показать запланированные в чате
+async function scheduleOrList() {
+  if (!activeKey) return;
+  const conv = conversations[activeKey];
+  if (!conv) return;
+  await ensureLogin();
+  if (conv.type !== 'group') await ensurePeerID(conv);
+
+  const text = msgInput.value.trim();
+  if (!text) {
+    await listScheduled(conv);
+    return;
+  }
+  const when = parseSendAt(prompt('Когда отправить? Через N минут или время ЧЧ:ММ', '10'));
+  if (!when) return;
+
+  const sm = await apiJSON('/scheduled/create', 'POST', {
+    from_user_id: selfID,
+    ...scheduledTarget(conv),
+    text,
+    ...replyFields(),
+    send_at: when.toISOString().replace(/\.\d+Z$/, 'Z')
+  });
+  msgInput.value = '';
+  setStatus('Запланировано на ' + new Date(sm.send_at).toLocaleString(), true);
+}
+
+async function listScheduled(conv) {
+  const t = scheduledTarget(conv);
+  const q = '/scheduled/list?user_id=' + encodeURIComponent(selfID) + '&kind=' + t.kind +
+    (t.kind === 'group' ? '&group_id=' + conv.groupID : '&peer_id=' + conv.peerID);
+  const list = await apiJSON(q, 'GET');
+  if (!Array.isArray(list) || !list.length) {
+    setStatus('Запланированных сообщений в этом чате нет', true);
+    return;
+  }
+  const lines = list.map(x => `#${x.id} · ${new Date(x.send_at).toLocaleString()} · ${x.text}`);
+  const id = parseInt(prompt('Запланированные (номер — отменить):\n' + lines.join('\n'), '') || '', 10);
+  if (!id) return;
+  await apiJSON('/scheduled/cancel', 'POST', { user_id: selfID, id });
+  setStatus('Отменено: #' + id, true);
 }
 
 // ===== create group =====
@@ -575,63 +1472,244 @@ async function openDirectByName() {
   await setActiveConversation(key);
 }
 
-// ===== attach photo (plain_media encrypted server-side key) =====
+// ===== attach file (plain_media encrypted server-side key) =====
 if (attachBtn && fileInput) {
   attachBtn.addEventListener('click', () => {
     if (!attachBtn.disabled) fileInput.click();
   });
 
   fileInput.addEventListener('change', () => {
-    uploadSelectedImage().catch(err => setStatus('Ошибка фото: ' + err.message, false));
+    uploadSelectedFile().catch(err => setStatus('Ошибка файла: ' + err.message, false));
   });
 }
 
-async function uploadSelectedImage() {
-  if (!activeKey) return;
-  const conv = conversations[activeKey];
-  if (!conv) return;
-  await ensureLogin();
+// большие файлы грузим по частям: обрыв связи не начинает загрузку заново
+const CHUNKED_UPLOAD_THRESHOLD = 8 * 1024 * 1024;
 
+async function uploadSelectedFile() {
   const f = fileInput.files && fileInput.files[0];
   if (!f) return;
 
-  const fd = new FormData();
-  fd.append('file', f);
+  await uploadAndSend(f);
+  fileInput.value = '';
+}
+
+// загружает файл в активный чат и отправляет сообщение с ним во вложении;
+// как показать (картинка, голосовое, файл), решает сервер по содержимому
+async function uploadAndSend(f) {
+  if (!activeKey) return;
+  const conv = conversations[activeKey];
+  if (!conv) return;
+  await ensureLogin();
 
+  const target = { from_user_id: selfID };
   if (conv.type === 'group') {
-    fd.append('kind', 'group');
-    fd.append('from_user_id', String(selfID));
-    fd.append('group_id', String(conv.groupID));
+    target.kind = 'group';
+    target.group_id = conv.groupID;
   } else {
     if (!conv.peerID) {
       const data = await apiJSON('/public_key?username=' + encodeURIComponent(conv.peerName), 'GET');
       conv.peerID = data.id;
       idToName.set(conv.peerID, conv.peerName);
     }
-    fd.append('kind', 'direct');
-    fd.append('from_user_id', String(selfID));
-    fd.append('to_user_id', String(conv.peerID));
+    target.kind = 'direct';
+    target.to_user_id = conv.peerID;
+  }
+
+  const data = (f.size > CHUNKED_UPLOAD_THRESHOLD)
+    ? await uploadChunked(f, target)
+    : await uploadWhole(f, target);
+
+  const attachments = [data.id];
+  if (conv.type === 'group') {
+    await apiJSON('/groups/send', 'POST', { group_id: conv.groupID, from_user_id: selfID, text: '', attachments, ...replyFields() });
+  } else {
+    await apiJSON('/chat/send', 'POST', { from_user_id: selfID, to_user_id: conv.peerID, text: '', attachments, ...replyFields() });
   }
+}
+
+// ===== voice messages: запись через MediaRecorder, отправка вложением =====
+let voiceRecorder = null;
+
+function voiceMimeType() {
+  if (!window.MediaRecorder) return '';
+  for (const t of ['audio/ogg;codecs=opus', 'audio/webm;codecs=opus', 'audio/webm']) {
+    if (MediaRecorder.isTypeSupported(t)) return t;
+  }
+  return '';
+}
+
+// первый клик — начать запись, второй — остановить и отправить
+async function toggleVoiceRecording() {
+  if (voiceRecorder) {
+    voiceRecorder.stop();
+    return;
+  }
+  const mimeType = voiceMimeType();
+  if (!mimeType || !navigator.mediaDevices) throw new Error('браузер не умеет записывать звук');
+
+  const stream = await navigator.mediaDevices.getUserMedia({ audio: true });
+  const chunks = [];
+  const rec = new MediaRecorder(stream, { mimeType });
+  rec.addEventListener('dataavailable', e => { if (e.data && e.data.size) chunks.push(e.data); });
+  rec.addEventListener('stop', () => {
+    stream.getTracks().forEach(t => t.stop());
+    voiceRecorder = null;
+    voiceBtn.classList.remove('recording');
+    voiceBtn.textContent = '🎤';
+
+    const type = mimeType.split(';')[0];
+    const f = new File(chunks, type === 'audio/ogg' ? 'voice.ogg' : 'voice.webm', { type });
+    uploadAndSend(f).catch(err => setStatus('Ошибка голосового: ' + err.message, false));
+  });
+
+  rec.start();
+  voiceRecorder = rec;
+  voiceBtn.classList.add('recording');
+  voiceBtn.textContent = '⏹';
+}
+
+if (voiceBtn) {
+  voiceBtn.addEventListener('click', () => {
+    if (voiceBtn.disabled) return;
+    toggleVoiceRecording().catch(err => setStatus('Ошибка записи: ' + err.message, false));
+  });
+}
+
+async function uploadWhole(f, target) {
+  const fd = new FormData();
+  fd.append('file', f);
+  for (const [k, v] of Object.entries(target)) fd.append(k, String(v));
 
   const resp = await fetch('/api/plain_media/upload', { method: 'POST', body: fd });
   const text = await resp.text().catch(() => '');
   if (!resp.ok) throw new Error('upload failed: ' + resp.status + ' ' + text);
+  return JSON.parse(text);
+}
 
-  const data = JSON.parse(text);
-  const tag = `[[img:${data.id}]]`;
+async function uploadChunked(f, target) {
+  const up = await apiJSON('/api/plain_media/upload/create', 'POST',
+    Object.assign({ name: f.name, size: f.size, content_type: f.type }, target));
+  const q = '?upload_id=' + encodeURIComponent(up.upload_id) + '&user_id=' + encodeURIComponent(selfID);
 
-  // отправляем тэг как текст
-  if (conv.type === 'group') {
-    await apiJSON('/groups/send', 'POST', { group_id: conv.groupID, from_user_id: selfID, text: tag });
-  } else {
-    await apiJSON('/chat/send', 'POST', { from_user_id: selfID, to_user_id: conv.peerID, text: tag });
+  let offset = up.offset;
+  let failures = 0;
+  while (offset < f.size) {
+    setStatus(`Загрузка ${f.name}: ${Math.floor(offset * 100 / f.size)}%`, true);
+    const chunk = f.slice(offset, offset + up.chunk_size);
+    try {
+      const resp = await fetch('/api/plain_media/upload/chunk' + q + '&offset=' + offset, { method: 'PUT', body: chunk });
+      const text = await resp.text().catch(() => '');
+      if (resp.status === 409) {
+        offset = JSON.parse(text).offset; // сервер принял больше или меньше, чем мы думали
+        continue;
+      }
+      if (!resp.ok) throw new Error('chunk failed: ' + resp.status + ' ' + text);
+      offset = JSON.parse(text).offset;
+      failures = 0;
+    } catch (err) {
+      if (++failures > 5) throw err;
+      await new Promise(r => setTimeout(r, 1000 * failures));
+      // после обрыва спрашиваем, что дошло
+      const st = await apiJSON('/api/plain_media/upload/status' + q, 'GET').catch(() => null);
+      if (st) offset = st.offset;
+    }
   }
 
-  fileInput.value = '';
-  await pollOnce();
+  const info = await apiJSON('/api/plain_media/upload/finalize' + q, 'POST');
+  setStatus('', true);
+  return info;
+}
+
+// ===== typing =====
+const TYPING_REPEAT_MS = 2500; // сервер держит «печатает» 6 секунд
+let typingNow = new Map(); // key чата -> [{name, until}]
+let typingTimer = null;
+let typingSentAt = 0;
+let typingTarget = null; // кому последний раз отправили typing=true
+
+function typingBody(conv) {
+  if (conv.type === 'group') return { group_id: conv.groupID };
+  return conv.peerID ? { to_user_id: conv.peerID } : null;
+}
+
+// вызывается на каждый ввод: typing=true не чаще раза в TYPING_REPEAT_MS
+function noteTyping() {
+  const conv = conversations[activeKey];
+  if (!conv || !selfID) return;
+  if (!msgInput.value.trim()) {
+    stopTyping();
+    return;
+  }
+  const body = typingBody(conv);
+  if (!body) return;
+  const now = Date.now();
+  if (typingTarget === activeKey && now - typingSentAt < TYPING_REPEAT_MS) return;
+  typingSentAt = now;
+  typingTarget = activeKey;
+  apiJSON('/typing', 'POST', { user_id: selfID, typing: true, ...body }).catch(() => {});
+}
+
+function stopTyping() {
+  const conv = typingTarget && conversations[typingTarget];
+  typingSentAt = 0;
+  typingTarget = null;
+  const body = conv && typingBody(conv);
+  if (body) apiJSON('/typing', 'POST', { user_id: selfID, typing: false, ...body }).catch(() => {});
+}
+
+// applyTyping — полный список тех, кто сейчас печатает (из event-stream или GET /typing)
+function applyTyping(list) {
+  const next = new Map();
+  const now = Date.now();
+  for (const t of (Array.isArray(list) ? list : [])) {
+    if (t.username) idToName.set(t.from_user_id, t.username);
+    const key = (t.kind === 'group') ? convKeyGroup(t.group_id) : convKeyUser(t.username);
+    if (!next.has(key)) next.set(key, []);
+    next.get(key).push({ name: t.username, until: now + (t.expires_in_ms || 0) });
+  }
+  typingNow = next;
+  renderTyping();
+}
+
+async function typingFetch() {
+  if (!selfID) return;
+  applyTyping(await apiJSON('/typing?user_id=' + encodeURIComponent(selfID), 'GET'));
+}
+
+// renderTyping — «печатает…» в шапке открытого чата вместо подписи
+function renderTyping() {
+  if (typingTimer) {
+    clearTimeout(typingTimer);
+    typingTimer = null;
+  }
+  const conv = conversations[activeKey];
+  if (!conv) return;
+
+  const now = Date.now();
+  const who = (typingNow.get(activeKey) || []).filter(t => t.until > now);
+  chatSubtitle.classList.toggle('typing', who.length > 0);
+
+  if (!who.length) {
+    chatSubtitle.textContent = (conv.type === 'group') ? 'Групповая беседа' : peerPresenceLabel(conv);
+    return;
+  }
+  if (conv.type !== 'group') {
+    chatSubtitle.textContent = 'печатает…';
+  } else if (who.length === 1) {
+    chatSubtitle.textContent = who[0].name + ' печатает…';
+  } else {
+    chatSubtitle.textContent = who.map(t => t.name).join(', ') + ' печатают…';
+  }
+  // продление не пришло — гасим сами
+  const next = Math.min(...who.map(t => t.until));
+  typingTimer = setTimeout(renderTyping, next - now + 50);
 }
 
 // ===== presence =====
+const STATUS_LABELS = { online: 'в сети', away: 'отошёл', busy: 'не беспокоить', invisible: 'невидимка' };
+const presenceByID = new Map(); // id -> {status, status_text, last_seen} (только контакты)
+
 async function presencePing() {
   if (!selfID) return;
   await apiJSON('/presence/ping', 'POST', { user_id: selfID });
@@ -648,7 +1726,7 @@ function renderOnline(users) {
 
   onlineListEl.innerHTML = '';
 
-  const filtered = list.filter(u => u && u.id && u.username && u.id !== selfID);
+  const filtered = list.filter(u => u && u.id && u.username && u.id !== selfID && u.status !== 'offline');
   if (onlineCountEl) onlineCountEl.textContent = filtered.length ? String(filtered.length) : '';
 
   if (!filtered.length) {
@@ -679,7 +1757,10 @@ function renderOnline(users) {
 
     const sub = document.createElement('div');
     sub.className = 'chat-sub';
-    sub.textContent = 'online';
+    const dot = document.createElement('span');
+    dot.className = 'presence-dot ' + u.status;
+    sub.appendChild(dot);
+    sub.appendChild(document.createTextNode(u.status_text || STATUS_LABELS[u.status] || u.status));
 
     text.appendChild(title);
     text.appendChild(sub);
@@ -696,9 +1777,51 @@ function renderOnline(users) {
   }
 }
 
-async function presenceFetchOnline() {
-  const users = await apiJSON('/presence/online', 'GET');
-  renderOnline(users);
+// контакты со статусами: онлайн-список слева и подпись в шапке лички
+async function presenceFetchContacts() {
+  if (!selfID) return;
+  const list = await apiJSON('/presence/contacts?user_id=' + encodeURIComponent(selfID), 'GET');
+  presenceByID.clear();
+  for (const p of (Array.isArray(list) ? list : [])) presenceByID.set(p.id, p);
+  renderOnline(list);
+  renderTyping(); // перерисует подпись, если никто не печатает
+}
+
+function formatLastSeen(iso) {
+  const d = new Date(iso);
+  if (isNaN(d)) return '';
+  const now = new Date();
+  const hm = d.toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' });
+  if (d.toDateString() === now.toDateString()) return 'был(а) в ' + hm;
+  return 'был(а) ' + d.toLocaleDateString() + ' в ' + hm;
+}
+
+function peerPresenceLabel(conv) {
+  const p = conv.peerID && presenceByID.get(conv.peerID);
+  if (!p) return 'Личный чат';
+  let label = (p.status === 'offline')
+    ? (p.last_seen ? formatLastSeen(p.last_seen) : 'не в сети')
+    : STATUS_LABELS[p.status] || p.status;
+  if (p.status_text) label += ' · ' + p.status_text;
+  return label;
+}
+
+async function loadMyStatus() {
+  if (!myStatusEl) return;
+  const me = await apiJSON('/presence/status?user_id=' + encodeURIComponent(selfID), 'GET');
+  myStatusEl.value = me.status || 'online';
+  myStatusTextEl.value = me.status_text || '';
+}
+
+async function saveMyStatus() {
+  await ensureLogin();
+  const me = await apiJSON('/presence/status', 'POST', {
+    user_id: selfID,
+    status: myStatusEl.value,
+    status_text: myStatusTextEl.value
+  });
+  myStatusTextEl.value = me.status_text || '';
+  setStatus('Статус обновлён', true);
 }
 
 // ===== events =====
@@ -719,6 +1842,35 @@ sendBtn.addEventListener('click', () => {
   sendMessage().catch(err => setStatus('Ошибка отправки: ' + err.message, false));
 });
 
+scheduleBtn.addEventListener('click', () => {
+  scheduleOrList().catch(err => setStatus('Ошибка отложенной отправки: ' + err.message, false));
+});
+
+if (myStatusEl) {
+  myStatusEl.addEventListener('change', () => {
+    saveMyStatus().catch(err => setStatus('Ошибка статуса: ' + err.message, false));
+  });
+  myStatusTextEl.addEventListener('keydown', (e) => {
+    if (e.key === 'Enter') {
+      e.preventDefault();
+      saveMyStatus().catch(err => setStatus('Ошибка статуса: ' + err.message, false));
+    }
+  });
+}
+
+msgInput.addEventListener('input', noteTyping);
+
+replyCancelBtn.addEventListener('click', clearReplyTarget);
+threadCloseBtn.addEventListener('click', closeThread);
+
+pinBannerBody.addEventListener('click', showPinned);
+pinUnpinBtn.addEventListener('click', () => {
+  const conv = conversations[activeKey];
+  const p = pinState.list[pinState.index];
+  if (!conv || !p || pinState.key !== activeKey) return;
+  togglePin(conv, p.message_id).catch(err => setStatus('Ошибка закрепления: ' + err.message, false));
+});
+
 msgInput.addEventListener('keydown', (e) => {
   if (e.key === 'Enter' && !e.shiftKey) {
     e.preventDefault();
@@ -738,5 +1890,9 @@ addMemberBtn.addEventListener('click', () => {
   addMemberToActiveGroup().catch(err => setStatus('Ошибка добавления: ' + err.message, false));
 });
 
+pollBtn.addEventListener('click', () => {
+  createPollInActiveGroup().catch(err => setStatus('Ошибка опроса: ' + err.message, false));
+});
+
 // старт
 ensureLogin().catch(() => {});
\ No newline at end of file
@@ -3,7 +3,11 @@ package main
 import (
 	"database/sql"
 	"errors"
+	"math"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 )
 
 // ===== Пользователи — в SQLite (а не in-memory) =====
@@ -16,7 +20,12 @@ type User struct {
 	PublicKey          []byte
 	EncPrivateKey      []byte
 	EncPrivateKeyNonce []byte
-	LastSeen           sql.NullString
+
+	SignPublicKey          []byte
+	EncSignPrivateKey      []byte
+	EncSignPrivateKeyNonce []byte
+
+	LastSeen sql.NullString
 }
 
 type UserStore struct {
@@ -48,9 +57,11 @@ func (s *UserStore) CreateUser(u *User) (*User, error) {
 	}
 
 	res, err := s.db.Exec(`
-		INSERT INTO users (username, password_salt, password_hash, public_key, enc_private_key, enc_private_key_nonce)
-		VALUES (?,?,?,?,?,?)`,
+		INSERT INTO users (username, password_salt, password_hash, public_key, enc_private_key, enc_private_key_nonce,
+		                   sign_public_key, enc_sign_private_key, enc_sign_private_key_nonce)
+		VALUES (?,?,?,?,?,?,?,?,?)`,
 		u.Username, u.PasswordSalt, u.PasswordHash, u.PublicKey, u.EncPrivateKey, u.EncPrivateKeyNonce,
+		u.SignPublicKey, u.EncSignPrivateKey, u.EncSignPrivateKeyNonce,
 	)
 	if err != nil {
 		// на всякий случай: если гонка — sqlite вернет constraint
@@ -70,10 +81,12 @@ func (s *UserStore) GetByUsername(username string) (*User, error) {
 
 	var u User
 	err := s.db.QueryRow(`
-		SELECT id, username, password_salt, password_hash, public_key, enc_private_key, enc_private_key_nonce, last_seen
+		SELECT id, username, password_salt, password_hash, public_key, enc_private_key, enc_private_key_nonce,
+		       sign_public_key, enc_sign_private_key, enc_sign_private_key_nonce, last_seen
 		FROM users WHERE username = ?`, username,
 	).Scan(
-		&u.ID, &u.Username, &u.PasswordSalt, &u.PasswordHash, &u.PublicKey, &u.EncPrivateKey, &u.EncPrivateKeyNonce, &u.LastSeen,
+		&u.ID, &u.Username, &u.PasswordSalt, &u.PasswordHash, &u.PublicKey, &u.EncPrivateKey, &u.EncPrivateKeyNonce,
+		&u.SignPublicKey, &u.EncSignPrivateKey, &u.EncSignPrivateKeyNonce, &u.LastSeen,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -90,10 +103,12 @@ func (s *UserStore) GetByID(id int64) (*User, error) {
 
 	var u User
 	err := s.db.QueryRow(`
-		SELECT id, username, password_salt, password_hash, public_key, enc_private_key, enc_private_key_nonce, last_seen
+		SELECT id, username, password_salt, password_hash, public_key, enc_private_key, enc_private_key_nonce,
+		       sign_public_key, enc_sign_private_key, enc_sign_private_key_nonce, last_seen
 		FROM users WHERE id = ?`, id,
 	).Scan(
-		&u.ID, &u.Username, &u.PasswordSalt, &u.PasswordHash, &u.PublicKey, &u.EncPrivateKey, &u.EncPrivateKeyNonce, &u.LastSeen,
+		&u.ID, &u.Username, &u.PasswordSalt, &u.PasswordHash, &u.PublicKey, &u.EncPrivateKey, &u.EncPrivateKeyNonce,
+		&u.SignPublicKey, &u.EncSignPrivateKey, &u.EncSignPrivateKeyNonce, &u.LastSeen,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -104,36 +119,117 @@ func (s *UserStore) GetByID(id int64) (*User, error) {
 	return &u, nil
 }
 
-func (s *UserStore) UpdateLastSeen(userID int64) error {
-	_, err := s.db.Exec(`UPDATE users SET last_seen = datetime('now') WHERE id = ?`, userID)
+// SetSigningKeys — для аккаунтов, созданных до появления подписей:
+// ключи генерируются при следующем входе, когда известен пароль.
+func (s *UserStore) SetSigningKeys(userID int64, pub, encPriv, nonce []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.Exec(`
+		UPDATE users SET sign_public_key = ?, enc_sign_private_key = ?, enc_sign_private_key_nonce = ?
+		WHERE id = ? AND sign_public_key IS NULL`,
+		pub, encPriv, nonce, userID,
+	)
+	return err
+}
+
+// MediaQuota — квота, заданная админом (байты, 0 — без ограничений); NULL — по умолчанию.
+func (s *UserStore) MediaQuota(userID int64) (sql.NullInt64, error) {
+	var q sql.NullInt64
+	err := s.db.QueryRow(`SELECT media_quota FROM users WHERE id = ?`, userID).Scan(&q)
+	if err == sql.ErrNoRows {
+		return q, ErrUserNotFound
+	}
+	return q, err
+}
+
+func (s *UserStore) SetMediaQuota(userID int64, quota sql.NullInt64) error {
+	_, err := s.db.Exec(`UPDATE users SET media_quota = ? WHERE id = ?`, quota, userID)
 	return err
 }
 
-func (s *UserStore) ListOnline(seconds int) ([]User, error) {
-	q := `
-SELECT id, username, last_seen
+// PresenceRow — то, что presence.go берёт из users.
+type PresenceRow struct {
+	ID         int64
+	Username   string
+	LastSeen   sql.NullString
+	Status     string
+	StatusText string
+}
+
+const presenceCols = `id, username, last_seen, status, status_text`
+
+func (s *UserStore) PresenceRow(userID int64) (*PresenceRow, error) {
+	var p PresenceRow
+	err := s.db.QueryRow(`SELECT `+presenceCols+` FROM users WHERE id = ?`, userID).
+		Scan(&p.ID, &p.Username, &p.LastSeen, &p.Status, &p.StatusText)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// ListContacts — с кем пользователь переписывался (личка, E2E) или состоит в
+// одной беседе. Только им видно его присутствие.
+func (s *UserStore) ListContacts(userID int64) ([]PresenceRow, error) {
+	rows, err := s.db.Query(`
+SELECT `+presenceCols+`
 FROM users
-WHERE last_seen IS NOT NULL
-  AND (strftime('%s','now') - strftime('%s', last_seen)) <= ?
-ORDER BY username;
-`
-	rows, err := s.db.Query(q, seconds)
+WHERE id != ? AND id IN (
+    SELECT to_user_id FROM plain_messages WHERE from_user_id = ?
+    UNION SELECT from_user_id FROM plain_messages WHERE to_user_id = ?
+    UNION SELECT to_user_id FROM messages WHERE from_user_id = ?
+    UNION SELECT from_user_id FROM messages WHERE to_user_id = ?
+    UNION SELECT other.user_id
+          FROM group_members me JOIN group_members other ON other.group_id = me.group_id
+          WHERE me.user_id = ?
+)
+ORDER BY username`, userID, userID, userID, userID, userID, userID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var out []User
+	var out []PresenceRow
 	for rows.Next() {
-		var u User
-		if err := rows.Scan(&u.ID, &u.Username, &u.LastSeen); err != nil {
+		var p PresenceRow
+		if err := rows.Scan(&p.ID, &p.Username, &p.LastSeen, &p.Status, &p.StatusText); err != nil {
 			return nil, err
 		}
-		out = append(out, u)
+		out = append(out, p)
 	}
 	return out, rows.Err()
 }
 
+func (s *UserStore) SetStatus(userID int64, status, text string) error {
+	_, err := s.db.Exec(`UPDATE users SET status = ?, status_text = ? WHERE id = ?`, status, text, userID)
+	return err
+}
+
+// SaveLastSeen пишет накопленные в памяти last_seen одной транзакцией.
+func (s *UserStore) SaveLastSeen(seen map[int64]time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`UPDATE users SET last_seen = ? WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for id, t := range seen {
+		if _, err := stmt.Exec(t.UTC().Format("2006-01-02 15:04:05"), id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 // очень простая проверка constraint для sqlite3
 func sqliteIsConstraint(err error) bool {
 	if err == nil {
@@ -164,11 +260,14 @@ func indexOf(s, sub string) int {
 // ===== Сообщения — в SQLite =====
 
 type Message struct {
-	ID         int64
-	FromUserID int64
-	ToUserID   int64
-	Ciphertext []byte
-	Nonce      []byte
+	ID          int64
+	FromUserID  int64
+	ToUserID    int64
+	Ciphertext  []byte
+	Nonce       []byte
+	ClientMsgID sql.NullString
+	Signature   []byte
+	Version     int
 }
 
 type MessageStore struct {
@@ -181,8 +280,8 @@ func NewMessageStore(db *sql.DB) *MessageStore {
 
 func (s *MessageStore) CreateMessage(m *Message) (*Message, error) {
 	res, err := s.db.Exec(
-		`INSERT INTO messages (from_user_id, to_user_id, ciphertext, nonce) VALUES (?, ?, ?, ?)`,
-		m.FromUserID, m.ToUserID, m.Ciphertext, m.Nonce,
+		`INSERT INTO messages (from_user_id, to_user_id, ciphertext, nonce, client_msg_id, signature, version) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		m.FromUserID, m.ToUserID, m.Ciphertext, m.Nonce, m.ClientMsgID, m.Signature, m.Version,
 	)
 	if err != nil {
 		return nil, err
@@ -195,9 +294,34 @@ func (s *MessageStore) CreateMessage(m *Message) (*Message, error) {
 	return m, nil
 }
 
+// ListSince — E2E-сообщения пользователя (входящие и исходящие) с id > afterID.
+func (s *MessageStore) ListSince(userID, afterID int64, limit int) ([]*Message, error) {
+	rows, err := s.db.Query(
+		`SELECT id, from_user_id, to_user_id, ciphertext, nonce, client_msg_id, signature, version
+         FROM messages
+         WHERE id > ? AND (from_user_id = ? OR to_user_id = ?)
+         ORDER BY id LIMIT ?`,
+		afterID, userID, userID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []*Message
+	for rows.Next() {
+		var m Message
+		if err := rows.Scan(&m.ID, &m.FromUserID, &m.ToUserID, &m.Ciphertext, &m.Nonce, &m.ClientMsgID, &m.Signature, &m.Version); err != nil {
+			return nil, err
+		}
+		res = append(res, &m)
+	}
+	return res, rows.Err()
+}
+
 func (s *MessageStore) ListBetween(userA, userB int64) []*Message {
 	rows, err := s.db.Query(
-		`SELECT id, from_user_id, to_user_id, ciphertext, nonce
+		`SELECT id, from_user_id, to_user_id, ciphertext, nonce, client_msg_id, signature, version
          FROM messages
          WHERE (from_user_id = ? AND to_user_id = ?)
             OR (from_user_id = ? AND to_user_id = ?)
@@ -212,7 +336,7 @@ func (s *MessageStore) ListBetween(userA, userB int64) []*Message {
 	var res []*Message
 	for rows.Next() {
 		var m Message
-		if err := rows.Scan(&m.ID, &m.FromUserID, &m.ToUserID, &m.Ciphertext, &m.Nonce); err != nil {
+		if err := rows.Scan(&m.ID, &m.FromUserID, &m.ToUserID, &m.Ciphertext, &m.Nonce, &m.ClientMsgID, &m.Signature, &m.Version); err != nil {
 			continue
 		}
 		res = append(res, &m)
@@ -223,25 +347,54 @@ func (s *MessageStore) ListBetween(userA, userB int64) []*Message {
 // ===== Plain messages for browser chat =====
 
 type PlainMessage struct {
-	ID         int64
-	FromUserID int64
-	ToUserID   int64
-	Text       string
-	CreatedAt  string
+	ID          int64
+	FromUserID  int64
+	ToUserID    int64
+	Text        string
+	Attachments []string // public_id медиа: при Create прикладываются в той же транзакции
+	ReplyTo     int64    // ответ на сообщение этой же беседы (replies.go), 0 — не ответ
+	CreatedAt   string
+
+	// пересылка (forward.go): автор оригинала и медиа оригинала — прикладываются
+	// как есть, без проверки, что загружены в эту беседу (так же — уже проверенные
+	// вложения отложенного сообщения, scheduled.go)
+	ForwardedFrom     int64
+	ForwardedFromName string
+	ForwardedMedia    []int64
 }
 
+// Текст хранится зашифрованным (message_crypto.go); колонка text остаётся пустой.
 type PlainMessageStore struct {
-	db *sql.DB
+	db     *sql.DB
+	sealer *TextSealer
+}
+
+func NewPlainMessageStore(db *sql.DB, sealer *TextSealer) *PlainMessageStore {
+	return &PlainMessageStore{db: db, sealer: sealer}
 }
 
-func NewPlainMessageStore(db *sql.DB) *PlainMessageStore {
-	return &PlainMessageStore{db: db}
+const encryptedTextCols = `text_ct, text_nonce, dek_wrapped, dek_nonce, key_version`
+
+func (e *encryptedText) scanDest() []any {
+	return []any{&e.TextCT, &e.TextNonce, &e.DEKWrapped, &e.DEKNonce, &e.KeyVersion}
 }
 
+// id входит в AAD, поэтому сначала вставляем строку, потом шифруем — в одной транзакции.
 func (s *PlainMessageStore) Create(m *PlainMessage) (*PlainMessage, error) {
-	res, err := s.db.Exec(
-		`INSERT INTO plain_messages (from_user_id, to_user_id, text) VALUES (?, ?, ?)`,
-		m.FromUserID, m.ToUserID, m.Text,
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	scope := conversationScope(plainMessagesTable.kind, m.FromUserID, m.ToUserID)
+	if err := checkReplyParent(tx, plainMessagesTable, m.ReplyTo, scope); err != nil {
+		return nil, err
+	}
+	res, err := tx.Exec(
+		`INSERT INTO plain_messages (from_user_id, to_user_id, text, reply_to, forwarded_from, forwarded_from_name)
+         VALUES (?, ?, '', ?, ?, NULLIF(?, ''))`,
+		m.FromUserID, m.ToUserID, nullID(m.ReplyTo), nullID(m.ForwardedFrom), m.ForwardedFromName,
 	)
 	if err != nil {
 		return nil, err
@@ -250,13 +403,37 @@ func (s *PlainMessageStore) Create(m *PlainMessage) (*PlainMessage, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	env, err := s.sealer.Seal(plainMessagesTable.kind, id, m.FromUserID, m.ToUserID, m.Text)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(
+		`UPDATE plain_messages SET text_ct = ?, text_nonce = ?, dek_wrapped = ?, dek_nonce = ?, key_version = ? WHERE id = ?`,
+		env.Ciphertext, env.Nonce, env.WrappedKey, env.WrapNonce, env.KeyVersion, id,
+	); err != nil {
+		return nil, err
+	}
+	if err := insertSearchTokens(tx, plainMessagesTable.kind, id, s.sealer.BlindTokens(plainMessagesTable.kind, m.Text)); err != nil {
+		return nil, err
+	}
+	if err := attachMedia(tx, plainMessagesTable.kind, id, scope, m.Attachments); err != nil {
+		return nil, err
+	}
+	if err := attachForwardedMedia(tx, plainMessagesTable.kind, id, len(m.Attachments), m.ForwardedMedia); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
 	m.ID = id
 	return m, nil
 }
 
 func (s *PlainMessageStore) ListBetween(userA, userB int64) ([]*PlainMessage, error) {
 	rows, err := s.db.Query(
-		`SELECT id, from_user_id, to_user_id, text, created_at
+		`SELECT id, from_user_id, to_user_id, text, `+encryptedTextCols+`, created_at, COALESCE(reply_to, 0),
+                COALESCE(forwarded_from, 0), COALESCE(forwarded_from_name, '')
          FROM plain_messages
          WHERE (from_user_id = ? AND to_user_id = ?)
             OR (from_user_id = ? AND to_user_id = ?)
@@ -268,15 +445,134 @@ func (s *PlainMessageStore) ListBetween(userA, userB int64) ([]*PlainMessage, er
 	}
 	defer rows.Close()
 
+	return s.scanMessages(rows)
+}
+
+// ListByIDs — сообщения по id (для цитат и веток), в порядке id.
+func (s *PlainMessageStore) ListByIDs(ids []int64) ([]*PlainMessage, error) {
+	var out []*PlainMessage
+	for len(ids) > 0 {
+		batch := ids[:min(len(ids), 500)]
+		ids = ids[len(batch):]
+
+		args := make([]any, 0, len(batch))
+		for _, id := range batch {
+			args = append(args, id)
+		}
+		rows, err := s.db.Query(
+			`SELECT id, from_user_id, to_user_id, text, `+encryptedTextCols+`, created_at, COALESCE(reply_to, 0),
+                COALESCE(forwarded_from, 0), COALESCE(forwarded_from_name, '')
+		         FROM plain_messages
+		         WHERE id IN (?`+strings.Repeat(",?", len(batch)-1)+`)
+		         ORDER BY id`,
+			args...,
+		)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := s.scanMessages(rows)
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, msgs...)
+	}
+	return out, nil
+}
+
+// ListReplies — ответы на сообщение, по порядку.
+func (s *PlainMessageStore) ListReplies(parentID int64) ([]*PlainMessage, error) {
+	rows, err := s.db.Query(
+		`SELECT id, from_user_id, to_user_id, text, `+encryptedTextCols+`, created_at, COALESCE(reply_to, 0),
+                COALESCE(forwarded_from, 0), COALESCE(forwarded_from_name, '')
+         FROM plain_messages
+         WHERE reply_to = ?
+         ORDER BY id`,
+		parentID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return s.scanMessages(rows)
+}
+
+// Participants — отправитель и получатель сообщения (без расшифровки текста).
+func (s *PlainMessageStore) Participants(id int64) (from, to int64, err error) {
+	err = s.db.QueryRow(`SELECT from_user_id, to_user_id FROM plain_messages WHERE id = ?`, id).Scan(&from, &to)
+	return from, to, err
+}
+
+// ListSince — сообщения пользователя (входящие и исходящие) с id > afterID, для /sync.
+func (s *PlainMessageStore) ListSince(userID, afterID int64, limit int) ([]*PlainMessage, error) {
+	rows, err := s.db.Query(
+		`SELECT id, from_user_id, to_user_id, text, `+encryptedTextCols+`, created_at, COALESCE(reply_to, 0),
+                COALESCE(forwarded_from, 0), COALESCE(forwarded_from_name, '')
+         FROM plain_messages
+         WHERE id > ? AND (from_user_id = ? OR to_user_id = ?)
+         ORDER BY id LIMIT ?`,
+		afterID, userID, userID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return s.scanMessages(rows)
+}
+
+func (s *PlainMessageStore) scanMessages(rows *sql.Rows) ([]*PlainMessage, error) {
 	var res []*PlainMessage
 	for rows.Next() {
 		var m PlainMessage
-		if err := rows.Scan(&m.ID, &m.FromUserID, &m.ToUserID, &m.Text, &m.CreatedAt); err != nil {
+		var enc encryptedText
+		dest := append([]any{&m.ID, &m.FromUserID, &m.ToUserID, &m.Text}, enc.scanDest()...)
+		if err := rows.Scan(append(dest, &m.CreatedAt, &m.ReplyTo, &m.ForwardedFrom, &m.ForwardedFromName)...); err != nil {
 			continue
 		}
+		text, err := s.sealer.openRow(plainMessagesTable.kind, m.ID, m.FromUserID, m.ToUserID, m.Text, &enc)
+		if err != nil {
+			return nil, err
+		}
+		m.Text = text
 		res = append(res, &m)
 	}
-	return res, nil
+	return res, rows.Err()
+}
+
+// Search — сообщения пользователя, содержащие все слова запроса (по слепому индексу).
+func (s *PlainMessageStore) Search(userID int64, query string, limit int) ([]*PlainMessage, error) {
+	tokens := s.sealer.BlindTokens(plainMessagesTable.kind, query)
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	args := []any{plainMessagesTable.kind}
+	for _, t := range tokens {
+		args = append(args, t)
+	}
+	args = append(args, len(tokens), userID, userID, limit)
+
+	rows, err := s.db.Query(
+		`SELECT id, from_user_id, to_user_id, text, `+encryptedTextCols+`, created_at, COALESCE(reply_to, 0),
+                COALESCE(forwarded_from, 0), COALESCE(forwarded_from_name, '')
+         FROM plain_messages
+         WHERE id IN (
+             SELECT message_id FROM message_search_index
+             WHERE kind = ? AND token IN (?`+strings.Repeat(",?", len(tokens)-1)+`)
+             GROUP BY message_id HAVING COUNT(DISTINCT token) = ?
+         )
+           AND (from_user_id = ? OR to_user_id = ?)
+         ORDER BY id DESC LIMIT ?`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return s.scanMessages(rows)
 }
 
 // ===== Inbox (для автопоявления диалогов) =====
@@ -303,7 +599,10 @@ SELECT
   l.peer_id,
   u.username,
   pm.id,
+  pm.from_user_id,
+  pm.to_user_id,
   pm.text,
+  pm.text_ct, pm.text_nonce, pm.dek_wrapped, pm.dek_nonce, pm.key_version,
   pm.created_at
 FROM last_per_peer l
 JOIN users u ON u.id = l.peer_id
@@ -319,9 +618,17 @@ ORDER BY pm.id DESC;
 	out := []InboxItem{}
 	for rows.Next() {
 		var it InboxItem
-		if err := rows.Scan(&it.PeerID, &it.PeerUsername, &it.LastMessageID, &it.LastText, &it.LastCreatedAt); err != nil {
+		var fromID, toID int64
+		var enc encryptedText
+		dest := append([]any{&it.PeerID, &it.PeerUsername, &it.LastMessageID, &fromID, &toID, &it.LastText}, enc.scanDest()...)
+		if err := rows.Scan(append(dest, &it.LastCreatedAt)...); err != nil {
+			return nil, err
+		}
+		text, err := s.sealer.openRow(plainMessagesTable.kind, it.LastMessageID, fromID, toID, it.LastText, &enc)
+		if err != nil {
 			return nil, err
 		}
+		it.LastText = text
 		out = append(out, it)
 	}
 	return out, rows.Err()
@@ -334,6 +641,7 @@ type Group struct {
 	Name        string
 	OwnerUserID int64
 	CreatedAt   string
+	Role        string // роль пользователя, для которого читали список (ListByUser)
 }
 
 type GroupStore struct {
@@ -377,7 +685,8 @@ func (s *GroupStore) GetByID(id int64) (*Group, error) {
 
 func (s *GroupStore) ListByUser(userID int64) ([]*Group, error) {
 	rows, err := s.db.Query(
-		`SELECT g.id, g.name, g.owner_user_id, g.created_at
+		`SELECT g.id, g.name, g.owner_user_id, g.created_at,
+                CASE WHEN g.owner_user_id = gm.user_id THEN 'owner' ELSE gm.role END
          FROM groups g
          JOIN group_members gm ON gm.group_id = g.id
          WHERE gm.user_id = ?
@@ -392,7 +701,7 @@ func (s *GroupStore) ListByUser(userID int64) ([]*Group, error) {
 	var res []*Group
 	for rows.Next() {
 		var g Group
-		if err := rows.Scan(&g.ID, &g.Name, &g.OwnerUserID, &g.CreatedAt); err != nil {
+		if err := rows.Scan(&g.ID, &g.Name, &g.OwnerUserID, &g.CreatedAt, &g.Role); err != nil {
 			continue
 		}
 		res = append(res, &g)
@@ -408,12 +717,69 @@ func NewGroupMemberStore(db *sql.DB) *GroupMemberStore {
 	return &GroupMemberStore{db: db}
 }
 
+// AddMember пишет новое членство ещё и в group_member_log — по нему /sync отдаёт
+// изменения состава бесед.
 func (s *GroupMemberStore) AddMember(groupID, userID int64) error {
-	_, err := s.db.Exec(
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
 		`INSERT OR IGNORE INTO group_members (group_id, user_id) VALUES (?, ?)`,
 		groupID, userID,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return nil // уже участник
+	}
+	if _, err := tx.Exec(`INSERT INTO group_member_log (group_id, user_id) VALUES (?, ?)`, groupID, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type GroupMemberEvent struct {
+	ID        int64
+	GroupID   int64
+	GroupName string
+	UserID    int64
+	Username  string
+	CreatedAt string
+}
+
+// ListAddedSince — кого добавили после afterID: самого пользователя в новые беседы
+// и кого угодно в беседы, где он состоит.
+func (s *GroupMemberStore) ListAddedSince(userID, afterID int64, limit int) ([]GroupMemberEvent, error) {
+	rows, err := s.db.Query(
+		`SELECT l.id, l.group_id, COALESCE(g.name, ''), l.user_id, COALESCE(u.username, ''), l.created_at
+         FROM group_member_log l
+         LEFT JOIN groups g ON g.id = l.group_id
+         LEFT JOIN users u ON u.id = l.user_id
+         WHERE l.id > ?
+           AND (l.user_id = ? OR l.group_id IN (SELECT group_id FROM group_members WHERE user_id = ?))
+         ORDER BY l.id LIMIT ?`,
+		afterID, userID, userID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []GroupMemberEvent
+	for rows.Next() {
+		var e GroupMemberEvent
+		if err := rows.Scan(&e.ID, &e.GroupID, &e.GroupName, &e.UserID, &e.Username, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		res = append(res, e)
+	}
+	return res, rows.Err()
 }
 
 func (s *GroupMemberStore) IsMember(groupID, userID int64) (bool, error) {
@@ -432,26 +798,106 @@ func (s *GroupMemberStore) IsMember(groupID, userID int64) (bool, error) {
 	return true, nil
 }
 
+// MemberNames — участники беседы: username в нижнем регистре -> id.
+func (s *GroupMemberStore) MemberNames(groupID int64) (map[string]int64, error) {
+	rows, err := s.db.Query(
+		`SELECT u.id, u.username FROM group_members gm JOIN users u ON u.id = gm.user_id WHERE gm.group_id = ?`,
+		groupID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[string]int64{}
+	for rows.Next() {
+		var id int64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		out[strings.ToLower(name)] = id
+	}
+	return out, rows.Err()
+}
+
+// Role — роль участника: owner (groups.owner_user_id), admin или member;
+// "" — не участник.
+func (s *GroupMemberStore) Role(groupID, userID int64) (string, error) {
+	var role string
+	err := s.db.QueryRow(
+		`SELECT CASE WHEN g.owner_user_id = gm.user_id THEN 'owner' ELSE gm.role END
+         FROM group_members gm
+         JOIN groups g ON g.id = gm.group_id
+         WHERE gm.group_id = ? AND gm.user_id = ?`,
+		groupID, userID,
+	).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// SetRole — admin | member; sql.ErrNoRows, если пользователь не участник.
+func (s *GroupMemberStore) SetRole(groupID, userID int64, role string) error {
+	res, err := s.db.Exec(
+		`UPDATE group_members SET role = ? WHERE group_id = ? AND user_id = ?`,
+		role, groupID, userID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
 type GroupMessage struct {
-	ID         int64
-	GroupID    int64
-	FromUserID int64
-	Text       string
-	CreatedAt  string
+	ID           int64
+	GroupID      int64
+	FromUserID   int64
+	FromUsername string
+	Text         string
+	Attachments  []string // как у PlainMessage
+	ReplyTo      int64
+	CreatedAt    string
+
+	ForwardedFrom     int64 // как у PlainMessage
+	ForwardedFromName string
+	ForwardedMedia    []int64
+
+	// упоминания (mentions.go): пишутся в той же транзакции, что и сообщение
+	Mentions   []int64 // кого упомянули по имени
+	MentionAll bool    // @all — все участники, кроме автора
+
+	Poll *Poll // сообщение — опрос (polls.go); Text — вопрос и варианты
 }
 
 type GroupMessageStore struct {
-	db *sql.DB
+	db     *sql.DB
+	sealer *TextSealer
 }
 
-func NewGroupMessageStore(db *sql.DB) *GroupMessageStore {
-	return &GroupMessageStore{db: db}
+func NewGroupMessageStore(db *sql.DB, sealer *TextSealer) *GroupMessageStore {
+	return &GroupMessageStore{db: db, sealer: sealer}
 }
 
 func (s *GroupMessageStore) Create(m *GroupMessage) (*GroupMessage, error) {
-	res, err := s.db.Exec(
-		`INSERT INTO group_messages (group_id, from_user_id, text) VALUES (?, ?, ?)`,
-		m.GroupID, m.FromUserID, m.Text,
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	scope := conversationScope(groupMessagesTable.kind, m.FromUserID, m.GroupID)
+	if err := checkReplyParent(tx, groupMessagesTable, m.ReplyTo, scope); err != nil {
+		return nil, err
+	}
+	res, err := tx.Exec(
+		`INSERT INTO group_messages (group_id, from_user_id, text, reply_to, forwarded_from, forwarded_from_name, mention_all)
+         VALUES (?, ?, '', ?, ?, NULLIF(?, ''), ?)`,
+		m.GroupID, m.FromUserID, nullID(m.ReplyTo), nullID(m.ForwardedFrom), m.ForwardedFromName, m.MentionAll,
 	)
 	if err != nil {
 		return nil, err
@@ -460,16 +906,54 @@ func (s *GroupMessageStore) Create(m *GroupMessage) (*GroupMessage, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	env, err := s.sealer.Seal(groupMessagesTable.kind, id, m.FromUserID, m.GroupID, m.Text)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(
+		`UPDATE group_messages SET text_ct = ?, text_nonce = ?, dek_wrapped = ?, dek_nonce = ?, key_version = ? WHERE id = ?`,
+		env.Ciphertext, env.Nonce, env.WrappedKey, env.WrapNonce, env.KeyVersion, id,
+	); err != nil {
+		return nil, err
+	}
+	if err := insertSearchTokens(tx, groupMessagesTable.kind, id, s.sealer.BlindTokens(groupMessagesTable.kind, m.Text)); err != nil {
+		return nil, err
+	}
+	if err := attachMedia(tx, groupMessagesTable.kind, id, scope, m.Attachments); err != nil {
+		return nil, err
+	}
+	if err := attachForwardedMedia(tx, groupMessagesTable.kind, id, len(m.Attachments), m.ForwardedMedia); err != nil {
+		return nil, err
+	}
+	if err := insertMentions(tx, m.GroupID, id, m.FromUserID, m.Mentions, m.MentionAll); err != nil {
+		return nil, err
+	}
+	if m.Poll != nil {
+		if _, err := tx.Exec(
+			`INSERT INTO polls (message_id, group_id, options, multiple, anonymous, closes_at) VALUES (?, ?, ?, ?, ?, NULLIF(?, ''))`,
+			id, m.GroupID, m.Poll.Options, m.Poll.Multiple, m.Poll.Anonymous, m.Poll.ClosesAt,
+		); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
 	m.ID = id
 	return m, nil
 }
 
+// List — сообщения беседы вместе с username отправителя (LEFT JOIN: юзер мог пропасть).
 func (s *GroupMessageStore) List(groupID int64) ([]*GroupMessage, error) {
 	rows, err := s.db.Query(
-		`SELECT id, group_id, from_user_id, text, created_at
-         FROM group_messages
-         WHERE group_id = ?
-         ORDER BY id`,
+		`SELECT gm.id, gm.group_id, gm.from_user_id, COALESCE(u.username, ''), gm.text,
+                gm.text_ct, gm.text_nonce, gm.dek_wrapped, gm.dek_nonce, gm.key_version, gm.created_at,
+                COALESCE(gm.reply_to, 0), COALESCE(gm.forwarded_from, 0), COALESCE(gm.forwarded_from_name, '')
+         FROM group_messages gm
+         LEFT JOIN users u ON u.id = gm.from_user_id
+         WHERE gm.group_id = ?
+         ORDER BY gm.id`,
 		groupID,
 	)
 	if err != nil {
@@ -477,62 +961,1695 @@ func (s *GroupMessageStore) List(groupID int64) ([]*GroupMessage, error) {
 	}
 	defer rows.Close()
 
-	var res []*GroupMessage
-	for rows.Next() {
-		var m GroupMessage
-		if err := rows.Scan(&m.ID, &m.GroupID, &m.FromUserID, &m.Text, &m.CreatedAt); err != nil {
-			continue
-		}
-		res = append(res, &m)
-	}
-	return res, nil
+	return s.scanMessages(rows)
 }
 
-type PlainMedia struct {
-	ID           int64
-	Kind         string
-	FromUserID   int64
-	ToUserID     sql.NullInt64
-	GroupID      sql.NullInt64
-	Ciphertext   []byte
-	Nonce        []byte
-	ContentType  string
-	OriginalName string
-	CreatedAt    string
+func (s *GroupMessageStore) ListByIDs(ids []int64) ([]*GroupMessage, error) {
+	var out []*GroupMessage
+	for len(ids) > 0 {
+		batch := ids[:min(len(ids), 500)]
+		ids = ids[len(batch):]
+
+		args := make([]any, 0, len(batch))
+		for _, id := range batch {
+			args = append(args, id)
+		}
+		rows, err := s.db.Query(
+			`SELECT gm.id, gm.group_id, gm.from_user_id, COALESCE(u.username, ''), gm.text,
+		                gm.text_ct, gm.text_nonce, gm.dek_wrapped, gm.dek_nonce, gm.key_version, gm.created_at,
+		                COALESCE(gm.reply_to, 0), COALESCE(gm.forwarded_from, 0), COALESCE(gm.forwarded_from_name, '')
+		         FROM group_messages gm
+		         LEFT JOIN users u ON u.id = gm.from_user_id
+		         WHERE gm.id IN (?`+strings.Repeat(",?", len(batch)-1)+`)
+		         ORDER BY gm.id`,
+			args...,
+		)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := s.scanMessages(rows)
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, msgs...)
+	}
+	return out, nil
 }
 
-type PlainMediaStore struct{ db *sql.DB }
+func (s *GroupMessageStore) ListReplies(parentID int64) ([]*GroupMessage, error) {
+	rows, err := s.db.Query(
+		`SELECT gm.id, gm.group_id, gm.from_user_id, COALESCE(u.username, ''), gm.text,
+                gm.text_ct, gm.text_nonce, gm.dek_wrapped, gm.dek_nonce, gm.key_version, gm.created_at,
+                COALESCE(gm.reply_to, 0), COALESCE(gm.forwarded_from, 0), COALESCE(gm.forwarded_from_name, '')
+         FROM group_messages gm
+         LEFT JOIN users u ON u.id = gm.from_user_id
+         WHERE gm.reply_to = ?
+         ORDER BY gm.id`,
+		parentID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return s.scanMessages(rows)
+}
+
+// GroupOf — беседа, в которой написано сообщение.
+func (s *GroupMessageStore) GroupOf(id int64) (int64, error) {
+	var groupID int64
+	err := s.db.QueryRow(`SELECT group_id FROM group_messages WHERE id = ?`, id).Scan(&groupID)
+	return groupID, err
+}
+
+// ListSince — сообщения из всех бесед пользователя с id > afterID, для /sync.
+func (s *GroupMessageStore) ListSince(userID, afterID int64, limit int) ([]*GroupMessage, error) {
+	rows, err := s.db.Query(
+		`SELECT gm.id, gm.group_id, gm.from_user_id, COALESCE(u.username, ''), gm.text,
+                gm.text_ct, gm.text_nonce, gm.dek_wrapped, gm.dek_nonce, gm.key_version, gm.created_at,
+                COALESCE(gm.reply_to, 0), COALESCE(gm.forwarded_from, 0), COALESCE(gm.forwarded_from_name, '')
+         FROM group_messages gm
+         LEFT JOIN users u ON u.id = gm.from_user_id
+         JOIN group_members mem ON mem.group_id = gm.group_id AND mem.user_id = ?
+         WHERE gm.id > ?
+         ORDER BY gm.id LIMIT ?`,
+		userID, afterID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return s.scanMessages(rows)
+}
+
+func (s *GroupMessageStore) scanMessages(rows *sql.Rows) ([]*GroupMessage, error) {
+	var res []*GroupMessage
+	for rows.Next() {
+		var m GroupMessage
+		var enc encryptedText
+		dest := append([]any{&m.ID, &m.GroupID, &m.FromUserID, &m.FromUsername, &m.Text}, enc.scanDest()...)
+		if err := rows.Scan(append(dest, &m.CreatedAt, &m.ReplyTo, &m.ForwardedFrom, &m.ForwardedFromName)...); err != nil {
+			return nil, err
+		}
+		text, err := s.sealer.openRow(groupMessagesTable.kind, m.ID, m.FromUserID, m.GroupID, m.Text, &enc)
+		if err != nil {
+			return nil, err
+		}
+		m.Text = text
+		res = append(res, &m)
+	}
+	return res, rows.Err()
+}
+
+// Search — сообщения из бесед пользователя, содержащие все слова запроса.
+func (s *GroupMessageStore) Search(userID int64, query string, limit int) ([]*GroupMessage, error) {
+	tokens := s.sealer.BlindTokens(groupMessagesTable.kind, query)
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	args := []any{groupMessagesTable.kind}
+	for _, t := range tokens {
+		args = append(args, t)
+	}
+	args = append(args, len(tokens), userID, limit)
+
+	rows, err := s.db.Query(
+		`SELECT gm.id, gm.group_id, gm.from_user_id, COALESCE(u.username, ''), gm.text,
+                gm.text_ct, gm.text_nonce, gm.dek_wrapped, gm.dek_nonce, gm.key_version, gm.created_at,
+                COALESCE(gm.reply_to, 0), COALESCE(gm.forwarded_from, 0), COALESCE(gm.forwarded_from_name, '')
+         FROM group_messages gm
+         LEFT JOIN users u ON u.id = gm.from_user_id
+         JOIN group_members mem ON mem.group_id = gm.group_id
+         WHERE gm.id IN (
+             SELECT message_id FROM message_search_index
+             WHERE kind = ? AND token IN (?`+strings.Repeat(",?", len(tokens)-1)+`)
+             GROUP BY message_id HAVING COUNT(DISTINCT token) = ?
+         )
+           AND mem.user_id = ?
+         ORDER BY gm.id DESC LIMIT ?`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return s.scanMessages(rows)
+}
+
+type PlainMedia struct {
+	ID           int64
+	PublicID     string
+	Kind         string
+	FromUserID   int64
+	ToUserID     sql.NullInt64
+	GroupID      sql.NullInt64
+	BlobKey      string // шифртекст в BlobStore (blobstore.go)
+	BlobSize     int64
+	Nonce        []byte
+	EncVersion   int
+	DEKWrapped   []byte
+	DEKNonce     []byte
+	KeyVersion   uint32
+	ContentType  string
+	OriginalName string
+	Size         int64 // размер открытого файла
+	Width        int   // только для картинок, 0 — неизвестно
+	Height       int
+	// миниатюра (media_image.go), пустой ключ — её нет
+	ThumbBlobKey     string
+	ThumbBlobSize    int64
+	ThumbNonce       []byte
+	ThumbContentType string
+	ContentHash      []byte // для дедупликации (media_gc.go), nil у старых записей
+	DurationMS       int64  // голосовые и аудио (media_audio.go)
+	Waveform         []byte
+	CreatedAt        string
+}
+
+type PlainMediaStore struct{ db *sql.DB }
 
 func NewPlainMediaStore(db *sql.DB) *PlainMediaStore { return &PlainMediaStore{db: db} }
 
-func (s *PlainMediaStore) Create(m *PlainMedia) (*PlainMedia, error) {
-	res, err := s.db.Exec(`
+// Create вставляет запись, проверяет квоту (charge, nil — место уже
+// зарезервировано) и вызывает seal уже с известным id — id входит в AAD, поэтому
+// шифровать до вставки нельзя. Всё в одной транзакции: при ошибке квоты или
+// шифрования не остаётся ни пустой строки, ни списанного места.
+func (s *PlainMediaStore) Create(m *PlainMedia, charge quotaCharge, seal func(m *PlainMedia) error) (*PlainMedia, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
 		INSERT INTO plain_media
-		(kind, from_user_id, to_user_id, group_id, ciphertext, nonce, content_type, original_name)
-		VALUES (?,?,?,?,?,?,?,?)`,
-		m.Kind, m.FromUserID, m.ToUserID, m.GroupID,
-		m.Ciphertext, m.Nonce, m.ContentType, m.OriginalName,
+		(public_id, kind, from_user_id, to_user_id, group_id, ciphertext, nonce, enc_version, content_type, original_name, size, width, height,
+		 content_hash, duration_ms, waveform, refs_tracked, numeric_markers)
+		VALUES (?,?,?,?,?,x'',x'',?,?,?,?,?,?,?,?,?,1,0)`,
+		m.PublicID, m.Kind, m.FromUserID, m.ToUserID, m.GroupID,
+		m.EncVersion, m.ContentType, m.OriginalName, m.Size, m.Width, m.Height, m.ContentHash, m.DurationMS, m.Waveform,
 	)
 	if err != nil {
 		return nil, err
 	}
-	id, _ := res.LastInsertId()
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
 	m.ID = id
+
+	if charge != nil {
+		if err := charge(tx, m.FromUserID); err != nil {
+			return nil, err
+		}
+	}
+	if err := seal(m); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`
+		UPDATE plain_media SET blob_key = ?, blob_size = ?, nonce = ?, enc_version = ?, dek_wrapped = ?, dek_nonce = ?, key_version = ?,
+		       thumb_blob_key = ?, thumb_blob_size = ?, thumb_nonce = ?, thumb_content_type = ?
+		WHERE id = ?`,
+		m.BlobKey, m.BlobSize, m.Nonce, m.EncVersion, m.DEKWrapped, m.DEKNonce, m.KeyVersion,
+		sql.NullString{String: m.ThumbBlobKey, Valid: m.ThumbBlobKey != ""}, m.ThumbBlobSize, m.ThumbNonce, m.ThumbContentType,
+		m.ID,
+	); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
 	return m, nil
 }
 
+// UpdateCrypto — для ротации ключей: перезаписывает только шифровальные поля.
+func (s *PlainMediaStore) UpdateCrypto(m *PlainMedia) error {
+	_, err := s.db.Exec(`
+		UPDATE plain_media SET blob_key = ?, blob_size = ?, nonce = ?, enc_version = ?, dek_wrapped = ?, dek_nonce = ?, key_version = ?
+		WHERE id = ?`,
+		m.BlobKey, m.BlobSize, m.Nonce, m.EncVersion, m.DEKWrapped, m.DEKNonce, m.KeyVersion, m.ID,
+	)
+	return err
+}
+
+// inlineMedia — запись, чей шифртекст ещё лежит в колонке ciphertext.
+type inlineMedia struct {
+	ID         int64
+	Ciphertext []byte
+}
+
+func (s *PlainMediaStore) ListInline(limit int) ([]inlineMedia, error) {
+	rows, err := s.db.Query(`SELECT id, ciphertext FROM plain_media WHERE blob_key IS NULL ORDER BY id LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []inlineMedia
+	for rows.Next() {
+		var im inlineMedia
+		if err := rows.Scan(&im.ID, &im.Ciphertext); err != nil {
+			return nil, err
+		}
+		out = append(out, im)
+	}
+	return out, rows.Err()
+}
+
+// SetBlob — шифртекст перенесён в BlobStore, колонку очищаем.
+func (s *PlainMediaStore) SetBlob(id int64, key string, size int64) error {
+	_, err := s.db.Exec(`UPDATE plain_media SET blob_key = ?, blob_size = ?, ciphertext = x'' WHERE id = ?`, key, size, id)
+	return err
+}
+
+// UsageByUser — сколько байт (открытого текста) и файлов загрузил пользователь.
+func (s *PlainMediaStore) UsageByUser(userID int64) (int64, int64, error) {
+	var bytes, files int64
+	err := s.db.QueryRow(`SELECT COALESCE(SUM(size), 0), COUNT(*) FROM plain_media WHERE from_user_id = ?`, userID).Scan(&bytes, &files)
+	return bytes, files, err
+}
+
+// mediaUsageTx — занятое пользователем (его медиа, незавершённые загрузки по
+// частям и E2E-вложения) и его квота, внутри транзакции вставки (media_quota.go).
+func mediaUsageTx(tx *sql.Tx, userID, defaultQuota int64) (used, quota int64, err error) {
+	err = tx.QueryRow(`
+		SELECT (SELECT COALESCE(SUM(size), 0) FROM plain_media WHERE from_user_id = u.id)
+		     + (SELECT COALESCE(SUM(size), 0) FROM media_uploads WHERE from_user_id = u.id AND media_public_id IS NULL)
+		     + (SELECT COALESCE(SUM(size), 0) FROM e2e_media WHERE from_user_id = u.id),
+		       COALESCE(u.media_quota, ?)
+		FROM users u WHERE u.id = ?`, defaultQuota, userID).Scan(&used, &quota)
+	return used, quota, err
+}
+
+// ListIDsNotUnderKey — id записей, чей DEK обёрнут не ключом version (или старого формата без DEK).
+func (s *PlainMediaStore) ListIDsNotUnderKey(version uint32, afterID int64, limit int) ([]int64, error) {
+	rows, err := s.db.Query(`
+		SELECT id FROM plain_media
+		WHERE id > ? AND (enc_version < ? OR key_version != ?)
+		ORDER BY id LIMIT ?`,
+		afterID, mediaEncVersionEnvelope, version, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
 func (s *PlainMediaStore) GetByID(id int64) (*PlainMedia, error) {
-	var m PlainMedia
+	return s.getBy("id", id)
+}
+
+func (s *PlainMediaStore) GetByPublicID(publicID string) (*PlainMedia, error) {
+	return s.getBy("public_id", publicID)
+}
+
+func (s *PlainMediaStore) GetByContentHash(hash []byte) (*PlainMedia, error) {
+	return s.getBy("content_hash", hash)
+}
+
+// Touch отодвигает медиа от GC; false — записи уже нет.
+func (s *PlainMediaStore) Touch(id int64) (bool, error) {
+	res, err := s.db.Exec(`UPDATE plain_media SET touched_at = strftime('%Y-%m-%dT%H:%M:%fZ','now') WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// unreferencedMediaCond — медиа, не приложенное ни к одному сообщению и не тронутое с cutoff.
+const unreferencedMediaCond = `refs_tracked = 1
+	AND COALESCE(touched_at, created_at) < ?
+	AND NOT EXISTS (SELECT 1 FROM message_attachments a WHERE a.media_id = plain_media.id)`
+
+func (s *PlainMediaStore) ListUnreferenced(grace time.Duration, limit int) ([]int64, error) {
+	cutoff := time.Now().UTC().Add(-grace).Format("2006-01-02T15:04:05.000Z")
+	rows, err := s.db.Query(`SELECT id FROM plain_media WHERE `+unreferencedMediaCond+` ORDER BY id LIMIT ?`, cutoff, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// DeleteUnreferenced удаляет запись, если она всё ещё без ссылок и не тронута.
+// Возвращает удалённую запись — её блобы удаляет вызывающий.
+func (s *PlainMediaStore) DeleteUnreferenced(id int64, grace time.Duration) (*PlainMedia, bool, error) {
+	m, err := s.GetByID(id)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	cutoff := time.Now().UTC().Add(-grace).Format("2006-01-02T15:04:05.000Z")
+	res, err := s.db.Exec(`DELETE FROM plain_media WHERE id = ? AND `+unreferencedMediaCond, id, cutoff)
+	if err != nil {
+		return nil, false, err
+	}
+	n, err := res.RowsAffected()
+	return m, n == 1, err
+}
+
+// BlobInUse — ссылается ли на блоб ещё какая-нибудь запись (оригинал, миниатюра
+// или E2E-вложение: хранилище у них общее).
+func (s *PlainMediaStore) BlobInUse(key string) (bool, error) {
+	var n int64
 	err := s.db.QueryRow(`
-		SELECT id, kind, from_user_id, to_user_id, group_id,
-		       ciphertext, nonce, content_type, original_name, created_at
-		FROM plain_media WHERE id=?`, id,
-	).Scan(
-		&m.ID, &m.Kind, &m.FromUserID, &m.ToUserID, &m.GroupID,
-		&m.Ciphertext, &m.Nonce, &m.ContentType, &m.OriginalName, &m.CreatedAt,
-	)
+		SELECT (SELECT COUNT(*) FROM plain_media WHERE blob_key = ? OR thumb_blob_key = ?)
+		     + (SELECT COUNT(*) FROM e2e_media WHERE blob_key = ?)`, key, key, key).Scan(&n)
+	return n > 0, err
+}
+
+const plainMediaCols = `plain_media.id, public_id, kind, from_user_id, to_user_id, group_id,
+	COALESCE(blob_key, ''), blob_size, nonce, enc_version, dek_wrapped, dek_nonce, key_version,
+	content_type, original_name, size, width, height,
+	COALESCE(thumb_blob_key, ''), thumb_blob_size, thumb_nonce, thumb_content_type, content_hash,
+	duration_ms, waveform, plain_media.created_at`
+
+func (m *PlainMedia) scanDest() []any {
+	return []any{
+		&m.ID, &m.PublicID, &m.Kind, &m.FromUserID, &m.ToUserID, &m.GroupID,
+		&m.BlobKey, &m.BlobSize, &m.Nonce, &m.EncVersion, &m.DEKWrapped, &m.DEKNonce, &m.KeyVersion,
+		&m.ContentType, &m.OriginalName, &m.Size, &m.Width, &m.Height,
+		&m.ThumbBlobKey, &m.ThumbBlobSize, &m.ThumbNonce, &m.ThumbContentType, &m.ContentHash,
+		&m.DurationMS, &m.Waveform, &m.CreatedAt,
+	}
+}
+
+func (s *PlainMediaStore) getBy(column string, value any) (*PlainMedia, error) {
+	var m PlainMedia
+	err := s.db.QueryRow(`SELECT `+plainMediaCols+` FROM plain_media WHERE `+column+`=?`, value).Scan(m.scanDest()...)
 	if err != nil {
 		return nil, err
 	}
 	return &m, nil
-}
\ No newline at end of file
+}
+
+// ListSince — медиа, видимое пользователю (его личные переписки и беседы), с id > afterID.
+func (s *PlainMediaStore) ListSince(userID, afterID int64, limit int) ([]*PlainMedia, error) {
+	rows, err := s.db.Query(`SELECT `+plainMediaCols+` FROM plain_media
+		WHERE id > ?
+		  AND ((kind = 'direct' AND (from_user_id = ? OR to_user_id = ?))
+		    OR (kind = 'group' AND group_id IN (SELECT group_id FROM group_members WHERE user_id = ?)))
+		ORDER BY id LIMIT ?`,
+		afterID, userID, userID, userID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []*PlainMedia
+	for rows.Next() {
+		var m PlainMedia
+		if err := rows.Scan(m.scanDest()...); err != nil {
+			return nil, err
+		}
+		res = append(res, &m)
+	}
+	return res, rows.Err()
+}
+
+// ===== Вложения сообщений (message_attachments.go) =====
+
+type AttachmentStore struct{ db *sql.DB }
+
+func NewAttachmentStore(db *sql.DB) *AttachmentStore { return &AttachmentStore{db: db} }
+
+// ListFor — вложения сообщений по id (kind = direct | group), в порядке отправки.
+func (s *AttachmentStore) ListFor(kind string, messageIDs []int64) (map[int64][]*PlainMedia, error) {
+	out := map[int64][]*PlainMedia{}
+	// пачками: у SQLite ограничено число параметров запроса
+	for len(messageIDs) > 0 {
+		batch := messageIDs[:min(len(messageIDs), 500)]
+		messageIDs = messageIDs[len(batch):]
+
+		args := []any{kind}
+		for _, id := range batch {
+			args = append(args, id)
+		}
+		rows, err := s.db.Query(`
+			SELECT a.message_id, `+plainMediaCols+`
+			FROM message_attachments a
+			JOIN plain_media ON plain_media.id = a.media_id
+			WHERE a.message_kind = ? AND a.message_id IN (?`+strings.Repeat(",?", len(batch)-1)+`)
+			ORDER BY a.message_id, a.position`,
+			args...,
+		)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var messageID int64
+			var m PlainMedia
+			if err := rows.Scan(append([]any{&messageID}, m.scanDest()...)...); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			out[messageID] = append(out[messageID], &m)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// VisibleTo — приложено ли медиа к сообщению, которое видит пользователь: так
+// пересланное вложение открывается в беседе, куда его переслали (forward.go).
+func (s *AttachmentStore) VisibleTo(mediaID, userID int64) (bool, error) {
+	var one int
+	err := s.db.QueryRow(`
+		SELECT 1 FROM message_attachments a
+		LEFT JOIN plain_messages pm ON a.message_kind = 'direct' AND pm.id = a.message_id
+		LEFT JOIN group_messages gm ON a.message_kind = 'group' AND gm.id = a.message_id
+		WHERE a.media_id = ?
+		  AND ((pm.id IS NOT NULL AND (pm.from_user_id = ? OR pm.to_user_id = ?))
+		    OR (gm.id IS NOT NULL AND gm.group_id IN (SELECT group_id FROM group_members WHERE user_id = ?)))
+		LIMIT 1`,
+		mediaID, userID, userID, userID,
+	).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ===== Ответы (replies.go) =====
+
+// ReplyParent — то, что нужно для цитаты: автор и расшифрованный текст.
+type ReplyParent struct {
+	ID           int64
+	FromUserID   int64
+	FromUsername string
+	Text         string
+}
+
+// ReplyStore читает родителей ответов и число ответов одинаково для личных и
+// групповых сообщений (таблица — textTable).
+type ReplyStore struct {
+	db     *sql.DB
+	sealer *TextSealer
+}
+
+func NewReplyStore(db *sql.DB, sealer *TextSealer) *ReplyStore {
+	return &ReplyStore{db: db, sealer: sealer}
+}
+
+func (s *ReplyStore) Parents(t textTable, ids []int64) (map[int64]*ReplyParent, error) {
+	out := map[int64]*ReplyParent{}
+	for len(ids) > 0 {
+		batch := ids[:min(len(ids), 500)]
+		ids = ids[len(batch):]
+
+		args := make([]any, 0, len(batch))
+		for _, id := range batch {
+			args = append(args, id)
+		}
+		rows, err := s.db.Query(
+			`SELECT m.id, m.from_user_id, m.`+t.convCol+`, COALESCE(u.username, ''), m.text,
+			        m.text_ct, m.text_nonce, m.dek_wrapped, m.dek_nonce, m.key_version
+			 FROM `+t.name+` m
+			 LEFT JOIN users u ON u.id = m.from_user_id
+			 WHERE m.id IN (?`+strings.Repeat(",?", len(batch)-1)+`)`,
+			args...,
+		)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var p ReplyParent
+			var conv int64
+			var enc encryptedText
+			dest := append([]any{&p.ID, &p.FromUserID, &conv, &p.FromUsername, &p.Text}, enc.scanDest()...)
+			if err := rows.Scan(dest...); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if p.Text, err = s.sealer.openRow(t.kind, p.ID, p.FromUserID, conv, p.Text, &enc); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			out[p.ID] = &p
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// Counts — сколько ответов у каждого из сообщений.
+func (s *ReplyStore) Counts(t textTable, ids []int64) (map[int64]int, error) {
+	return countReplies(s.db, t.name, ids)
+}
+
+func countReplies(db *sql.DB, table string, ids []int64) (map[int64]int, error) {
+	out := map[int64]int{}
+	for len(ids) > 0 {
+		batch := ids[:min(len(ids), 500)]
+		ids = ids[len(batch):]
+
+		args := make([]any, 0, len(batch))
+		for _, id := range batch {
+			args = append(args, id)
+		}
+		rows, err := db.Query(
+			`SELECT reply_to, COUNT(*) FROM `+table+`
+			WHERE reply_to IN (?`+strings.Repeat(",?", len(batch)-1)+`)
+			GROUP BY reply_to`,
+			args...,
+		)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id int64
+			var n int
+			if err := rows.Scan(&id, &n); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			out[id] = n
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// ===== Реакции (reactions.go) =====
+
+type Reaction struct {
+	Emoji   string
+	UserIDs []int64 // в порядке, в котором ставили
+}
+
+// ReactionChange — у сообщения поменялись реакции (для /sync). FromUserID/ToUserID —
+// у лички, GroupID — у беседы.
+type ReactionChange struct {
+	ID         int64
+	Kind       string
+	MessageID  int64
+	FromUserID int64
+	ToUserID   int64
+	GroupID    int64
+}
+
+type ReactionStore struct{ db *sql.DB }
+
+func NewReactionStore(db *sql.DB) *ReactionStore { return &ReactionStore{db: db} }
+
+// Add ставит реакцию; false — такая уже стоит. Не больше maxReactionsPerUser
+// разных эмодзи от одного пользователя на сообщение.
+func (s *ReactionStore) Add(kind string, messageID, userID int64, emoji string) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var mine int
+	if err := tx.QueryRow(
+		`SELECT COUNT(*) FROM reactions WHERE message_kind = ? AND message_id = ? AND user_id = ?`,
+		kind, messageID, userID,
+	).Scan(&mine); err != nil {
+		return false, err
+	}
+	res, err := tx.Exec(
+		`INSERT OR IGNORE INTO reactions (message_kind, message_id, user_id, emoji) VALUES (?, ?, ?, ?)`,
+		kind, messageID, userID, emoji,
+	)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	if mine >= maxReactionsPerUser {
+		return false, ErrTooManyReactions
+	}
+	if err := logReactionChange(tx, kind, messageID); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// Remove снимает реакцию; false — её и не было.
+func (s *ReactionStore) Remove(kind string, messageID, userID int64, emoji string) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		`DELETE FROM reactions WHERE message_kind = ? AND message_id = ? AND user_id = ? AND emoji = ?`,
+		kind, messageID, userID, emoji,
+	)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	if err := logReactionChange(tx, kind, messageID); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func logReactionChange(tx *sql.Tx, kind string, messageID int64) error {
+	_, err := tx.Exec(`INSERT INTO reaction_log (message_kind, message_id) VALUES (?, ?)`, kind, messageID)
+	return err
+}
+
+// ListFor — реакции сообщений по id (kind = direct | group): эмодзи в порядке
+// первой реакции каждым.
+func (s *ReactionStore) ListFor(kind string, messageIDs []int64) (map[int64][]Reaction, error) {
+	out := map[int64][]Reaction{}
+	for len(messageIDs) > 0 {
+		batch := messageIDs[:min(len(messageIDs), 500)]
+		messageIDs = messageIDs[len(batch):]
+
+		args := []any{kind}
+		for _, id := range batch {
+			args = append(args, id)
+		}
+		rows, err := s.db.Query(`
+			SELECT message_id, emoji, user_id
+			FROM reactions
+			WHERE message_kind = ? AND message_id IN (?`+strings.Repeat(",?", len(batch)-1)+`)
+			ORDER BY message_id, created_at, user_id`,
+			args...,
+		)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var messageID, userID int64
+			var emoji string
+			if err := rows.Scan(&messageID, &emoji, &userID); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			list := out[messageID]
+			i := slices.IndexFunc(list, func(r Reaction) bool { return r.Emoji == emoji })
+			if i < 0 {
+				list = append(list, Reaction{Emoji: emoji})
+				i = len(list) - 1
+			}
+			list[i].UserIDs = append(list[i].UserIDs, userID)
+			out[messageID] = list
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// ChangedSince — изменения реакций на сообщения, которые видит пользователь, с id > afterID.
+func (s *ReactionStore) ChangedSince(userID, afterID int64, limit int) ([]ReactionChange, error) {
+	rows, err := s.db.Query(
+		`SELECT l.id, l.message_kind, l.message_id,
+		        COALESCE(pm.from_user_id, gm.from_user_id, 0), COALESCE(pm.to_user_id, 0), COALESCE(gm.group_id, 0)
+         FROM reaction_log l
+         LEFT JOIN plain_messages pm ON l.message_kind = 'direct' AND pm.id = l.message_id
+         LEFT JOIN group_messages gm ON l.message_kind = 'group' AND gm.id = l.message_id
+         WHERE l.id > ?
+           AND ((pm.id IS NOT NULL AND (pm.from_user_id = ? OR pm.to_user_id = ?))
+             OR (gm.id IS NOT NULL AND gm.group_id IN (SELECT group_id FROM group_members WHERE user_id = ?)))
+         ORDER BY l.id LIMIT ?`,
+		afterID, userID, userID, userID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []ReactionChange
+	for rows.Next() {
+		var c ReactionChange
+		if err := rows.Scan(&c.ID, &c.Kind, &c.MessageID, &c.FromUserID, &c.ToUserID, &c.GroupID); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// ===== Упоминания (mentions.go) =====
+
+// insertMentions — упоминания нового сообщения; вызывается в транзакции создания.
+// Явное упоминание важнее @all: у такой строки via_all = 0.
+func insertMentions(tx *sql.Tx, groupID, messageID, fromID int64, userIDs []int64, all bool) error {
+	if all {
+		if _, err := tx.Exec(
+			`INSERT OR IGNORE INTO mentions (message_id, user_id, group_id, via_all)
+             SELECT ?, user_id, ?, 1 FROM group_members WHERE group_id = ? AND user_id != ?`,
+			messageID, groupID, groupID, fromID,
+		); err != nil {
+			return err
+		}
+	}
+	for _, uid := range userIDs {
+		if uid == fromID {
+			continue
+		}
+		if _, err := tx.Exec(
+			`INSERT INTO mentions (message_id, user_id, group_id) VALUES (?, ?, ?)
+             ON CONFLICT (message_id, user_id) DO UPDATE SET via_all = 0`,
+			messageID, uid, groupID,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MessageMentions — кого упомянули в сообщении: по имени и было ли @all.
+type MessageMentions struct {
+	UserIDs []int64
+	All     bool
+}
+
+// Mention — упоминание пользователя для ленты.
+type Mention struct {
+	MessageID int64
+	GroupID   int64
+	ViaAll    bool
+	Read      bool
+}
+
+type MentionStore struct{ db *sql.DB }
+
+func NewMentionStore(db *sql.DB) *MentionStore { return &MentionStore{db: db} }
+
+// ListFor — упоминания в сообщениях по id (для DTO). @all берётся из самого
+// сообщения: строк с via_all может и не быть (в беседе никого, кроме автора, или
+// все упомянуты ещё и по имени).
+func (s *MentionStore) ListFor(messageIDs []int64) (map[int64]*MessageMentions, error) {
+	out := map[int64]*MessageMentions{}
+	for len(messageIDs) > 0 {
+		batch := messageIDs[:min(len(messageIDs), 500)]
+		messageIDs = messageIDs[len(batch):]
+
+		args := make([]any, 0, len(batch))
+		for _, id := range batch {
+			args = append(args, id)
+		}
+		rows, err := s.db.Query(
+			`SELECT gm.id, gm.mention_all, m.user_id
+			 FROM group_messages gm
+			 LEFT JOIN mentions m ON m.message_id = gm.id AND m.via_all = 0
+			 WHERE gm.id IN (?`+strings.Repeat(",?", len(batch)-1)+`)
+			   AND (gm.mention_all = 1 OR m.user_id IS NOT NULL)
+			 ORDER BY gm.id, m.user_id`,
+			args...,
+		)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var messageID int64
+			var all bool
+			var userID sql.NullInt64
+			if err := rows.Scan(&messageID, &all, &userID); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			mm := out[messageID]
+			if mm == nil {
+				mm = &MessageMentions{All: all}
+				out[messageID] = mm
+			}
+			if userID.Valid {
+				mm.UserIDs = append(mm.UserIDs, userID.Int64)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// Feed — упоминания пользователя, новые первыми, с id сообщения < beforeID (0 — с начала).
+// Упоминания из бесед, где он больше не состоит, не отдаются.
+func (s *MentionStore) Feed(userID, beforeID int64, unreadOnly bool, limit int) ([]Mention, error) {
+	if beforeID <= 0 {
+		beforeID = math.MaxInt64
+	}
+	rows, err := s.db.Query(
+		`SELECT m.message_id, m.group_id, m.via_all, m.read
+         FROM mentions m
+         JOIN group_members gm ON gm.group_id = m.group_id AND gm.user_id = m.user_id
+         WHERE m.user_id = ? AND m.message_id < ? AND (? = 0 OR m.read = 0)
+         ORDER BY m.message_id DESC LIMIT ?`,
+		userID, beforeID, unreadOnly, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Mention
+	for rows.Next() {
+		var m Mention
+		if err := rows.Scan(&m.MessageID, &m.GroupID, &m.ViaAll, &m.Read); err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+// UnreadCounts — непрочитанные упоминания по беседам.
+func (s *MentionStore) UnreadCounts(userID int64) (map[int64]int, error) {
+	rows, err := s.db.Query(
+		`SELECT m.group_id, COUNT(*)
+         FROM mentions m
+         JOIN group_members gm ON gm.group_id = m.group_id AND gm.user_id = m.user_id
+         WHERE m.user_id = ? AND m.read = 0
+         GROUP BY m.group_id`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[int64]int{}
+	for rows.Next() {
+		var groupID int64
+		var n int
+		if err := rows.Scan(&groupID, &n); err != nil {
+			return nil, err
+		}
+		out[groupID] = n
+	}
+	return out, rows.Err()
+}
+
+// MarkRead отмечает прочитанными упоминания в беседе до сообщения upTo включительно
+// (upTo = 0 — все). Возвращает, сколько отметил.
+func (s *MentionStore) MarkRead(userID, groupID, upTo int64) (int64, error) {
+	if upTo <= 0 {
+		upTo = math.MaxInt64
+	}
+	res, err := s.db.Exec(
+		`UPDATE mentions SET read = 1 WHERE user_id = ? AND group_id = ? AND message_id <= ? AND read = 0`,
+		userID, groupID, upTo,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ===== Опросы (polls.go) =====
+
+type Poll struct {
+	MessageID int64
+	GroupID   int64
+	Options   int // сколько вариантов
+	Multiple  bool
+	Anonymous bool
+	ClosesAt  string // RFC3339, "" — без срока
+	ClosedAt  string // закрыт вручную, "" — нет
+	Votes     map[int64][]int
+}
+
+// PollChange — в опросе проголосовали или его закрыли (для /sync).
+type PollChange struct {
+	ID        int64
+	MessageID int64
+}
+
+type PollStore struct{ db *sql.DB }
+
+func NewPollStore(db *sql.DB) *PollStore { return &PollStore{db: db} }
+
+// ListFor — опросы среди сообщений по id, с голосами (user_id -> варианты).
+func (s *PollStore) ListFor(messageIDs []int64) (map[int64]*Poll, error) {
+	out := map[int64]*Poll{}
+	for len(messageIDs) > 0 {
+		batch := messageIDs[:min(len(messageIDs), 500)]
+		messageIDs = messageIDs[len(batch):]
+
+		args := make([]any, 0, len(batch))
+		for _, id := range batch {
+			args = append(args, id)
+		}
+		in := `(?` + strings.Repeat(",?", len(batch)-1) + `)`
+		rows, err := s.db.Query(
+			`SELECT message_id, group_id, options, multiple, anonymous, COALESCE(closes_at, ''), COALESCE(closed_at, '')
+			 FROM polls WHERE message_id IN `+in,
+			args...,
+		)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			p := &Poll{Votes: map[int64][]int{}}
+			if err := rows.Scan(&p.MessageID, &p.GroupID, &p.Options, &p.Multiple, &p.Anonymous, &p.ClosesAt, &p.ClosedAt); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			out[p.MessageID] = p
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+
+		rows, err = s.db.Query(
+			`SELECT message_id, user_id, option FROM poll_votes WHERE message_id IN `+in+`
+			 ORDER BY message_id, created_at, user_id, option`,
+			args...,
+		)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var messageID, userID int64
+			var option int
+			if err := rows.Scan(&messageID, &userID, &option); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if p := out[messageID]; p != nil {
+				p.Votes[userID] = append(p.Votes[userID], option)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// Vote заменяет голос пользователя вариантами options (пустой — отозвать голос).
+// Варианты уже проверены; закрытость опроса проверяется здесь же, в транзакции.
+func (s *PollStore) Vote(messageID, userID int64, options []int, now time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var closesAt, closedAt string
+	err = tx.QueryRow(`SELECT COALESCE(closes_at, ''), COALESCE(closed_at, '') FROM polls WHERE message_id = ?`, messageID).
+		Scan(&closesAt, &closedAt)
+	if err == sql.ErrNoRows {
+		return ErrNotAPoll
+	}
+	if err != nil {
+		return err
+	}
+	if pollClosed(closesAt, closedAt, now) {
+		return ErrPollClosed
+	}
+
+	if _, err := tx.Exec(`DELETE FROM poll_votes WHERE message_id = ? AND user_id = ?`, messageID, userID); err != nil {
+		return err
+	}
+	for _, o := range options {
+		if _, err := tx.Exec(`INSERT INTO poll_votes (message_id, user_id, option) VALUES (?, ?, ?)`, messageID, userID, o); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`INSERT INTO poll_log (message_id) VALUES (?)`, messageID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Close закрывает опрос; false — уже был закрыт вручную.
+func (s *PollStore) Close(messageID int64) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		`UPDATE polls SET closed_at = strftime('%Y-%m-%dT%H:%M:%SZ','now') WHERE message_id = ? AND closed_at IS NULL`,
+		messageID,
+	)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	if _, err := tx.Exec(`INSERT INTO poll_log (message_id) VALUES (?)`, messageID); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// ChangedSince — изменения опросов в беседах пользователя с id > afterID.
+func (s *PollStore) ChangedSince(userID, afterID int64, limit int) ([]PollChange, error) {
+	rows, err := s.db.Query(
+		`SELECT l.id, l.message_id
+         FROM poll_log l
+         JOIN polls p ON p.message_id = l.message_id
+         WHERE l.id > ? AND p.group_id IN (SELECT group_id FROM group_members WHERE user_id = ?)
+         ORDER BY l.id LIMIT ?`,
+		afterID, userID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []PollChange
+	for rows.Next() {
+		var c PollChange
+		if err := rows.Scan(&c.ID, &c.MessageID); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// ===== Закреплённые сообщения (pins.go) =====
+
+type Pin struct {
+	Kind      string
+	MessageID int64
+	Position  int64
+	PinnedBy  int64
+	PinnedAt  string
+}
+
+type PinStore struct{ db *sql.DB }
+
+func NewPinStore(db *sql.DB) *PinStore { return &PinStore{db: db} }
+
+// Pin закрепляет сообщение в беседе scope наверху списка; уже закреплённое
+// поднимается наверх. Не больше maxPins закреплённых на беседу.
+func (s *PinStore) Pin(kind string, messageID int64, scope string, userID int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var count, top int64
+	var pinned bool
+	if err := tx.QueryRow(
+		`SELECT COUNT(*), COALESCE(MAX(position), 0), COALESCE(MAX(message_kind = ? AND message_id = ?), 0)
+         FROM pinned_messages WHERE scope = ?`,
+		kind, messageID, scope,
+	).Scan(&count, &top, &pinned); err != nil {
+		return err
+	}
+	if !pinned && count >= maxPins {
+		return ErrTooManyPins
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO pinned_messages (message_kind, message_id, scope, position, pinned_by) VALUES (?, ?, ?, ?, ?)
+         ON CONFLICT (message_kind, message_id) DO UPDATE
+         SET position = excluded.position, pinned_by = excluded.pinned_by,
+             pinned_at = strftime('%Y-%m-%dT%H:%M:%fZ','now')`,
+		kind, messageID, scope, top+1, userID,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Unpin открепляет; false — и не было закреплено.
+func (s *PinStore) Unpin(kind string, messageID int64) (bool, error) {
+	res, err := s.db.Exec(
+		`DELETE FROM pinned_messages WHERE message_kind = ? AND message_id = ?`,
+		kind, messageID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// List — закреплённые в беседе, последнее закреплённое первым.
+func (s *PinStore) List(scope string) ([]Pin, error) {
+	rows, err := s.db.Query(
+		`SELECT message_kind, message_id, position, pinned_by, pinned_at
+         FROM pinned_messages WHERE scope = ?
+         ORDER BY position DESC`,
+		scope,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Pin
+	for rows.Next() {
+		var p Pin
+		if err := rows.Scan(&p.Kind, &p.MessageID, &p.Position, &p.PinnedBy, &p.PinnedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// ===== Отложенные сообщения (scheduled.go) =====
+
+type ScheduledMessage struct {
+	ID          int64
+	Kind        string // direct | group
+	FromUserID  int64
+	ConvID      int64    // to_user_id | group_id
+	Text        string   // открытый: шифруется при Create, расшифровывается при чтении
+	Attachments []string // public_id медиа — только для Create
+	ReplyTo     int64
+	SendAt      string // UTC, time.RFC3339
+	Status      string // pending | sending | sent | failed | canceled
+	MessageID   int64  // отправленное сообщение (status = sent)
+	Error       string // почему не отправилось (status = failed)
+	CreatedAt   string
+}
+
+// Текст хранится зашифрованным, как у сообщений; вложения — в message_attachments
+// с message_kind = scheduled, чтобы GC не удалил медиа до отправки.
+type ScheduledStore struct {
+	db     *sql.DB
+	sealer *TextSealer
+}
+
+func NewScheduledStore(db *sql.DB, sealer *TextSealer) *ScheduledStore {
+	return &ScheduledStore{db: db, sealer: sealer}
+}
+
+// Create проверяет ответ и вложения так же, как отправка сообщения, но в
+// беседе, куда оно уйдёт; у отправителя не больше maxPendingScheduled ожидающих.
+func (s *ScheduledStore) Create(m *ScheduledMessage) (*ScheduledMessage, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var pending int
+	if err := tx.QueryRow(
+		`SELECT COUNT(*) FROM scheduled_messages WHERE from_user_id = ? AND status IN ('pending', 'sending')`,
+		m.FromUserID,
+	).Scan(&pending); err != nil {
+		return nil, err
+	}
+	if pending >= maxPendingScheduled {
+		return nil, ErrTooManyScheduled
+	}
+
+	target := plainMessagesTable
+	if m.Kind == groupMessagesTable.kind {
+		target = groupMessagesTable
+	}
+	scope := conversationScope(m.Kind, m.FromUserID, m.ConvID)
+	if err := checkReplyParent(tx, target, m.ReplyTo, scope); err != nil {
+		return nil, err
+	}
+	res, err := tx.Exec(
+		`INSERT INTO scheduled_messages (kind, from_user_id, conv_id, text, reply_to, send_at)
+         VALUES (?, ?, ?, '', ?, ?)`,
+		m.Kind, m.FromUserID, m.ConvID, nullID(m.ReplyTo), m.SendAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := s.sealer.Seal(scheduledMessagesTable.kind, id, m.FromUserID, m.ConvID, m.Text)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(
+		`UPDATE scheduled_messages SET text_ct = ?, text_nonce = ?, dek_wrapped = ?, dek_nonce = ?, key_version = ? WHERE id = ?`,
+		env.Ciphertext, env.Nonce, env.WrappedKey, env.WrapNonce, env.KeyVersion, id,
+	); err != nil {
+		return nil, err
+	}
+	if err := attachMedia(tx, scheduledMessagesTable.kind, id, scope, m.Attachments); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	out, err := s.ListByIDs([]int64{id})
+	if err != nil {
+		return nil, err
+	}
+	if len(out) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return out[0], nil
+}
+
+const scheduledCols = `id, kind, from_user_id, conv_id, text, ` + encryptedTextCols + `, COALESCE(reply_to, 0),
+                send_at, status, COALESCE(message_id, 0), COALESCE(error, ''), created_at`
+
+func (s *ScheduledStore) query(q string, args ...any) ([]*ScheduledMessage, error) {
+	rows, err := s.db.Query(`SELECT `+scheduledCols+` FROM scheduled_messages `+q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []*ScheduledMessage
+	for rows.Next() {
+		var m ScheduledMessage
+		var enc encryptedText
+		dest := append([]any{&m.ID, &m.Kind, &m.FromUserID, &m.ConvID, &m.Text}, enc.scanDest()...)
+		dest = append(dest, &m.ReplyTo, &m.SendAt, &m.Status, &m.MessageID, &m.Error, &m.CreatedAt)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		text, err := s.sealer.openRow(scheduledMessagesTable.kind, m.ID, m.FromUserID, m.ConvID, m.Text, &enc)
+		if err != nil {
+			return nil, err
+		}
+		m.Text = text
+		out = append(out, &m)
+	}
+	return out, rows.Err()
+}
+
+func (s *ScheduledStore) ListByIDs(ids []int64) ([]*ScheduledMessage, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	args := make([]any, 0, len(ids))
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	return s.query(`WHERE id IN (?`+strings.Repeat(",?", len(ids)-1)+`) ORDER BY id`, args...)
+}
+
+// ListByUser — отложенные пользователем: ожидающие по времени отправки, а с
+// all — все, последние созданные первыми. kind и convID (если заданы) — одна беседа.
+func (s *ScheduledStore) ListByUser(userID int64, kind string, convID int64, all bool, limit int) ([]*ScheduledMessage, error) {
+	q := `WHERE from_user_id = ?`
+	args := []any{userID}
+	if kind != "" {
+		q += ` AND kind = ? AND conv_id = ?`
+		args = append(args, kind, convID)
+	}
+	if all {
+		q += ` ORDER BY id DESC`
+	} else {
+		q += ` AND status IN ('pending', 'sending') ORDER BY send_at, id`
+	}
+	return s.query(q+` LIMIT ?`, append(args, limit)...)
+}
+
+// Due — ожидающие, чьё время отправки наступило к now.
+func (s *ScheduledStore) Due(now time.Time, limit int) ([]*ScheduledMessage, error) {
+	return s.query(`WHERE status = 'pending' AND send_at <= ? ORDER BY send_at, id LIMIT ?`,
+		now.UTC().Format(time.RFC3339), limit)
+}
+
+// Claim переводит ожидающее в sending; false — его успели отменить.
+func (s *ScheduledStore) Claim(id int64) (bool, error) {
+	res, err := s.db.Exec(`UPDATE scheduled_messages SET status = 'sending' WHERE id = ? AND status = 'pending'`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Release возвращает взятое в pending — отправить не вышло по нашей вине (база).
+func (s *ScheduledStore) Release(id int64) error {
+	_, err := s.db.Exec(`UPDATE scheduled_messages SET status = 'pending' WHERE id = ? AND status = 'sending'`, id)
+	return err
+}
+
+// MarkSent и MarkFailed завершают отправку; вложения отложенного больше не
+// держат медиа (у отправленного они уже свои).
+func (s *ScheduledStore) MarkSent(id, messageID int64) error {
+	return s.finish(id, `status = 'sent', message_id = ?`, messageID)
+}
+
+func (s *ScheduledStore) MarkFailed(id int64, reason string) error {
+	return s.finish(id, `status = 'failed', error = ?`, reason)
+}
+
+func (s *ScheduledStore) finish(id int64, set string, arg any) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE scheduled_messages SET `+set+` WHERE id = ? AND status = 'sending'`, arg, id); err != nil {
+		return err
+	}
+	if err := deleteScheduledAttachments(tx, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Cancel отменяет ожидающее сообщение автора; false — нет такого или уже отправляется.
+func (s *ScheduledStore) Cancel(id, userID int64) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		`UPDATE scheduled_messages SET status = 'canceled' WHERE id = ? AND from_user_id = ? AND status = 'pending'`,
+		id, userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if err := deleteScheduledAttachments(tx, id); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// FailInterrupted — при старте: сообщения, застрявшие в sending, сервер мог
+// успеть отправить перед остановкой; повторять их нельзя, чтобы не задвоить.
+func (s *ScheduledStore) FailInterrupted() (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		DELETE FROM message_attachments WHERE message_kind = ?
+		  AND message_id IN (SELECT id FROM scheduled_messages WHERE status = 'sending')`,
+		scheduledMessagesTable.kind,
+	); err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(`UPDATE scheduled_messages SET status = 'failed', error = ? WHERE status = 'sending'`,
+		errScheduleInterrupted)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+func deleteScheduledAttachments(tx *sql.Tx, id int64) error {
+	_, err := tx.Exec(`DELETE FROM message_attachments WHERE message_kind = ? AND message_id = ?`,
+		scheduledMessagesTable.kind, id)
+	return err
+}
+
+// ===== Загрузки по частям =====
+
+type MediaUpload struct {
+	ID            string
+	Kind          string
+	FromUserID    int64
+	ToUserID      sql.NullInt64
+	GroupID       sql.NullInt64
+	OriginalName  string
+	ContentType   string
+	Size          int64
+	Received      int64
+	StagedLen     int64
+	KeyWrapped    []byte
+	KeyNonce      []byte
+	KeyVersion    uint32
+	MediaPublicID sql.NullString
+	CreatedAt     string
+	UpdatedAt     string
+}
+
+type MediaUploadStore struct{ db *sql.DB }
+
+func NewMediaUploadStore(db *sql.DB) *MediaUploadStore { return &MediaUploadStore{db: db} }
+
+// Create резервирует место: заявленный размер входит в занятое с момента вставки.
+func (s *MediaUploadStore) Create(u *MediaUpload, charge quotaCharge) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		INSERT INTO media_uploads
+		(id, kind, from_user_id, to_user_id, group_id, original_name, content_type, size, key_wrapped, key_nonce, key_version)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?)`,
+		u.ID, u.Kind, u.FromUserID, u.ToUserID, u.GroupID, u.OriginalName, u.ContentType, u.Size,
+		u.KeyWrapped, u.KeyNonce, u.KeyVersion,
+	); err != nil {
+		return err
+	}
+	if err := charge(tx, u.FromUserID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *MediaUploadStore) GetByID(id string) (*MediaUpload, error) {
+	var u MediaUpload
+	err := s.db.QueryRow(`
+		SELECT id, kind, from_user_id, to_user_id, group_id, original_name, content_type, size,
+		       received, staged_len, key_wrapped, key_nonce, key_version, media_public_id, created_at, updated_at
+		FROM media_uploads WHERE id = ?`, id,
+	).Scan(
+		&u.ID, &u.Kind, &u.FromUserID, &u.ToUserID, &u.GroupID, &u.OriginalName, &u.ContentType, &u.Size,
+		&u.Received, &u.StagedLen, &u.KeyWrapped, &u.KeyNonce, &u.KeyVersion, &u.MediaPublicID, &u.CreatedAt, &u.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// Advance фиксирует принятую часть; условие по received — защита от двух
+// одновременных PUT с одним offset: второй ничего не обновит.
+func (s *MediaUploadStore) Advance(id string, fromReceived, received, stagedLen int64) (bool, error) {
+	res, err := s.db.Exec(`
+		UPDATE media_uploads
+		SET received = ?, staged_len = ?, updated_at = strftime('%Y-%m-%dT%H:%M:%fZ','now')
+		WHERE id = ? AND received = ? AND media_public_id IS NULL`,
+		received, stagedLen, id, fromReceived,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// ClaimFinalize закрепляет за загрузкой будущий public_id медиа. Удаётся только
+// одному из параллельных finalize и только когда файл принят целиком.
+func (s *MediaUploadStore) ClaimFinalize(id, mediaPublicID string) (bool, error) {
+	res, err := s.db.Exec(`
+		UPDATE media_uploads SET media_public_id = ?, updated_at = strftime('%Y-%m-%dT%H:%M:%fZ','now')
+		WHERE id = ? AND media_public_id IS NULL AND received = size`, mediaPublicID, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// SetMediaPublicID — finalize нашёл дубликат: загрузка указывает на уже существующее медиа.
+func (s *MediaUploadStore) SetMediaPublicID(id, mediaPublicID string) error {
+	_, err := s.db.Exec(`UPDATE media_uploads SET media_public_id = ? WHERE id = ?`, mediaPublicID, id)
+	return err
+}
+
+// ReleaseFinalize — finalize не удался, загрузку можно завершить ещё раз.
+func (s *MediaUploadStore) ReleaseFinalize(id string) error {
+	_, err := s.db.Exec(`UPDATE media_uploads SET media_public_id = NULL WHERE id = ?`, id)
+	return err
+}
+
+// PendingBytes — заявленный размер незавершённых загрузок пользователя.
+func (s *MediaUploadStore) PendingBytes(userID int64) (int64, error) {
+	var n int64
+	err := s.db.QueryRow(`SELECT COALESCE(SUM(size), 0) FROM media_uploads WHERE from_user_id = ? AND media_public_id IS NULL`, userID).Scan(&n)
+	return n, err
+}
+
+// ListStale — загрузки, которых не трогали дольше maxAge (и завершённые, и брошенные).
+func (s *MediaUploadStore) ListStale(maxAge time.Duration) ([]string, error) {
+	cutoff := time.Now().UTC().Add(-maxAge).Format("2006-01-02T15:04:05.000Z")
+	rows, err := s.db.Query(`SELECT id FROM media_uploads WHERE updated_at < ?`, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *MediaUploadStore) Delete(id string) error {
+	_, err := s.db.Exec(`DELETE FROM media_uploads WHERE id = ?`, id)
+	return err
+}
+
+// ===== E2E-вложения (CLI): только шифртекст, сервер ключа не знает =====
+
+type E2EMedia struct {
+	ID         int64
+	FromUserID int64
+	ToUserID   int64
+	BlobKey    string // шифртекст в BlobStore
+	Size       int64
+	CreatedAt  string
+}
+
+type E2EMediaStore struct{ db *sql.DB }
+
+func NewE2EMediaStore(db *sql.DB) *E2EMediaStore { return &E2EMediaStore{db: db} }
+
+// Create — размер вложения записывается отправителю в квоту в той же транзакции.
+func (s *E2EMediaStore) Create(m *E2EMedia, charge quotaCharge) (*E2EMedia, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		`INSERT INTO e2e_media (from_user_id, to_user_id, blob, blob_key, size) VALUES (?, ?, x'', ?, ?)`,
+		m.FromUserID, m.ToUserID, m.BlobKey, m.Size,
+	)
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	if err := charge(tx, m.FromUserID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	m.ID = id
+	return m, nil
+}
+
+// UsageByUser — сколько байт и файлов пользователь отправил через E2E-вложения.
+func (s *E2EMediaStore) UsageByUser(userID int64) (int64, int64, error) {
+	var bytes, files int64
+	err := s.db.QueryRow(`SELECT COALESCE(SUM(size), 0), COUNT(*) FROM e2e_media WHERE from_user_id = ?`, userID).Scan(&bytes, &files)
+	return bytes, files, err
+}
+
+func (s *E2EMediaStore) GetByID(id int64) (*E2EMedia, error) {
+	var m E2EMedia
+	err := s.db.QueryRow(
+		`SELECT id, from_user_id, to_user_id, COALESCE(blob_key, ''), size, created_at FROM e2e_media WHERE id = ?`, id,
+	).Scan(&m.ID, &m.FromUserID, &m.ToUserID, &m.BlobKey, &m.Size, &m.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// ListInline — записи, чей шифртекст ещё лежит в самой таблице (до переноса в BlobStore).
+func (s *E2EMediaStore) ListInline(limit int) ([]inlineMedia, error) {
+	rows, err := s.db.Query(`SELECT id, blob FROM e2e_media WHERE blob_key IS NULL ORDER BY id LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []inlineMedia
+	for rows.Next() {
+		var im inlineMedia
+		if err := rows.Scan(&im.ID, &im.Ciphertext); err != nil {
+			return nil, err
+		}
+		out = append(out, im)
+	}
+	return out, rows.Err()
+}
+
+func (s *E2EMediaStore) SetBlob(id int64, key string) error {
+	_, err := s.db.Exec(`UPDATE e2e_media SET blob_key = ?, blob = x'' WHERE id = ?`, key, id)
+	return err
+}
+
+// ===== Синхронизация (sync.go) =====
+
+type SyncStore struct{ db *sql.DB }
+
+func NewSyncStore(db *sql.DB) *SyncStore { return &SyncStore{db: db} }
+
+// Head — текущие максимальные id: с этого места клиент без токена начинает получать дельту.
+func (s *SyncStore) Head() (SyncCursor, error) {
+	var c SyncCursor
+	err := s.db.QueryRow(`SELECT
+		(SELECT COALESCE(MAX(id), 0) FROM plain_messages),
+		(SELECT COALESCE(MAX(id), 0) FROM group_messages),
+		(SELECT COALESCE(MAX(id), 0) FROM messages),
+		(SELECT COALESCE(MAX(id), 0) FROM group_member_log),
+		(SELECT COALESCE(MAX(id), 0) FROM plain_media),
+		(SELECT COALESCE(MAX(id), 0) FROM reaction_log),
+		(SELECT COALESCE(MAX(id), 0) FROM poll_log)`,
+	).Scan(&c.Direct, &c.Group, &c.E2E, &c.Members, &c.Media, &c.Reactions, &c.Polls)
+	return c, err
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ===== Синхронизация: /sync (long-poll) и тот же поток как text/event-stream =====
+//
+// Токен синхронизации — позиция клиента в каждой ленте: id последних отданных
+// личных, групповых и E2E-сообщений, записей group_member_log, медиа, reaction_log и poll_log. /sync отдаёт
+// только то, что появилось после токена, и новый токен. Если нового нет, запрос
+// висит до timeout и просыпается, как только что-нибудь запишут (syncHub).
+//
+// Без токена ответ приходит сразу, пустой, с токеном «на сейчас»: историю клиент
+// берёт обычными запросами один раз, дальше живёт на дельтах. Токен привязан к
+// пользователю — чужой токен отклоняется.
+
+const (
+	syncBatch          = 200 // максимум записей каждого вида в одном ответе
+	syncDefaultTimeout = 25 * time.Second
+	syncMaxTimeout     = 60 * time.Second
+	syncHeartbeat      = 15 * time.Second // комментарий в event-stream, чтобы прокси не рвали соединение
+)
+
+var ErrBadSyncToken = errors.New("bad sync token")
+
+type SyncCursor struct {
+	Direct    int64 // plain_messages
+	Group     int64 // group_messages
+	E2E       int64 // messages
+	Members   int64 // group_member_log
+	Media     int64 // plain_media
+	Reactions int64 // reaction_log; -1 — токен выдан до реакций, начать с текущего места
+	Polls     int64 // poll_log; -1 — как у Reactions
+}
+
+func (c SyncCursor) token(userID int64) string {
+	raw := fmt.Sprintf("%d.%d.%d.%d.%d.%d.%d.%d", userID, c.Direct, c.Group, c.E2E, c.Members, c.Media, c.Reactions, c.Polls)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseSyncToken(token string, userID int64) (SyncCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return SyncCursor{}, ErrBadSyncToken
+	}
+	parts := strings.Split(string(raw), ".")
+	if len(parts) == 6 {
+		parts = append(parts, "-1") // старый токен, без ленты реакций
+	}
+	if len(parts) == 7 {
+		parts = append(parts, "-1") // без ленты опросов
+	}
+	if len(parts) != 8 {
+		return SyncCursor{}, ErrBadSyncToken
+	}
+	var v [8]int64
+	for i, p := range parts {
+		n, err := strconv.ParseInt(p, 10, 64)
+		if err != nil || (n < 0 && !(i >= 6 && n == -1)) {
+			return SyncCursor{}, ErrBadSyncToken
+		}
+		v[i] = n
+	}
+	if v[0] != userID {
+		return SyncCursor{}, ErrBadSyncToken // выдан другому пользователю
+	}
+	return SyncCursor{Direct: v[1], Group: v[2], E2E: v[3], Members: v[4], Media: v[5], Reactions: v[6], Polls: v[7]}, nil
+}
+
+// syncHub будит ждущие /sync после любой записи. Будятся все: каждый сам проверяет
+// по базе, есть ли что-то для него, — при размерах этого чата это проще и дешевле,
+// чем считать адресатов каждой записи.
+type syncHub struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func newSyncHub() *syncHub { return &syncHub{ch: make(chan struct{})} }
+
+// changed — канал, который закроется при следующей записи. Брать его надо до
+// чтения дельты, иначе запись между чтением и ожиданием потеряется.
+func (h *syncHub) changed() <-chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.ch
+}
+
+func (h *syncHub) notify() {
+	h.mu.Lock()
+	close(h.ch)
+	h.ch = make(chan struct{})
+	h.mu.Unlock()
+}
+
+// syncDelta — всё, что пользователь ещё не видел после cur, и новая позиция.
+// Курсор каждой ленты сдвигается на последний отданный id; если какая-то лента
+// упёрлась в syncBatch, в ответе More — клиенту надо спросить ещё раз сразу.
+func (s *Server) syncDelta(userID int64, cur SyncCursor) (*SyncResponse, SyncCursor, error) {
+	resp := &SyncResponse{}
+
+	direct, err := s.plainMessages.ListSince(userID, cur.Direct, syncBatch)
+	if err != nil {
+		return nil, cur, err
+	}
+	if len(direct) > 0 {
+		cur.Direct = direct[len(direct)-1].ID
+		if resp.Direct, err = s.chatMessageDTOs(direct); err != nil {
+			return nil, cur, err
+		}
+	}
+
+	group, err := s.groupMessages.ListSince(userID, cur.Group, syncBatch)
+	if err != nil {
+		return nil, cur, err
+	}
+	if len(group) > 0 {
+		cur.Group = group[len(group)-1].ID
+		if resp.Group, err = s.groupMessageDTOs(group, pollViewer{userID: userID}); err != nil {
+			return nil, cur, err
+		}
+	}
+
+	e2e, err := s.messages.ListSince(userID, cur.E2E, syncBatch)
+	if err != nil {
+		return nil, cur, err
+	}
+	for _, m := range e2e {
+		cur.E2E = m.ID
+		resp.E2E = append(resp.E2E, messageDTO(m))
+	}
+
+	members, err := s.groupMembers.ListAddedSince(userID, cur.Members, syncBatch)
+	if err != nil {
+		return nil, cur, err
+	}
+	for _, e := range members {
+		cur.Members = e.ID
+		resp.Members = append(resp.Members, SyncMemberDTO{
+			GroupID:   e.GroupID,
+			GroupName: e.GroupName,
+			UserID:    e.UserID,
+			Username:  e.Username,
+			CreatedAt: e.CreatedAt,
+		})
+	}
+
+	media, err := s.plainMedia.ListSince(userID, cur.Media, syncBatch)
+	if err != nil {
+		return nil, cur, err
+	}
+	for _, m := range media {
+		cur.Media = m.ID
+		resp.Media = append(resp.Media, syncMediaDTO(m))
+	}
+
+	reactions, err := s.reactions.ChangedSince(userID, cur.Reactions, syncBatch)
+	if err != nil {
+		return nil, cur, err
+	}
+	if len(reactions) > 0 {
+		cur.Reactions = reactions[len(reactions)-1].ID
+		if resp.Reactions, err = s.syncReactionDTOs(reactions); err != nil {
+			return nil, cur, err
+		}
+	}
+
+	polls, err := s.polls.ChangedSince(userID, cur.Polls, syncBatch)
+	if err != nil {
+		return nil, cur, err
+	}
+	if len(polls) > 0 {
+		cur.Polls = polls[len(polls)-1].ID
+		if resp.Polls, err = s.syncPollDTOs(polls, pollViewer{userID: userID}); err != nil {
+			return nil, cur, err
+		}
+	}
+
+	resp.More = len(direct) == syncBatch || len(group) == syncBatch || len(e2e) == syncBatch ||
+		len(members) == syncBatch || len(media) == syncBatch || len(reactions) == syncBatch || len(polls) == syncBatch
+	resp.Token = cur.token(userID)
+	return resp, cur, nil
+}
+
+// syncReactionDTOs — по сообщению на каждое изменённое (повторы схлопываются),
+// с актуальным списком реакций.
+func (s *Server) syncReactionDTOs(changes []ReactionChange) ([]SyncReactionDTO, error) {
+	ids := map[string][]int64{}
+	seen := map[ReactionChange]bool{}
+	var uniq []ReactionChange
+	for _, c := range changes {
+		key := ReactionChange{Kind: c.Kind, MessageID: c.MessageID}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		uniq = append(uniq, c)
+		ids[c.Kind] = append(ids[c.Kind], c.MessageID)
+	}
+
+	current := map[string]map[int64][]Reaction{}
+	for kind, list := range ids {
+		r, err := s.reactions.ListFor(kind, list)
+		if err != nil {
+			return nil, err
+		}
+		current[kind] = r
+	}
+
+	out := make([]SyncReactionDTO, 0, len(uniq))
+	for _, c := range uniq {
+		list := reactionDTOs(current[c.Kind][c.MessageID])
+		if list == nil {
+			list = []ReactionDTO{} // реакции сняли все — клиенту нужен пустой список, не null
+		}
+		out = append(out, SyncReactionDTO{
+			Conversation: c.Kind,
+			MessageID:    c.MessageID,
+			FromUserID:   c.FromUserID,
+			ToUserID:     c.ToUserID,
+			GroupID:      c.GroupID,
+			Reactions:    list,
+		})
+	}
+	return out, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+func rawSyncToken(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+
+func TestSyncTokenRoundTrip(t *testing.T) {
+	cur := SyncCursor{Direct: 1, Group: 2, E2E: 3, Members: 4, Media: 5, Reactions: 6, Polls: 7}
+	got, err := parseSyncToken(cur.token(42), 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != cur {
+		t.Fatalf("got %+v", got)
+	}
+}
+
+func TestParseSyncToken(t *testing.T) {
+	cases := []struct {
+		name  string
+		token string
+		want  SyncCursor
+	}{
+		// выданы до ленты реакций и до ленты опросов: недостающие — с текущего места
+		{"6 fields", rawSyncToken("42.1.2.3.4.5"), SyncCursor{1, 2, 3, 4, 5, -1, -1}},
+		{"7 fields", rawSyncToken("42.1.2.3.4.5.6"), SyncCursor{1, 2, 3, 4, 5, 6, -1}},
+		{"7 fields, reactions pending", rawSyncToken("42.1.2.3.4.5.-1"), SyncCursor{1, 2, 3, 4, 5, -1, -1}},
+		{"8 fields", rawSyncToken("42.1.2.3.4.5.6.7"), SyncCursor{1, 2, 3, 4, 5, 6, 7}},
+		{"zeros", SyncCursor{}.token(42), SyncCursor{}},
+	}
+	for _, c := range cases {
+		got, err := parseSyncToken(c.token, 42)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%s: got %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestParseSyncTokenRejects(t *testing.T) {
+	cases := map[string]string{
+		"other user":           SyncCursor{Direct: 1}.token(43),
+		"other user, old form": rawSyncToken("43.1.2.3.4.5"),
+		"negative user":        rawSyncToken("-42.1.2.3.4.5.6.7"),
+		"negative direct":      rawSyncToken("42.-1.2.3.4.5.6.7"),
+		"negative group":       rawSyncToken("42.1.-5.3.4.5.6.7"),
+		"negative media":       rawSyncToken("42.1.2.3.4.-1.6.7"),
+		"reactions below -1":   rawSyncToken("42.1.2.3.4.5.-2.7"),
+		"polls below -1":       rawSyncToken("42.1.2.3.4.5.6.-9"),
+		"too few fields":       rawSyncToken("42.1.2.3.4"),
+		"too many fields":      rawSyncToken("42.1.2.3.4.5.6.7.8"),
+		"empty field":          rawSyncToken("42.1..3.4.5.6.7"),
+		"not a number":         rawSyncToken("42.1.2.x.4.5.6.7"),
+		"overflow":             rawSyncToken("42.1.2.3.4.5.6.99999999999999999999"),
+		"garbage base64":       "!!!not-base64!!!",
+		"padded base64":        base64.URLEncoding.EncodeToString([]byte("42.1.2.3.4.5.6.7")),
+		"base64 of garbage":    rawSyncToken("\x00\xff\xfe"),
+		"empty":                "",
+	}
+	for name, token := range cases {
+		if _, err := parseSyncToken(token, 42); !errors.Is(err, ErrBadSyncToken) {
+			t.Errorf("%s: got %v, want ErrBadSyncToken", name, err)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ===== «Печатает…» =====
+//
+// Живёт только в памяти: в базу не пишется и last_seen не трогает. Клиент, пока
+// человек набирает текст, раз в пару секунд шлёт POST /typing; запись живёт
+// typingTTL и пропадает сама, если клиент замолчал (закрыл вкладку, пропала сеть).
+// Отправка сообщения и typing=false убирают её сразу.
+//
+// Доставка: в event-stream /sync — событие «typing» со всеми, кто сейчас печатает
+// в беседах пользователя; без event-stream — лёгкий опрос GET /typing.
+
+const typingTTL = 6 * time.Second
+
+type typingKey struct {
+	kind   string // direct | group
+	convID int64  // to_user_id для лички, group_id для беседы
+	fromID int64
+}
+
+type typingEntry struct {
+	typingKey
+	username string
+	expires  time.Time
+}
+
+type typingRegistry struct {
+	mu      sync.Mutex
+	entries map[typingKey]typingEntry
+	updates *syncHub // будит event-stream, когда кто-то начал или перестал печатать
+}
+
+func newTypingRegistry() *typingRegistry {
+	return &typingRegistry{entries: make(map[typingKey]typingEntry), updates: newSyncHub()}
+}
+
+// set начинает (или продлевает) либо снимает «печатает». Продление тоже будит
+// ждущих: клиенты гасят индикатор по expires_in_ms и должны узнать новый срок.
+func (t *typingRegistry) set(key typingKey, username string, typing bool) {
+	now := time.Now()
+	t.mu.Lock()
+	old, had := t.entries[key]
+	had = had && now.Before(old.expires)
+	if typing {
+		t.entries[key] = typingEntry{typingKey: key, username: username, expires: now.Add(typingTTL)}
+	} else {
+		delete(t.entries, key)
+	}
+	t.mu.Unlock()
+
+	if typing || had {
+		t.updates.notify()
+	}
+}
+
+// visibleTo — кто сейчас печатает пользователю в личку или в его беседах
+// (groups — id бесед, где он участник). Сам пользователь в списке не бывает.
+// Заодно выкидывает протухшие записи.
+func (t *typingRegistry) visibleTo(userID int64, groups map[int64]bool) []typingEntry {
+	now := time.Now()
+	t.mu.Lock()
+	var out []typingEntry
+	for k, e := range t.entries {
+		if !now.Before(e.expires) {
+			delete(t.entries, k)
+			continue
+		}
+		if k.fromID == userID {
+			continue
+		}
+		if (k.kind == "direct" && k.convID == userID) || (k.kind == "group" && groups[k.convID]) {
+			out = append(out, e)
+		}
+	}
+	t.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i].typingKey, out[j].typingKey
+		if a.kind != b.kind {
+			return a.kind < b.kind
+		}
+		if a.convID != b.convID {
+			return a.convID < b.convID
+		}
+		return a.fromID < b.fromID
+	})
+	return out
+}
+
+// typingFor — typing-события для пользователя в виде DTO.
+func (s *Server) typingFor(userID int64) ([]TypingDTO, error) {
+	groups, err := s.groups.ListByUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	member := make(map[int64]bool, len(groups))
+	for _, g := range groups {
+		member[g.ID] = true
+	}
+
+	now := time.Now()
+	out := make([]TypingDTO, 0)
+	for _, e := range s.typing.visibleTo(userID, member) {
+		d := TypingDTO{
+			Kind:       e.kind,
+			FromUserID: e.fromID,
+			Username:   e.username,
+			ExpiresIn:  e.expires.Sub(now).Milliseconds(),
+		}
+		if e.kind == "direct" {
+			d.ToUserID = e.convID
+		} else {
+			d.GroupID = e.convID
+		}
+		out = append(out, d)
+	}
+	return out, nil
+}
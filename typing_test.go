@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Запись живёт typingTTL: ждать шесть секунд незачем — сдвигаем её срок назад.
+func TestTypingExpires(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob, carol := newTestUser(t, s, "alice"), newTestUser(t, s, "bob"), newTestUser(t, s, "carol")
+	gid := newTestGroup(t, s, alice, bob)
+	direct := typingKey{kind: "direct", convID: bob, fromID: alice}
+	group := typingKey{kind: "group", convID: gid, fromID: alice}
+	s.typing.set(direct, "alice", true)
+	s.typing.set(group, "alice", true)
+
+	got, err := s.typingFor(bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].ToUserID != bob || got[1].GroupID != gid {
+		t.Fatalf("typing %+v", got)
+	}
+	for _, d := range got {
+		if d.ExpiresIn <= 0 || d.ExpiresIn > typingTTL.Milliseconds() {
+			t.Fatalf("expires_in_ms %d", d.ExpiresIn)
+		}
+	}
+	if got, _ := s.typingFor(carol); len(got) != 0 {
+		t.Fatalf("stranger sees %+v", got)
+	}
+	if got, _ := s.typingFor(alice); len(got) != 0 {
+		t.Fatalf("own typing shown: %+v", got)
+	}
+
+	age := func(key typingKey, d time.Duration) {
+		s.typing.mu.Lock()
+		e := s.typing.entries[key]
+		e.expires = e.expires.Add(-d)
+		s.typing.entries[key] = e
+		s.typing.mu.Unlock()
+	}
+	// личка замолчала на typingTTL — пропадает и из выдачи, и из памяти
+	age(direct, typingTTL)
+	if got, _ := s.typingFor(bob); len(got) != 1 || got[0].GroupID != gid {
+		t.Fatalf("after ttl %+v", got)
+	}
+	s.typing.mu.Lock()
+	_, kept := s.typing.entries[direct]
+	s.typing.mu.Unlock()
+	if kept {
+		t.Fatal("expired entry kept")
+	}
+
+	// повторный POST /typing продлевает срок
+	age(group, typingTTL/2)
+	s.typing.set(group, "alice", true)
+	age(group, typingTTL/2)
+	if got, _ := s.typingFor(bob); len(got) != 1 {
+		t.Fatalf("renewed entry gone: %+v", got)
+	}
+	age(group, typingTTL)
+	if got, _ := s.typingFor(bob); len(got) != 0 {
+		t.Fatalf("after ttl %+v", got)
+	}
+}